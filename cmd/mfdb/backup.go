@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database"
+	"manifold.mleku.dev/errorf"
+)
+
+func backup(args []string) (err error) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	since := fs.Uint64("since", 0,
+		"make an incremental backup of changes after this version, "+
+			"as printed by the previous backup")
+	out := fs.String("o", "", "file to write the backup to (default stdout)")
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, "usage: mfdb backup [flags] <database directory>\n")
+		fs.PrintDefaults()
+	}
+	if err = fs.Parse(args); chk.E(err) {
+		return
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		var fh *os.File
+		if fh, err = os.Create(*out); chk.E(err) {
+			return
+		}
+		defer fh.Close()
+		w = fh
+	}
+	var d *database.D
+	if d, err = open(fs.Arg(0)); chk.E(err) {
+		return
+	}
+	defer d.Close()
+	var next uint64
+	if next, err = d.Backup(w, *since); chk.E(err) {
+		return
+	}
+	_, _ = fmt.Fprintf(os.Stderr,
+		"backup complete, use -since %d for the next incremental backup\n", next)
+	return
+}
+
+func restore(args []string) (err error) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, "usage: mfdb restore <new database directory> "+
+			"<full backup> [incremental backup...]\n")
+		fs.PrintDefaults()
+	}
+	if err = fs.Parse(args); chk.E(err) {
+		return
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var readers []io.Reader
+	for _, name := range fs.Args()[1:] {
+		var fh *os.File
+		if fh, err = os.Open(name); chk.E(err) {
+			return
+		}
+		defer fh.Close()
+		readers = append(readers, fh)
+	}
+	if err = database.Restore(fs.Arg(0), keyProvider(), readers...); chk.E(err) {
+		return
+	}
+	var d *database.D
+	if d, err = open(fs.Arg(0)); chk.E(err) {
+		return
+	}
+	defer d.Close()
+	if err = d.WaitMigrations(); chk.E(err) {
+		return
+	}
+	var r *database.CheckReport
+	if r, err = d.Check(false); chk.E(err) {
+		return
+	}
+	fmt.Println(r)
+	if !r.Ok() {
+		err = errorf.E("restored database has integrity problems")
+		return
+	}
+	return
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database"
+	"manifold.mleku.dev/errorf"
+)
+
+func check(args []string) (err error) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	repair := fs.Bool("repair", false,
+		"write missing index keys and delete orphaned and stale index keys")
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, "usage: mfdb check [-repair] <database directory>\n")
+		fs.PrintDefaults()
+	}
+	if err = fs.Parse(args); chk.E(err) {
+		return
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var d *database.D
+	if d, err = open(fs.Arg(0)); chk.E(err) {
+		return
+	}
+	defer d.Close()
+	var r *database.CheckReport
+	if r, err = d.Check(*repair); chk.E(err) {
+		return
+	}
+	fmt.Println(r)
+	if !r.Ok() && !*repair {
+		err = errorf.E("database has integrity problems, run with -repair to fix indexes")
+		return
+	}
+	return
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database"
+)
+
+func consolidate(args []string) (err error) {
+	fs := flag.NewFlagSet("consolidate", flag.ExitOnError)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, "usage: mfdb consolidate <database directory>\n")
+		fs.PrintDefaults()
+	}
+	if err = fs.Parse(args); chk.E(err) {
+		return
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var d *database.D
+	if d, err = open(fs.Arg(0)); chk.E(err) {
+		return
+	}
+	defer d.Close()
+	if err = consolidateOne(d, "database"); chk.E(err) {
+		return
+	}
+	var names []string
+	if names, err = d.Namespaces(); chk.E(err) {
+		return
+	}
+	for _, name := range names {
+		var ns *database.D
+		if ns, err = d.Namespace(name); chk.E(err) {
+			return
+		}
+		if err = consolidateOne(ns, "namespace "+name); chk.E(err) {
+			return
+		}
+	}
+	return
+}
+
+// consolidateOne consolidates the serials of a database or namespace, printing
+// its progress.
+func consolidateOne(d *database.D, name string) (err error) {
+	var r *database.ConsolidateReport
+	if r, err = d.Consolidate(func(done, total int) {
+		fmt.Printf("%s: rewrote %d/%d index families\n", name, done, total)
+	}); chk.E(err) {
+		return
+	}
+	fmt.Printf("%s: %d events, %d renumbered, %d orphaned index keys deleted\n",
+		name, r.Events, r.Renumbered, r.Orphans)
+	return
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database"
+	"manifold.mleku.dev/errorf"
+	"manifold.mleku.dev/filter"
+)
+
+func export(args []string) (err error) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "binary", "archive format, text or binary")
+	compress := fs.Bool("gzip", false, "compress the archive with gzip")
+	filterFile := fs.String("filter", "",
+		"file containing a filter in the sentinel text encoding to select events")
+	out := fs.String("o", "", "file to write the archive to (default stdout)")
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, "usage: mfdb export [flags] <database directory>\n")
+		fs.PrintDefaults()
+	}
+	if err = fs.Parse(args); chk.E(err) {
+		return
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var af database.ArchiveFormat
+	switch *format {
+	case "text":
+		af = database.Text
+	case "binary":
+		af = database.Binary
+	default:
+		err = errorf.E("unknown archive format %s", *format)
+		return
+	}
+	var f *filter.F
+	if *filterFile != "" {
+		var b []byte
+		if b, err = os.ReadFile(*filterFile); chk.E(err) {
+			return
+		}
+		f = &filter.F{}
+		if err = f.Unmarshal(b); chk.E(err) {
+			return
+		}
+	}
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		var fh *os.File
+		if fh, err = os.Create(*out); chk.E(err) {
+			return
+		}
+		defer fh.Close()
+		w = fh
+	}
+	var d *database.D
+	if d, err = open(fs.Arg(0)); chk.E(err) {
+		return
+	}
+	defer d.Close()
+	var n int
+	if n, err = d.Export(w, f, af, *compress); chk.E(err) {
+		return
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "exported %d events\n", n)
+	return
+}
+
+func import_(args []string) (err error) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	verify := fs.Bool("verify", true, "skip events with invalid signatures")
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr,
+			"usage: mfdb import [flags] <database directory> <archive>...\n")
+		fs.PrintDefaults()
+	}
+	if err = fs.Parse(args); chk.E(err) {
+		return
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var d *database.D
+	if d, err = open(fs.Arg(0)); chk.E(err) {
+		return
+	}
+	defer d.Close()
+	for _, name := range fs.Args()[1:] {
+		var fh *os.File
+		if fh, err = os.Open(name); chk.E(err) {
+			return
+		}
+		var r *database.ImportReport
+		r, err = d.Import(fh, *verify)
+		_ = fh.Close()
+		if chk.E(err) {
+			return
+		}
+		fmt.Printf("%s: %s\n", name, r)
+	}
+	return
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database"
+)
+
+func rotateKey(args []string) (err error) {
+	fs := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	hexEnv := fs.String("env", "", "environment variable holding the new key in hex")
+	file := fs.String("file", "", "file containing the raw bytes of the new key")
+	hexFile := fs.String("hex-file", "", "file containing the new key in hex")
+	passEnv := fs.String("passphrase-env", "",
+		"environment variable holding a passphrase to derive the new key from")
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, "usage: mfdb rotate-key [flags] <database directory>\n\n"+
+			"The database must not be in use. The current key is read from the\n"+
+			"MFDB_KEY, MFDB_KEY_FILE, MFDB_KEY_HEX_FILE or MFDB_PASSPHRASE\n"+
+			"environment variables.\n\n")
+		fs.PrintDefaults()
+	}
+	if err = fs.Parse(args); chk.E(err) {
+		return
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var newKey database.KeyProvider
+	switch {
+	case *hexEnv != "":
+		newKey = database.KeyFromEnv(*hexEnv)
+	case *file != "":
+		newKey = database.KeyFromFile(*file)
+	case *hexFile != "":
+		newKey = database.KeyFromHexFile(*hexFile)
+	case *passEnv != "":
+		newKey = database.KeyFromPassphrase(os.Getenv(*passEnv))
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err = database.RotateKey(fs.Arg(0), keyProvider(), newKey); chk.E(err) {
+		return
+	}
+	fmt.Println("master key rotated")
+	return
+}
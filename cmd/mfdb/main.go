@@ -0,0 +1,104 @@
+// Command mfdb is a maintenance tool for manifold event databases.
+//
+// Usage:
+//
+//	mfdb <command> [flags] <database directory>
+//
+// The commands are:
+//
+//	check        verify the integrity of the event records and indexes
+//	stats        count the keys, events, authors and tags of the database
+//	migrate      upgrade the database to the current schema version
+//	export       write events to a portable archive
+//	import       store the events from archives written by export
+//	backup       write a full or incremental physical backup
+//	restore      restore physical backups into a new database and verify it
+//	rotate-key   re-encrypt the database with a new master key
+//	consolidate  renumber the event serials densely and reset their sequence
+//
+// Encrypted databases are opened with the master key from the first of these
+// environment variables that is set:
+//
+//	MFDB_KEY           the key in hex
+//	MFDB_KEY_FILE      a file containing the raw bytes of the key
+//	MFDB_KEY_HEX_FILE  a file containing the key in hex
+//	MFDB_PASSPHRASE    a passphrase the key is derived from
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database"
+	"manifold.mleku.dev/lol"
+)
+
+type command struct {
+	name, usage string
+	run         func(args []string) (err error)
+}
+
+var commands = []command{
+	{"check", "verify the integrity of the event records and indexes", check},
+	{"stats", "count the keys, events, authors and tags of the database", stats},
+	{"migrate", "upgrade the database to the current schema version", migrate},
+	{"export", "write events to a portable archive", export},
+	{"import", "store the events from archives written by export", import_},
+	{"backup", "write a full or incremental physical backup", backup},
+	{"restore", "restore physical backups into a new database and verify it", restore},
+	{"rotate-key", "re-encrypt the database with a new master key", rotateKey},
+	{"consolidate", "renumber the event serials densely and reset their sequence", consolidate},
+}
+
+func usage() {
+	_, _ = fmt.Fprintf(os.Stderr, "usage: mfdb <command> [flags] <database directory>\n\ncommands:\n")
+	for _, c := range commands {
+		_, _ = fmt.Fprintf(os.Stderr, "  %-11s %s\n", c.name, c.usage)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name == os.Args[1] {
+			if err := c.run(os.Args[2:]); chk.E(err) {
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	usage()
+	os.Exit(2)
+}
+
+// keyProvider returns the provider of the master key named by the environment,
+// or nil if the database is not encrypted.
+func keyProvider() database.KeyProvider {
+	switch {
+	case os.Getenv("MFDB_KEY") != "":
+		return database.KeyFromEnv("MFDB_KEY")
+	case os.Getenv("MFDB_KEY_FILE") != "":
+		return database.KeyFromFile(os.Getenv("MFDB_KEY_FILE"))
+	case os.Getenv("MFDB_KEY_HEX_FILE") != "":
+		return database.KeyFromHexFile(os.Getenv("MFDB_KEY_HEX_FILE"))
+	case os.Getenv("MFDB_PASSPHRASE") != "":
+		return database.KeyFromPassphrase(os.Getenv("MFDB_PASSPHRASE"))
+	}
+	return nil
+}
+
+// open initialises the database found at path, with badger logging kept to
+// warnings and errors.
+func open(path string) (d *database.D, err error) {
+	d = database.New()
+	d.InitLogLevel = lol.Warn
+	d.KeyProvider = keyProvider()
+	if err = d.Init(path); chk.E(err) {
+		return
+	}
+	return
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database"
+)
+
+func migrate(args []string) (err error) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, "usage: mfdb migrate <database directory>\n")
+		fs.PrintDefaults()
+	}
+	if err = fs.Parse(args); chk.E(err) {
+		return
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var d *database.D
+	if d, err = open(fs.Arg(0)); chk.E(err) {
+		return
+	}
+	defer d.Close()
+	done := make(chan struct{})
+	go func() {
+		tick := time.NewTicker(time.Second)
+		defer tick.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-tick.C:
+				s := d.Migrations()
+				fmt.Printf("schema version %d: %s %d/%d\n",
+					s.Version, s.Description, s.Done, s.Total)
+			}
+		}
+	}()
+	err = d.WaitMigrations()
+	close(done)
+	if chk.E(err) {
+		return
+	}
+	fmt.Printf("database is at schema version %d\n", d.Migrations().Version)
+	return
+}
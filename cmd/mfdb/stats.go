@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database"
+)
+
+func stats(args []string) (err error) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	prometheus := fs.Bool("prometheus", false,
+		"print the stats in the Prometheus text exposition format")
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, "usage: mfdb stats [-prometheus] <database directory>\n")
+		fs.PrintDefaults()
+	}
+	if err = fs.Parse(args); chk.E(err) {
+		return
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var d *database.D
+	if d, err = open(fs.Arg(0)); chk.E(err) {
+		return
+	}
+	defer d.Close()
+	var s *database.Stats
+	if s, err = d.Stats(); chk.E(err) {
+		return
+	}
+	if *prometheus {
+		return s.WritePrometheus(os.Stdout)
+	}
+	fmt.Println(s)
+	return
+}
@@ -0,0 +1,318 @@
+package database
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"manifold.mleku.dev/database/store"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/database/indexes/types/number"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/log"
+)
+
+// now is the clock used to record access times.
+var now = time.Now
+
+func init() {
+	RegisterMigration(Migration{
+		From:        1,
+		Description: "record access times of stored events",
+		Run: func(d *D, progress func(done, total int)) (err error) {
+			return d.initAccessTimes(progress)
+		},
+	})
+}
+
+// accessKeys returns the LastAccessed and SerialAccessed keys recording an
+// access of an event at a time.
+func accessKeys(ser *number.Uint40, ts *number.Uint64) (keys [][]byte, err error) {
+	la := new(bytes.Buffer)
+	if err = indexes.LastAccessedEnc(ts, ser).MarshalWrite(la); chk.E(err) {
+		return
+	}
+	sa := new(bytes.Buffer)
+	if err = indexes.SerialAccessedEnc(ser, ts).MarshalWrite(sa); chk.E(err) {
+		return
+	}
+	keys = [][]byte{la.Bytes(), sa.Bytes()}
+	return
+}
+
+// lastAccess finds the time an event was last accessed. ts is nil if there is
+// no record of an access.
+func (d *D) lastAccess(txn store.Txn, ser *number.Uint40) (ts *number.Uint64, err error) {
+	prf := new(bytes.Buffer)
+	if err = indexes.SerialAccessedSearch(ser).MarshalWrite(prf); chk.E(err) {
+		return
+	}
+	it := txn.NewIterator(store.IteratorOptions{Prefix: prf.Bytes()})
+	defer it.Close()
+	for it.Seek(prf.Bytes()); it.Valid(); it.Next() {
+		s, t := indexes.SerialAccessedVars()
+		if err = indexes.SerialAccessedDec(s, t).UnmarshalRead(bytes.NewBuffer(it.Key())); chk.E(err) {
+			return
+		}
+		ts = t
+	}
+	return
+}
+
+// accessKeysOf returns the access keys currently recorded for an event.
+func (d *D) accessKeysOf(txn store.Txn, ser *number.Uint40) (keys [][]byte, err error) {
+	var ts *number.Uint64
+	if ts, err = d.lastAccess(txn, ser); chk.E(err) || ts == nil {
+		return
+	}
+	return accessKeys(ser, ts)
+}
+
+// touch records an access of an event, unless the recorded access is more
+// recent than AccessResolution.
+func (d *D) touch(ser *number.Uint40) (err error) {
+	if d.writable() != nil {
+		return
+	}
+	d.serials.RLock()
+	defer d.serials.RUnlock()
+	t := now().Unix()
+	err = d.store.Update(func(txn store.Txn) (err error) {
+		var last *number.Uint64
+		if last, err = d.lastAccess(txn, ser); chk.E(err) {
+			return
+		}
+		if last != nil {
+			if t-int64(last.Get()) < int64(d.AccessResolution/time.Second) {
+				return
+			}
+			var old [][]byte
+			if old, err = accessKeys(ser, last); chk.E(err) {
+				return
+			}
+			for _, k := range old {
+				if err = txn.Delete(k); chk.E(err) {
+					return
+				}
+			}
+		}
+		ts := new(number.Uint64)
+		ts.Set(uint64(t))
+		var keys [][]byte
+		if keys, err = accessKeys(ser, ts); chk.E(err) {
+			return
+		}
+		for _, k := range keys {
+			if err = txn.Set(k, nil); chk.E(err) {
+				return
+			}
+		}
+		return
+	})
+	if err == store.ErrConflict {
+		// a concurrent read of the same event has recorded the access.
+		err = nil
+	}
+	return
+}
+
+// initAccessTimes records the current time as the access time of every event
+// that has no access recorded.
+func (d *D) initAccessTimes(progress func(done, total int)) (err error) {
+	var total, done int
+	if total, err = d.CountEvents(); chk.E(err) {
+		return
+	}
+	accessed := make(map[uint64]struct{})
+	if err = d.View(func(txn store.Txn) (err error) {
+		prf := []byte(indexes.Prefix(indexes.SerialAccessed))
+		it := txn.NewIterator(store.IteratorOptions{Prefix: prf})
+		defer it.Close()
+		for it.Seek(prf); it.Valid(); it.Next() {
+			ser, ts := indexes.SerialAccessedVars()
+			if err = indexes.SerialAccessedDec(ser, ts).UnmarshalRead(bytes.NewBuffer(it.Key())); chk.E(err) {
+				return
+			}
+			accessed[ser.Get()] = struct{}{}
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	ts := new(number.Uint64)
+	ts.Set(uint64(now().Unix()))
+	wb := d.store.NewWriteBatch()
+	defer wb.Cancel()
+	if err = d.ForEachEvent(func(ser *number.Uint40, ev *event.E) (err error) {
+		if _, ok := accessed[ser.Get()]; !ok {
+			var keys [][]byte
+			if keys, err = accessKeys(ser, ts); chk.E(err) {
+				return
+			}
+			for _, k := range keys {
+				if err = wb.Set(k, nil); chk.E(err) {
+					return
+				}
+			}
+		}
+		done++
+		progress(done, total)
+		return
+	}); err != nil {
+		return
+	}
+	return wb.Flush()
+}
+
+// Size returns the size of the database as reported by its store, or zero if
+// the store cannot measure it.
+func (d *D) Size() (size int64) {
+	if s, ok := d.store.(store.Sizer); ok {
+		size = s.Size()
+	}
+	return
+}
+
+// exempt returns true if an event is by one of the ExemptAuthors or carries
+// one of the ExemptTags, and so must not be evicted.
+func (d *D) exempt(ev *event.E) bool {
+	for _, pk := range d.ExemptAuthors {
+		if bytes.Equal(ev.Pubkey, pk) {
+			return true
+		}
+	}
+	if ev.Tags == nil {
+		return false
+	}
+	for _, t := range *ev.Tags {
+		values, ok := d.ExemptTags[string(t.Key)]
+		if !ok {
+			continue
+		}
+		// a tag key with no values exempts every event with the tag.
+		if len(values) == 0 {
+			return true
+		}
+		for _, v := range values {
+			if bytes.Equal(v, t.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// gcState is the space evicted by GC that the store has not yet reclaimed,
+// which badger does only as it compacts its tables and collects its value log,
+// and until then reports in its size, with the tombstones of the evictions.
+type gcState struct {
+	mx sync.Mutex
+	// measured is the size of the store when GC last measured it.
+	measured int64
+	// pending is the size of the events and indexes evicted that the store
+	// has not shrunk by since.
+	pending int64
+}
+
+// GC evicts the least recently accessed events that are not exempt, when the
+// size of the database exceeds MaxSize, until the size of the evicted events
+// and their indexes brings it to 90% of MaxSize. The space is reclaimed on
+// disk as badger compacts its tables and collects its value log, so the space
+// evicted is taken off the size until the store shrinks by it, rather than
+// evicted again.
+func (d *D) GC() (evicted int, err error) {
+	// a read replica holds what its primary does
+	if d.MaxSize <= 0 || d.writable() != nil {
+		return
+	}
+	d.gc.mx.Lock()
+	defer d.gc.mx.Unlock()
+	size := d.sizeFn()
+	if shrunk := d.gc.measured - size; shrunk > 0 {
+		d.gc.pending -= min(shrunk, d.gc.pending)
+	}
+	d.gc.measured = size
+	size -= d.gc.pending
+	if size <= d.MaxSize {
+		return
+	}
+	target := size - d.MaxSize*9/10
+	d.serials.RLock()
+	defer d.serials.RUnlock()
+	var freed int64
+	var victims []*number.Uint40
+	if err = d.View(func(txn store.Txn) (err error) {
+		prf := []byte(indexes.Prefix(indexes.LastAccessed))
+		it := txn.NewIterator(store.IteratorOptions{Prefix: prf})
+		defer it.Close()
+		for it.Seek(prf); it.Valid() && freed < target; it.Next() {
+			ts, ser := indexes.LastAccessedVars()
+			if err = indexes.LastAccessedDec(ts, ser).UnmarshalRead(bytes.NewBuffer(it.Key())); chk.E(err) {
+				return
+			}
+			evk := new(bytes.Buffer)
+			if err = indexes.EventEnc(ser).MarshalWrite(evk); chk.E(err) {
+				return
+			}
+			var val []byte
+			if val, err = txn.Get(evk.Bytes()); err != nil {
+				// the event is already gone, so the access keys will be
+				// removed by Check.
+				err = nil
+				continue
+			}
+			ev := &event.E{}
+			if err = ev.ReadBinary(bytes.NewBuffer(val)); chk.E(err) {
+				err = nil
+				continue
+			}
+			if d.exempt(ev) {
+				continue
+			}
+			var idxs [][]byte
+			if idxs, err = d.GetEventIndexesForSerial(ev, ser); chk.E(err) {
+				return
+			}
+			freed += int64(evk.Len() + len(val))
+			for _, k := range idxs {
+				freed += int64(len(k))
+			}
+			victims = append(victims, ser)
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	for _, ser := range victims {
+		if err = d.deleteEvent(ser); chk.E(err) {
+			return
+		}
+		evicted++
+	}
+	d.gc.pending += freed
+	log.I.F("evicted %d events of %d bytes from %s, size %d exceeds %d",
+		evicted, freed, d.dataDir, size, d.MaxSize)
+	if d.bdb != nil {
+		for d.bdb.RunValueLogGC(0.5) == nil {
+		}
+	}
+	return
+}
+
+// gcLoop runs GC every GCInterval until the database is closed.
+func (d *D) gcLoop() {
+	defer d.workers.Done()
+	tick := time.NewTicker(d.GCInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-tick.C:
+			if _, err := d.GC(); chk.E(err) {
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package database
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+)
+
+// TestGC tests that GC evicts the least recently accessed events that are not
+// exempt when the database exceeds its size limit.
+func TestGC(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifold-test-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	db := New()
+	if err = db.Init(tempDir); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+	defer func() { now = time.Now }()
+
+	var events []*event.E
+	if events, err = generateTestEvents(10); err != nil {
+		t.Fatalf("Failed to generate test events: %v", err)
+	}
+	start := time.Now()
+	now = func() time.Time { return start }
+	for _, ev := range events {
+		if err = db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+	// read two of the events later
+	now = func() time.Time { return start.Add(time.Hour * 2) }
+	for _, ev := range events[1:3] {
+		var id []byte
+		if id, err = ev.Id(); err != nil {
+			t.Fatalf("Failed to get event ID: %v", err)
+		}
+		if _, err = db.GetEventById(id); err != nil {
+			t.Fatalf("Failed to get event: %v", err)
+		}
+	}
+
+	// the events of the first author are events 0, 3, 6 and 9.
+	db.ExemptAuthors = [][]byte{events[0].Pubkey}
+	db.MaxSize = 1000
+	// just over the limit, the least recently accessed event not exempt is
+	// evicted.
+	db.sizeFn = func() int64 { return db.MaxSize + 1 }
+	var evicted int
+	if evicted, err = db.GC(); err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+	if evicted != 1 {
+		t.Fatalf("Expected 1 event evicted, got %d", evicted)
+	}
+	var id []byte
+	if id, err = events[4].Id(); err != nil {
+		t.Fatalf("Failed to get event ID: %v", err)
+	}
+	if _, err = db.FindEventSerialById(id); err == nil {
+		t.Fatalf("Expected event 4 to be evicted")
+	}
+
+	// far over the limit, every event that is not exempt is evicted.
+	db.sizeFn = func() int64 { return db.MaxSize * 1000 }
+	if evicted, err = db.GC(); err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+	if evicted != 5 {
+		t.Fatalf("Expected 5 events evicted, got %d", evicted)
+	}
+	var ids [][]byte
+	if ids, err = db.QueryEvents(filter.F{}); err != nil {
+		t.Fatalf("QueryEvents failed: %v", err)
+	}
+	if len(ids) != 4 {
+		t.Fatalf("Expected 4 events, got %d", len(ids))
+	}
+	for _, id := range ids {
+		var ev *event.E
+		if ev, err = db.GetEventById(id); err != nil {
+			t.Fatalf("Failed to get event: %v", err)
+		}
+		if !bytes.Equal(ev.Pubkey, events[0].Pubkey) {
+			t.Fatalf("Event of an author that is not exempt was not evicted")
+		}
+	}
+	var r *CheckReport
+	if r, err = db.Check(false); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !r.Ok() {
+		t.Fatalf("Expected clean report after GC, got\n%s", r)
+	}
+}
+
+// TestGCPending tests that the space GC evicted is not evicted again while the
+// store has not reclaimed it, and is once the store shrinks.
+func TestGCPending(t *testing.T) {
+	db := newMemoryDB(t)
+	defer db.Close()
+	events, err := generateTestEvents(10)
+	if err != nil {
+		t.Fatalf("Failed to generate test events: %v", err)
+	}
+	for _, ev := range events {
+		if err = db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+	db.MaxSize = 1000
+	// the size the store reports does not shrink after the evictions
+	size := db.MaxSize + 1
+	db.sizeFn = func() int64 { return size }
+	evicted, err := db.GC()
+	if err != nil || evicted != 1 {
+		t.Fatalf("Expected 1 event evicted, got %d: %v", evicted, err)
+	}
+	if evicted, err = db.GC(); err != nil || evicted != 0 {
+		t.Fatalf("Expected no events evicted before the space is reclaimed, got %d: %v",
+			evicted, err)
+	}
+	// once the store shrinks by what was evicted, growing over the limit
+	// evicts again
+	size = 100
+	if evicted, err = db.GC(); err != nil || evicted != 0 {
+		t.Fatalf("Expected no events evicted under the limit, got %d: %v", evicted, err)
+	}
+	size = db.MaxSize + 1
+	if evicted, err = db.GC(); err != nil || evicted != 1 {
+		t.Fatalf("Expected 1 event evicted, got %d: %v", evicted, err)
+	}
+}
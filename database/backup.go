@@ -0,0 +1,75 @@
+package database
+
+import (
+	"io"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"manifold.mleku.dev/apputil"
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/errorf"
+	"manifold.mleku.dev/log"
+	"manifold.mleku.dev/lol"
+)
+
+// Backup writes a physical backup of the database to w while it is in use. The
+// backup contains every key written after the badger version since, so a since
+// of zero makes a full backup. The returned version is the since to use for the
+// next incremental backup.
+func (d *D) Backup(w io.Writer, since uint64) (next uint64, err error) {
+	if d.bdb == nil {
+		err = errorf.E("backup is only supported by the badger store")
+		return
+	}
+	log.I.F("backing up %s from version %d", d.dataDir, since)
+	if next, err = d.bdb.Backup(w, since); chk.E(err) {
+		return
+	}
+	return
+}
+
+// Restore loads a full backup written by Backup, followed by the incremental
+// backups made after it, in order, into a new database at path. The database
+// must not be open; it should be opened with Init afterwards, which migrates it
+// if the backup is from an older schema version. Backups contain the decrypted
+// events, so if key is not nil the new database is encrypted with the master
+// key it provides, which may differ from that of the database backed up.
+//
+// The backups are loaded into a bare badger instance, so the event serial
+// sequence and schema version are those recorded in the backups rather than
+// written by Init.
+func Restore(path string, key KeyProvider, backups ...io.Reader) (err error) {
+	if apputil.FileExists(filepath.Join(path, badger.ManifestFilename)) {
+		err = errorf.E("cannot restore into %s, it already contains a database",
+			path)
+		return
+	}
+	log.I.Ln("restoring backup to", path)
+	opts := badger.DefaultOptions(path)
+	opts.Logger = NewLogger(lol.Warn, path)
+	if key != nil {
+		if opts.EncryptionKey, err = key(path); chk.E(err) {
+			return
+		}
+		if err = checkKey(opts.EncryptionKey); chk.E(err) {
+			return
+		}
+		opts.IndexCacheSize = encryptionIndexCacheSize
+	}
+	var db *badger.DB
+	if db, err = badger.Open(opts); chk.E(err) {
+		return
+	}
+	defer func() {
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	for _, r := range backups {
+		if err = db.Load(r, 256); chk.E(err) {
+			return
+		}
+	}
+	return
+}
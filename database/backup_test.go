@@ -0,0 +1,86 @@
+package database
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+)
+
+// TestBackupRestore makes a full and an incremental backup and restores them
+// into a new database.
+func TestBackupRestore(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifold-test-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	db := New()
+	if err = db.Init(tempDir); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	var events []*event.E
+	if events, err = generateTestEvents(11); err != nil {
+		t.Fatalf("Failed to generate test events: %v", err)
+	}
+	for _, ev := range events[:5] {
+		if err = db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+	full := new(bytes.Buffer)
+	var since uint64
+	if since, err = db.Backup(full, 0); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	for _, ev := range events[5:10] {
+		if err = db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+	incr := new(bytes.Buffer)
+	if _, err = db.Backup(incr, since); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	restoreDir, err := os.MkdirTemp("", "manifold-test-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(restoreDir)
+	if err = Restore(restoreDir, nil, full, incr); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if err = Restore(restoreDir, nil, full); err == nil {
+		t.Fatalf("Expected error restoring over an existing database")
+	}
+	db2 := New()
+	if err = db2.Init(restoreDir); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db2.Close()
+	var ids [][]byte
+	if ids, err = db2.QueryEvents(filter.F{}); err != nil {
+		t.Fatalf("QueryEvents failed: %v", err)
+	}
+	if len(ids) != 10 {
+		t.Fatalf("Expected 10 events, got %d", len(ids))
+	}
+
+	// a new event must not be given the serial of a restored one
+	if err = db2.StoreEvent(events[10]); err != nil {
+		t.Fatalf("Failed to store event: %v", err)
+	}
+	var r *CheckReport
+	if r, err = db2.Check(false); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !r.Ok() || r.Events != 11 {
+		t.Fatalf("Expected clean report for 11 events, got\n%s", r)
+	}
+}
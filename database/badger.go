@@ -0,0 +1,91 @@
+package database
+
+import (
+	"github.com/dgraph-io/badger/v4"
+
+	"manifold.mleku.dev/database/store"
+)
+
+// badgerStore is the implementation of store.I on a badger database.
+type badgerStore struct{ *badger.DB }
+
+var _ store.I = badgerStore{}
+
+// translate converts the badger errors that callers test for into their store
+// equivalents.
+func translate(err error) error {
+	switch err {
+	case badger.ErrKeyNotFound:
+		return store.ErrKeyNotFound
+	case badger.ErrConflict:
+		return store.ErrConflict
+	}
+	return err
+}
+
+func (b badgerStore) View(fn func(txn store.Txn) (err error)) (err error) {
+	return translate(b.DB.View(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn})
+	}))
+}
+
+func (b badgerStore) Update(fn func(txn store.Txn) (err error)) (err error) {
+	return translate(b.DB.Update(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn})
+	}))
+}
+
+func (b badgerStore) NewWriteBatch() store.WriteBatch { return b.DB.NewWriteBatch() }
+
+func (b badgerStore) GetSequence(key []byte, bandwidth uint64) (seq store.Sequence, err error) {
+	return b.DB.GetSequence(key, bandwidth)
+}
+
+// Size returns the size of the database on disk, as last measured by badger.
+func (b badgerStore) Size() (size int64) {
+	lsm, vlog := b.DB.Size()
+	return lsm + vlog
+}
+
+// PrefixSize returns the size of the keys that start with a prefix and their
+// values, as estimated by badger without reading the values.
+func (b badgerStore) PrefixSize(prefix []byte) (size int64) {
+	_ = b.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+		defer it.Close()
+		for it.Seek(prefix); it.Valid(); it.Next() {
+			size += it.Item().EstimatedSize()
+		}
+		return nil
+	})
+	return
+}
+
+type badgerTxn struct{ *badger.Txn }
+
+func (t badgerTxn) Get(key []byte) (val []byte, err error) {
+	var item *badger.Item
+	if item, err = t.Txn.Get(key); err != nil {
+		err = translate(err)
+		return
+	}
+	return item.ValueCopy(nil)
+}
+
+func (t badgerTxn) Set(key, val []byte) (err error) { return translate(t.Txn.Set(key, val)) }
+
+func (t badgerTxn) Delete(key []byte) (err error) { return translate(t.Txn.Delete(key)) }
+
+func (t badgerTxn) NewIterator(opts store.IteratorOptions) store.Iterator {
+	return badgerIterator{t.Txn.NewIterator(badger.IteratorOptions{
+		Prefix:         opts.Prefix,
+		Reverse:        opts.Reverse,
+		PrefetchValues: false,
+	})}
+}
+
+type badgerIterator struct{ *badger.Iterator }
+
+func (it badgerIterator) Key() []byte { return it.Item().KeyCopy(nil) }
+
+func (it badgerIterator) Value() (val []byte, err error) { return it.Item().ValueCopy(nil) }
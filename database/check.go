@@ -0,0 +1,280 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/database/indexes/types/number"
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/log"
+	"manifold.mleku.dev/p256k"
+)
+
+func init() {
+	RegisterMigration(Migration{
+		From:        12,
+		Description: "remove events without tags that verify only with the ids of earlier versions",
+		Run: func(d *D, progress func(done, total int)) (err error) {
+			return d.removeLegacyEvents(progress)
+		},
+	})
+}
+
+// CheckReport is the summary of an integrity check of the database.
+type CheckReport struct {
+	// Events is the number of event records that were examined.
+	Events int
+	// BadEvents is the number of event records that could not be decoded.
+	BadEvents int
+	// BadSignatures is the number of events whose signature does not verify
+	// against the recomputed event Id.
+	BadSignatures int
+	// MissingIndexes is the number of index keys that should exist for the
+	// stored events but were not found.
+	MissingIndexes int
+	// OrphanedIndexes is the number of index keys that refer to a serial for
+	// which there is no event record.
+	OrphanedIndexes int
+	// StaleIndexes is the number of index keys that refer to a stored event
+	// but do not match the keys generated from it, such as an IdPubkeyTimestamp
+	// key carrying a different Id than the recomputed one.
+	StaleIndexes int
+	// BadStatistics is the number of word frequencies and totals used for
+	// search ranking that differ from the counts of the stored events.
+	BadStatistics int
+	// Rebuilt is the number of missing index keys that were written back.
+	Rebuilt int
+	// Deleted is the number of orphaned and stale index keys that were removed.
+	Deleted int
+}
+
+// Ok returns true if no problems were found.
+func (r *CheckReport) Ok() bool {
+	return r.BadEvents == 0 && r.BadSignatures == 0 && r.MissingIndexes == 0 &&
+		r.OrphanedIndexes == 0 && r.StaleIndexes == 0 && r.BadStatistics == 0
+}
+
+func (r *CheckReport) String() string {
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "events:           %d\n", r.Events)
+	fmt.Fprintf(b, "bad events:       %d\n", r.BadEvents)
+	fmt.Fprintf(b, "bad signatures:   %d\n", r.BadSignatures)
+	fmt.Fprintf(b, "missing indexes:  %d\n", r.MissingIndexes)
+	fmt.Fprintf(b, "orphaned indexes: %d\n", r.OrphanedIndexes)
+	fmt.Fprintf(b, "stale indexes:    %d\n", r.StaleIndexes)
+	fmt.Fprintf(b, "bad statistics:   %d\n", r.BadStatistics)
+	fmt.Fprintf(b, "rebuilt:          %d\n", r.Rebuilt)
+	fmt.Fprintf(b, "deleted:          %d", r.Deleted)
+	return b.String()
+}
+
+// Check walks every event record in the database, decodes it, recomputes its
+// Id and verifies its signature, and checks that every index key that
+// GetEventIndexesForSerial generates for it exists. It then walks every index
+// family looking for keys that refer to serials with no event record, or that
+// do not match the keys generated from the event they refer to. The keys of the
+// indexes.Tracking families are only checked for referring to an event. Last,
+// the word frequencies used for search ranking are compared with the counts of
+// the words of the events.
+//
+// If repair is true, missing index keys are written, orphaned and stale keys
+// are deleted, and wrong word frequencies are replaced with the counts. Events
+// that cannot be decoded or fail signature verification are only reported.
+//
+// The set of expected keys is held in memory for the duration of the check.
+func (d *D) Check(repair bool) (r *CheckReport, err error) {
+	r = &CheckReport{}
+	serials := make(map[uint64]struct{})
+	undecodable := make(map[uint64]struct{})
+	expected := make(map[string]struct{})
+	var missing, remove [][]byte
+	stats := newWordStats()
+	if err = d.View(func(txn store.Txn) (err error) {
+		prf := new(bytes.Buffer)
+		if err = indexes.EventEnc(nil).MarshalWrite(prf); chk.E(err) {
+			return
+		}
+		it := txn.NewIterator(store.IteratorOptions{Prefix: prf.Bytes()})
+		defer it.Close()
+		for it.Seek(prf.Bytes()); it.Valid(); it.Next() {
+			ser := indexes.EventVars()
+			if err = indexes.EventDec(ser).UnmarshalRead(bytes.NewBuffer(it.Key())); chk.E(err) {
+				return
+			}
+			r.Events++
+			serials[ser.Get()] = struct{}{}
+			var val []byte
+			if val, err = it.Value(); chk.E(err) {
+				return
+			}
+			ev := &event.E{}
+			if err = ev.ReadBinary(bytes.NewBuffer(val)); err != nil {
+				log.W.F("event serial %d could not be decoded: %v", ser.Get(), err)
+				err = nil
+				r.BadEvents++
+				undecodable[ser.Get()] = struct{}{}
+				continue
+			}
+			var valid bool
+			if valid, err = ev.Verify(); err != nil || !valid {
+				log.W.F("event serial %d has an invalid signature", ser.Get())
+				err = nil
+				r.BadSignatures++
+			}
+			stats.add(ev)
+			var idxs [][]byte
+			if idxs, err = d.GetEventIndexesForSerial(ev, ser); chk.E(err) {
+				return
+			}
+			for _, k := range idxs {
+				expected[string(k)] = struct{}{}
+				if _, err = txn.Get(k); err != nil {
+					if err != store.ErrKeyNotFound {
+						return
+					}
+					err = nil
+					r.MissingIndexes++
+					missing = append(missing, k)
+				}
+			}
+		}
+		for _, f := range indexes.Families {
+			tracking := slices.Contains(indexes.Tracking, f)
+			fp := []byte(indexes.Prefix(f))
+			fit := txn.NewIterator(store.IteratorOptions{Prefix: fp})
+			for fit.Seek(fp); fit.Valid(); fit.Next() {
+				k := fit.Key()
+				var ser *number.Uint40
+				if ser, err = indexes.SerialOf(k); err != nil {
+					log.W.F("malformed index key %0x: %v", k, err)
+					err = nil
+					r.OrphanedIndexes++
+					remove = append(remove, k)
+					continue
+				}
+				if _, ok := serials[ser.Get()]; !ok {
+					r.OrphanedIndexes++
+					remove = append(remove, k)
+					continue
+				}
+				if _, ok := undecodable[ser.Get()]; ok {
+					// nothing can be said about the indexes of an event that
+					// can't be decoded.
+					continue
+				}
+				if tracking {
+					continue
+				}
+				if _, ok := expected[string(k)]; !ok {
+					r.StaleIndexes++
+					remove = append(remove, k)
+				}
+			}
+			fit.Close()
+		}
+		if r.BadStatistics, err = checkWordStats(txn, stats); chk.E(err) {
+			return
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	if repair && r.BadStatistics > 0 {
+		if err = d.writeWordStats(stats); chk.E(err) {
+			return
+		}
+	}
+	if !repair || (len(missing) == 0 && len(remove) == 0) {
+		return
+	}
+	wb := d.store.NewWriteBatch()
+	defer wb.Cancel()
+	for _, k := range missing {
+		if err = wb.Set(k, nil); chk.E(err) {
+			return
+		}
+		r.Rebuilt++
+	}
+	for _, k := range remove {
+		if err = wb.Delete(k); chk.E(err) {
+			return
+		}
+		r.Deleted++
+	}
+	if err = wb.Flush(); chk.E(err) {
+		return
+	}
+	return
+}
+
+// removeLegacyEvents deletes the events without tags whose signatures verify
+// only for their event.E.LegacyId, which versions before the fix of Marshal
+// gave events whose tags were empty. They cannot be served with a valid
+// signature, and are indexed under ids that no longer match them, so their
+// index keys and the word frequencies are repaired by Check afterwards.
+func (d *D) removeLegacyEvents(progress func(done, total int)) (err error) {
+	var total int
+	if total, err = d.CountEvents(); chk.E(err) {
+		return
+	}
+	var legacy [][]byte
+	var done int
+	if err = d.ForEachEvent(func(ser *number.Uint40, ev *event.E) (err error) {
+		done++
+		if progress != nil {
+			progress(done, total)
+		}
+		if ev.Tags != nil && len(*ev.Tags) > 0 {
+			return
+		}
+		if valid, _ := ev.Verify(); valid {
+			return
+		}
+		var id []byte
+		if id, err = ev.LegacyId(); chk.E(err) {
+			return
+		}
+		pub := new(p256k.Signer)
+		if err = pub.InitPub(ev.Pubkey); err != nil {
+			// reported by Check as a bad signature
+			return nil
+		}
+		if valid, _ := pub.Verify(id, ev.Signature); !valid {
+			return
+		}
+		log.W.F("removing event %0x, which has the id of an earlier version", id)
+		evk := new(bytes.Buffer)
+		if err = indexes.EventEnc(ser).MarshalWrite(evk); chk.E(err) {
+			return
+		}
+		legacy = append(legacy, evk.Bytes())
+		return
+	}); err != nil {
+		return
+	}
+	if len(legacy) == 0 {
+		return
+	}
+	wb := d.store.NewWriteBatch()
+	defer wb.Cancel()
+	for _, k := range legacy {
+		if err = wb.Delete(k); chk.E(err) {
+			return
+		}
+	}
+	if err = wb.Flush(); chk.E(err) {
+		return
+	}
+	var r *CheckReport
+	if r, err = d.Check(true); chk.E(err) {
+		return
+	}
+	log.I.F("removed %d events with the ids of earlier versions, and %d of their index keys",
+		len(legacy), r.Deleted)
+	return
+}
@@ -0,0 +1,167 @@
+package database
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/database/indexes/types/number"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+	"manifold.mleku.dev/p256k"
+)
+
+// TestCheck damages the indexes of a database and verifies that Check finds
+// and repairs the damage.
+func TestCheck(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifold-test-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	db := New()
+	if err = db.Init(tempDir); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	var events []*event.E
+	if events, err = generateTestEvents(10); err != nil {
+		t.Fatalf("Failed to generate test events: %v", err)
+	}
+	for _, ev := range events {
+		if err = db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+
+	var r *CheckReport
+	if r, err = db.Check(false); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !r.Ok() || r.Events != len(events) {
+		t.Fatalf("Expected clean report for %d events, got\n%s", len(events), r)
+	}
+
+	// delete the Timestamp index key of the first event
+	var ser *number.Uint40
+	var id []byte
+	if id, err = events[0].Id(); err != nil {
+		t.Fatalf("Failed to get event ID: %v", err)
+	}
+	if ser, err = db.FindEventSerialById(id); err != nil {
+		t.Fatalf("Failed to find event serial: %v", err)
+	}
+	var idxs [][]byte
+	if idxs, err = db.GetEventIndexesForSerial(events[0], ser); err != nil {
+		t.Fatalf("Failed to get event indexes: %v", err)
+	}
+	var missing []byte
+	for _, k := range idxs {
+		if indexes.Identify(k) == indexes.Timestamp {
+			missing = k
+		}
+	}
+	if err = db.Delete(missing); err != nil {
+		t.Fatalf("Failed to delete index key: %v", err)
+	}
+
+	// add an index key pointing at a serial that doesn't exist
+	orphan := new(number.Uint40)
+	if err = orphan.Set(number.MaxUint40); err != nil {
+		t.Fatal(err)
+	}
+	ts := new(number.Uint64)
+	ts.Set(1)
+	ok := new(bytes.Buffer)
+	if err = indexes.TimestampEnc(ts, orphan).MarshalWrite(ok); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set(ok.Bytes(), nil); err != nil {
+		t.Fatalf("Failed to write orphan key: %v", err)
+	}
+
+	if r, err = db.Check(true); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if r.MissingIndexes != 1 || r.OrphanedIndexes != 1 {
+		t.Fatalf("Expected 1 missing and 1 orphaned index, got\n%s", r)
+	}
+	if r.Rebuilt != 1 || r.Deleted != 1 {
+		t.Fatalf("Expected 1 rebuilt and 1 deleted index, got\n%s", r)
+	}
+
+	if r, err = db.Check(false); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !r.Ok() {
+		t.Fatalf("Expected clean report after repair, got\n%s", r)
+	}
+}
+
+// TestLegacyEvents tests that the migration to schema version 13 removes the
+// events without tags that verify only with the ids of earlier versions.
+func TestLegacyEvents(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifold-test-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	db := New()
+	if err = db.Init(tempDir); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	signer := new(p256k.Signer)
+	if err = signer.Generate(); err != nil {
+		t.Fatalf("Failed to generate signer: %v", err)
+	}
+	current := &event.E{Pubkey: signer.Pub(), Timestamp: 1700000000, Content: []byte("current")}
+	if err = current.Sign(signer); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	// signed as earlier versions did an event with empty tags
+	legacy := &event.E{Pubkey: signer.Pub(), Timestamp: 1700000001, Content: []byte("legacy")}
+	id, err := legacy.LegacyId()
+	if err != nil {
+		t.Fatalf("Failed to get legacy id: %v", err)
+	}
+	if legacy.Signature, err = signer.Sign(id); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	for _, ev := range []*event.E{current, legacy} {
+		if err = db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+	if err = db.setSchemaVersion(12); err != nil {
+		t.Fatalf("Failed to set schema version: %v", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+	db = New()
+	if err = db.Init(tempDir); err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	if err = db.WaitMigrations(); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	ids, err := db.QueryEvents(filter.F{})
+	if err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+	currentId, _ := current.Id()
+	if len(ids) != 1 || !bytes.Equal(ids[0], currentId) {
+		t.Errorf("Expected only the current event to remain, got %d events", len(ids))
+	}
+	r, err := db.Check(false)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !r.Ok() {
+		t.Errorf("Expected a consistent database after the migration:\n%s", r)
+	}
+}
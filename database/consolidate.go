@@ -0,0 +1,157 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/database/indexes/types/number"
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/log"
+)
+
+// sequenceKey is the key of the sequence that the serials of events are taken
+// from, and sequenceBandwidth how many are leased from the store at a time.
+var sequenceKey = []byte("EVENTS")
+
+const sequenceBandwidth = 1000
+
+// ConsolidateReport is the outcome of Consolidate.
+type ConsolidateReport struct {
+	// Events is the number of stored events, which now have the serials from
+	// zero to one less than it.
+	Events int
+	// Renumbered is the number of events given a new serial.
+	Renumbered int
+	// Orphans is the number of index keys deleted because their event is gone.
+	Orphans int
+}
+
+// Consolidate renumbers the serials of the stored events densely from zero, in
+// the order they were stored, closing the gaps left by deleted and evicted
+// events, and rewrites the keys of every index family with the new serials,
+// deleting those of events that are gone. The sequence that new serials are
+// taken from is reset to follow the last event.
+//
+// Storing and deleting events wait until it is done, and queries made
+// meanwhile may miss events. The serials of events, such as those sent to
+// subscribers of the change feed, refer to other events or none afterwards.
+// progress is called after each index family is rewritten.
+func (d *D) Consolidate(progress func(done, total int)) (r *ConsolidateReport, err error) {
+	if err = d.writable(); err != nil {
+		return
+	}
+	if err = d.WaitMigrations(); chk.E(err) {
+		return
+	}
+	d.serials.Lock()
+	defer d.serials.Unlock()
+	r = &ConsolidateReport{}
+	// renumber is the new serial of each stored event by its old serial
+	renumber := make(map[uint64]*number.Uint40)
+	if err = d.View(func(txn store.Txn) (err error) {
+		prf := []byte(indexes.Prefix(indexes.Event))
+		it := txn.NewIterator(store.IteratorOptions{Prefix: prf})
+		defer it.Close()
+		for it.Seek(prf); it.Valid(); it.Next() {
+			ser := indexes.EventVars()
+			if err = indexes.EventDec(ser).UnmarshalRead(bytes.NewBuffer(it.Key())); chk.E(err) {
+				return
+			}
+			to := new(number.Uint40)
+			if err = to.Set(uint64(len(renumber))); chk.E(err) {
+				return
+			}
+			if to.Get() != ser.Get() {
+				r.Renumbered++
+			}
+			renumber[ser.Get()] = to
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	r.Events = len(renumber)
+	log.I.F("consolidating the serials of %d events, %d of them renumbered",
+		r.Events, r.Renumbered)
+	// the keys are rewritten in ascending order, and serials only decrease, so
+	// a key is never written over one that is yet to be moved.
+	families := slices.Concat([]int{indexes.Event}, indexes.Families)
+	for i, f := range families {
+		if err = d.renumberFamily(f, renumber, r); chk.E(err) {
+			return
+		}
+		progress(i+1, len(families))
+	}
+	if err = d.resetSequence(uint64(r.Events)); chk.E(err) {
+		return
+	}
+	log.I.F("consolidated %d events, deleted %d orphaned index keys",
+		r.Events, r.Orphans)
+	return
+}
+
+// renumberFamily rewrites the keys of an index family with the new serials of
+// their events, and deletes those of events that are not stored.
+func (d *D) renumberFamily(f int, renumber map[uint64]*number.Uint40,
+	r *ConsolidateReport) (err error) {
+
+	wb := d.store.NewWriteBatch()
+	defer wb.Cancel()
+	if err = d.View(func(txn store.Txn) (err error) {
+		prf := []byte(indexes.Prefix(f))
+		it := txn.NewIterator(store.IteratorOptions{Prefix: prf})
+		defer it.Close()
+		for it.Seek(prf); it.Valid(); it.Next() {
+			k := it.Key()
+			var ser *number.Uint40
+			if ser, err = indexes.SerialOf(k); chk.E(err) {
+				return
+			}
+			to, ok := renumber[ser.Get()]
+			switch {
+			case !ok:
+				r.Orphans++
+				if err = wb.Delete(k); chk.E(err) {
+					return
+				}
+			case to.Get() != ser.Get():
+				var val, nk []byte
+				if val, err = it.Value(); chk.E(err) {
+					return
+				}
+				if nk, err = indexes.WithSerial(k, to); chk.E(err) {
+					return
+				}
+				if err = wb.Delete(k); chk.E(err) {
+					return
+				}
+				if err = wb.Set(nk, val); chk.E(err) {
+					return
+				}
+			}
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	return wb.Flush()
+}
+
+// resetSequence makes next the next serial taken from the sequence.
+func (d *D) resetSequence(next uint64) (err error) {
+	if err = d.seq.Release(); chk.E(err) {
+		return
+	}
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, next)
+	if err = d.Set(sequenceKey, val); chk.E(err) {
+		return
+	}
+	if d.seq, err = d.store.GetSequence(sequenceKey, sequenceBandwidth); chk.E(err) {
+		return
+	}
+	return
+}
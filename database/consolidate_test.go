@@ -0,0 +1,133 @@
+package database
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/database/indexes/types/number"
+	"manifold.mleku.dev/filter"
+)
+
+// TestConsolidate tests that consolidating a database with deleted events and
+// an orphaned index key numbers the events densely, keeps them queryable, and
+// resets the sequence of serials.
+func TestConsolidate(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifold-test-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	onDisk := New()
+	if err = onDisk.Init(tempDir); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer onDisk.Close()
+	for name, db := range map[string]*D{"badger": onDisk, "memory": newMemoryDB(t)} {
+		t.Run(name, func(t *testing.T) {
+			testConsolidate(t, db)
+		})
+	}
+}
+
+func testConsolidate(t *testing.T, db *D) {
+	events, err := generateTestEvents(12)
+	if err != nil {
+		t.Fatalf("Failed to generate test events: %v", err)
+	}
+	for _, ev := range events[:10] {
+		if err = db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+	deleted := map[int]bool{0: true, 3: true, 4: true, 8: true}
+	for n := range deleted {
+		id, err := events[n].Id()
+		if err != nil {
+			t.Fatalf("Failed to get event ID: %v", err)
+		}
+		if err = db.DeleteEventById(id); err != nil {
+			t.Fatalf("Failed to delete event: %v", err)
+		}
+	}
+	// an index key of an event that is not stored
+	orphan := new(number.Uint40)
+	if err = orphan.Set(900); err != nil {
+		t.Fatalf("Failed to set serial: %v", err)
+	}
+	_, n := indexes.ContentLengthVars()
+	ck := new(bytes.Buffer)
+	if err = indexes.ContentLengthEnc(orphan, n).MarshalWrite(ck); err != nil {
+		t.Fatalf("Failed to encode key: %v", err)
+	}
+	if err = db.Set(ck.Bytes(), nil); err != nil {
+		t.Fatalf("Failed to write orphaned key: %v", err)
+	}
+	before, err := db.QueryEvents(filter.F{Sort: "asc"})
+	if err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+
+	r, err := db.Consolidate(func(done, total int) {})
+	if err != nil {
+		t.Fatalf("Failed to consolidate: %v", err)
+	}
+	if r.Events != 6 || r.Renumbered != 6 || r.Orphans != 1 {
+		t.Errorf("Unexpected report %+v", r)
+	}
+	var c *CheckReport
+	if c, err = db.Check(false); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !c.Ok() || c.Events != 6 {
+		t.Fatalf("Expected clean report for 6 events, got\n%s", c)
+	}
+	kept := 0
+	for n, ev := range events[:10] {
+		if deleted[n] {
+			continue
+		}
+		id, err := ev.Id()
+		if err != nil {
+			t.Fatalf("Failed to get event ID: %v", err)
+		}
+		ser, err := db.FindEventSerialById(id)
+		if err != nil {
+			t.Fatalf("Failed to find event %d: %v", n, err)
+		}
+		if ser.Get() != uint64(kept) {
+			t.Errorf("Expected event %d to have serial %d, got %d", n, kept, ser.Get())
+		}
+		kept++
+	}
+	after, err := db.QueryEvents(filter.F{Sort: "asc"})
+	if err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("Expected %d events after consolidating, got %d", len(before), len(after))
+	}
+	for i := range after {
+		if !bytes.Equal(after[i], before[i]) {
+			t.Fatalf("Expected the same events after consolidating, differs at %d", i)
+		}
+	}
+	// new events take the serials following the last
+	for n, ev := range events[10:] {
+		if err = db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+		id, err := ev.Id()
+		if err != nil {
+			t.Fatalf("Failed to get event ID: %v", err)
+		}
+		ser, err := db.FindEventSerialById(id)
+		if err != nil {
+			t.Fatalf("Failed to find event: %v", err)
+		}
+		if ser.Get() != uint64(6+n) {
+			t.Errorf("Expected new event to have serial %d, got %d", 6+n, ser.Get())
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package database
+
+import (
+	"bytes"
+	"strconv"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/database/indexes/types/number"
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/ec/schnorr"
+	"manifold.mleku.dev/errorf"
+	"manifold.mleku.dev/filter"
+)
+
+// Count counts the events that match a filter, and if it has a GroupBy, the
+// number in each group, from the indexes without decoding the events. Author
+// and tag groups are sorted by count, most first, and time groups by time, and
+// no more than the Limit of the filter are returned. It returns ErrMigrating
+// while schema migrations are running.
+func (d *D) Count(f filter.F) (c *filter.Counts, err error) {
+	if err = d.migrated(); err != nil {
+		return
+	}
+	var tag string
+	var period int64
+	if f.GroupBy != "" {
+		if tag, period, err = filter.ParseGroupBy(f.GroupBy); chk.E(err) {
+			return
+		}
+	}
+	groupBy, limit := f.GroupBy, f.Limit
+	r := d.root()
+	r.replica.mx.RLock()
+	defer r.replica.mx.RUnlock()
+	f.Sort, f.SortTag, f.Limit, f.Count, f.GroupBy = "asc", "", 0, false, ""
+	var results []result
+	if results, err = d.queryResults(f); chk.E(err) {
+		return
+	}
+	c = &filter.Counts{}
+	// the events of a filter by Ids are not looked up by the query, so their
+	// serials are found here, skipping those that are not stored.
+	if len(f.Ids) > 0 {
+		found := results[:0]
+		for _, res := range results {
+			if res.ser, err = d.FindEventSerialById(res.Id); err != nil || res.ser == nil {
+				err = nil
+				continue
+			}
+			if _, res.Pubkey, res.Timestamp, err = d.GetIdPubkeyTimestampFromSerial(res.ser); chk.E(err) {
+				return
+			}
+			found = append(found, res)
+		}
+		results = found
+	}
+	c.Total = len(results)
+	switch {
+	case groupBy == "":
+		return
+	case period > 0:
+		c.Groups = countByTime(results, period)
+	case tag != "":
+		c.Groups, err = d.countByTag(results, tag)
+	default:
+		c.Groups, err = d.countByAuthor(results)
+	}
+	if err != nil {
+		return
+	}
+	c.Sort(period > 0)
+	if limit > 0 && len(c.Groups) > limit {
+		c.Groups = c.Groups[:limit]
+	}
+	return
+}
+
+// countByAuthor counts events by the hash of their author in the index, and
+// reads the pubkey of each group from the start of the record of one of its
+// events, without decoding it.
+func (d *D) countByAuthor(results []result) (groups []filter.Group, err error) {
+	counts := make(map[string]int)
+	first := make(map[string]*number.Uint40)
+	for _, r := range results {
+		if counts[string(r.Pubkey)]++; counts[string(r.Pubkey)] == 1 {
+			first[string(r.Pubkey)] = r.ser
+		}
+	}
+	err = d.View(func(txn store.Txn) (err error) {
+		for pk, n := range counts {
+			var pubkey []byte
+			if pubkey, err = eventPubkey(txn, first[pk]); chk.E(err) {
+				return
+			}
+			groups = append(groups, filter.Group{Key: pubkey, Count: n})
+		}
+		return
+	})
+	return
+}
+
+// eventPubkey reads the pubkey of an event, which its record starts with.
+func eventPubkey(txn store.Txn, ser *number.Uint40) (pk []byte, err error) {
+	evk := new(bytes.Buffer)
+	if err = indexes.EventEnc(ser).MarshalWrite(evk); chk.E(err) {
+		return
+	}
+	var val []byte
+	if val, err = txn.Get(evk.Bytes()); chk.E(err) {
+		return
+	}
+	if len(val) < schnorr.PubKeyBytesLen {
+		err = errorf.E("event serial %d is too short for a pubkey", ser.Get())
+		return
+	}
+	return bytes.Clone(val[:schnorr.PubKeyBytesLen]), nil
+}
+
+// countByTag counts events by the values of their tags of a key, as stored in
+// the index, so values longer than rawvalue.MaxLen are grouped by their start.
+// An event with several tags of the key is counted in each of their groups.
+func (d *D) countByTag(results []result, key string) (groups []filter.Group, err error) {
+	matching := make(map[uint64]struct{}, len(results))
+	for _, r := range results {
+		matching[r.ser.Get()] = struct{}{}
+	}
+	counts := make(map[string]int)
+	seen := make(map[string]struct{})
+	if err = d.View(func(txn store.Txn) (err error) {
+		return scanTagKeyValue(txn, key, nil, func(ser *number.Uint40, value []byte) (err error) {
+			if _, ok := matching[ser.Get()]; !ok {
+				return
+			}
+			pair := string(value) + "\x00" + strconv.FormatUint(ser.Get(), 10)
+			if _, ok := seen[pair]; ok {
+				return
+			}
+			seen[pair] = struct{}{}
+			counts[string(value)]++
+			return
+		})
+	}); chk.E(err) {
+		return
+	}
+	for value, n := range counts {
+		groups = append(groups, filter.Group{Key: []byte(value), Count: n})
+	}
+	return
+}
+
+// countByTime counts events by the period of a number of seconds that their
+// timestamp is in.
+func countByTime(results []result, period int64) (groups []filter.Group) {
+	counts := make(map[int64]int)
+	for _, r := range results {
+		ts := r.Timestamp
+		start := ts - ts%period
+		if ts < 0 && ts%period != 0 {
+			start -= period
+		}
+		counts[start]++
+	}
+	for start, n := range counts {
+		groups = append(groups, filter.Group{Key: []byte(strconv.FormatInt(start, 10)), Count: n})
+	}
+	return
+}
@@ -0,0 +1,104 @@
+package database
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+	"manifold.mleku.dev/p256k"
+)
+
+// TestCount tests counting events and grouping them by author, tag value and
+// period.
+func TestCount(t *testing.T) {
+	db := newMemoryDB(t)
+	defer db.Close()
+	signers := make([]*p256k.Signer, 2)
+	for i := range signers {
+		signers[i] = new(p256k.Signer)
+		if err := signers[i].Generate(); err != nil {
+			t.Fatalf("Failed to generate signer: %v", err)
+		}
+	}
+	const day = 86400
+	base := int64(19675 * day)
+	events := []struct {
+		author int
+		ts     int64
+		tags   []string
+	}{
+		{0, base + 10, []string{"go", "db"}},
+		{0, base + 20, []string{"go"}},
+		{0, base + day + 5, []string{"go", "go"}},
+		{1, base + 2*day, []string{"db"}},
+		{1, base + 2*day + 1, nil},
+	}
+	ids := make([][]byte, len(events))
+	for i, e := range events {
+		ev := &event.E{
+			Pubkey:    signers[e.author].Pub(),
+			Timestamp: e.ts,
+			Content:   []byte("count me"),
+			Tags:      &event.Tags{},
+		}
+		for _, v := range e.tags {
+			*ev.Tags = append(*ev.Tags, event.Tag{Key: []byte("t"), Value: []byte(v)})
+		}
+		if err := ev.Sign(signers[e.author]); err != nil {
+			t.Fatalf("Failed to sign event: %v", err)
+		}
+		if err := db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+		var err error
+		if ids[i], err = ev.Id(); err != nil {
+			t.Fatalf("Failed to get event ID: %v", err)
+		}
+	}
+	missing := make([]byte, 32)
+	group := func(key string, n int) filter.Group { return filter.Group{Key: []byte(key), Count: n} }
+	period := func(p int64) string { return strconv.FormatInt(p, 10) }
+	a, b := string(signers[0].Pub()), string(signers[1].Pub())
+	byAuthor := []filter.Group{group(a, 3), group(b, 2)}
+	tests := []struct {
+		name     string
+		f        filter.F
+		total    int
+		expected []filter.Group
+	}{
+		{"Total", filter.F{Count: true}, 5, nil},
+		{"ByAuthor", filter.F{Count: true, GroupBy: "author"}, 5, byAuthor},
+		{"ByTag", filter.F{Count: true, GroupBy: "tag:t"}, 5,
+			[]filter.Group{group("go", 3), group("db", 2)}},
+		{"ByTime", filter.F{Count: true, GroupBy: "time:86400"}, 5,
+			[]filter.Group{group(period(base), 2), group(period(base+day), 1), group(period(base+2*day), 2)}},
+		{"Filtered", filter.F{Count: true, GroupBy: "tag:t", Authors: [][]byte{signers[1].Pub()}}, 2,
+			[]filter.Group{group("db", 1)}},
+		{"Since", filter.F{Count: true, GroupBy: "author", Since: base + day}, 3,
+			[]filter.Group{group(b, 2), group(a, 1)}},
+		{"Limit", filter.F{Count: true, GroupBy: "tag:t", Limit: 1}, 5,
+			[]filter.Group{group("go", 3)}},
+		{"NoTag", filter.F{Count: true, GroupBy: "tag:x"}, 5, nil},
+		{"Ids", filter.F{Count: true, GroupBy: "author", Ids: [][]byte{ids[0], ids[1], missing}}, 2,
+			[]filter.Group{group(a, 2)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := db.Count(tt.f)
+			if err != nil {
+				t.Fatalf("Count failed: %v", err)
+			}
+			if c.Total != tt.total {
+				t.Errorf("Expected a total of %d, got %d", tt.total, c.Total)
+			}
+			if !reflect.DeepEqual(c.Groups, tt.expected) {
+				t.Errorf("Expected groups %q, got %q", tt.expected, c.Groups)
+			}
+		})
+	}
+	if _, err := db.Count(filter.F{Count: true, GroupBy: "kind"}); err == nil {
+		t.Errorf("Expected an error for an unknown group by")
+	}
+}
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"bytes"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/database/indexes/types/number"
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/event"
+)
+
+// DeleteEvent removes an event and all of its index keys from the database.
+func (d *D) DeleteEvent(ser *number.Uint40) (err error) {
+	if err = d.writable(); err != nil {
+		return
+	}
+	d.serials.RLock()
+	defer d.serials.RUnlock()
+	return d.deleteEvent(ser)
+}
+
+// deleteEvent removes an event and its index keys. It must be called with
+// serials held for reading.
+func (d *D) deleteEvent(ser *number.Uint40) (err error) {
+	var ev *event.E
+	if ev, err = d.fetchEventFromSerial(ser); chk.E(err) {
+		return
+	}
+	var keys [][]byte
+	if keys, err = d.GetEventIndexesForSerial(ev, ser); chk.E(err) {
+		return
+	}
+	evk := new(bytes.Buffer)
+	if err = indexes.EventEnc(ser).MarshalWrite(evk); chk.E(err) {
+		return
+	}
+	keys = append(keys, evk.Bytes())
+	d.feed.commit.RLock()
+	defer d.feed.commit.RUnlock()
+	c := Change{Serial: ser.Get(), Event: ev, Deleted: true}
+	if err = d.updateWithWords(ev, -1, func(txn store.Txn) (err error) {
+		var acc [][]byte
+		if acc, err = d.accessKeysOf(txn, ser); chk.E(err) {
+			return
+		}
+		for _, k := range append(keys, acc...) {
+			if err = txn.Delete(k); chk.E(err) {
+				return
+			}
+		}
+		return d.pendViews(txn, c)
+	}); err != nil {
+		return
+	}
+	d.updateViews(c)
+	d.publish(c)
+	return
+}
+
+// DeleteEventById removes the event with the given Id and all of its index
+// keys from the database.
+func (d *D) DeleteEventById(evId []byte) (err error) {
+	if err = d.writable(); err != nil {
+		return
+	}
+	d.serials.RLock()
+	defer d.serials.RUnlock()
+	var ser *number.Uint40
+	if ser, err = d.FindEventSerialById(evId); chk.E(err) {
+		return
+	}
+	return d.deleteEvent(ser)
+}
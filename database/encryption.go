@@ -0,0 +1,177 @@
+package database
+
+import (
+	"bytes"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"manifold.mleku.dev/apputil"
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/errorf"
+	"manifold.mleku.dev/log"
+)
+
+// KeyProvider returns the master key that encrypts a database at rest, given
+// the directory of the database. The key is an AES key of 16, 24 or 32 bytes.
+//
+// The master key encrypts the data keys that badger generates to encrypt the
+// event records and index keys, which are replaced every KeyRotation.
+type KeyProvider func(dir string) (key []byte, err error)
+
+// encryptionIndexCacheSize is the size of the badger index cache used when
+// encryption is enabled, as encrypted table indexes are decrypted into it
+// rather than read from the memory mapped tables.
+const encryptionIndexCacheSize = 256 << 20
+
+// saltFile is the name of the file in the database directory holding the salt
+// of a passphrase derived key.
+const saltFile = "KEYSALT"
+
+// passphraseIterations is the PBKDF2 iteration count for passphrase keys.
+const passphraseIterations = 600_000
+
+// checkKey returns an error if key is not a valid AES key length.
+func checkKey(key []byte) (err error) {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		err = errorf.E("encryption key must be 16, 24 or 32 bytes, got %d",
+			len(key))
+	}
+	return
+}
+
+// decodeHexKey decodes a hex encoded key, ignoring the white space around it.
+func decodeHexKey(b []byte) (key []byte, err error) {
+	if key, err = hex.DecodeString(string(bytes.TrimSpace(b))); err != nil {
+		return nil, errorf.E("encryption key is not valid hex: %v", err)
+	}
+	return key, checkKey(key)
+}
+
+// KeyFromEnv provides a hex encoded key from an environment variable.
+func KeyFromEnv(name string) KeyProvider {
+	return func(string) (key []byte, err error) {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			err = errorf.E("encryption key variable %s is not set", name)
+			return
+		}
+		return decodeHexKey([]byte(v))
+	}
+}
+
+// KeyFromFile provides a key from a file containing exactly the raw key bytes,
+// without a line break.
+func KeyFromFile(path string) KeyProvider {
+	return func(string) (key []byte, err error) {
+		if key, err = os.ReadFile(path); chk.E(err) {
+			return
+		}
+		if err = checkKey(key); err != nil {
+			err = errorf.E("key file %s must hold the raw key: %v", path, err)
+		}
+		return
+	}
+}
+
+// KeyFromHexFile provides a hex encoded key from a file, which may end with a
+// line break.
+func KeyFromHexFile(path string) KeyProvider {
+	return func(string) (key []byte, err error) {
+		var b []byte
+		if b, err = os.ReadFile(path); chk.E(err) {
+			return
+		}
+		return decodeHexKey(b)
+	}
+}
+
+// KeyFromPassphrase provides a 32 byte key derived from a passphrase with
+// PBKDF2. The random salt is created in the database directory the first time
+// the key is derived, and must be kept with the database.
+func KeyFromPassphrase(passphrase string) KeyProvider {
+	return func(dir string) (key []byte, err error) {
+		path := filepath.Join(dir, saltFile)
+		var salt []byte
+		if apputil.FileExists(path) {
+			if salt, err = os.ReadFile(path); chk.E(err) {
+				return
+			}
+		} else {
+			salt = make([]byte, 16)
+			if _, err = rand.Read(salt); chk.E(err) {
+				return
+			}
+			if err = os.MkdirAll(dir, 0700); chk.E(err) {
+				return
+			}
+			if err = os.WriteFile(path, salt, 0600); chk.E(err) {
+				return
+			}
+		}
+		return pbkdf2.Key(sha256.New, passphrase, salt, passphraseIterations, 32)
+	}
+}
+
+// encryption configures the badger options for encryption at rest with the
+// master key from d.KeyProvider, if it is set.
+func (d *D) encryption(opts *badger.Options) (err error) {
+	if d.KeyProvider == nil {
+		return
+	}
+	var key []byte
+	if key, err = d.KeyProvider(d.dataDir); chk.E(err) {
+		return
+	}
+	if err = checkKey(key); chk.E(err) {
+		return
+	}
+	log.I.Ln("encryption at rest enabled for", d.dataDir)
+	opts.EncryptionKey = key
+	if d.KeyRotation > 0 {
+		opts.EncryptionKeyRotationDuration = d.KeyRotation
+	}
+	opts.IndexCacheSize = encryptionIndexCacheSize
+	return
+}
+
+// RotateKey re-encrypts the data keys of the closed database at path with a new
+// master key. If oldKey is nil the database is not yet encrypted; its existing
+// tables are then encrypted as badger compacts them after it is opened with the
+// new key.
+func RotateKey(path string, oldKey, newKey KeyProvider) (err error) {
+	opts := badger.KeyRegistryOptions{Dir: path, ReadOnly: true}
+	if oldKey != nil {
+		if opts.EncryptionKey, err = oldKey(path); chk.E(err) {
+			return
+		}
+	}
+	var kr *badger.KeyRegistry
+	if kr, err = badger.OpenKeyRegistry(opts); chk.E(err) {
+		return
+	}
+	defer func() {
+		if cerr := kr.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	opts.ReadOnly = false
+	if opts.EncryptionKey, err = newKey(path); chk.E(err) {
+		return
+	}
+	if err = checkKey(opts.EncryptionKey); chk.E(err) {
+		return
+	}
+	if err = badger.WriteKeyRegistry(kr, opts); chk.E(err) {
+		return
+	}
+	log.I.Ln("rotated master key of", path)
+	return
+}
@@ -0,0 +1,108 @@
+package database
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+)
+
+// TestEncryption tests that an encrypted database can only be opened with its
+// master key, and that it remains readable after the master key is rotated.
+func TestEncryption(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifold-test-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	db := New()
+	db.KeyProvider = KeyFromPassphrase("correct horse battery staple")
+	if err = db.Init(tempDir); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	var events []*event.E
+	if events, err = generateTestEvents(10); err != nil {
+		t.Fatalf("Failed to generate test events: %v", err)
+	}
+	for _, ev := range events {
+		if err = db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+	if err = db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	for name, key := range map[string]KeyProvider{
+		"no key":         nil,
+		"wrong key":      KeyFromPassphrase("incorrect horse battery staple"),
+		"invalid length": func(string) ([]byte, error) { return []byte("short"), nil },
+	} {
+		db = New()
+		db.KeyProvider = key
+		if err = db.Init(tempDir); err == nil {
+			db.Close()
+			t.Fatalf("Expected error opening encrypted database with %s", name)
+		}
+	}
+
+	t.Setenv("MANIFOLD_TEST_KEY",
+		"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	if err = RotateKey(tempDir, KeyFromPassphrase("correct horse battery staple"),
+		KeyFromEnv("MANIFOLD_TEST_KEY")); err != nil {
+		t.Fatalf("Failed to rotate key: %v", err)
+	}
+	db = New()
+	db.KeyProvider = KeyFromEnv("MANIFOLD_TEST_KEY")
+	if err = db.Init(tempDir); err != nil {
+		t.Fatalf("Failed to open database with rotated key: %v", err)
+	}
+	defer db.Close()
+	var ids [][]byte
+	if ids, err = db.QueryEvents(filter.F{}); err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+	if len(ids) != len(events) {
+		t.Fatalf("Expected %d events after key rotation, got %d", len(events), len(ids))
+	}
+}
+
+// TestKeyProviders tests that keys are read from the environment in hex and
+// from files raw or in hex, without guessing the encoding.
+func TestKeyProviders(t *testing.T) {
+	dir := t.TempDir()
+	// a raw key of only hex characters is not decoded as hex
+	raw := []byte("0123456789abcdef0123456789abcdef")
+	rawFile := filepath.Join(dir, "raw")
+	if err := os.WriteFile(rawFile, raw, 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+	if key, err := KeyFromFile(rawFile)(dir); err != nil || !bytes.Equal(key, raw) {
+		t.Errorf("Expected the raw key from the file, got %x: %v", key, err)
+	}
+	if err := os.WriteFile(rawFile, append(raw, '\n'), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+	if _, err := KeyFromFile(rawFile)(dir); err == nil {
+		t.Errorf("Expected an error reading a raw key file with a line break")
+	}
+	hexFile := filepath.Join(dir, "hex")
+	if err := os.WriteFile(hexFile, append(raw, '\n'), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+	if key, err := KeyFromHexFile(hexFile)(dir); err != nil || len(key) != 16 {
+		t.Errorf("Expected a 16 byte key from the hex file, got %x: %v", key, err)
+	}
+	t.Setenv("MANIFOLD_TEST_KEY", string(raw[:24]))
+	if _, err := KeyFromEnv("MANIFOLD_TEST_KEY")(dir); err == nil {
+		t.Errorf("Expected an error for a hex key of an invalid length")
+	}
+	t.Setenv("MANIFOLD_TEST_KEY", "not hex at all, but 32 bytes ok")
+	if _, err := KeyFromEnv("MANIFOLD_TEST_KEY")(dir); err == nil {
+		t.Errorf("Expected an error for a key in the environment that is not hex")
+	}
+}
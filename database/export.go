@@ -0,0 +1,284 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"manifold.mleku.dev/database/store"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/errorf"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+	"manifold.mleku.dev/log"
+	"manifold.mleku.dev/units"
+	"manifold.mleku.dev/varint"
+)
+
+// ArchiveFormat is the encoding of the events in an archive written by Export.
+type ArchiveFormat int
+
+const (
+	// Text archives contain events in the sentinel text encoding, each
+	// followed by an empty line. Because text fields escape line breaks, an
+	// empty line never appears inside an event.
+	Text ArchiveFormat = iota
+	// Binary archives contain events in the WriteBinary encoding, each
+	// prefixed by its length as a varint.
+	Binary
+)
+
+// gzipMagic is the first two bytes of a gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// MaxArchivedEventSize is the largest encoding of an event that Import reads
+// from an archive, so that a corrupt archive cannot exhaust memory.
+const MaxArchivedEventSize = 64 * units.Mb
+
+// Export writes the events matching a filter to w in the given format,
+// compressed with gzip if compress is true. If f is nil every event is
+// exported in the order of their serials, without the cost of a query.
+func (d *D) Export(w io.Writer, f *filter.F, format ArchiveFormat, compress bool) (n int, err error) {
+	if compress {
+		gw := gzip.NewWriter(w)
+		defer func() {
+			if cerr := gw.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		w = gw
+	}
+	bw := bufio.NewWriter(w)
+	defer func() {
+		if ferr := bw.Flush(); err == nil {
+			err = ferr
+		}
+	}()
+	write := func(ev *event.E) (err error) {
+		switch format {
+		case Text:
+			var b []byte
+			if b, err = ev.Marshal(); chk.E(err) {
+				return
+			}
+			if _, err = bw.Write(b); chk.E(err) {
+				return
+			}
+			if _, err = bw.Write([]byte("\n\n")); chk.E(err) {
+				return
+			}
+		case Binary:
+			buf := new(bytes.Buffer)
+			if err = ev.WriteBinary(buf); chk.E(err) {
+				return
+			}
+			varint.Encode(bw, buf.Len())
+			if _, err = bw.Write(buf.Bytes()); chk.E(err) {
+				return
+			}
+		default:
+			err = errorf.E("unknown archive format %d", format)
+			return
+		}
+		n++
+		return
+	}
+	if f == nil {
+		err = d.View(func(txn store.Txn) (err error) {
+			prf := []byte(indexes.Prefix(indexes.Event))
+			it := txn.NewIterator(store.IteratorOptions{Prefix: prf})
+			defer it.Close()
+			for it.Seek(prf); it.Valid(); it.Next() {
+				var val []byte
+				if val, err = it.Value(); chk.E(err) {
+					return
+				}
+				ev := &event.E{}
+				if err = ev.ReadBinary(bytes.NewBuffer(val)); chk.E(err) {
+					return
+				}
+				if err = write(ev); err != nil {
+					return
+				}
+			}
+			return
+		})
+		return
+	}
+	var ids [][]byte
+	if ids, err = d.QueryEvents(*f); chk.E(err) {
+		return
+	}
+	for _, id := range ids {
+		var ev *event.E
+		if ev, err = d.GetEventById(id); chk.E(err) {
+			return
+		}
+		if err = write(ev); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// ImportReport is the summary of an Import.
+type ImportReport struct {
+	// Read is the number of events read from the archive.
+	Read int
+	// Stored is the number of new events stored in the database.
+	Stored int
+	// Duplicates is the number of events that were already in the database.
+	Duplicates int
+	// Invalid is the number of events that failed signature verification.
+	Invalid int
+}
+
+func (r *ImportReport) String() string {
+	return fmt.Sprintf("read %d, stored %d, duplicates %d, invalid %d",
+		r.Read, r.Stored, r.Duplicates, r.Invalid)
+}
+
+// Import reads an archive written by Export and stores the events it contains
+// that are not already in the database. The format and compression of the
+// archive are detected from its first bytes. If verify is true, events with
+// invalid signatures are skipped.
+func (d *D) Import(r io.Reader, verify bool) (rep *ImportReport, err error) {
+	rep = &ImportReport{}
+	br := bufio.NewReader(r)
+	var magic []byte
+	if magic, err = br.Peek(len(gzipMagic)); err == io.EOF {
+		err = nil
+		return
+	} else if chk.E(err) {
+		return
+	}
+	if bytes.Equal(magic, gzipMagic) {
+		var gr *gzip.Reader
+		if gr, err = gzip.NewReader(br); chk.E(err) {
+			return
+		}
+		defer gr.Close()
+		br = bufio.NewReader(gr)
+	}
+	store := func(ev *event.E) (err error) {
+		rep.Read++
+		if verify {
+			var valid bool
+			if valid, err = ev.Verify(); err != nil || !valid {
+				log.W.F("skipping event with invalid signature")
+				rep.Invalid++
+				err = nil
+				return
+			}
+		}
+		var id []byte
+		if id, err = ev.Id(); chk.E(err) {
+			return
+		}
+		if ser, _ := d.FindEventSerialById(id); ser != nil {
+			rep.Duplicates++
+			return
+		}
+		if err = d.StoreEvent(ev); chk.E(err) {
+			return
+		}
+		rep.Stored++
+		return
+	}
+	var start []byte
+	if start, err = br.Peek(len(event.Sentinels[event.PUBKEY])); err == io.EOF {
+		err = nil
+		return
+	} else if chk.E(err) {
+		return
+	}
+	if bytes.Equal(start, event.Sentinels[event.PUBKEY]) {
+		rec := new(bytes.Buffer)
+		flush := func() (err error) {
+			if rec.Len() == 0 {
+				return
+			}
+			ev := &event.E{}
+			if err = ev.Unmarshal(rec.Bytes()); chk.E(err) {
+				return
+			}
+			rec.Reset()
+			return store(ev)
+		}
+		for {
+			var line []byte
+			if line, err = readLine(br, MaxArchivedEventSize-rec.Len()); err == io.EOF {
+				err = nil
+				break
+			} else if chk.E(err) {
+				return
+			}
+			if len(line) == 0 {
+				if err = flush(); err != nil {
+					return
+				}
+				continue
+			}
+			if rec.Len() > 0 {
+				rec.WriteByte('\n')
+			}
+			rec.Write(line)
+		}
+		err = flush()
+		return
+	}
+	for {
+		if _, err = br.Peek(1); err == io.EOF {
+			err = nil
+			return
+		} else if chk.E(err) {
+			return
+		}
+		var l uint64
+		if l, err = varint.Decode(br); chk.E(err) {
+			return
+		}
+		if l > MaxArchivedEventSize {
+			err = errorf.E("archived event of %d bytes is larger than the limit of %d",
+				l, MaxArchivedEventSize)
+			return
+		}
+		b := make([]byte, l)
+		if _, err = io.ReadFull(br, b); chk.E(err) {
+			return
+		}
+		ev := &event.E{}
+		if err = ev.ReadBinary(bytes.NewBuffer(b)); chk.E(err) {
+			return
+		}
+		if err = store(ev); err != nil {
+			return
+		}
+	}
+}
+
+// readLine reads a line without its line break, returning an error if it is
+// longer than limit, and io.EOF at the end of the input.
+func readLine(br *bufio.Reader, limit int) (line []byte, err error) {
+	for {
+		var b []byte
+		b, err = br.ReadSlice('\n')
+		if len(line)+len(b) > limit {
+			return nil, errorf.E("archived event is larger than the limit of %d bytes",
+				MaxArchivedEventSize)
+		}
+		line = append(line, b...)
+		if err != bufio.ErrBufferFull {
+			break
+		}
+	}
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte{'\n'}), []byte{'\r'})
+	return
+}
@@ -0,0 +1,139 @@
+package database
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+	"manifold.mleku.dev/p256k"
+	"manifold.mleku.dev/varint"
+)
+
+// TestExportImport exports events in each archive format, with and without
+// compression, and imports them into a new database.
+func TestExportImport(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifold-test-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	db := New()
+	if err = db.Init(tempDir); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	var events []*event.E
+	if events, err = generateTestEvents(10); err != nil {
+		t.Fatalf("Failed to generate test events: %v", err)
+	}
+	for _, ev := range events {
+		if err = db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		format   ArchiveFormat
+		compress bool
+		f        *filter.F
+		expected int
+	}{
+		{"Text", Text, false, nil, len(events)},
+		{"TextGzip", Text, true, nil, len(events)},
+		{"Binary", Binary, false, nil, len(events)},
+		{"BinaryGzip", Binary, true, nil, len(events)},
+		{"Filtered", Binary, false,
+			&filter.F{Authors: [][]byte{events[0].Pubkey}}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			var n int
+			if n, err = db.Export(buf, tt.f, tt.format, tt.compress); err != nil {
+				t.Fatalf("Export failed: %v", err)
+			}
+			if n != tt.expected {
+				t.Fatalf("Expected %d events exported, got %d", tt.expected, n)
+			}
+			archive := buf.Bytes()
+
+			dir, err := os.MkdirTemp("", "manifold-test-db")
+			if err != nil {
+				t.Fatalf("Failed to create temp directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			db2 := New()
+			if err = db2.Init(dir); err != nil {
+				t.Fatalf("Failed to initialize database: %v", err)
+			}
+			defer db2.Close()
+
+			var r *ImportReport
+			if r, err = db2.Import(bytes.NewReader(archive), true); err != nil {
+				t.Fatalf("Import failed: %v", err)
+			}
+			if r.Read != tt.expected || r.Stored != tt.expected || r.Invalid != 0 {
+				t.Fatalf("Unexpected import result: %s", r)
+			}
+			var ids [][]byte
+			if ids, err = db2.QueryEvents(filter.F{}); err != nil {
+				t.Fatalf("QueryEvents failed: %v", err)
+			}
+			if len(ids) != tt.expected {
+				t.Fatalf("Expected %d events, got %d", tt.expected, len(ids))
+			}
+
+			// importing a second time only finds duplicates
+			if r, err = db2.Import(bytes.NewReader(archive), true); err != nil {
+				t.Fatalf("Import failed: %v", err)
+			}
+			if r.Duplicates != tt.expected || r.Stored != 0 {
+				t.Fatalf("Unexpected import result: %s", r)
+			}
+		})
+	}
+}
+
+// TestImportLarge tests that events longer than a line buffer are imported from
+// both formats, and that an archive claiming a longer event than
+// MaxArchivedEventSize is refused.
+func TestImportLarge(t *testing.T) {
+	db := newMemoryDB(t)
+	defer db.Close()
+	signer := new(p256k.Signer)
+	if err := signer.Generate(); err != nil {
+		t.Fatalf("Failed to generate signer: %v", err)
+	}
+	ev := &event.E{Pubkey: signer.Pub(), Timestamp: 1700000000,
+		Content: bytes.Repeat([]byte("x"), 1_200_000), Tags: &event.Tags{}}
+	if err := ev.Sign(signer); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	if err := db.StoreEvent(ev); err != nil {
+		t.Fatalf("Failed to store event: %v", err)
+	}
+	for _, format := range []ArchiveFormat{Text, Binary} {
+		buf := new(bytes.Buffer)
+		if _, err := db.Export(buf, nil, format, false); err != nil {
+			t.Fatalf("Export failed: %v", err)
+		}
+		db2 := newMemoryDB(t)
+		r, err := db2.Import(buf, true)
+		if err != nil || r.Stored != 1 {
+			t.Errorf("Expected the large event imported in format %d, got %v: %v", format, r, err)
+		}
+		db2.Close()
+	}
+
+	buf := new(bytes.Buffer)
+	varint.Encode(buf, 1<<40)
+	buf.WriteString("truncated")
+	if _, err := db.Import(buf, false); err == nil {
+		t.Errorf("Expected an error importing an event longer than the limit")
+	}
+}
@@ -0,0 +1,293 @@
+package database
+
+import (
+	"bytes"
+	"sync"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/database/indexes/types/number"
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+	"manifold.mleku.dev/log"
+)
+
+// Change is an event that was stored in or deleted from the database.
+type Change struct {
+	// Serial is the serial of the event in the database.
+	Serial uint64
+	Event  *event.E
+	// Deleted is true if the event was deleted, rather than stored.
+	Deleted bool
+}
+
+// Overflow is what the change feed does when the buffer of a subscriber is
+// full.
+type Overflow int
+
+const (
+	// OverflowClose closes the channel of the subscriber, who can subscribe
+	// again to resume from the serial after the last change it received.
+	OverflowClose Overflow = iota
+	// OverflowBlock makes StoreEvent and DeleteEvent wait until the subscriber
+	// takes the change, or cancels the subscription. Other subscribers and new
+	// subscriptions are not held up, except those that Resume, which wait for
+	// the writes in progress.
+	OverflowBlock
+	// OverflowDrop discards the changes that do not fit in the buffer.
+	OverflowDrop
+)
+
+// DefaultFeedBuffer is the number of changes buffered for a subscriber if
+// SubscribeOptions.Buffer is zero.
+const DefaultFeedBuffer = 256
+
+// SubscribeOptions are the options of a subscription to the change feed.
+type SubscribeOptions struct {
+	// Buffer is the number of changes buffered for the subscriber.
+	Buffer int
+	// Overflow is what happens when the buffer is full.
+	Overflow Overflow
+	// Resume sends the stored events that match, with a serial of From or
+	// more, before the changes made after subscribing. Deletions made while
+	// the subscriber was away are not sent.
+	Resume bool
+	From   uint64
+}
+
+// feed is the set of subscribers to the changes of the database.
+type feed struct {
+	// commit is held for reading while a change is written and published, and
+	// for writing while a resuming subscriber is added and its snapshot of the
+	// stored events taken, so that every change is either in the snapshot or
+	// published to it, and not both.
+	commit sync.RWMutex
+	mx     sync.Mutex
+	subs   map[*subscriber]struct{}
+}
+
+type subscriber struct {
+	f        filter.F
+	ch       chan Change
+	overflow Overflow
+	// sendMx is held while a change is sent to an OverflowBlock subscriber
+	// outside the lock of the feed, and while its channel is closed.
+	sendMx sync.Mutex
+	// done is closed when the subscription is cancelled.
+	done chan struct{}
+	once sync.Once
+	// closed is true once the channel is closed, or is to be closed when the
+	// stored events have been replayed.
+	closed bool
+	// replaying is true while stored events are sent to the subscriber, and
+	// live changes are kept in pending.
+	replaying bool
+	pending   []Change
+}
+
+// Subscribe returns a channel that receives the changes to the events matching
+// a filter, after they are committed, and a function to cancel the
+// subscription. The channel is closed when the subscription is cancelled, when
+// the database is closed, or on overflow with OverflowClose.
+//
+// The changes are published by StoreEvent and DeleteEvent, rather than taken
+// from the subscriptions of the badger store, which do not tell deleted keys
+// from written ones, are not provided by other stores, and only send the writes
+// made after subscribing. A subscriber resumes instead from a snapshot of the
+// stored events with a serial of From or more, which is taken while writes are
+// held back, so that each change is either in it or sent after it.
+func (d *D) Subscribe(f filter.F, o SubscribeOptions) (changes <-chan Change, cancel func()) {
+	if o.Buffer <= 0 {
+		o.Buffer = DefaultFeedBuffer
+	}
+	s := &subscriber{
+		f:         f,
+		ch:        make(chan Change, o.Buffer),
+		overflow:  o.Overflow,
+		done:      make(chan struct{}),
+		replaying: o.Resume,
+	}
+	cancel = func() {
+		s.once.Do(func() { close(s.done) })
+		d.feed.mx.Lock()
+		defer d.feed.mx.Unlock()
+		d.feed.close(s)
+	}
+	if !o.Resume {
+		d.feed.mx.Lock()
+		d.feed.add(s)
+		d.feed.mx.Unlock()
+		return s.ch, cancel
+	}
+	d.feed.commit.Lock()
+	d.feed.mx.Lock()
+	d.feed.add(s)
+	d.feed.mx.Unlock()
+	d.workers.Add(1)
+	go d.replay(s, o.From)
+	return s.ch, cancel
+}
+
+func (fd *feed) add(s *subscriber) {
+	if fd.subs == nil {
+		fd.subs = make(map[*subscriber]struct{})
+	}
+	fd.subs[s] = struct{}{}
+}
+
+// close removes a subscriber and closes its channel, unless stored events are
+// being replayed to it, in which case the replay closes it when it stops. It
+// must be called with mx held.
+func (fd *feed) close(s *subscriber) {
+	delete(fd.subs, s)
+	s.sendMx.Lock()
+	defer s.sendMx.Unlock()
+	if !s.closed && !s.replaying {
+		close(s.ch)
+	}
+	s.closed = true
+}
+
+// closeAll closes the channels of every subscriber.
+func (fd *feed) closeAll() {
+	fd.mx.Lock()
+	defer fd.mx.Unlock()
+	for s := range fd.subs {
+		fd.close(s)
+	}
+}
+
+// send sends a change to a subscriber during replay, returning false if the
+// subscription is cancelled or the database closed.
+func (d *D) send(s *subscriber, c Change) bool {
+	select {
+	case s.ch <- c:
+		return true
+	case <-s.done:
+	case <-d.ctx.Done():
+	}
+	return false
+}
+
+// replay sends the stored events matching the filter of a subscriber with a
+// serial of from or more, and then the changes made meanwhile, before handing
+// the subscriber over to publish. It is called with commit held, which it
+// releases once it has a snapshot of the stored events.
+func (d *D) replay(s *subscriber, from uint64) {
+	defer d.workers.Done()
+	locked := true
+	unlock := func() {
+		if locked {
+			d.feed.commit.Unlock()
+			locked = false
+		}
+	}
+	defer unlock()
+	ok := true
+	if err := d.View(func(txn store.Txn) (err error) {
+		unlock()
+		start := new(number.Uint40)
+		if err = start.Set(min(from, number.MaxUint40)); chk.E(err) {
+			return
+		}
+		sk := new(bytes.Buffer)
+		if err = indexes.EventEnc(start).MarshalWrite(sk); chk.E(err) {
+			return
+		}
+		prf := []byte(indexes.Prefix(indexes.Event))
+		it := txn.NewIterator(store.IteratorOptions{Prefix: prf})
+		defer it.Close()
+		for it.Seek(sk.Bytes()); ok && it.Valid(); it.Next() {
+			ser := indexes.EventVars()
+			if err = indexes.EventDec(ser).UnmarshalRead(bytes.NewBuffer(it.Key())); chk.E(err) {
+				return
+			}
+			var val []byte
+			if val, err = it.Value(); chk.E(err) {
+				return
+			}
+			ev := &event.E{}
+			if err = ev.ReadBinary(bytes.NewBuffer(val)); err != nil {
+				log.W.F("event serial %d could not be decoded: %v", ser.Get(), err)
+				err = nil
+				continue
+			}
+			if Matches(s.f, ev) {
+				ok = d.send(s, Change{Serial: ser.Get(), Event: ev})
+			}
+		}
+		return
+	}); err != nil {
+		ok = false
+	}
+	// send the changes made during the replay until there are none left, and
+	// then leave the subscriber to publish.
+	for {
+		d.feed.mx.Lock()
+		pending := s.pending
+		s.pending = nil
+		if !ok || s.closed || len(pending) == 0 {
+			s.replaying = false
+			if !ok || s.closed {
+				delete(d.feed.subs, s)
+				close(s.ch)
+				s.closed = true
+			}
+			d.feed.mx.Unlock()
+			return
+		}
+		d.feed.mx.Unlock()
+		for _, c := range pending {
+			if ok = d.send(s, c); !ok {
+				break
+			}
+		}
+	}
+}
+
+// publish sends a change to the subscribers whose filter matches the event. It
+// must be called with commit held for reading.
+func (d *D) publish(c Change) {
+	var blocking []*subscriber
+	d.feed.mx.Lock()
+	for s := range d.feed.subs {
+		if s.closed || !Matches(s.f, c.Event) {
+			continue
+		}
+		if s.replaying {
+			s.pending = append(s.pending, c)
+			continue
+		}
+		switch s.overflow {
+		case OverflowBlock:
+			blocking = append(blocking, s)
+		case OverflowDrop:
+			select {
+			case s.ch <- c:
+			default:
+			}
+		default:
+			select {
+			case s.ch <- c:
+			default:
+				log.W.F("change feed subscriber fell behind at serial %d, closing", c.Serial)
+				d.feed.close(s)
+			}
+		}
+	}
+	d.feed.mx.Unlock()
+	// subscribers that block are waited for without the lock of the feed, so
+	// that a slow one does not hold up the others.
+	for _, s := range blocking {
+		s.sendMx.Lock()
+		if !s.closed {
+			select {
+			case s.ch <- c:
+			case <-s.done:
+			case <-d.ctx.Done():
+			}
+		}
+		s.sendMx.Unlock()
+	}
+}
@@ -0,0 +1,247 @@
+package database
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"manifold.mleku.dev/database/store/memory"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+)
+
+func newMemoryDB(t *testing.T) (db *D) {
+	db = New()
+	if err := db.InitStore(memory.New()); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	return
+}
+
+// receive returns the next change from a subscription, failing the test if
+// none arrives or the channel is closed.
+func receive(t *testing.T, changes <-chan Change) (c Change) {
+	t.Helper()
+	select {
+	case c, ok := <-changes:
+		if !ok {
+			t.Fatalf("Expected a change, channel was closed")
+		}
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a change")
+	}
+	return
+}
+
+func TestSubscribe(t *testing.T) {
+	db := newMemoryDB(t)
+	defer db.Close()
+	events, err := generateTestEvents(6)
+	if err != nil {
+		t.Fatalf("Failed to generate test events: %v", err)
+	}
+	changes, cancel := db.Subscribe(filter.F{Authors: [][]byte{events[0].Pubkey}}, SubscribeOptions{})
+	for _, ev := range events {
+		if err = db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+	// events 0 and 3 are by the first author
+	for _, n := range []int{0, 3} {
+		c := receive(t, changes)
+		if c.Event != events[n] || c.Deleted {
+			t.Fatalf("Expected stored event %d", n)
+		}
+	}
+	id, err := events[3].Id()
+	if err != nil {
+		t.Fatalf("Failed to get event ID: %v", err)
+	}
+	if err = db.DeleteEventById(id); err != nil {
+		t.Fatalf("Failed to delete event: %v", err)
+	}
+	if c := receive(t, changes); !c.Deleted || c.Event.Timestamp != events[3].Timestamp {
+		t.Fatalf("Expected deletion of event 3")
+	}
+	cancel()
+	if _, ok := <-changes; ok {
+		t.Fatalf("Expected channel to be closed by cancel")
+	}
+	cancel()
+}
+
+func TestSubscribeResume(t *testing.T) {
+	db := newMemoryDB(t)
+	defer db.Close()
+	events, err := generateTestEvents(6)
+	if err != nil {
+		t.Fatalf("Failed to generate test events: %v", err)
+	}
+	for _, ev := range events[:4] {
+		if err = db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+	id, err := events[1].Id()
+	if err != nil {
+		t.Fatalf("Failed to get event ID: %v", err)
+	}
+	ser, err := db.FindEventSerialById(id)
+	if err != nil {
+		t.Fatalf("Failed to find serial: %v", err)
+	}
+	changes, cancel := db.Subscribe(filter.F{}, SubscribeOptions{
+		Buffer: 1, Resume: true, From: ser.Get()})
+	defer cancel()
+	// store more events while the stored ones are being replayed
+	for _, ev := range events[4:] {
+		if err = db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+	last := ser.Get()
+	for n := 1; n < len(events); n++ {
+		c := receive(t, changes)
+		if !bytes.Equal(c.Event.Signature, events[n].Signature) {
+			t.Fatalf("Expected event %d", n)
+		}
+		if n > 1 && c.Serial <= last {
+			t.Fatalf("Expected serials in ascending order, got %d after %d", c.Serial, last)
+		}
+		last = c.Serial
+	}
+	select {
+	case c := <-changes:
+		t.Fatalf("Unexpected change of serial %d", c.Serial)
+	default:
+	}
+}
+
+func TestSubscribeOverflow(t *testing.T) {
+	db := newMemoryDB(t)
+	defer db.Close()
+	events, err := generateTestEvents(3)
+	if err != nil {
+		t.Fatalf("Failed to generate test events: %v", err)
+	}
+	closing, _ := db.Subscribe(filter.F{}, SubscribeOptions{Buffer: 1})
+	dropping, cancel := db.Subscribe(filter.F{}, SubscribeOptions{Buffer: 1, Overflow: OverflowDrop})
+	for _, ev := range events {
+		if err = db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+	receive(t, closing)
+	if _, ok := <-closing; ok {
+		t.Fatalf("Expected channel to be closed on overflow")
+	}
+	receive(t, dropping)
+	select {
+	case <-dropping:
+		t.Fatalf("Expected changes to be dropped")
+	default:
+	}
+	cancel()
+}
+
+// TestSubscribeBlock tests that a subscriber that blocks writes does not hold
+// up the other subscribers or new subscriptions.
+func TestSubscribeBlock(t *testing.T) {
+	db := newMemoryDB(t)
+	defer db.Close()
+	events, err := generateTestEvents(3)
+	if err != nil {
+		t.Fatalf("Failed to generate test events: %v", err)
+	}
+	_, cancelBlocking := db.Subscribe(filter.F{}, SubscribeOptions{Buffer: 1, Overflow: OverflowBlock})
+	other, cancel := db.Subscribe(filter.F{}, SubscribeOptions{})
+	defer cancel()
+	stored := make(chan error)
+	go func() {
+		for _, ev := range events {
+			if err := db.StoreEvent(ev); err != nil {
+				stored <- err
+				return
+			}
+		}
+		close(stored)
+	}()
+	// the second change waits for the blocking subscriber, after the others
+	// have it
+	receive(t, other)
+	receive(t, other)
+	subscribed := make(chan struct{})
+	go func() {
+		_, cancel := db.Subscribe(filter.F{}, SubscribeOptions{})
+		cancel()
+		close(subscribed)
+	}()
+	select {
+	case <-subscribed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out subscribing while a subscriber blocks")
+	}
+	select {
+	case <-stored:
+		t.Fatalf("Expected the writes to wait for the blocking subscriber")
+	default:
+	}
+	cancelBlocking()
+	if err = <-stored; err != nil {
+		t.Fatalf("Failed to store event: %v", err)
+	}
+	receive(t, other)
+}
+
+// TestMatches tests that Matches agrees with QueryEvents on which events match
+// a filter.
+func TestMatches(t *testing.T) {
+	db := newMemoryDB(t)
+	defer db.Close()
+	events, err := generateTestEvents(12)
+	if err != nil {
+		t.Fatalf("Failed to generate test events: %v", err)
+	}
+	*events[5].Tags = append(*events[5].Tags,
+		event.Tag{Key: []byte("price"), Value: []byte("12.5")},
+		event.Tag{Key: []byte("g"), Value: []byte("gcpvj0")})
+	for _, ev := range events {
+		if err = db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+	filters := []filter.F{
+		{Authors: [][]byte{events[1].Pubkey}},
+		{NotAuthors: [][]byte{events[1].Pubkey}, Tags: filter.TagMap{"type": {[]byte("text")}}},
+		{Tags: filter.TagMap{"category": {[]byte("test")}, "importance": {[]byte("high")}}},
+		{NotTags: filter.TagMap{"type": {[]byte("text")}}, Since: events[3].Timestamp},
+		{HasTags: []string{"importance"}},
+		{TagPrefixes: filter.TagMap{"category": {[]byte("te")}}},
+		{Ranges: map[string]filter.Range{"price": {Min: 10, Max: 20}}},
+		{Near: &filter.Circle{Lat: 51.5, Lon: -0.12, Radius: 5000}},
+		{Search: "content 7"},
+		{Search: `"test content"`, Until: events[2].Timestamp},
+	}
+	for i, f := range filters {
+		f.Sort = "asc"
+		ids, err := db.QueryEvents(f)
+		if err != nil {
+			t.Fatalf("Failed to query events: %v", err)
+		}
+		found := make(map[string]struct{})
+		for _, id := range ids {
+			found[string(id)] = struct{}{}
+		}
+		for n, ev := range events {
+			id, err := ev.Id()
+			if err != nil {
+				t.Fatalf("Failed to get event ID: %v", err)
+			}
+			_, queried := found[string(id)]
+			if m := Matches(f, ev); m != queried {
+				t.Errorf("Filter %d: event %d matches %v, found by query %v", i, n, m, queried)
+			}
+		}
+	}
+}
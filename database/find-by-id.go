@@ -2,32 +2,36 @@ package database
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 
-	"github.com/dgraph-io/badger/v4"
 	"manifold.mleku.dev/chk"
 	"manifold.mleku.dev/database/indexes"
 	"manifold.mleku.dev/database/indexes/types/idhash"
 	"manifold.mleku.dev/database/indexes/types/number"
+	"manifold.mleku.dev/database/store"
 	"manifold.mleku.dev/event"
 )
 
+// ErrEventNotFound is the error, wrapped with the id, of looking up an event
+// that is not stored.
+var ErrEventNotFound = errors.New("event not found")
+
 func (d *D) FindEventSerialById(evId []byte) (ser *number.Uint40, err error) {
 	id := idhash.New()
 	if err = id.FromId(evId); chk.E(err) {
 		return
 	}
 	// find by id
-	if err = d.View(func(txn *badger.Txn) (err error) {
+	if err = d.View(func(txn store.Txn) (err error) {
 		key := new(bytes.Buffer)
 		if err = indexes.IdSearch(id).MarshalWrite(key); chk.E(err) {
 			return
 		}
-		it := txn.NewIterator(badger.IteratorOptions{Prefix: key.Bytes()})
+		it := txn.NewIterator(store.IteratorOptions{Prefix: key.Bytes()})
 		defer it.Close()
 		for it.Seek(key.Bytes()); it.Valid(); it.Next() {
-			item := it.Item()
-			k := item.KeyCopy(nil)
+			k := it.Key()
 			buf := bytes.NewBuffer(k)
 			ser = new(number.Uint40)
 			if err = indexes.IdDec(id, ser).UnmarshalRead(buf); chk.E(err) {
@@ -39,25 +43,35 @@ func (d *D) FindEventSerialById(evId []byte) (ser *number.Uint40, err error) {
 		return
 	}
 	if ser == nil {
-		err = fmt.Errorf("event %0x not found", evId)
+		err = fmt.Errorf("%w: %0x", ErrEventNotFound, evId)
 		return
 	}
 	return
 }
 
+// GetEventFromSerial fetches an event by its serial, recording the access in
+// the LastAccessed index.
 func (d *D) GetEventFromSerial(ser *number.Uint40) (ev *event.E, err error) {
-	if err = d.View(func(txn *badger.Txn) (err error) {
+	if ev, err = d.fetchEventFromSerial(ser); err != nil {
+		return
+	}
+	if err = d.touch(ser); chk.E(err) {
+		return
+	}
+	return
+}
+
+// fetchEventFromSerial fetches an event by its serial without recording the
+// access.
+func (d *D) fetchEventFromSerial(ser *number.Uint40) (ev *event.E, err error) {
+	if err = d.View(func(txn store.Txn) (err error) {
 		enc := indexes.EventEnc(ser)
 		kb := new(bytes.Buffer)
 		if err = enc.MarshalWrite(kb); chk.E(err) {
 			return
 		}
-		var item *badger.Item
-		if item, err = txn.Get(kb.Bytes()); err != nil {
-			return
-		}
 		var val []byte
-		if val, err = item.ValueCopy(nil); chk.E(err) {
+		if val, err = txn.Get(kb.Bytes()); err != nil {
 			return
 		}
 		ev = &event.E{}
@@ -75,20 +89,29 @@ func (d *D) GetEventFromSerial(ser *number.Uint40) (ev *event.E, err error) {
 type IdPubkeyTimestamp struct {
 	Id, Pubkey []byte
 	Timestamp  int64
+	// Nanos is the nanoseconds past the second of the Timestamp.
+	Nanos int
+}
+
+// Before returns true if the event was made before another, to the nanosecond.
+func (i IdPubkeyTimestamp) Before(o IdPubkeyTimestamp) bool {
+	if i.Timestamp != o.Timestamp {
+		return i.Timestamp < o.Timestamp
+	}
+	return i.Nanos < o.Nanos
 }
 
 func (d *D) GetIdPubkeyTimestampFromSerial(ser *number.Uint40) (id, pk []byte, ts int64, err error) {
-	if err = d.View(func(txn *badger.Txn) (err error) {
+	if err = d.View(func(txn store.Txn) (err error) {
 		enc := indexes.IdPubkeyTimestampSearch(ser)
 		prf := new(bytes.Buffer)
 		if err = enc.MarshalWrite(prf); chk.E(err) {
 			return
 		}
-		it := txn.NewIterator(badger.IteratorOptions{Prefix: prf.Bytes()})
+		it := txn.NewIterator(store.IteratorOptions{Prefix: prf.Bytes()})
 		defer it.Close()
 		for it.Seek(prf.Bytes()); it.Valid(); it.Next() {
-			item := it.Item()
-			key := item.KeyCopy(nil)
+			key := it.Key()
 			kbuf := bytes.NewBuffer(key)
 			_, t, p, ca := indexes.IdPubkeyTimestampVars()
 			dec := indexes.IdPubkeyTimestampDec(ser, t, p, ca)
@@ -97,7 +120,7 @@ func (d *D) GetIdPubkeyTimestampFromSerial(ser *number.Uint40) (id, pk []byte, t
 			}
 			id = t.Bytes()
 			pk = p.Bytes()
-			ts = int64(ca.Get())
+			ts = ca.Int64()
 		}
 		return
 	}); chk.E(err) {
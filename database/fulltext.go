@@ -0,0 +1,216 @@
+package database
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+
+	uaxfilter "github.com/clipperhouse/uax29/iterators/filter"
+	"github.com/clipperhouse/uax29/words"
+	"golang.org/x/text/cases"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/database/indexes/types/number"
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/event"
+)
+
+func init() {
+	for _, w := range strings.Fields(stopwordList) {
+		stopwords[w] = struct{}{}
+	}
+	RegisterMigration(Migration{
+		From:        2,
+		Description: "index the words of event content",
+		Run: func(d *D, progress func(done, total int)) (err error) {
+			return d.RebuildIndexes(progress, indexes.FulltextWord)
+		},
+	})
+}
+
+// maxWordLen is the length in bytes of the longest word that is indexed;
+// longer tokens, such as encoded data pasted into a message, are skipped.
+const maxWordLen = 64
+
+// stopwords are common English words that are not indexed, as they match most
+// events and so do not narrow a search.
+var stopwords = make(map[string]struct{})
+
+const stopwordList = `
+a about above after again against all am an and any are as at be because
+been before being below between both but by can could did do does doing down
+during each few for from further had has have having he her here hers
+herself him himself his how i if in into is it its itself just me more most
+my myself no nor not now of off on once only or other our ours ourselves out
+over own same she should so some such than that the their theirs them
+themselves then there these they this those through to too under until up
+very was we were what when where which while who whom why will with would
+you your yours yourself yourselves
+`
+
+// Word is a word of a text and its position among the words of the text.
+type Word struct {
+	Text []byte
+	Pos  int
+	// Start and End are the byte offsets of the word in the text.
+	Start, End int
+}
+
+// segment splits text into words on Unicode word boundaries and folds their
+// case, numbering every word in order.
+func segment(text []byte) (ws []Word) {
+	seg := words.NewSegmenter(text)
+	seg.Filter(uaxfilter.Wordlike)
+	fold := cases.Fold()
+	for pos := 0; seg.Next() && pos < int(number.MaxUint24); pos++ {
+		ws = append(ws, Word{Text: fold.Bytes(seg.Bytes()), Pos: pos,
+			Start: seg.Start(), End: seg.End()})
+	}
+	return
+}
+
+// indexed returns true if a word is not too long, and is not a stopword.
+func indexed(w []byte) bool {
+	if len(w) > maxWordLen {
+		return false
+	}
+	_, stop := stopwords[string(w)]
+	return !stop
+}
+
+// Words splits text into words on Unicode word boundaries and folds their case.
+// Stopwords are dropped, but still counted in the positions of the words that
+// follow them, so that a phrase matches only the same words at the same
+// distances.
+func Words(text []byte) (ws []Word) {
+	for _, w := range segment(text) {
+		if indexed(w.Text) {
+			ws = append(ws, w)
+		}
+	}
+	return
+}
+
+// contentWords returns the indexed words of the content of an event. Binary
+// content is not indexed.
+func contentWords(ev *event.E) (ws []Word) {
+	if bytes.HasPrefix(ev.Content, event.BinPrefix) {
+		return
+	}
+	return Words(ev.Content)
+}
+
+// GetFulltextIndexes generates the FulltextWord keys of the words of the
+// content of an event, and its ContentLength key.
+func GetFulltextIndexes(ev *event.E, ser *number.Uint40) (indices [][]byte, err error) {
+	ws := contentWords(ev)
+	if len(ws) == 0 {
+		return
+	}
+	n := new(number.Uint24)
+	if err = n.SetInt(len(ws)); chk.E(err) {
+		return
+	}
+	cl := new(bytes.Buffer)
+	if err = indexes.ContentLengthEnc(ser, n).MarshalWrite(cl); chk.E(err) {
+		return
+	}
+	indices = append(indices, cl.Bytes())
+	for _, w := range ws {
+		fw, pos, _ := indexes.FullTextWordVars()
+		fw.FromWord(w.Text)
+		if err = pos.SetInt(w.Pos); chk.E(err) {
+			return
+		}
+		b := new(bytes.Buffer)
+		if err = indexes.FullTextWordEnc(fw, pos, ser).MarshalWrite(b); chk.E(err) {
+			return
+		}
+		indices = append(indices, b.Bytes())
+	}
+	return
+}
+
+// parseSearch splits a search into phrases. The words between each pair of
+// double quotes form a phrase, and every other word is a phrase of its own.
+func parseSearch(search string) (phrases [][]Word) {
+	for i, part := range strings.Split(search, `"`) {
+		ws := Words([]byte(part))
+		if i%2 == 1 {
+			if len(ws) > 0 {
+				phrases = append(phrases, ws)
+			}
+			continue
+		}
+		for _, w := range ws {
+			phrases = append(phrases, []Word{w})
+		}
+	}
+	return
+}
+
+// postings returns the positions of a word in each event that contains it,
+// keyed by the serial of the event, in ascending order.
+func postings(txn store.Txn, word []byte) (p map[uint64][]int, err error) {
+	p = make(map[uint64][]int)
+	w, _, _ := indexes.FullTextWordVars()
+	w.FromWord(word)
+	prf := new(bytes.Buffer)
+	if err = indexes.FullTextWordEnc(w, nil, nil).MarshalWrite(prf); chk.E(err) {
+		return
+	}
+	it := txn.NewIterator(store.IteratorOptions{Prefix: prf.Bytes()})
+	defer it.Close()
+	for it.Seek(prf.Bytes()); it.Valid(); it.Next() {
+		w, pos, ser := indexes.FullTextWordVars()
+		if err = indexes.FullTextWordDec(w, pos, ser).UnmarshalRead(bytes.NewBuffer(it.Key())); chk.E(err) {
+			return
+		}
+		p[ser.Get()] = append(p[ser.Get()], pos.Int())
+	}
+	return
+}
+
+// search returns the serials of the events whose content matches every phrase
+// of a search, and the postings of each word of the search. A search with no
+// words other than stopwords matches nothing.
+func (d *D) search(txn store.Txn, search string) (found map[uint64]struct{}, words map[string]map[uint64][]int, err error) {
+	words = make(map[string]map[uint64][]int)
+	for _, phrase := range parseSearch(search) {
+		lists := make([]map[uint64][]int, len(phrase))
+		for i, w := range phrase {
+			var ok bool
+			if lists[i], ok = words[string(w.Text)]; !ok {
+				if lists[i], err = postings(txn, w.Text); chk.E(err) {
+					return
+				}
+				words[string(w.Text)] = lists[i]
+			}
+		}
+		matches := make(map[uint64]struct{})
+	events:
+		for ser, positions := range lists[0] {
+			if _, ok := found[ser]; found != nil && !ok {
+				continue
+			}
+		starts:
+			for _, start := range positions {
+				for i, w := range phrase[1:] {
+					if !slices.Contains(lists[i+1][ser], start+w.Pos-phrase[0].Pos) {
+						continue starts
+					}
+				}
+				matches[ser] = struct{}{}
+				continue events
+			}
+		}
+		if found = matches; len(found) == 0 {
+			break
+		}
+	}
+	if found == nil {
+		found = make(map[uint64]struct{})
+	}
+	return
+}
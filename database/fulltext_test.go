@@ -0,0 +1,119 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"manifold.mleku.dev/database/store/memory"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+	"manifold.mleku.dev/p256k"
+)
+
+// TestWords tests that words are split on Unicode boundaries, case folded, and
+// that stopwords are dropped without changing the positions of other words.
+func TestWords(t *testing.T) {
+	var got []string
+	for _, w := range Words([]byte("The CAFÉ, on Straße-7; 東京!")) {
+		got = append(got, fmt.Sprintf("%s@%d", w.Text, w.Pos))
+	}
+	expected := []string{"café@1", "strasse@3", "7@4", "東@5", "京@6"}
+	if !slices.Equal(got, expected) {
+		t.Fatalf("Expected words %v, got %v", expected, got)
+	}
+}
+
+// TestSearch tests word and phrase searches of event content.
+func TestSearch(t *testing.T) {
+	db := New()
+	if err := db.InitStore(memory.New()); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	signer := new(p256k.Signer)
+	if err := signer.Generate(); err != nil {
+		t.Fatalf("Failed to generate signer: %v", err)
+	}
+	contents := []string{
+		"The quick brown fox jumps over the lazy dog",
+		"A quick brown dog",
+		"brown quick fox",
+		"Le Café est fermé",
+		"BIN:quick brown fox",
+	}
+	var ids [][]byte
+	for i, c := range contents {
+		ev := &event.E{
+			Pubkey:    signer.Pub(),
+			Timestamp: time.Now().Add(time.Duration(i) * time.Minute).Unix(),
+			Content:   []byte(c),
+		}
+		if err := ev.Sign(signer); err != nil {
+			t.Fatalf("Failed to sign event: %v", err)
+		}
+		if err := db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+		id, err := ev.Id()
+		if err != nil {
+			t.Fatalf("Failed to get event ID: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	tests := []struct {
+		search   string
+		expected []int
+	}{
+		{"quick", []int{0, 1, 2}},
+		{"QUICK dog", []int{0, 1}},
+		{`"quick brown"`, []int{0, 1}},
+		{`"brown fox"`, []int{0}},
+		{`"fox jumps over the lazy dog"`, []int{0}},
+		{`"lazy fox"`, nil},
+		{`café "brown dog"`, nil},
+		{"CAFÉ", []int{3}},
+		{"the", nil},
+	}
+	for _, tt := range tests {
+		results, err := db.QueryEvents(filter.F{Search: tt.search, Sort: "asc"})
+		if err != nil {
+			t.Fatalf("Failed to search %q: %v", tt.search, err)
+		}
+		if len(results) != len(tt.expected) {
+			t.Fatalf("Expected %d results for %q, got %d", len(tt.expected), tt.search, len(results))
+		}
+		for i, n := range tt.expected {
+			if !bytes.Equal(results[i], ids[n]) {
+				t.Fatalf("Expected event %d as result %d for %q", n, i, tt.search)
+			}
+		}
+	}
+
+	// the search is combined with the other fields of the filter
+	results, err := db.QueryEvents(filter.F{
+		Search:  "quick",
+		Authors: [][]byte{signer.Pub()},
+		Since:   time.Now().Add(90 * time.Second).Unix(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to search: %v", err)
+	}
+	if len(results) != 1 || !bytes.Equal(results[0], ids[2]) {
+		t.Fatalf("Expected only event 2 for search with author and since, got %d results", len(results))
+	}
+
+	if err = db.DeleteEventById(ids[0]); err != nil {
+		t.Fatalf("Failed to delete event: %v", err)
+	}
+	if results, err = db.QueryEvents(filter.F{Search: `"brown fox"`}); err != nil {
+		t.Fatalf("Failed to search: %v", err)
+	}
+	if len(results) != 0 {
+		t.Fatalf("Expected no results for deleted event, got %d", len(results))
+	}
+}
@@ -0,0 +1,182 @@
+package database
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/database/indexes/types/location"
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+)
+
+func init() {
+	RegisterMigration(Migration{
+		From:        6,
+		Description: "index the locations of tags",
+		Run: func(d *D, progress func(done, total int)) (err error) {
+			return d.RebuildIndexes(progress, indexes.Location)
+		},
+	})
+}
+
+// earthRadius is the mean radius of the earth in meters.
+const earthRadius = 6371008.8
+
+// geohashAlphabet is the base32 alphabet of geohashes.
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// tagLocation returns the location given by a tag, which is either a "g" tag
+// with a geohash, giving the middle of its cell, or a "latlon" tag with a
+// latitude and longitude in degrees separated by a comma.
+func tagLocation(t event.Tag) (lat, lon float64, ok bool) {
+	switch string(t.Key) {
+	case "g":
+		return geohash(string(t.Value))
+	case "latlon":
+		la, lo, found := strings.Cut(string(t.Value), ",")
+		if !found {
+			return
+		}
+		var err error
+		if lat, err = strconv.ParseFloat(strings.TrimSpace(la), 64); err != nil {
+			return
+		}
+		if lon, err = strconv.ParseFloat(strings.TrimSpace(lo), 64); err != nil {
+			return
+		}
+		if !(lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180) {
+			return
+		}
+		return lat, lon, true
+	}
+	return
+}
+
+// geohash decodes a geohash into the location of the middle of its cell.
+func geohash(hash string) (lat, lon float64, ok bool) {
+	if hash == "" {
+		return
+	}
+	latRange, lonRange := [2]float64{-90, 90}, [2]float64{-180, 180}
+	even := true
+	for _, c := range strings.ToLower(hash) {
+		n := strings.IndexRune(geohashAlphabet, c)
+		if n < 0 {
+			return
+		}
+		for bit := 4; bit >= 0; bit-- {
+			r := &latRange
+			if even {
+				r = &lonRange
+			}
+			mid := (r[0] + r[1]) / 2
+			if n>>bit&1 == 1 {
+				r[0] = mid
+			} else {
+				r[1] = mid
+			}
+			even = !even
+		}
+	}
+	return (latRange[0] + latRange[1]) / 2, (lonRange[0] + lonRange[1]) / 2, true
+}
+
+// distance returns the great circle distance in meters between two locations
+// given in degrees.
+func distance(lat1, lon1, lat2, lon2 float64) (d float64) {
+	rad := math.Pi / 180
+	dLat, dLon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	a := math.Pow(math.Sin(dLat/2), 2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Pow(math.Sin(dLon/2), 2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(min(a, 1)))
+}
+
+// inBox returns true if a location is within a box, which crosses the
+// antimeridian if its MinLon is greater than its MaxLon.
+func inBox(b *filter.Box, lat, lon float64) bool {
+	if lat < b.MinLat || lat > b.MaxLat {
+		return false
+	}
+	if b.MinLon <= b.MaxLon {
+		return lon >= b.MinLon && lon <= b.MaxLon
+	}
+	return lon >= b.MinLon || lon <= b.MaxLon
+}
+
+// boundingBox returns a box that contains every location within the radius of
+// a circle.
+func boundingBox(c *filter.Circle) (b *filter.Box) {
+	r := c.Radius / earthRadius
+	dLat := r * 180 / math.Pi
+	b = &filter.Box{MinLat: c.Lat - dLat, MinLon: -180, MaxLat: c.Lat + dLat, MaxLon: 180}
+	if b.MinLat <= -90 || b.MaxLat >= 90 || r >= math.Pi/2 {
+		// the circle contains a pole, so it spans every longitude
+		b.MinLat, b.MaxLat = max(b.MinLat, -90), min(b.MaxLat, 90)
+		return
+	}
+	dLon := math.Asin(math.Sin(r)/math.Cos(c.Lat*math.Pi/180)) * 180 / math.Pi
+	if b.MinLon = c.Lon - dLon; b.MinLon < -180 {
+		b.MinLon += 360
+	}
+	if b.MaxLon = c.Lon + dLon; b.MaxLon > 180 {
+		b.MaxLon -= 360
+	}
+	return
+}
+
+// locationSerials returns the serials of the events with a tag giving a
+// location that is within the box and the circle, either of which may be nil.
+func (d *D) locationSerials(txn store.Txn, within *filter.Box, near *filter.Circle) (found map[uint64]struct{}, err error) {
+	found = make(map[uint64]struct{})
+	b := within
+	if near != nil {
+		b = boundingBox(near)
+	}
+	if b == nil {
+		return
+	}
+	// split a box that crosses the antimeridian in two
+	boxes := []filter.Box{*b}
+	if b.MinLon > b.MaxLon {
+		boxes = []filter.Box{
+			{MinLat: b.MinLat, MinLon: b.MinLon, MaxLat: b.MaxLat, MaxLon: 180},
+			{MinLat: b.MinLat, MinLon: -180, MaxLat: b.MaxLat, MaxLon: b.MaxLon},
+		}
+	}
+	prf := []byte(indexes.Prefix(indexes.Location))
+	it := txn.NewIterator(store.IteratorOptions{Prefix: prf})
+	defer it.Close()
+	for _, box := range boxes {
+		for _, r := range location.Cover(box.MinLat, box.MinLon, box.MaxLat, box.MaxLon) {
+			start := location.New()
+			start.SetZ(r.From)
+			sb := new(bytes.Buffer)
+			if err = indexes.LocationEnc(start, nil, nil).MarshalWrite(sb); chk.E(err) {
+				return
+			}
+			for it.Seek(sb.Bytes()); it.Valid(); it.Next() {
+				l, ts, ser := indexes.LocationVars()
+				if err = indexes.LocationDec(l, ts, ser).UnmarshalRead(bytes.NewBuffer(it.Key())); chk.E(err) {
+					return
+				}
+				if l.Z() > r.To {
+					break
+				}
+				lat, lon := l.Get()
+				if within != nil && !inBox(within, lat, lon) {
+					continue
+				}
+				if near != nil && distance(near.Lat, near.Lon, lat, lon) > near.Radius {
+					continue
+				}
+				found[ser.Get()] = struct{}{}
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,121 @@
+package database
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"manifold.mleku.dev/database/store/memory"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+	"manifold.mleku.dev/p256k"
+)
+
+func TestGeohash(t *testing.T) {
+	lat, lon, ok := geohash("u4pruydqqvj")
+	if !ok {
+		t.Fatalf("Failed to decode geohash")
+	}
+	if math.Abs(lat-57.64911) > 1e-5 || math.Abs(lon-10.40744) > 1e-5 {
+		t.Errorf("Expected 57.64911, 10.40744, got %v, %v", lat, lon)
+	}
+	if _, _, ok = geohash("u4pa"); ok {
+		t.Errorf("Expected geohash with invalid character to fail")
+	}
+}
+
+// TestLocationQueries tests finding events by the locations of their tags,
+// within a box and within a distance.
+func TestLocationQueries(t *testing.T) {
+	db := New()
+	if err := db.InitStore(memory.New()); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	signers := make([]*p256k.Signer, 2)
+	for i := range signers {
+		signers[i] = new(p256k.Signer)
+		if err := signers[i].Generate(); err != nil {
+			t.Fatalf("Failed to generate signer: %v", err)
+		}
+	}
+	tags := [][]string{
+		{"g", "gcpvj0"},                 // London
+		{"latlon", "48.8566, 2.3522"},   // Paris
+		{"latlon", "-33.8688,151.2093"}, // Sydney
+		{"latlon", "-17.7,178.0"},       // Fiji, west of the antimeridian
+		{"latlon", "-16.5,-179.9"},      // Fiji, east of the antimeridian
+		{"g", "not a geohash"},
+		{"latlon", "91,0"},
+		{"g", "gcpvj0"}, // London, by the other signer
+	}
+	var ids [][]byte
+	now := time.Now()
+	for i, kv := range tags {
+		signer := signers[i/7]
+		ev := &event.E{
+			Pubkey:    signer.Pub(),
+			Timestamp: now.Add(time.Duration(i) * time.Minute).Unix(),
+			Content:   []byte("located"),
+			Tags:      &event.Tags{{Key: []byte(kv[0]), Value: []byte(kv[1])}},
+		}
+		if err := ev.Sign(signer); err != nil {
+			t.Fatalf("Failed to sign event: %v", err)
+		}
+		if err := db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+		id, err := ev.Id()
+		if err != nil {
+			t.Fatalf("Failed to get event ID: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	tests := []struct {
+		name     string
+		f        filter.F
+		expected []int
+	}{
+		{"Within", filter.F{Within: &filter.Box{
+			MinLat: 51.28, MinLon: -0.51, MaxLat: 51.69, MaxLon: 0.33}}, []int{0, 7}},
+		{"WithinEurope", filter.F{Within: &filter.Box{
+			MinLat: 35, MinLon: -10, MaxLat: 60, MaxLon: 30}}, []int{0, 1, 7}},
+		{"WithinAntimeridian", filter.F{Within: &filter.Box{
+			MinLat: -20, MinLon: 170, MaxLat: -10, MaxLon: -170}}, []int{3, 4}},
+		{"Near", filter.F{Near: &filter.Circle{
+			Lat: 48.85, Lon: 2.35, Radius: 10000}}, []int{1}},
+		{"NearFar", filter.F{Near: &filter.Circle{
+			Lat: 48.85, Lon: 2.35, Radius: 400000}}, []int{0, 1, 7}},
+		{"NearAntimeridian", filter.F{Near: &filter.Circle{
+			Lat: -17, Lon: 179.9, Radius: 300000}}, []int{3, 4}},
+		{"NearAndWithin", filter.F{
+			Near:   &filter.Circle{Lat: 48.85, Lon: 2.35, Radius: 400000},
+			Within: &filter.Box{MinLat: 50, MinLon: -1, MaxLat: 52, MaxLon: 1}}, []int{0, 7}},
+		{"NearWithAuthor", filter.F{
+			Authors: [][]byte{signers[1].Pub()},
+			Near:    &filter.Circle{Lat: 51.5, Lon: -0.12, Radius: 5000}}, []int{7}},
+		{"NearWithUntil", filter.F{
+			Until: now.Add(time.Minute).Unix(),
+			Near:  &filter.Circle{Lat: 51.5, Lon: -0.12, Radius: 5000}}, []int{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.f.Sort = "asc"
+			results, err := db.QueryEvents(tt.f)
+			if err != nil {
+				t.Fatalf("Failed to query events: %v", err)
+			}
+			if len(results) != len(tt.expected) {
+				t.Fatalf("Expected %d results, got %d", len(tt.expected), len(results))
+			}
+			for i, n := range tt.expected {
+				if !bytes.Equal(results[i], ids[n]) {
+					t.Fatalf("Expected event %d as result %d", n, i)
+				}
+			}
+		})
+	}
+}
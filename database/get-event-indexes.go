@@ -8,11 +8,16 @@ import (
 	"manifold.mleku.dev/database/indexes/types/fullid"
 	"manifold.mleku.dev/database/indexes/types/identhash"
 	"manifold.mleku.dev/database/indexes/types/idhash"
+	"manifold.mleku.dev/database/indexes/types/location"
 	"manifold.mleku.dev/database/indexes/types/number"
 	"manifold.mleku.dev/database/indexes/types/pubhash"
+	"manifold.mleku.dev/database/indexes/types/rawvalue"
+	"manifold.mleku.dev/errorf"
 	"manifold.mleku.dev/event"
 )
 
+// GetEventIndexes allocates a new serial for an event and generates the index
+// keys for it.
 func (d *D) GetEventIndexes(ev *event.E) (indices [][]byte, ser *number.Uint40, err error) {
 
 	ser = new(number.Uint40)
@@ -21,11 +26,18 @@ func (d *D) GetEventIndexes(ev *event.E) (indices [][]byte, ser *number.Uint40,
 		return
 	}
 	if err = ser.Set(s); chk.E(err) {
-		panic("there is more than 2^40 events in the database now. " +
-			"database needs to be re-consolidated " +
-			"(this is ~1,000,000,000,000 at average size 512bytes or 500 terabytes)")
+		err = errorf.E("the serials of events are used up at %d, the database "+
+			"must be consolidated to number them densely with Consolidate", s)
+		return
 	}
+	indices, err = d.GetEventIndexesForSerial(ev, ser)
+	return
+}
 
+// GetEventIndexesForSerial generates the index keys for an event that has
+// already been assigned a serial, such as when checking or rebuilding the
+// indexes of an event that is already stored.
+func (d *D) GetEventIndexesForSerial(ev *event.E, ser *number.Uint40) (indices [][]byte, err error) {
 	id := idhash.New()
 	var idb []byte
 	if idb, err = ev.Id(); chk.E(err) {
@@ -49,7 +61,7 @@ func (d *D) GetEventIndexes(ev *event.E) (indices [][]byte, ser *number.Uint40,
 		return
 	}
 	ts := new(number.Uint64)
-	ts.Set(uint64(ev.Timestamp))
+	ts.SetInt64(ev.Timestamp)
 	evIFiB := new(bytes.Buffer)
 	if err = indexes.IdPubkeyTimestampEnc(ser, fid, p, ts).MarshalWrite(evIFiB); chk.E(err) {
 		return
@@ -67,6 +79,16 @@ func (d *D) GetEventIndexes(ev *event.E) (indices [][]byte, ser *number.Uint40,
 		return
 	}
 	indices = append(indices, evICaB.Bytes())
+
+	if ns := ev.Nanos(); ns != 0 {
+		n := new(number.Uint32)
+		n.Set(uint32(ns))
+		nb := new(bytes.Buffer)
+		if err = indexes.NanosEnc(ser, n).MarshalWrite(nb); chk.E(err) {
+			return
+		}
+		indices = append(indices, nb.Bytes())
+	}
 	if ev.Tags != nil {
 		for _, t := range *ev.Tags {
 			k, v := identhash.New(), identhash.New()
@@ -87,8 +109,52 @@ func (d *D) GetEventIndexes(ev *event.E) (indices [][]byte, ser *number.Uint40,
 				return
 			}
 			indices = append(indices, ptb.Bytes())
+
+			rv := rawvalue.New()
+			rv.FromValue(t.Value)
+			tkb := new(bytes.Buffer)
+			if err = indexes.TagKeyValueEnc(k, rv, ts, ser).MarshalWrite(tkb); chk.E(err) {
+				return
+			}
+			indices = append(indices, tkb.Bytes())
+
+			if f, ok := tagNumber(t.Value); ok {
+				n := new(number.Uint64)
+				n.SetFloat(f)
+				tnb := new(bytes.Buffer)
+				if err = indexes.TagNumberEnc(k, n, ts, ser).MarshalWrite(tnb); chk.E(err) {
+					return
+				}
+				indices = append(indices, tnb.Bytes())
+			}
+
+			if lat, lon, ok := tagLocation(t); ok {
+				l := location.New()
+				l.Set(lat, lon)
+				lb := new(bytes.Buffer)
+				if err = indexes.LocationEnc(l, ts, ser).MarshalWrite(lb); chk.E(err) {
+					return
+				}
+				indices = append(indices, lb.Bytes())
+			}
+
+			if ref, ok := event.Reference(t.Value); ok {
+				r := idhash.New()
+				if err = r.FromId(ref); chk.E(err) {
+					return
+				}
+				rb := new(bytes.Buffer)
+				if err = indexes.ReferenceEnc(r, ts, ser).MarshalWrite(rb); chk.E(err) {
+					return
+				}
+				indices = append(indices, rb.Bytes())
+			}
 		}
 	}
-
+	var fw [][]byte
+	if fw, err = GetFulltextIndexes(ev, ser); chk.E(err) {
+		return
+	}
+	indices = append(indices, fw...)
 	return
 }
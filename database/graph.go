@@ -0,0 +1,422 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/errorf"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+	"manifold.mleku.dev/log"
+	"manifold.mleku.dev/sha256"
+)
+
+func init() {
+	RegisterMigration(Migration{
+		From:        graphSchemaVersion - 1,
+		Description: "build the social graph of the follow lists",
+		Run: func(d *D, progress func(done, total int)) (err error) {
+			return d.RebuildView(graphView)
+		},
+	})
+}
+
+// graphSchemaVersion is the schema version from which the social graph is
+// built.
+const graphSchemaVersion = 12
+
+const (
+	// FollowsType is the value of the type tag of a follow list, whose
+	// FollowTag tags refer to the pubkeys its author follows. Only the latest
+	// follow list of each author is in the social graph.
+	FollowsType = "follows"
+	FollowTag   = "p"
+	// graphView is the name of the view the social graph is kept in.
+	graphView = "graph"
+)
+
+// the keys of the state of the graph view start with a letter for what they
+// hold: the pubkeys an author follows, those that follow a pubkey, and the
+// latest follow list of an author.
+const (
+	followingKey = 'o'
+	followersKey = 'i'
+	latestKey    = 'l'
+)
+
+// followsFilter matches the follow lists of the social graph.
+var followsFilter = filter.F{Tags: filter.TagMap{"type": {[]byte(FollowsType)}}}
+
+// Reach is a pubkey reached in the social graph, by following Hops follow
+// lists.
+type Reach struct {
+	Pubkey []byte
+	Hops   int
+}
+
+// TrustScore is the personalised PageRank of a pubkey from another.
+type TrustScore struct {
+	Pubkey []byte
+	Score  float64
+}
+
+// TrustOptions are the parameters of TrustScores.
+type TrustOptions struct {
+	// Radius is the most follow lists followed from the root; the graph beyond
+	// it is not scored. Zero is 3.
+	Radius int
+	// Damping is the chance of following a follow list rather than returning
+	// to the root at each step. Zero is 0.85.
+	Damping float64
+	// Iterations is how many times the scores are propagated. Zero is 20.
+	Iterations int
+}
+
+// graphLatest is the follow list of an author that is in the social graph.
+type graphLatest struct {
+	id []byte
+	ts int64
+	ns int
+}
+
+func (l graphLatest) bytes() (b []byte) {
+	b = append(bytes.Clone(l.id), make([]byte, 12)...)
+	binary.BigEndian.PutUint64(b[len(l.id):], uint64(l.ts))
+	binary.BigEndian.PutUint32(b[len(l.id)+8:], uint32(l.ns))
+	return
+}
+
+func latestOf(b []byte) (l graphLatest, ok bool) {
+	if len(b) != sha256.Size+12 {
+		return
+	}
+	return graphLatest{
+		id: b[:sha256.Size],
+		ts: int64(binary.BigEndian.Uint64(b[sha256.Size:])),
+		ns: int(binary.BigEndian.Uint32(b[sha256.Size+8:])),
+	}, true
+}
+
+// before returns true if a follow list was made before another, or at the same
+// time with a lesser id, so that one of any two is the latest.
+func (l graphLatest) before(o graphLatest) bool {
+	if l.ts != o.ts {
+		return l.ts < o.ts
+	}
+	if l.ns != o.ns {
+		return l.ns < o.ns
+	}
+	return bytes.Compare(l.id, o.id) < 0
+}
+
+func graphKey(kind byte, pks ...[]byte) []byte {
+	return bytes.Join(append([][]byte{{kind}}, pks...), nil)
+}
+
+// socialGraph returns the view that keeps the social graph of the latest
+// follow list of each author.
+func socialGraph() View {
+	return View{
+		Name:    graphView,
+		Filter:  followsFilter,
+		Version: "1",
+		Reduce:  reduceGraph,
+	}
+}
+
+// checkGraph returns the schema version to migrate a database at version v
+// from, which is the one before graphSchemaVersion if its social graph is not
+// at the version of socialGraph, such as after its reducer failed, so that the
+// migration builds it again.
+func (d *D) checkGraph(v uint32) (from uint32, err error) {
+	from = v
+	if v < graphSchemaVersion {
+		return
+	}
+	var version []byte
+	if err = d.View(func(txn store.Txn) (err error) {
+		if version, err = txn.Get(viewVersionKey(graphView)); err == store.ErrKeyNotFound {
+			version, err = nil, nil
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	if string(version) == socialGraph().Version {
+		return
+	}
+	var empty bool
+	if empty, err = d.isEmpty(); chk.E(err) {
+		return
+	}
+	if empty {
+		// the graph of a new database is built as events are stored
+		return from, d.Set(viewVersionKey(graphView), []byte(socialGraph().Version))
+	}
+	log.W.F("the social graph is not at version %s, it will be rebuilt",
+		socialGraph().Version)
+	from = graphSchemaVersion - 1
+	err = d.setSchemaVersion(from)
+	return
+}
+
+func reduceGraph(s *ViewState, c Change) (err error) {
+	pk := c.Event.Pubkey
+	var id, v []byte
+	if id, err = c.Event.Id(); chk.E(err) {
+		return
+	}
+	if v, err = s.Get(graphKey(latestKey, pk)); chk.E(err) {
+		return
+	}
+	latest, ok := latestOf(v)
+	if !c.Deleted {
+		l := graphLatest{id: id, ts: c.Event.Timestamp, ns: c.Event.Nanos()}
+		if ok && !latest.before(l) {
+			return
+		}
+		return setFollows(s, pk, l, c.Event)
+	}
+	if !ok || !bytes.Equal(latest.id, id) {
+		return
+	}
+	// the latest follow list was deleted, so the one before it is the latest
+	f := followsFilter
+	f.Authors, f.Sort, f.Limit = [][]byte{pk}, "desc", 1
+	var ids [][]byte
+	if ids, err = s.QueryEvents(f); chk.E(err) {
+		return
+	}
+	var ev *event.E
+	if len(ids) > 0 {
+		if ev, err = s.GetEventById(ids[0]); chk.E(err) {
+			return
+		}
+	}
+	if ev == nil {
+		if err = setFollows(s, pk, graphLatest{}, nil); chk.E(err) {
+			return
+		}
+		return s.Delete(graphKey(latestKey, pk))
+	}
+	return setFollows(s, pk, graphLatest{id: ids[0], ts: ev.Timestamp, ns: ev.Nanos()}, ev)
+}
+
+// setFollows replaces the pubkeys an author follows with those of a follow
+// list, or clears them if it is nil.
+func setFollows(s *ViewState, pk []byte, l graphLatest, ev *event.E) (err error) {
+	var old [][]byte
+	if err = s.Scan(graphKey(followingKey, pk), func(key, _ []byte) (err error) {
+		old = append(old, bytes.Clone(key[1+len(pk):]))
+		return
+	}); chk.E(err) {
+		return
+	}
+	for _, f := range old {
+		if err = s.Delete(graphKey(followingKey, pk, f)); chk.E(err) {
+			return
+		}
+		if err = s.Delete(graphKey(followersKey, f, pk)); chk.E(err) {
+			return
+		}
+	}
+	if ev == nil {
+		return
+	}
+	for _, tag := range *ev.Tags {
+		if string(tag.Key) != FollowTag {
+			continue
+		}
+		f, ok := event.Reference(tag.Value)
+		if !ok || bytes.Equal(f, pk) {
+			continue
+		}
+		if err = s.Set(graphKey(followingKey, pk, f), nil); chk.E(err) {
+			return
+		}
+		if err = s.Set(graphKey(followersKey, f, pk), nil); chk.E(err) {
+			return
+		}
+	}
+	return s.Set(graphKey(latestKey, pk), l.bytes())
+}
+
+// edges returns the pubkeys that an author follows, or that follow a pubkey,
+// by the kind of the keys.
+func edges(s *ViewState, kind byte, pk []byte) (pks [][]byte, err error) {
+	prf := graphKey(kind, pk)
+	err = s.Scan(prf, func(key, _ []byte) (err error) {
+		pks = append(pks, bytes.Clone(key[len(prf):]))
+		return
+	})
+	return
+}
+
+// Following returns the pubkeys that the latest follow list of an author
+// follows, in order.
+func (d *D) Following(pk []byte) (pks [][]byte, err error) {
+	err = d.ReadView(graphView, func(s *ViewState) (err error) {
+		pks, err = edges(s, followingKey, pk)
+		return
+	})
+	return
+}
+
+// Followers returns the authors whose latest follow list follows a pubkey, in
+// order.
+func (d *D) Followers(pk []byte) (pks [][]byte, err error) {
+	err = d.ReadView(graphView, func(s *ViewState) (err error) {
+		pks, err = edges(s, followersKey, pk)
+		return
+	})
+	return
+}
+
+// reach walks the social graph breadth first from a root to a radius, and calls
+// fn with each pubkey reached, the hops to it and the pubkeys it follows, in
+// order of hops and then pubkey.
+func reach(s *ViewState, root []byte, radius int,
+	fn func(pk []byte, hops int, following [][]byte)) (err error) {
+
+	seen := map[string]struct{}{string(root): {}}
+	level := [][]byte{root}
+	for hops := 0; len(level) > 0; hops++ {
+		var next [][]byte
+		for _, pk := range level {
+			var following [][]byte
+			if following, err = edges(s, followingKey, pk); chk.E(err) {
+				return
+			}
+			fn(pk, hops, following)
+			if hops == radius {
+				continue
+			}
+			for _, f := range following {
+				if _, ok := seen[string(f)]; !ok {
+					seen[string(f)] = struct{}{}
+					next = append(next, f)
+				}
+			}
+		}
+		sort.Slice(next, func(i, j int) bool { return bytes.Compare(next[i], next[j]) < 0 })
+		level = next
+	}
+	return
+}
+
+// Reachable returns the root and the pubkeys it reaches by following at most
+// radius follow lists, by the fewest hops to them, nearest first.
+func (d *D) Reachable(root []byte, radius int) (reached []Reach, err error) {
+	if radius < 0 {
+		return nil, errorf.E("negative radius %d", radius)
+	}
+	err = d.ReadView(graphView, func(s *ViewState) (err error) {
+		return reach(s, root, radius, func(pk []byte, hops int, _ [][]byte) {
+			reached = append(reached, Reach{Pubkey: pk, Hops: hops})
+		})
+	})
+	return
+}
+
+// TrustScores returns the personalised PageRank of the pubkeys within a radius
+// of a root in the social graph, highest first: the chance of being at each of
+// them on a random walk along follows that returns to the root at every step
+// with a chance of 1-Damping, and from pubkeys that follow no one. The scores
+// add up to 1.
+func (d *D) TrustScores(root []byte, o TrustOptions) (scores []TrustScore, err error) {
+	if o.Radius <= 0 {
+		o.Radius = 3
+	}
+	if o.Damping <= 0 || o.Damping >= 1 {
+		o.Damping = 0.85
+	}
+	if o.Iterations <= 0 {
+		o.Iterations = 20
+	}
+	var pks [][]byte
+	index := make(map[string]int)
+	var out [][]int
+	if err = d.ReadView(graphView, func(s *ViewState) (err error) {
+		var follows [][][]byte
+		if err = reach(s, root, o.Radius, func(pk []byte, _ int, following [][]byte) {
+			index[string(pk)] = len(pks)
+			pks = append(pks, pk)
+			follows = append(follows, following)
+		}); err != nil {
+			return
+		}
+		// follows of pubkeys beyond the radius leave the scored graph
+		out = make([][]int, len(pks))
+		for i, following := range follows {
+			for _, f := range following {
+				if j, ok := index[string(f)]; ok {
+					out[i] = append(out[i], j)
+				}
+			}
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	rank := make([]float64, len(pks))
+	rank[0] = 1
+	for range o.Iterations {
+		next := make([]float64, len(pks))
+		next[0] = 1 - o.Damping
+		for i, r := range rank {
+			if len(out[i]) == 0 {
+				next[0] += o.Damping * r
+				continue
+			}
+			share := o.Damping * r / float64(len(out[i]))
+			for _, j := range out[i] {
+				next[j] += share
+			}
+		}
+		rank = next
+	}
+	for i, pk := range pks {
+		scores = append(scores, TrustScore{Pubkey: pk, Score: rank[i]})
+	}
+	sort.SliceStable(scores, func(i, j int) bool { return scores[i].Score > scores[j].Score })
+	return
+}
+
+// withinTrust restricts the authors of a filter to those within its trust
+// radius of its trust root, and returns false if none of them are.
+func (d *D) withinTrust(f filter.F) (g filter.F, ok bool, err error) {
+	g = f
+	if f.TrustRoot == nil {
+		return g, true, nil
+	}
+	var reached []Reach
+	if reached, err = d.Reachable(f.TrustRoot, f.TrustRadius); chk.E(err) {
+		return
+	}
+	trusted := make([][]byte, 0, len(reached))
+	for _, r := range reached {
+		trusted = append(trusted, r.Pubkey)
+	}
+	if len(f.Authors) > 0 {
+		trusted = filterAuthors(f.Authors, trusted)
+	}
+	g.Authors, g.TrustRoot, g.TrustRadius = trusted, nil, 0
+	return g, len(trusted) > 0, nil
+}
+
+// filterAuthors returns the authors that are in trusted.
+func filterAuthors(authors, trusted [][]byte) (in [][]byte) {
+	set := make(map[string]struct{}, len(trusted))
+	for _, pk := range trusted {
+		set[string(pk)] = struct{}{}
+	}
+	for _, a := range authors {
+		if _, ok := set[string(a)]; ok {
+			in = append(in, a)
+		}
+	}
+	return
+}
@@ -0,0 +1,232 @@
+package database
+
+import (
+	"bytes"
+	"encoding/base64"
+	"math"
+	"os"
+	"slices"
+	"testing"
+
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+	"manifold.mleku.dev/p256k"
+)
+
+// TestSocialGraph tests the social graph of the latest follow lists, reaching
+// and scoring pubkeys in it, and restricting queries to a trust radius.
+func TestSocialGraph(t *testing.T) {
+	db := newMemoryDB(t)
+	defer db.Close()
+	signers := make([]*p256k.Signer, 5)
+	pks := make([][]byte, len(signers))
+	for i := range signers {
+		signers[i] = new(p256k.Signer)
+		if err := signers[i].Generate(); err != nil {
+			t.Fatalf("Failed to generate signer: %v", err)
+		}
+		pks[i] = signers[i].Pub()
+	}
+	const a, b, c, d, e = 0, 1, 2, 3, 4
+	store := func(author int, ts int64, tags ...event.Tag) (id []byte) {
+		ev := &event.E{Pubkey: pks[author], Timestamp: ts, Content: []byte("graph"),
+			Tags: (*event.Tags)(&tags)}
+		if err := ev.Sign(signers[author]); err != nil {
+			t.Fatalf("Failed to sign event: %v", err)
+		}
+		if err := db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+		var err error
+		if id, err = ev.Id(); err != nil {
+			t.Fatalf("Failed to get event ID: %v", err)
+		}
+		return
+	}
+	follows := func(author int, ts int64, followed ...int) (id []byte) {
+		tags := []event.Tag{{Key: []byte("type"), Value: []byte(FollowsType)}}
+		for i, f := range followed {
+			// pubkeys as raw bytes and as base64url are both followed
+			v := pks[f]
+			if i%2 == 1 {
+				v = []byte(base64.RawURLEncoding.EncodeToString(pks[f]))
+			}
+			tags = append(tags, event.Tag{Key: []byte(FollowTag), Value: v})
+		}
+		return store(author, ts, tags...)
+	}
+	sorted := func(i ...int) (s [][]byte) {
+		for _, n := range i {
+			s = append(s, pks[n])
+		}
+		slices.SortFunc(s, bytes.Compare)
+		return
+	}
+	follows(a, 100, b)
+	newer := follows(a, 200, b, c)
+	follows(b, 100, d)
+	follows(c, 100, a, d, c)
+	follows(d, 100, e)
+	for i := range pks {
+		store(i, 300, event.Tag{Key: []byte("type"), Value: []byte("note")})
+	}
+
+	following, err := db.Following(pks[a])
+	if err != nil {
+		t.Fatalf("Failed to get following: %v", err)
+	}
+	if !slices.EqualFunc(following, sorted(b, c), bytes.Equal) {
+		t.Errorf("Expected the latest follow list to follow 2, got %d", len(following))
+	}
+	followers, err := db.Followers(pks[d])
+	if err != nil {
+		t.Fatalf("Failed to get followers: %v", err)
+	}
+	if !slices.EqualFunc(followers, sorted(b, c), bytes.Equal) {
+		t.Errorf("Expected 2 followers, got %d", len(followers))
+	}
+	if following, _ = db.Following(pks[c]); len(following) != 2 {
+		t.Errorf("Expected a pubkey not to follow itself, got %d follows", len(following))
+	}
+
+	reached, err := db.Reachable(pks[a], 1)
+	if err != nil {
+		t.Fatalf("Failed to get reachable pubkeys: %v", err)
+	}
+	hops := make(map[string]int)
+	for _, r := range reached {
+		hops[string(r.Pubkey)] = r.Hops
+	}
+	if len(reached) != 3 || hops[string(pks[a])] != 0 || hops[string(pks[b])] != 1 ||
+		hops[string(pks[c])] != 1 {
+		t.Errorf("Expected the root and 2 pubkeys at 1 hop, got %v", reached)
+	}
+	if reached, _ = db.Reachable(pks[a], 3); len(reached) != 5 || reached[4].Hops != 3 {
+		t.Errorf("Expected 5 pubkeys within 3 hops, got %v", reached)
+	}
+
+	scores, err := db.TrustScores(pks[a], TrustOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get trust scores: %v", err)
+	}
+	var total float64
+	for _, s := range scores {
+		total += s.Score
+	}
+	if len(scores) != 5 || !bytes.Equal(scores[0].Pubkey, pks[a]) || math.Abs(total-1) > 1e-9 {
+		t.Errorf("Expected 5 scores adding up to 1, the root highest, got %v", scores)
+	}
+	score := make(map[string]float64)
+	for _, s := range scores {
+		score[string(s.Pubkey)] = s.Score
+	}
+	if score[string(pks[d])] <= score[string(pks[e])] {
+		t.Errorf("Expected a pubkey followed by two to score more than one followed by one")
+	}
+
+	tests := []struct {
+		name     string
+		f        filter.F
+		expected int
+	}{
+		{"Radius0", filter.F{TrustRoot: pks[a]}, 1},
+		{"Radius1", filter.F{TrustRoot: pks[a], TrustRadius: 1}, 3},
+		{"Radius2", filter.F{TrustRoot: pks[a], TrustRadius: 2}, 4},
+		{"Authors", filter.F{TrustRoot: pks[a], TrustRadius: 1, Authors: [][]byte{pks[c], pks[d]}}, 1},
+		{"Untrusted", filter.F{TrustRoot: pks[a], TrustRadius: 1, Authors: [][]byte{pks[e]}}, 0},
+		{"Unknown", filter.F{TrustRoot: bytes.Repeat([]byte{1}, 32), TrustRadius: 2}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := tt.f
+			f.Tags = filter.TagMap{"type": {[]byte("note")}}
+			ids, err := db.QueryEvents(f)
+			if err != nil {
+				t.Fatalf("QueryEvents failed: %v", err)
+			}
+			if len(ids) != tt.expected {
+				t.Errorf("Expected %d events, got %d", tt.expected, len(ids))
+			}
+			f.Count = true
+			counts, err := db.Count(f)
+			if err != nil {
+				t.Fatalf("Count failed: %v", err)
+			}
+			if counts.Total != tt.expected {
+				t.Errorf("Expected a count of %d, got %d", tt.expected, counts.Total)
+			}
+		})
+	}
+
+	// deleting the latest follow list puts the one before it in the graph
+	if err = db.DeleteEventById(newer); err != nil {
+		t.Fatalf("Failed to delete event: %v", err)
+	}
+	if following, _ = db.Following(pks[a]); !slices.EqualFunc(following, sorted(b), bytes.Equal) {
+		t.Errorf("Expected the earlier follow list after deleting the latest, got %d", len(following))
+	}
+	if followers, _ = db.Followers(pks[c]); len(followers) != 0 {
+		t.Errorf("Expected no followers of a pubkey no longer followed, got %d", len(followers))
+	}
+	// an older follow list stored later does not replace the latest
+	follows(b, 50, a, c, e)
+	if following, _ = db.Following(pks[b]); !slices.EqualFunc(following, sorted(d), bytes.Equal) {
+		t.Errorf("Expected an older follow list not to replace the latest, got %d", len(following))
+	}
+}
+
+// TestGraphMigration tests that a social graph that is not at the version of the
+// code is built again by a migration when the database is opened.
+func TestGraphMigration(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifold-test-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	db := New()
+	if err = db.Init(tempDir); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	signer, followed := new(p256k.Signer), new(p256k.Signer)
+	if err = signer.Generate(); err != nil {
+		t.Fatalf("Failed to generate signer: %v", err)
+	}
+	if err = followed.Generate(); err != nil {
+		t.Fatalf("Failed to generate signer: %v", err)
+	}
+	ev := &event.E{Pubkey: signer.Pub(), Timestamp: 100, Content: []byte("graph"),
+		Tags: &event.Tags{{Key: []byte("type"), Value: []byte(FollowsType)},
+			{Key: []byte(FollowTag), Value: followed.Pub()}}}
+	if err = ev.Sign(signer); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	if err = db.StoreEvent(ev); err != nil {
+		t.Fatalf("Failed to store event: %v", err)
+	}
+	// as if the reducer of the graph had failed
+	if err = db.store.DropPrefix(viewKeyPrefix(graphView), viewVersionKey(graphView)); err != nil {
+		t.Fatalf("Failed to drop the graph: %v", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+	db = New()
+	if err = db.Init(tempDir); err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	if err = db.WaitMigrations(); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	if v, err := db.SchemaVersion(); err != nil || v != SchemaVersion {
+		t.Errorf("Expected schema version %d, got %d: %v", SchemaVersion, v, err)
+	}
+	following, err := db.Following(signer.Pub())
+	if err != nil {
+		t.Fatalf("Failed to get following: %v", err)
+	}
+	if len(following) != 1 || !bytes.Equal(following[0], followed.Pub()) {
+		t.Errorf("Expected the rebuilt graph to hold the follow list, got %d follows",
+			len(following))
+	}
+}
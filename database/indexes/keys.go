@@ -10,8 +10,10 @@ import (
 	"manifold.mleku.dev/database/indexes/types/fulltext"
 	"manifold.mleku.dev/database/indexes/types/identhash"
 	"manifold.mleku.dev/database/indexes/types/idhash"
+	"manifold.mleku.dev/database/indexes/types/location"
 	. "manifold.mleku.dev/database/indexes/types/number"
 	"manifold.mleku.dev/database/indexes/types/pubhash"
+	"manifold.mleku.dev/database/indexes/types/rawvalue"
 )
 
 type P struct {
@@ -62,6 +64,24 @@ func Prefix(prf int) (i I) {
 		return "tt"
 	case FulltextWord:
 		return "fw"
+	case LastAccessed:
+		return "la"
+	case SerialAccessed:
+		return "sa"
+	case ContentLength:
+		return "cl"
+	case WordFrequency:
+		return "wf"
+	case TagKeyValue:
+		return "tk"
+	case TagNumber:
+		return "tn"
+	case Location:
+		return "lo"
+	case Reference:
+		return "rf"
+	case Nanos:
+		return "ns"
 	}
 	return
 }
@@ -260,3 +280,181 @@ func FullTextWordEnc(fw *fulltext.T, pos *Uint24, ser *Uint40) (enc *T) {
 func FullTextWordDec(fw *fulltext.T, pos *Uint24, ser *Uint40) (enc *T) {
 	return New(NewPrefix(), fw, pos, ser)
 }
+
+// LastAccessed is an index of events in the order they were last read, so
+// that the least recently accessed events can be found to evict when the
+// database grows past its size limit.
+//
+// [ prefix ][ 8 bytes access timestamp ][ 8 serial ]
+const LastAccessed = 8
+
+func LastAccessedVars() (ts *Uint64, ser *Uint40) {
+	ts = new(Uint64)
+	ser = new(Uint40)
+	return
+}
+func LastAccessedEnc(ts *Uint64, ser *Uint40) (enc *T) {
+	return New(NewPrefix(LastAccessed), ts, ser)
+}
+func LastAccessedDec(ts *Uint64, ser *Uint40) (enc *T) {
+	return New(NewPrefix(), ts, ser)
+}
+
+// SerialAccessed is the last access time of an event by its serial, used to
+// find the LastAccessed key to replace when the event is read again.
+//
+// [ prefix ][ 8 serial ][ 8 bytes access timestamp ]
+const SerialAccessed = 9
+
+func SerialAccessedVars() (ser *Uint40, ts *Uint64) {
+	ser = new(Uint40)
+	ts = new(Uint64)
+	return
+}
+func SerialAccessedEnc(ser *Uint40, ts *Uint64) (enc *T) {
+	return New(NewPrefix(SerialAccessed), ser, ts)
+}
+func SerialAccessedSearch(ser *Uint40) (enc *T) {
+	return New(NewPrefix(SerialAccessed), ser)
+}
+func SerialAccessedDec(ser *Uint40, ts *Uint64) (enc *T) {
+	return New(NewPrefix(), ser, ts)
+}
+
+// ContentLength is the number of words of the content of an event that are in
+// the FulltextWord index, used to weigh search relevance by the length of the
+// content.
+//
+// [ prefix ][ 8 serial ][ 3 bytes word count ]
+const ContentLength = 10
+
+func ContentLengthVars() (ser *Uint40, n *Uint24) {
+	ser = new(Uint40)
+	n = new(Uint24)
+	return
+}
+func ContentLengthEnc(ser *Uint40, n *Uint24) (enc *T) {
+	return New(NewPrefix(ContentLength), ser, n)
+}
+func ContentLengthDec(ser *Uint40, n *Uint24) (enc *T) {
+	return New(NewPrefix(), ser, n)
+}
+
+// WordFrequency is the number of events whose content contains a word, which
+// is the document frequency of the word in search relevance scores. It is not
+// an index of events; the count is the value of the key, as an 8 byte big
+// endian number.
+//
+// [ prefix ][ full word, zero terminated ]
+const WordFrequency = 11
+
+func WordFrequencyVars() (fw *fulltext.T) {
+	return fulltext.New()
+}
+func WordFrequencyEnc(fw *fulltext.T) (enc *T) {
+	return New(NewPrefix(WordFrequency), fw)
+}
+func WordFrequencyDec(fw *fulltext.T) (enc *T) {
+	return New(NewPrefix(), fw)
+}
+
+// TagKeyValue is an index of tags by the hash of their key and their value as
+// it is, so that events can be found by the key of a tag alone, or by a prefix
+// of its value. Values longer than rawvalue.MaxLen are truncated.
+//
+// [ prefix ][ 8 bytes key hash ][ raw value, escaped and terminated ][ 8 timestamp ][ 8 serial ]
+const TagKeyValue = 12
+
+func TagKeyValueVars() (k *identhash.T, v *rawvalue.T, ts *Uint64, ser *Uint40) {
+	k = identhash.New()
+	v = rawvalue.New()
+	ts = new(Uint64)
+	ser = new(Uint40)
+	return
+}
+func TagKeyValueEnc(k *identhash.T, v *rawvalue.T, ts *Uint64, ser *Uint40) (enc *T) {
+	return New(NewPrefix(TagKeyValue), k, v, ts, ser)
+}
+func TagKeyValueDec(k *identhash.T, v *rawvalue.T, ts *Uint64, ser *Uint40) (enc *T) {
+	return New(NewPrefix(), k, v, ts, ser)
+}
+
+// TagNumber is an index of the tags whose values are numbers, by the hash of
+// their key and their value encoded with Uint64.SetFloat, so that events can
+// be found by a range of the value of a tag and sorted by it.
+//
+// [ prefix ][ 8 bytes key hash ][ 8 bytes value ][ 8 timestamp ][ 8 serial ]
+const TagNumber = 13
+
+func TagNumberVars() (k *identhash.T, v *Uint64, ts *Uint64, ser *Uint40) {
+	k = identhash.New()
+	v = new(Uint64)
+	ts = new(Uint64)
+	ser = new(Uint40)
+	return
+}
+func TagNumberEnc(k *identhash.T, v *Uint64, ts *Uint64, ser *Uint40) (enc *T) {
+	return New(NewPrefix(TagNumber), k, v, ts, ser)
+}
+func TagNumberDec(k *identhash.T, v *Uint64, ts *Uint64, ser *Uint40) (enc *T) {
+	return New(NewPrefix(), k, v, ts, ser)
+}
+
+// Location is an index of the locations given by the tags of events, as a
+// point on a Z-order curve, so that events can be found within a box or a
+// distance of a location.
+//
+// [ prefix ][ 8 bytes location ][ 8 timestamp ][ 8 serial ]
+const Location = 14
+
+func LocationVars() (l *location.T, ts *Uint64, ser *Uint40) {
+	l = location.New()
+	ts = new(Uint64)
+	ser = new(Uint40)
+	return
+}
+func LocationEnc(l *location.T, ts *Uint64, ser *Uint40) (enc *T) {
+	return New(NewPrefix(Location), l, ts, ser)
+}
+func LocationDec(l *location.T, ts *Uint64, ser *Uint40) (enc *T) {
+	return New(NewPrefix(), l, ts, ser)
+}
+
+// Reference is an index of the tags whose values are event ids or pubkeys,
+// whatever their key, by the hash of the id or pubkey, so that the events that
+// refer to an event or a pubkey can be found.
+//
+// [ prefix ][ 8 bytes id hash ][ 8 timestamp ][ 8 serial ]
+const Reference = 15
+
+func ReferenceVars() (r *idhash.T, ts *Uint64, ser *Uint40) {
+	r = idhash.New()
+	ts = new(Uint64)
+	ser = new(Uint40)
+	return
+}
+func ReferenceEnc(r *idhash.T, ts *Uint64, ser *Uint40) (enc *T) {
+	return New(NewPrefix(Reference), r, ts, ser)
+}
+func ReferenceDec(r *idhash.T, ts *Uint64, ser *Uint40) (enc *T) {
+	return New(NewPrefix(), r, ts, ser)
+}
+
+// Nanos is the nanoseconds past the second of the timestamp of an event given
+// by its event.NanosKey tag, so that events made within the same second sort in
+// the order they were made. Events without the tag have no key.
+//
+// [ prefix ][ 8 serial ][ 4 bytes nanoseconds ]
+const Nanos = 16
+
+func NanosVars() (ser *Uint40, ns *Uint32) {
+	ser = new(Uint40)
+	ns = new(Uint32)
+	return
+}
+func NanosEnc(ser *Uint40, ns *Uint32) (enc *T) {
+	return New(NewPrefix(Nanos), ser, ns)
+}
+func NanosDec(ser *Uint40, ns *Uint32) (enc *T) {
+	return New(NewPrefix(), ser, ns)
+}
@@ -0,0 +1,111 @@
+package indexes
+
+import (
+	"bytes"
+	"slices"
+
+	"manifold.mleku.dev/chk"
+	. "manifold.mleku.dev/database/indexes/types/number"
+	"manifold.mleku.dev/errorf"
+)
+
+// SerialLen is the length of the serial found in every index key.
+const SerialLen = 5
+
+// Families is the list of index families that refer to an event by its serial,
+// that is, every index except the Event record itself.
+var Families = []int{
+	Id,
+	IdPubkeyTimestamp,
+	Timestamp,
+	PubkeyTimestamp,
+	PubkeyTagTimestamp,
+	TagTimestamp,
+	FulltextWord,
+	LastAccessed,
+	SerialAccessed,
+	ContentLength,
+	TagKeyValue,
+	TagNumber,
+	Location,
+	Reference,
+	Nanos,
+}
+
+// Aggregates is the list of index families that hold statistics about many
+// events, rather than referring to one event by its serial.
+var Aggregates = []int{
+	WordFrequency,
+}
+
+// Tracking is the list of index families that record the use of an event at
+// runtime, rather than being generated from the event by GetEventIndexes.
+var Tracking = []int{
+	LastAccessed,
+	SerialAccessed,
+}
+
+// Identify returns the index family of a key from its prefix, or -1 if it is
+// not a known index prefix.
+func Identify(key []byte) (prf int) {
+	if len(key) < 2 {
+		return -1
+	}
+	for _, f := range slices.Concat([]int{Event}, Families, Aggregates) {
+		if bytes.Equal(key[:2], []byte(Prefix(f))) {
+			return f
+		}
+	}
+	return -1
+}
+
+// serialOffset returns where the serial of the event that an index key refers
+// to is in the key. In all indexes except IdPubkeyTimestamp, SerialAccessed,
+// ContentLength and Nanos the serial is the last field of the key. Keys of the
+// Aggregates families do not refer to an event.
+func serialOffset(key []byte) (off int, err error) {
+	prf := Identify(key)
+	switch {
+	case prf < 0:
+		err = errorf.E("unknown index prefix %0x", key[:min(len(key), 2)])
+	case slices.Contains(Aggregates, prf):
+		err = errorf.E("index key %0x does not refer to an event", key)
+	case len(key) < 2+SerialLen:
+		err = errorf.E("index key too short: %0x", key)
+	case prf == Event, prf == IdPubkeyTimestamp, prf == SerialAccessed,
+		prf == ContentLength, prf == Nanos:
+		off = 2
+	default:
+		off = len(key) - SerialLen
+	}
+	return
+}
+
+// SerialOf extracts the serial of the event that an index key refers to.
+func SerialOf(key []byte) (ser *Uint40, err error) {
+	var off int
+	if off, err = serialOffset(key); err != nil {
+		return
+	}
+	ser = new(Uint40)
+	if err = ser.UnmarshalRead(bytes.NewBuffer(key[off : off+SerialLen])); chk.E(err) {
+		return
+	}
+	return
+}
+
+// WithSerial returns a copy of an index key that refers to another event
+// serial.
+func WithSerial(key []byte, ser *Uint40) (k []byte, err error) {
+	var off int
+	if off, err = serialOffset(key); err != nil {
+		return
+	}
+	sb := new(bytes.Buffer)
+	if err = ser.MarshalWrite(sb); chk.E(err) {
+		return
+	}
+	k = bytes.Clone(key)
+	copy(k[off:], sb.Bytes())
+	return
+}
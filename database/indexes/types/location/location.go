@@ -0,0 +1,143 @@
+// Package location is an index field holding a latitude and longitude as a
+// point on a Z-order curve, so that locations that are near each other mostly
+// have keys that are near each other, and a box of locations is covered by a
+// few ranges of keys.
+//
+// Each coordinate is quantized to 32 bits, which is a precision of under a
+// centimeter, and the bits of the longitude and latitude are interleaved with
+// the longitude first, as in a geohash.
+package location
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"sort"
+)
+
+const Len = 8
+
+type T struct{ z uint64 }
+
+func New() (l *T) { return &T{} }
+
+// Set sets the location from a latitude and longitude in degrees.
+func (l *T) Set(lat, lon float64) { l.z = interleave(quantize(lon, 180), quantize(lat, 90)) }
+
+// Get returns the latitude and longitude in degrees.
+func (l *T) Get() (lat, lon float64) {
+	x, y := deinterleave(l.z)
+	return unquantize(y, 90), unquantize(x, 180)
+}
+
+// Z returns the position of the location on the Z-order curve.
+func (l *T) Z() (z uint64) { return l.z }
+
+// SetZ sets the position of the location on the Z-order curve.
+func (l *T) SetZ(z uint64) { l.z = z }
+
+func (l *T) MarshalWrite(w io.Writer) (err error) {
+	b := make([]byte, Len)
+	binary.BigEndian.PutUint64(b, l.z)
+	_, err = w.Write(b)
+	return
+}
+
+func (l *T) UnmarshalRead(r io.Reader) (err error) {
+	b := make([]byte, Len)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return
+	}
+	l.z = binary.BigEndian.Uint64(b)
+	return
+}
+
+// Range is an inclusive range of positions on the Z-order curve.
+type Range struct{ From, To uint64 }
+
+// maxCells is the most cells a box is divided into by Cover.
+const maxCells = 64
+
+// Cover returns the ranges of positions on the Z-order curve of the cells of
+// the largest size that cover a box with no more than maxCells cells. The box
+// is given in degrees, and must not cross the antimeridian. The ranges include
+// locations outside the box, so the locations found in them must be checked.
+func Cover(minLat, minLon, maxLat, maxLon float64) (ranges []Range) {
+	x0, x1 := quantize(minLon, 180), quantize(maxLon, 180)
+	y0, y1 := quantize(minLat, 90), quantize(maxLat, 90)
+	if x0 > x1 || y0 > y1 {
+		return
+	}
+	// find the most bits per coordinate that divide the box into few cells
+	var bits int
+	for bits < 32 {
+		s := 32 - (bits + 1)
+		if uint64(x1>>s-x0>>s+1)*uint64(y1>>s-y0>>s+1) > maxCells {
+			break
+		}
+		bits++
+	}
+	s := 32 - bits
+	for x := uint64(x0 >> s); x <= uint64(x1>>s); x++ {
+		for y := uint64(y0 >> s); y <= uint64(y1>>s); y++ {
+			from := interleave(uint32(x<<s), uint32(y<<s))
+			ranges = append(ranges, Range{from, from | (1<<(2*s) - 1)})
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].From < ranges[j].From })
+	// merge the ranges of cells that are adjacent on the curve
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r.From == last.To+1 {
+			last.To = r.To
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// quantize maps a coordinate in [-limit, limit] onto the range of a uint32.
+func quantize(v, limit float64) (q uint32) {
+	f := math.Floor((v + limit) / (2 * limit) * (1 << 32))
+	switch {
+	case f <= 0 || math.IsNaN(f):
+		return 0
+	case f >= math.MaxUint32:
+		return math.MaxUint32
+	}
+	return uint32(f)
+}
+
+// unquantize returns the coordinate at the middle of a quantized step.
+func unquantize(q uint32, limit float64) (v float64) {
+	return (float64(q)+0.5)/(1<<32)*(2*limit) - limit
+}
+
+// interleave returns the bits of x and y interleaved, with x first.
+func interleave(x, y uint32) (z uint64) { return spread(x)<<1 | spread(y) }
+
+func deinterleave(z uint64) (x, y uint32) { return squash(z >> 1), squash(z) }
+
+// spread moves the bits of v into the even bits of a uint64.
+func spread(v uint32) (s uint64) {
+	s = uint64(v)
+	s = (s | s<<16) & 0x0000ffff0000ffff
+	s = (s | s<<8) & 0x00ff00ff00ff00ff
+	s = (s | s<<4) & 0x0f0f0f0f0f0f0f0f
+	s = (s | s<<2) & 0x3333333333333333
+	s = (s | s<<1) & 0x5555555555555555
+	return
+}
+
+// squash collects the even bits of a uint64.
+func squash(s uint64) (v uint32) {
+	s &= 0x5555555555555555
+	s = (s | s>>1) & 0x3333333333333333
+	s = (s | s>>2) & 0x0f0f0f0f0f0f0f0f
+	s = (s | s>>4) & 0x00ff00ff00ff00ff
+	s = (s | s>>8) & 0x0000ffff0000ffff
+	s = (s | s>>16) & 0x00000000ffffffff
+	return uint32(s)
+}
@@ -0,0 +1,67 @@
+package location_test
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"testing"
+
+	"manifold.mleku.dev/database/indexes/types/location"
+)
+
+func TestT(t *testing.T) {
+	points := [][2]float64{
+		{0, 0},
+		{-90, -180},
+		{90, 180},
+		{51.5074, -0.1278},
+		{-33.8688, 151.2093},
+	}
+	for _, p := range points {
+		l := location.New()
+		l.Set(p[0], p[1])
+		buf := new(bytes.Buffer)
+		if err := l.MarshalWrite(buf); err != nil {
+			t.Fatalf("MarshalWrite failed: %v", err)
+		}
+		l2 := location.New()
+		if err := l2.UnmarshalRead(buf); err != nil {
+			t.Fatalf("UnmarshalRead failed: %v", err)
+		}
+		lat, lon := l2.Get()
+		if math.Abs(lat-p[0]) > 1e-7 || math.Abs(lon-p[1]) > 1e-7 {
+			t.Errorf("Set(%v, %v) decoded as %v, %v", p[0], p[1], lat, lon)
+		}
+	}
+}
+
+func TestCover(t *testing.T) {
+	boxes := [][4]float64{
+		{51.28, -0.51, 51.69, 0.33},
+		{-10, -10, 10, 10},
+		{-90, -180, 90, 180},
+		{1, 1, 1, 1},
+	}
+	rng := rand.New(rand.NewSource(1))
+	for _, b := range boxes {
+		ranges := location.Cover(b[0], b[1], b[2], b[3])
+		if len(ranges) == 0 || len(ranges) > 64 {
+			t.Fatalf("Cover(%v) returned %d ranges", b, len(ranges))
+		}
+		for i := 0; i < 1000; i++ {
+			l := location.New()
+			l.Set(b[0]+rng.Float64()*(b[2]-b[0]), b[1]+rng.Float64()*(b[3]-b[1]))
+			covered := false
+			for _, r := range ranges {
+				if l.Z() >= r.From && l.Z() <= r.To {
+					covered = true
+					break
+				}
+			}
+			if !covered {
+				lat, lon := l.Get()
+				t.Fatalf("location %v, %v in box %v is not covered", lat, lon, b)
+			}
+		}
+	}
+}
@@ -3,6 +3,7 @@ package number
 import (
 	"encoding/binary"
 	"io"
+	"math"
 )
 
 // Uint64 is a codec for encoding and decoding 64-bit unsigned integers.
@@ -32,6 +33,42 @@ func (c *Uint64) Int() int {
 	return int(c.value)
 }
 
+// SetInt64 sets the value as an int64, with the sign bit flipped so that the
+// order of the encoded values is the numeric order of the signed values, with
+// negative values before positive ones.
+func (c *Uint64) SetInt64(value int64) {
+	c.value = uint64(value) ^ 1<<63
+}
+
+// Int64 gets the value as an int64 set by SetInt64.
+func (c *Uint64) Int64() int64 {
+	return int64(c.value ^ 1<<63)
+}
+
+// SetFloat sets the value as a float64, encoded so that the order of the
+// encoded values is the numeric order of the floats: the sign bit is flipped
+// for positive numbers and every bit is flipped for negative numbers. Negative
+// zero is stored as zero.
+func (c *Uint64) SetFloat(value float64) {
+	if value == 0 {
+		value = 0
+	}
+	b := math.Float64bits(value)
+	if b&(1<<63) != 0 {
+		c.value = ^b
+	} else {
+		c.value = b | 1<<63
+	}
+}
+
+// Float gets the value as a float64 set by SetFloat.
+func (c *Uint64) Float() float64 {
+	if c.value&(1<<63) != 0 {
+		return math.Float64frombits(c.value &^ (1 << 63))
+	}
+	return math.Float64frombits(^c.value)
+}
+
 // MarshalWrite writes the uint64 value to the provided writer in BigEndian order.
 func (c *Uint64) MarshalWrite(w io.Writer) error {
 	return binary.Write(w, binary.BigEndian, c.value)
@@ -122,3 +122,49 @@ func getUint64Values(slice Uint64s) []uint64 {
 	}
 	return values
 }
+
+func TestUint64Float(t *testing.T) {
+	values := []float64{math.Inf(-1), -math.MaxFloat64, -1e10, -2.5, -1, -math.SmallestNonzeroFloat64,
+		0, math.SmallestNonzeroFloat64, 0.5, 1, 3.14159, 1e10, math.MaxFloat64, math.Inf(1)}
+	var prev []byte
+	for _, v := range values {
+		codec := new(Uint64)
+		codec.SetFloat(v)
+		if got := codec.Float(); got != v {
+			t.Errorf("Float round trip of %v gave %v", v, got)
+		}
+		buf := new(bytes.Buffer)
+		if err := codec.MarshalWrite(buf); err != nil {
+			t.Fatalf("MarshalWrite failed: %v", err)
+		}
+		if prev != nil && bytes.Compare(prev, buf.Bytes()) >= 0 {
+			t.Errorf("Encoding of %v does not sort after the previous value", v)
+		}
+		prev = buf.Bytes()
+	}
+	codec := new(Uint64)
+	codec.SetFloat(math.Copysign(0, -1))
+	if math.Signbit(codec.Float()) {
+		t.Errorf("Negative zero was not stored as zero")
+	}
+}
+
+func TestUint64Int64(t *testing.T) {
+	values := []int64{math.MinInt64, -1e12, -86400, -1, 0, 1, 1700000000, 1e12, math.MaxInt64}
+	var prev []byte
+	for _, v := range values {
+		codec := new(Uint64)
+		codec.SetInt64(v)
+		if got := codec.Int64(); got != v {
+			t.Errorf("Int64 round trip of %d gave %d", v, got)
+		}
+		buf := new(bytes.Buffer)
+		if err := codec.MarshalWrite(buf); err != nil {
+			t.Fatalf("MarshalWrite failed: %v", err)
+		}
+		if prev != nil && bytes.Compare(prev, buf.Bytes()) >= 0 {
+			t.Errorf("Encoding of %d does not sort after the previous value", v)
+		}
+		prev = buf.Bytes()
+	}
+}
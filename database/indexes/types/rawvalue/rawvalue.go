@@ -0,0 +1,73 @@
+// Package rawvalue is an index field holding a tag value as it is, encoded so
+// that the order of the encoded values is the order of the values, and so that
+// the encoding of a prefix of a value is a prefix of the encoding of the value.
+//
+// Zero bytes in the value are escaped as 0x00 0xff, and the value is
+// terminated by 0x00 0x00, which sorts before any escaped zero.
+package rawvalue
+
+import (
+	"bytes"
+	"io"
+
+	"manifold.mleku.dev/errorf"
+)
+
+// MaxLen is the number of bytes of a value that are stored; longer values are
+// truncated, so matches against them must be confirmed against the event.
+const MaxLen = 256
+
+type T struct{ val []byte }
+
+func New() (v *T) { return &T{} }
+
+// FromValue sets the value, truncated to MaxLen bytes.
+func (v *T) FromValue(val []byte) { v.val = val[:min(len(val), MaxLen)] }
+
+// Bytes returns the value.
+func (v *T) Bytes() (b []byte) { return v.val }
+
+// Escape returns the encoding of a value without the terminator, which is the
+// prefix of the encoding of every value that starts with it.
+func Escape(val []byte) (b []byte) {
+	b = make([]byte, 0, len(val))
+	for _, c := range val {
+		b = append(b, c)
+		if c == 0 {
+			b = append(b, 0xff)
+		}
+	}
+	return
+}
+
+func (v *T) MarshalWrite(w io.Writer) (err error) {
+	_, err = w.Write(append(Escape(v.val), 0, 0))
+	return
+}
+
+func (v *T) UnmarshalRead(r io.Reader) (err error) {
+	buf := new(bytes.Buffer)
+	b := make([]byte, 1)
+	for {
+		if _, err = io.ReadFull(r, b); err != nil {
+			return
+		}
+		if b[0] != 0 {
+			buf.WriteByte(b[0])
+			continue
+		}
+		if _, err = io.ReadFull(r, b); err != nil {
+			return
+		}
+		switch b[0] {
+		case 0:
+			v.val = buf.Bytes()
+			return
+		case 0xff:
+			buf.WriteByte(0)
+		default:
+			err = errorf.E("invalid escape 0x00 0x%02x in raw value", b[0])
+			return
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package rawvalue_test
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"manifold.mleku.dev/database/indexes/types/rawvalue"
+)
+
+func TestT(t *testing.T) {
+	values := [][]byte{
+		[]byte(""),
+		[]byte("\x00"),
+		[]byte("\x00\x00"),
+		[]byte("\x00a"),
+		[]byte("a"),
+		[]byte("a\x00"),
+		[]byte("a\x00b"),
+		[]byte("a\x01"),
+		[]byte("ab"),
+		[]byte("image/"),
+		[]byte("image/png"),
+		[]byte("\xff"),
+	}
+	var encoded [][]byte
+	for _, val := range values {
+		v := rawvalue.New()
+		v.FromValue(val)
+		buf := new(bytes.Buffer)
+		if err := v.MarshalWrite(buf); err != nil {
+			t.Fatalf("MarshalWrite failed: %v", err)
+		}
+		enc := buf.Bytes()
+		if !bytes.HasPrefix(enc, rawvalue.Escape(val)) {
+			t.Errorf("Escape(%q) is not a prefix of its encoding %x", val, enc)
+		}
+		// follow the value with more fields, as in an index key
+		buf.WriteString("rest")
+		v2 := rawvalue.New()
+		if err := v2.UnmarshalRead(buf); err != nil {
+			t.Fatalf("UnmarshalRead failed: %v", err)
+		}
+		if !bytes.Equal(v2.Bytes(), val) {
+			t.Errorf("Expected %q, got %q", val, v2.Bytes())
+		}
+		if buf.String() != "rest" {
+			t.Errorf("Expected the following fields to remain, got %q", buf.String())
+		}
+		encoded = append(encoded, enc)
+	}
+	if !slices.IsSortedFunc(encoded, bytes.Compare) {
+		t.Errorf("Encoded values are not in the order of the values")
+	}
+	for _, val := range values {
+		for j, other := range values {
+			if bytes.HasPrefix(other, val) != bytes.HasPrefix(encoded[j], rawvalue.Escape(val)) {
+				t.Errorf("Prefix match of %q against %q differs after encoding", val, other)
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package database
+
+import (
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+)
+
+// I is the interface of an event store, for relays and apps that store and
+// query events without depending on how they are kept. D implements it on any
+// store.I, such as badger on disk or the in-memory store of
+// database/store/memory.
+type I interface {
+	// StoreEvent stores an event and its indexes. Storing an event that is
+	// already stored does nothing.
+	StoreEvent(ev *event.E) (err error)
+	// GetEventById returns the event with an id.
+	GetEventById(evId []byte) (ev *event.E, err error)
+	// QueryEvents returns the ids of the events matching a filter.
+	QueryEvents(f filter.F) (eventIds [][]byte, err error)
+	// Count counts the events matching a filter, in the groups of its GroupBy.
+	Count(f filter.F) (c *filter.Counts, err error)
+	// DeleteEventById removes an event and its indexes.
+	DeleteEventById(evId []byte) (err error)
+	// Close releases the resources of the event store.
+	Close() (err error)
+}
+
+var _ I = (*D)(nil)
+
+// Sorter is implemented by event stores that return what the results of their
+// queries are sorted by, so that the results of several stores can be merged
+// without reading the events.
+type Sorter interface {
+	// QuerySorted returns the events matching a filter as QueryEvents does,
+	// with their times and the values of the SortTag of the filter.
+	QuerySorted(f filter.F) (results []Result, err error)
+}
+
+// Result is an event found by a query, with what it is sorted by. The events
+// of a filter by Ids are returned with only their Id.
+type Result struct {
+	Id        []byte
+	Timestamp int64
+	// Nanos is the nanoseconds past the second of the Timestamp.
+	Nanos int
+	// SortValue is the value of the SortTag of the filter, or NaN if the event
+	// has none.
+	SortValue float64
+}
+
+var _ Sorter = (*D)(nil)
@@ -0,0 +1,64 @@
+package database
+
+import (
+	"bytes"
+
+	"manifold.mleku.dev/database/store"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/database/indexes/types/number"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/log"
+)
+
+// ForEachEvent calls fn with every event in the database in the order of their
+// serials, skipping event records that cannot be decoded. Iteration stops at
+// the first error returned by fn, or when the database is closed. The events
+// are read in a single transaction, so fn must not write to the database.
+func (d *D) ForEachEvent(fn func(ser *number.Uint40, ev *event.E) (err error)) (err error) {
+	err = d.View(func(txn store.Txn) (err error) {
+		prf := []byte(indexes.Prefix(indexes.Event))
+		it := txn.NewIterator(store.IteratorOptions{Prefix: prf})
+		defer it.Close()
+		for it.Seek(prf); it.Valid(); it.Next() {
+			if err = d.ctx.Err(); err != nil {
+				return
+			}
+			ser := indexes.EventVars()
+			if err = indexes.EventDec(ser).UnmarshalRead(bytes.NewBuffer(it.Key())); chk.E(err) {
+				return
+			}
+			var val []byte
+			if val, err = it.Value(); chk.E(err) {
+				return
+			}
+			ev := &event.E{}
+			if err = ev.ReadBinary(bytes.NewBuffer(val)); err != nil {
+				log.W.F("skipping event serial %d that could not be decoded: %v",
+					ser.Get(), err)
+				err = nil
+				continue
+			}
+			if err = fn(ser, ev); err != nil {
+				return
+			}
+		}
+		return
+	})
+	return
+}
+
+// CountEvents returns the number of event records in the database.
+func (d *D) CountEvents() (n int, err error) {
+	err = d.View(func(txn store.Txn) (err error) {
+		prf := []byte(indexes.Prefix(indexes.Event))
+		it := txn.NewIterator(store.IteratorOptions{Prefix: prf})
+		defer it.Close()
+		for it.Seek(prf); it.Valid(); it.Next() {
+			n++
+		}
+		return
+	})
+	return
+}
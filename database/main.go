@@ -2,10 +2,14 @@ package database
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger/v4"
 
 	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/filter"
 	"manifold.mleku.dev/log"
 	"manifold.mleku.dev/units"
 )
@@ -17,22 +21,92 @@ type D struct {
 	BlockCacheSize int
 	Logger         *logger
 	InitLogLevel   int
-	// DB is the badger db
-	*badger.DB
+	// MaxSize is the size in bytes the database may grow to before the least
+	// recently accessed events are evicted. Zero disables eviction.
+	MaxSize int64
+	// GCInterval is how often the size of the database is checked against
+	// MaxSize.
+	GCInterval time.Duration
+	// AccessResolution is how old the recorded access time of an event must
+	// be before it is updated when the event is read again.
+	AccessResolution time.Duration
+	// ExemptAuthors are the pubkeys whose events are never evicted.
+	ExemptAuthors [][]byte
+	// ExemptTags are the tags whose events are never evicted. A key with no
+	// values exempts every event with a tag of that key.
+	ExemptTags filter.TagMap
+	// StatsInterval is how old the counts of keys returned by Stats may be
+	// before they are counted again in the background.
+	StatsInterval time.Duration
+	// KeyProvider supplies the master key to encrypt the database at rest.
+	// Encryption is disabled if it is nil. It applies only to the badger store.
+	KeyProvider KeyProvider
+	// KeyRotation is how often a new data key is generated to encrypt new
+	// data; zero uses the badger default of 10 days.
+	KeyRotation time.Duration
+	// Retention is how long the deletions of keys are kept for the replicas
+	// of the database, which take the whole of it again once they are further
+	// behind. The older versions of the keys written in that time are kept too.
+	// It applies only to the badger store.
+	Retention time.Duration
+	// store is the key/value store the events and indexes are kept in.
+	store store.I
+	// bdb is the badger db when the store is on disk, for the features that
+	// only badger provides, such as backups; it is nil for other stores.
+	bdb *badger.DB
 	// seq is the monotonic collision free index for raw event storage.
-	seq *badger.Sequence
+	seq store.Sequence
+	// serials is held for reading while events are stored and deleted by their
+	// serial, and for writing while Consolidate renumbers the serials.
+	serials sync.RWMutex
+	// migration is the status of schema migrations started by Init.
+	migration   MigrationStatus
+	migrationMx sync.Mutex
+	migrations  sync.WaitGroup
+	// workers are the background tasks that run until the database is closed.
+	workers sync.WaitGroup
+	// sizeFn measures the size of the database for GC.
+	sizeFn func() int64
+	// gc is the space evicted by GC that the store has not yet reclaimed.
+	gc gcState
+	// feed is the set of subscribers to the changes of the database.
+	feed feed
+	// stats are the last counts of keys and the query latencies for Stats.
+	stats statsCache
+	// namespaces are the open namespaces of the database.
+	namespaces   map[string]*D
+	namespacesMx sync.Mutex
+	// views are the materialized views registered on the database.
+	views   map[string]*View
+	viewsMx sync.RWMutex
+	// replica is the state of following a primary as a read replica.
+	replica replica
+	// retention keeps the deletions of keys for replicas.
+	retention retention
+	// parent is the database a namespace is in, and namespace its name.
+	parent    *D
+	namespace string
 }
 
 func New() (d *D) {
 	ctx, cancel := context.WithCancelCause(context.Background())
-	d = &D{BlockCacheSize: units.Gb, ctx: ctx, cancel: cancel}
+	d = &D{
+		BlockCacheSize:   units.Gb,
+		GCInterval:       time.Minute,
+		AccessResolution: time.Hour,
+		StatsInterval:    time.Minute,
+		Retention:        time.Hour,
+		ctx:              ctx,
+		cancel:           cancel,
+	}
+	d.sizeFn = d.Size
 	return
 }
 
 // Path returns the path where the database files are stored.
 func (d *D) Path() string { return d.dataDir }
 
-// Init sets up the database with the loaded configuration.
+// Init opens the badger database at path with the loaded configuration.
 func (d *D) Init(path string) (err error) {
 	d.dataDir = path
 	log.I.Ln("opening realy database at", d.dataDir)
@@ -43,18 +117,67 @@ func (d *D) Init(path string) (err error) {
 	opts.LmaxCompaction = true
 	d.Logger = NewLogger(d.InitLogLevel, d.dataDir)
 	opts.Logger = d.Logger
-	if d.DB, err = badger.Open(opts); chk.E(err) {
+	if err = d.encryption(&opts); chk.E(err) {
+		return err
+	}
+	if d.bdb, err = badger.Open(opts); chk.E(err) {
+		return err
+	}
+	if err = d.startRetention(); chk.E(err) {
+		_ = d.bdb.Close()
+		return err
+	}
+	if err = d.InitStore(badgerStore{d.bdb}); err != nil {
 		return err
 	}
+	d.workers.Add(1)
+	go d.retainLoop()
+	return
+}
+
+// InitStore sets up the database on a key/value store that is already open,
+// such as an in-memory store from database/store/memory. The store is closed
+// along with the database.
+func (d *D) InitStore(s store.I) (err error) {
+	d.store = s
 	log.I.Ln("getting event store sequence index", d.dataDir)
-	if d.seq, err = d.DB.GetSequence([]byte("EVENTS"), 1000); chk.E(err) {
+	if d.seq, err = d.store.GetSequence(sequenceKey, sequenceBandwidth); chk.E(err) {
+		_ = d.store.Close()
 		return err
 	}
+	// the social graph is built by a migration rather than when it is
+	// registered, so opening the database does not decode every event.
+	if err = d.addView(socialGraph()); chk.E(err) {
+		_ = d.store.Close()
+		return err
+	}
+	if err = d.initSchema(); chk.E(err) {
+		_ = d.store.Close()
+		return err
+	}
+	if d.MaxSize > 0 {
+		d.workers.Add(1)
+		go d.gcLoop()
+	}
 	return nil
-
 }
 
-func (d *D) Close() (err error) { return d.DB.Close() }
+// Close stops any running migrations and background tasks and closes the
+// database and its namespaces.
+func (d *D) Close() (err error) {
+	d.closeNamespaces()
+	d.cancel(nil)
+	d.migrations.Wait()
+	d.workers.Wait()
+	d.feed.closeAll()
+	// a read replica does not release its lease of the sequence, which would
+	// rewind the sequence taken from the primary.
+	if d.seq != nil && d.writable() == nil {
+		chk.E(d.seq.Release())
+	}
+	d.forget()
+	return d.store.Close()
+}
 
 // Serial returns the next monotonic conflict free unique serial on the database.
 func (d *D) Serial() (ser uint64, err error) {
@@ -64,21 +187,21 @@ func (d *D) Serial() (ser uint64, err error) {
 	return
 }
 
-func (d *D) View(fn func(txn *badger.Txn) (err error)) (err error) {
-	if err = d.DB.View(fn); chk.E(err) {
+func (d *D) View(fn func(txn store.Txn) (err error)) (err error) {
+	if err = d.store.View(fn); chk.E(err) {
 		return
 	}
 	return
 }
-func (d *D) Update(fn func(txn *badger.Txn) (err error)) (err error) {
-	if err = d.DB.Update(fn); chk.E(err) {
+func (d *D) Update(fn func(txn store.Txn) (err error)) (err error) {
+	if err = d.store.Update(fn); chk.E(err) {
 		return
 	}
 	return
 }
 
 func (d *D) Set(k, v []byte) (err error) {
-	if err = d.Update(func(txn *badger.Txn) (err error) {
+	if err = d.Update(func(txn store.Txn) (err error) {
 		if err = txn.Set(k, v); chk.E(err) {
 			return
 		}
@@ -89,12 +212,20 @@ func (d *D) Set(k, v []byte) (err error) {
 	return
 }
 func (d *D) Get(k []byte) (v []byte, err error) {
-	if err = d.Update(func(txn *badger.Txn) (err error) {
-		var it *badger.Item
-		if it, err = txn.Get(k); chk.E(err) {
+	if err = d.Update(func(txn store.Txn) (err error) {
+		if v, err = txn.Get(k); chk.E(err) {
 			return
 		}
-		if v, err = it.ValueCopy(nil); chk.E(err) {
+		return
+	}); chk.E(err) {
+		return
+	}
+	return
+}
+
+func (d *D) Delete(k []byte) (err error) {
+	if err = d.Update(func(txn store.Txn) (err error) {
+		if err = txn.Delete(k); chk.E(err) {
 			return
 		}
 		return
@@ -0,0 +1,127 @@
+package database
+
+import (
+	"bytes"
+	"slices"
+
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+)
+
+// Matches returns true if an event matches a filter as QueryEvents would find
+// it, without reading the database. The Sort, SortTag and Limit fields do not
+// affect which events match.
+func Matches(f filter.F, ev *event.E) bool {
+	if len(f.Ids) > 0 || len(f.NotIds) > 0 {
+		id, err := ev.Id()
+		if err != nil {
+			return false
+		}
+		if len(f.Ids) > 0 && !slices.ContainsFunc(f.Ids, func(i []byte) bool { return bytes.Equal(i, id) }) {
+			return false
+		}
+		if slices.ContainsFunc(f.NotIds, func(i []byte) bool { return bytes.Equal(i, id) }) {
+			return false
+		}
+		if len(f.Ids) > 0 {
+			return true
+		}
+	}
+	if len(f.Authors) > 0 && !slices.ContainsFunc(f.Authors, func(a []byte) bool { return bytes.Equal(a, ev.Pubkey) }) {
+		return false
+	}
+	if slices.ContainsFunc(f.NotAuthors, func(a []byte) bool { return bytes.Equal(a, ev.Pubkey) }) {
+		return false
+	}
+	f, r, err := timeBounds(f)
+	if err != nil {
+		return false
+	}
+	if !r.contains(ev.Timestamp, ev.Nanos()) {
+		return false
+	}
+	var tags event.Tags
+	if ev.Tags != nil {
+		tags = *ev.Tags
+	}
+	if len(f.Tags) > 0 && !hasTagIn(tags, f.Tags) {
+		return false
+	}
+	if len(f.NotTags) > 0 && hasTagIn(tags, f.NotTags) {
+		return false
+	}
+	if len(f.HasTags) > 0 && !slices.ContainsFunc(tags, func(t event.Tag) bool {
+		return slices.Contains(f.HasTags, string(t.Key))
+	}) {
+		return false
+	}
+	if len(f.TagPrefixes) > 0 && !slices.ContainsFunc(tags, func(t event.Tag) bool {
+		return slices.ContainsFunc(f.TagPrefixes[string(t.Key)], func(p []byte) bool {
+			return bytes.HasPrefix(t.Value, p)
+		})
+	}) {
+		return false
+	}
+	for key, r := range f.Ranges {
+		if !slices.ContainsFunc(tags, func(t event.Tag) bool {
+			n, ok := tagNumber(t.Value)
+			return ok && string(t.Key) == key && n >= r.Min && n <= r.Max
+		}) {
+			return false
+		}
+	}
+	if (f.Within != nil || f.Near != nil) && !slices.ContainsFunc(tags, func(t event.Tag) bool {
+		lat, lon, ok := tagLocation(t)
+		return ok && (f.Within == nil || inBox(f.Within, lat, lon)) &&
+			(f.Near == nil || distance(f.Near.Lat, f.Near.Lon, lat, lon) <= f.Near.Radius)
+	}) {
+		return false
+	}
+	if len(f.References) > 0 && !slices.ContainsFunc(tags, func(t event.Tag) bool {
+		ref, ok := event.Reference(t.Value)
+		return ok && slices.ContainsFunc(f.References, func(r []byte) bool {
+			r, ok := event.Reference(r)
+			return ok && bytes.Equal(r, ref)
+		})
+	}) {
+		return false
+	}
+	if f.Search != "" && !matchesSearch(ev, f.Search) {
+		return false
+	}
+	return true
+}
+
+// hasTagIn returns true if any of the tags has a key and value in tm.
+func hasTagIn(tags event.Tags, tm filter.TagMap) bool {
+	return slices.ContainsFunc(tags, func(t event.Tag) bool {
+		return slices.ContainsFunc(tm[string(t.Key)], func(v []byte) bool { return bytes.Equal(v, t.Value) })
+	})
+}
+
+// matchesSearch returns true if the content of an event contains every phrase
+// of a search, as the FulltextWord index would find it.
+func matchesSearch(ev *event.E, search string) bool {
+	positions := make(map[string][]int)
+	for _, w := range contentWords(ev) {
+		positions[string(w.Text)] = append(positions[string(w.Text)], w.Pos)
+	}
+	phrases := parseSearch(search)
+	if len(phrases) == 0 {
+		return false
+	}
+phrases:
+	for _, phrase := range phrases {
+	starts:
+		for _, start := range positions[string(phrase[0].Text)] {
+			for _, w := range phrase[1:] {
+				if !slices.Contains(positions[string(w.Text)], start+w.Pos-phrase[0].Pos) {
+					continue starts
+				}
+			}
+			continue phrases
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,185 @@
+package database
+
+import (
+	"bytes"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/database/store/prefixed"
+	"manifold.mleku.dev/errorf"
+	"manifold.mleku.dev/log"
+)
+
+// namespacePrefix is the start of the keys of every namespace, which no key of
+// the database outside the namespaces starts with.
+var namespacePrefix = []byte("NS")
+
+// MaxNamespaceLength is the longest name of a namespace.
+const MaxNamespaceLength = 64
+
+// NamespaceStats are the counts of the events and keys of a namespace.
+type NamespaceStats struct {
+	Name   string
+	Events int
+	Keys   int
+	// Bytes is the total length of the keys and values, before compression.
+	Bytes int64
+}
+
+// checkNamespace returns an error if a name is not valid for a namespace. Names
+// are made of lower case letters, digits, dots, dashes and underscores, so that
+// the prefix of no namespace starts with that of another.
+func checkNamespace(name string) (err error) { return checkName("namespace", name) }
+
+// checkName returns an error if a name of a kind of thing kept under a prefix
+// of its own is not made of 1 to MaxNamespaceLength lower case letters,
+// digits, dots, dashes and underscores.
+func checkName(kind, name string) (err error) {
+	if len(name) == 0 || len(name) > MaxNamespaceLength {
+		return errorf.E("%s must be 1 to %d characters, got %d",
+			kind, MaxNamespaceLength, len(name))
+	}
+	for _, c := range []byte(name) {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return errorf.E("invalid character %q in %s %q", c, kind, name)
+		}
+	}
+	return
+}
+
+// keyPrefix returns the prefix of the keys of a namespace.
+func keyPrefix(name string) []byte {
+	return append(append(bytes.Clone(namespacePrefix), name...), ':')
+}
+
+// Namespace returns a database of the events of an app, kept apart from those
+// of the database and its other namespaces by a prefix on every key, which
+// shares its store, and the badger cache, with the database. The namespace is
+// created if it does not exist, and is migrated to the current schema on its
+// own. It takes the MaxSize and eviction settings of the database, against
+// the size of its own keys. The namespace is closed when the database is.
+func (d *D) Namespace(name string) (ns *D, err error) {
+	if err = checkNamespace(name); chk.E(err) {
+		return
+	}
+	d.namespacesMx.Lock()
+	defer d.namespacesMx.Unlock()
+	if ns = d.namespaces[name]; ns != nil {
+		return
+	}
+	ns = New()
+	ns.dataDir = d.dataDir
+	ns.Logger = d.Logger
+	ns.InitLogLevel = d.InitLogLevel
+	ns.MaxSize = d.MaxSize
+	ns.GCInterval = d.GCInterval
+	ns.AccessResolution = d.AccessResolution
+	ns.ExemptAuthors = d.ExemptAuthors
+	ns.ExemptTags = d.ExemptTags
+	ns.parent, ns.namespace = d, name
+	log.I.F("opening namespace %s", name)
+	if err = ns.InitStore(prefixed.New(d.store, keyPrefix(name))); chk.E(err) {
+		ns = nil
+		return
+	}
+	if d.namespaces == nil {
+		d.namespaces = make(map[string]*D)
+	}
+	d.namespaces[name] = ns
+	return
+}
+
+// Namespaces returns the names of the namespaces in the database, in order,
+// whether or not they are open.
+func (d *D) Namespaces() (names []string, err error) {
+	err = d.View(func(txn store.Txn) (err error) {
+		it := txn.NewIterator(store.IteratorOptions{Prefix: namespacePrefix})
+		defer it.Close()
+		for it.Seek(namespacePrefix); it.Valid(); {
+			name, _, ok := bytes.Cut(it.Key()[len(namespacePrefix):], []byte{':'})
+			if !ok {
+				it.Next()
+				continue
+			}
+			names = append(names, string(name))
+			// skip the rest of the keys of the namespace
+			next := keyPrefix(string(name))
+			next[len(next)-1]++
+			it.Seek(next)
+		}
+		return
+	})
+	return
+}
+
+// NamespaceStats counts the events and keys of a namespace.
+func (d *D) NamespaceStats(name string) (s NamespaceStats, err error) {
+	if err = checkNamespace(name); chk.E(err) {
+		return
+	}
+	s.Name = name
+	prf := keyPrefix(name)
+	ev := append(bytes.Clone(prf), indexes.Prefix(indexes.Event)...)
+	err = d.View(func(txn store.Txn) (err error) {
+		it := txn.NewIterator(store.IteratorOptions{Prefix: prf})
+		defer it.Close()
+		for it.Seek(prf); it.Valid(); it.Next() {
+			k := it.Key()
+			var v []byte
+			if v, err = it.Value(); chk.E(err) {
+				return
+			}
+			s.Keys++
+			s.Bytes += int64(len(k) + len(v))
+			if bytes.HasPrefix(k, ev) {
+				s.Events++
+			}
+		}
+		return
+	})
+	return
+}
+
+// DropNamespace closes a namespace if it is open and deletes all of its events
+// and indexes.
+func (d *D) DropNamespace(name string) (err error) {
+	if err = checkNamespace(name); chk.E(err) {
+		return
+	}
+	d.namespacesMx.Lock()
+	ns := d.namespaces[name]
+	d.namespacesMx.Unlock()
+	if ns != nil {
+		if err = ns.Close(); chk.E(err) {
+			return
+		}
+	}
+	log.I.F("dropping namespace %s", name)
+	return d.dropPrefix(keyPrefix(name))
+}
+
+// closeNamespaces closes the open namespaces of the database.
+func (d *D) closeNamespaces() {
+	d.namespacesMx.Lock()
+	open := make([]*D, 0, len(d.namespaces))
+	for _, ns := range d.namespaces {
+		open = append(open, ns)
+	}
+	d.namespacesMx.Unlock()
+	for _, ns := range open {
+		chk.E(ns.Close())
+	}
+}
+
+// forget removes a closed namespace from those open in its parent.
+func (d *D) forget() {
+	if d.parent == nil {
+		return
+	}
+	d.parent.namespacesMx.Lock()
+	defer d.parent.namespacesMx.Unlock()
+	if d.parent.namespaces[d.namespace] == d {
+		delete(d.parent.namespaces, d.namespace)
+	}
+}
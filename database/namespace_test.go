@@ -0,0 +1,142 @@
+package database
+
+import (
+	"os"
+	"slices"
+	"testing"
+
+	"manifold.mleku.dev/filter"
+)
+
+// TestNamespaces tests that the events of namespaces sharing a badger database
+// are kept apart, counted and dropped on their own.
+func TestNamespaces(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifold-test-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	db := New()
+	if err = db.Init(tempDir); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+	events, err := generateTestEvents(9)
+	if err != nil {
+		t.Fatalf("Failed to generate test events: %v", err)
+	}
+	if _, err = db.Namespace("Bad:Name"); err == nil {
+		t.Errorf("Expected an error for an invalid namespace")
+	}
+	a, err := db.Namespace("app-a")
+	if err != nil {
+		t.Fatalf("Failed to open namespace: %v", err)
+	}
+	b, err := db.Namespace("app-b")
+	if err != nil {
+		t.Fatalf("Failed to open namespace: %v", err)
+	}
+	if again, _ := db.Namespace("app-a"); again != a {
+		t.Errorf("Expected the open namespace to be returned again")
+	}
+	// the first two events go to the root, the next three to a, and the rest
+	// to b, with event 8 in both
+	stores := []*D{db, db, a, a, a, b, b, b, b}
+	for i, ev := range events {
+		if err = stores[i].StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+	if err = a.StoreEvent(events[8]); err != nil {
+		t.Fatalf("Failed to store event: %v", err)
+	}
+	for _, tt := range []struct {
+		d        *D
+		expected int
+	}{{db, 2}, {a, 4}, {b, 4}} {
+		ids, err := tt.d.QueryEvents(filter.F{})
+		if err != nil {
+			t.Fatalf("Failed to query events: %v", err)
+		}
+		if len(ids) != tt.expected {
+			t.Errorf("Expected %d events, got %d", tt.expected, len(ids))
+		}
+	}
+	id, err := events[2].Id()
+	if err != nil {
+		t.Fatalf("Failed to get event ID: %v", err)
+	}
+	if _, err = b.GetEventById(id); err == nil {
+		t.Errorf("Expected event of namespace a not to be found in b")
+	}
+	names, err := db.Namespaces()
+	if err != nil {
+		t.Fatalf("Failed to list namespaces: %v", err)
+	}
+	if !slices.Equal(names, []string{"app-a", "app-b"}) {
+		t.Errorf("Expected namespaces app-a and app-b, got %v", names)
+	}
+	s, err := db.NamespaceStats("app-b")
+	if err != nil {
+		t.Fatalf("Failed to get namespace stats: %v", err)
+	}
+	if s.Events != 4 || s.Keys <= s.Events || s.Bytes == 0 {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+	if err = db.DropNamespace("app-b"); err != nil {
+		t.Fatalf("Failed to drop namespace: %v", err)
+	}
+	if s, err = db.NamespaceStats("app-b"); err != nil || s.Keys != 0 {
+		t.Errorf("Expected no keys left in the dropped namespace, got %d: %v", s.Keys, err)
+	}
+	if n, err := a.CountEvents(); err != nil || n != 4 {
+		t.Errorf("Expected 4 events left in namespace a, got %d: %v", n, err)
+	}
+	if n, err := db.CountEvents(); err != nil || n != 2 {
+		t.Errorf("Expected 2 events left in the root, got %d: %v", n, err)
+	}
+	// a dropped namespace is created again, empty, when it is opened
+	if b, err = db.Namespace("app-b"); err != nil {
+		t.Fatalf("Failed to reopen namespace: %v", err)
+	}
+	if n, err := b.CountEvents(); err != nil || n != 0 {
+		t.Errorf("Expected the reopened namespace to be empty, got %d: %v", n, err)
+	}
+}
+
+// TestNamespaceGC tests that a namespace takes the MaxSize of its database and
+// measures its own keys, so that GC evicts its events.
+func TestNamespaceGC(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifold-test-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	db := New()
+	if err = db.Init(tempDir); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+	events, err := generateTestEvents(10)
+	if err != nil {
+		t.Fatalf("Failed to generate test events: %v", err)
+	}
+	db.MaxSize = 1
+	ns, err := db.Namespace("app")
+	if err != nil {
+		t.Fatalf("Failed to open namespace: %v", err)
+	}
+	for _, ev := range events {
+		if err = ns.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+	if ns.MaxSize != db.MaxSize || ns.Size() == 0 {
+		t.Fatalf("Expected the namespace to have a MaxSize of %d and a size, got %d and %d",
+			db.MaxSize, ns.MaxSize, ns.Size())
+	}
+	if evicted, err := ns.GC(); err != nil || evicted != len(events) {
+		t.Errorf("Expected %d events evicted from the namespace, got %d: %v",
+			len(events), evicted, err)
+	}
+}
@@ -0,0 +1,107 @@
+package database
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/database/indexes/types/identhash"
+	"manifold.mleku.dev/database/indexes/types/number"
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+)
+
+func init() {
+	RegisterMigration(Migration{
+		From:        5,
+		Description: "index the numeric values of tags",
+		Run: func(d *D, progress func(done, total int)) (err error) {
+			return d.RebuildIndexes(progress, indexes.TagNumber)
+		},
+	})
+}
+
+// tagNumber parses a tag value as a decimal number. Values that are not finite
+// numbers are not indexed as numbers.
+func tagNumber(value []byte) (f float64, ok bool) {
+	var err error
+	if f, err = strconv.ParseFloat(string(value), 64); err != nil ||
+		math.IsInf(f, 0) || math.IsNaN(f) {
+		return
+	}
+	return f, true
+}
+
+// TagNumber returns the least numeric value of the tags of a key of an event,
+// which is the value that a SortTag of the key orders it by.
+func TagNumber(ev *event.E, key string) (n float64, ok bool) {
+	if ev.Tags == nil {
+		return
+	}
+	for _, t := range *ev.Tags {
+		if string(t.Key) != key {
+			continue
+		}
+		if v, isNumber := tagNumber(t.Value); isNumber && (!ok || v < n) {
+			n, ok = v, true
+		}
+	}
+	return
+}
+
+// scanTagNumber calls fn with the serial and value of every event with a tag
+// of a key whose numeric value is within a range, in the order of the values.
+func scanTagNumber(txn store.Txn, key string, r filter.Range,
+	fn func(ser *number.Uint40, value float64) (err error)) (err error) {
+
+	k := identhash.New()
+	if err = k.FromIdent([]byte(key)); chk.E(err) {
+		return
+	}
+	prf := new(bytes.Buffer)
+	if err = indexes.TagNumberEnc(k, nil, nil, nil).MarshalWrite(prf); chk.E(err) {
+		return
+	}
+	min := new(number.Uint64)
+	min.SetFloat(r.Min)
+	start := new(bytes.Buffer)
+	if err = indexes.TagNumberEnc(k, min, nil, nil).MarshalWrite(start); chk.E(err) {
+		return
+	}
+	it := txn.NewIterator(store.IteratorOptions{Prefix: prf.Bytes()})
+	defer it.Close()
+	for it.Seek(start.Bytes()); it.Valid(); it.Next() {
+		k, v, ts, ser := indexes.TagNumberVars()
+		if err = indexes.TagNumberDec(k, v, ts, ser).UnmarshalRead(bytes.NewBuffer(it.Key())); chk.E(err) {
+			return
+		}
+		if v.Float() > r.Max {
+			return
+		}
+		if err = fn(ser, v.Float()); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// tagRangeSerials returns the serials of the events that have, for every key
+// of ranges, a tag whose numeric value is within the range of the key.
+func (d *D) tagRangeSerials(txn store.Txn, ranges map[string]filter.Range) (found map[uint64]struct{}, err error) {
+	for key, r := range ranges {
+		matches := make(map[uint64]struct{})
+		if err = scanTagNumber(txn, key, r, func(ser *number.Uint40, _ float64) (err error) {
+			if _, ok := found[ser.Get()]; found == nil || ok {
+				matches[ser.Get()] = struct{}{}
+			}
+			return
+		}); err != nil {
+			return
+		}
+		found = matches
+	}
+	return
+}
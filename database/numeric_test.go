@@ -0,0 +1,106 @@
+package database
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"manifold.mleku.dev/database/store/memory"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+	"manifold.mleku.dev/p256k"
+)
+
+// TestTagRanges tests finding events by the numeric value of a tag and sorting
+// them by it.
+func TestTagRanges(t *testing.T) {
+	db := New()
+	if err := db.InitStore(memory.New()); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	signer := new(p256k.Signer)
+	if err := signer.Generate(); err != nil {
+		t.Fatalf("Failed to generate signer: %v", err)
+	}
+	tags := [][]string{
+		{"price", "10"},
+		{"price", "2.5", "size", "3"},
+		{"price", "-7"},
+		{"price", "100", "price", "1"},
+		{"price", "cheap"},
+		{"size", "12"},
+		{"price", "10"},
+	}
+	var ids [][]byte
+	for i, kv := range tags {
+		ev := &event.E{
+			Pubkey:    signer.Pub(),
+			Timestamp: time.Now().Add(time.Duration(i) * time.Minute).Unix(),
+			Content:   []byte("priced"),
+			Tags:      &event.Tags{},
+		}
+		for j := 0; j < len(kv); j += 2 {
+			*ev.Tags = append(*ev.Tags, event.Tag{Key: []byte(kv[j]), Value: []byte(kv[j+1])})
+		}
+		if err := ev.Sign(signer); err != nil {
+			t.Fatalf("Failed to sign event: %v", err)
+		}
+		if err := db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+		id, err := ev.Id()
+		if err != nil {
+			t.Fatalf("Failed to get event ID: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	inf := math.Inf(1)
+	tests := []struct {
+		name     string
+		f        filter.F
+		expected []int
+	}{
+		{"Range", filter.F{Ranges: map[string]filter.Range{
+			"price": {Min: 2, Max: 10}}}, []int{0, 1, 6}},
+		{"Negative", filter.F{Ranges: map[string]filter.Range{
+			"price": {Min: -inf, Max: 0}}}, []int{2}},
+		{"Decimal", filter.F{Ranges: map[string]filter.Range{
+			"price": {Min: 2.4, Max: 2.6}}}, []int{1}},
+		{"AnyValue", filter.F{Ranges: map[string]filter.Range{
+			"price": {Min: 50, Max: inf}}}, []int{3}},
+		{"Ranges", filter.F{Ranges: map[string]filter.Range{
+			"price": {Min: -inf, Max: inf}, "size": {Min: 0, Max: 5}}}, []int{1}},
+		{"Empty", filter.F{Ranges: map[string]filter.Range{
+			"price": {Min: 11, Max: 99}}}, nil},
+		{"SortTag", filter.F{SortTag: "price", Ranges: map[string]filter.Range{
+			"price": {Min: -inf, Max: inf}}}, []int{2, 3, 1, 0, 6}},
+		{"SortTagDesc", filter.F{SortTag: "price", Sort: "desc",
+			Ranges: map[string]filter.Range{"price": {Min: -inf, Max: inf}}},
+			[]int{6, 0, 1, 3, 2}},
+		{"SortTagMissing", filter.F{SortTag: "size",
+			Authors: [][]byte{signer.Pub()}}, []int{1, 5, 0, 2, 3, 4, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.f.Sort == "" {
+				tt.f.Sort = "asc"
+			}
+			results, err := db.QueryEvents(tt.f)
+			if err != nil {
+				t.Fatalf("Failed to query events: %v", err)
+			}
+			if len(results) != len(tt.expected) {
+				t.Fatalf("Expected %d results, got %d", len(tt.expected), len(results))
+			}
+			for i, n := range tt.expected {
+				if !bytes.Equal(results[i], ids[n]) {
+					t.Fatalf("Expected event %d as result %d", n, i)
+				}
+			}
+		})
+	}
+}
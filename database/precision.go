@@ -0,0 +1,122 @@
+package database
+
+import (
+	"bytes"
+	"time"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/database/indexes/types/number"
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/errorf"
+	"manifold.mleku.dev/filter"
+)
+
+func init() {
+	RegisterMigration(Migration{
+		From:        9,
+		Description: "index the nanoseconds of event timestamps",
+		Run: func(d *D, progress func(done, total int)) (err error) {
+			return d.RebuildIndexes(progress, indexes.Nanos)
+		},
+	})
+}
+
+// eventNanos reads the nanoseconds past the second of the timestamp of an
+// event, which are zero if it has none.
+func eventNanos(txn store.Txn, ser *number.Uint40) (ns int, err error) {
+	prf := new(bytes.Buffer)
+	if err = indexes.NanosEnc(ser, nil).MarshalWrite(prf); chk.E(err) {
+		return
+	}
+	it := txn.NewIterator(store.IteratorOptions{Prefix: prf.Bytes()})
+	defer it.Close()
+	it.Seek(prf.Bytes())
+	if !it.Valid() {
+		return
+	}
+	s, n := indexes.NanosVars()
+	if err = indexes.NanosDec(s, n).UnmarshalRead(bytes.NewBuffer(it.Key())); chk.E(err) {
+		return
+	}
+	ns = n.Int()
+	return
+}
+
+// GetNanosFromSerial returns the nanoseconds past the second of the timestamp
+// of the event with a serial.
+func (d *D) GetNanosFromSerial(ser *number.Uint40) (ns int, err error) {
+	err = d.View(func(txn store.Txn) (err error) {
+		ns, err = eventNanos(txn, ser)
+		return
+	})
+	return
+}
+
+// timeRange is the range of times of the events matching a filter, to the
+// nanosecond.
+type timeRange struct {
+	// since and until are true if the range is bounded below and above.
+	since, until bool
+	// sinceSec and untilSec are the seconds of the bounds, and sinceNs and
+	// untilNs the nanoseconds past them, which are the whole of the seconds if
+	// the Unit is seconds.
+	sinceSec, untilSec int64
+	sinceNs, untilNs   int
+}
+
+// timeBounds converts the Since and Until of a filter given in a finer Unit to
+// seconds for the index scans, and returns the range of times of the events.
+//
+// A Since or Until in the first second after the epoch has no whole seconds,
+// so the index scans are unbounded on that side, but the range still is.
+func timeBounds(f filter.F) (g filter.F, r timeRange, err error) {
+	g = f
+	r.since, r.sinceSec = f.Since != 0, f.Since
+	r.until, r.untilSec, r.untilNs = f.Until != 0, f.Until, int(time.Second)-1
+	var perSecond int64
+	switch f.Unit {
+	case "", "s":
+		return
+	case "ms":
+		perSecond = 1e3
+	case "ns":
+		perSecond = 1e9
+	default:
+		err = errorf.E("unknown time unit %q", f.Unit)
+		return
+	}
+	g.Unit = ""
+	// split a time into whole seconds, rounding down, and the units past them
+	split := func(v int64) (sec int64, ns int) {
+		sec, rem := v/perSecond, v%perSecond
+		if rem < 0 {
+			sec, rem = sec-1, rem+perSecond
+		}
+		return sec, int(rem * (1e9 / perSecond))
+	}
+	if r.since {
+		r.sinceSec, r.sinceNs = split(f.Since)
+		g.Since = r.sinceSec
+	}
+	if r.until {
+		r.untilSec, r.untilNs = split(f.Until)
+		// the last nanosecond of the unit
+		r.untilNs += int(1e9/perSecond) - 1
+		g.Until = r.untilSec
+	}
+	return
+}
+
+// needsNanos returns true if whether an event at a second is in the range
+// depends on the nanoseconds of its timestamp.
+func (r timeRange) needsNanos(ts int64) bool {
+	return (r.since && ts == r.sinceSec && r.sinceNs > 0) ||
+		(r.until && ts == r.untilSec && r.untilNs < int(time.Second)-1)
+}
+
+// contains returns true if a time is in the range.
+func (r timeRange) contains(ts int64, ns int) bool {
+	return !(r.since && (ts < r.sinceSec || (ts == r.sinceSec && ns < r.sinceNs))) &&
+		!(r.until && (ts > r.untilSec || (ts == r.untilSec && ns > r.untilNs)))
+}
@@ -0,0 +1,154 @@
+package database
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+	"manifold.mleku.dev/p256k"
+)
+
+// TestPrecision tests ordering and filtering events made within the same
+// second by the nanoseconds of their ns tag.
+func TestPrecision(t *testing.T) {
+	db := newMemoryDB(t)
+	defer db.Close()
+	signer := new(p256k.Signer)
+	if err := signer.Generate(); err != nil {
+		t.Fatalf("Failed to generate signer: %v", err)
+	}
+	// times are in order, and stored out of order so the serials are not
+	times := []time.Time{
+		time.Unix(1699999999, 999000000),
+		time.Unix(1700000000, 0),
+		time.Unix(1700000000, 1500000),
+		time.Unix(1700000000, 1500001),
+		time.Unix(1700000000, 250000000),
+		time.Unix(1700000001, 0),
+	}
+	events := make([]*event.E, len(times))
+	ids := make([][]byte, len(times))
+	for i, tm := range times {
+		events[i] = &event.E{Pubkey: signer.Pub(), Content: []byte("tick")}
+		events[i].SetTime(tm)
+		if err := events[i].Sign(signer); err != nil {
+			t.Fatalf("Failed to sign event: %v", err)
+		}
+		var err error
+		if ids[i], err = events[i].Id(); err != nil {
+			t.Fatalf("Failed to get event ID: %v", err)
+		}
+	}
+	for _, n := range []int{4, 2, 5, 0, 3, 1} {
+		if err := db.StoreEvent(events[n]); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+	tests := []struct {
+		name     string
+		f        filter.F
+		expected []int
+	}{
+		{"Ascending", filter.F{Sort: "asc"}, []int{0, 1, 2, 3, 4, 5}},
+		{"Descending", filter.F{Sort: "desc"}, []int{5, 4, 3, 2, 1, 0}},
+		{"Seconds", filter.F{Sort: "asc", Since: 1700000000, Until: 1700000000},
+			[]int{1, 2, 3, 4}},
+		{"SinceNanos", filter.F{Sort: "asc", Unit: "ns", Since: 1700000000001500001},
+			[]int{3, 4, 5}},
+		{"UntilNanos", filter.F{Sort: "asc", Unit: "ns", Until: 1700000000001500000},
+			[]int{0, 1, 2}},
+		{"SinceMillis", filter.F{Sort: "asc", Unit: "ms", Since: 1700000000002},
+			[]int{4, 5}},
+		{"UntilMillis", filter.F{Sort: "asc", Unit: "ms", Until: 1700000000001},
+			[]int{0, 1, 2, 3}},
+		{"OneMilli", filter.F{Sort: "asc", Unit: "ms", Since: 1700000000001,
+			Until: 1700000000001}, []int{2, 3}},
+		{"AuthorMillis", filter.F{Authors: [][]byte{signer.Pub()}, Sort: "desc", Unit: "ms",
+			Since: 1699999999999, Until: 1700000000000}, []int{1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := db.QueryEvents(tt.f)
+			if err != nil {
+				t.Fatalf("Failed to query events: %v", err)
+			}
+			if len(results) != len(tt.expected) {
+				t.Fatalf("Expected %d results, got %d", len(tt.expected), len(results))
+			}
+			for i, n := range tt.expected {
+				if !bytes.Equal(results[i], ids[n]) {
+					t.Fatalf("Expected event %d as result %d", n, i)
+				}
+			}
+			for n, ev := range events {
+				if m := Matches(tt.f, ev); m != bytes.Contains(bytes.Join(results, nil), ids[n]) {
+					t.Errorf("Event %d matches %v, not as found by query", n, m)
+				}
+			}
+		})
+	}
+	if _, err := db.QueryEvents(filter.F{Unit: "us"}); err == nil {
+		t.Errorf("Expected an error for an unknown unit")
+	}
+}
+
+func TestPrecisionEpoch(t *testing.T) {
+	db := newMemoryDB(t)
+	defer db.Close()
+	signer := new(p256k.Signer)
+	if err := signer.Generate(); err != nil {
+		t.Fatalf("Failed to generate signer: %v", err)
+	}
+	other := new(p256k.Signer)
+	if err := other.Generate(); err != nil {
+		t.Fatalf("Failed to generate signer: %v", err)
+	}
+	// the bounds in the first second after the epoch have no whole seconds
+	times := []time.Time{time.Unix(0, 1000000), time.Unix(0, 3000000), time.Unix(1, 0)}
+	ids := make([][]byte, len(times))
+	for i, tm := range times {
+		ev := &event.E{Pubkey: signer.Pub(), Content: []byte("tick")}
+		ev.SetTime(tm)
+		if err := ev.Sign(signer); err != nil {
+			t.Fatalf("Failed to sign event: %v", err)
+		}
+		var err error
+		if ids[i], err = ev.Id(); err != nil {
+			t.Fatalf("Failed to get event ID: %v", err)
+		}
+		if err = db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+	tests := []struct {
+		name     string
+		f        filter.F
+		expected []int
+	}{
+		{"SinceMillis", filter.F{Sort: "asc", Unit: "ms", Since: 2}, []int{1, 2}},
+		{"UntilMillis", filter.F{Sort: "asc", Unit: "ms", Until: 2}, []int{0}},
+		{"UntilNanos", filter.F{Sort: "asc", Unit: "ns", Until: 1}, nil},
+		{"NotAuthorsMillis", filter.F{Sort: "asc", Unit: "ms", Since: 2,
+			NotAuthors: [][]byte{other.Pub()}}, []int{1, 2}},
+		{"NotIdsMillis", filter.F{Sort: "asc", Unit: "ms", Until: 2,
+			NotIds: [][]byte{ids[1]}}, []int{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := db.QueryEvents(tt.f)
+			if err != nil {
+				t.Fatalf("Failed to query events: %v", err)
+			}
+			if len(results) != len(tt.expected) {
+				t.Fatalf("Expected %d results, got %d", len(tt.expected), len(results))
+			}
+			for i, n := range tt.expected {
+				if !bytes.Equal(results[i], ids[n]) {
+					t.Fatalf("Expected event %d as result %d", n, i)
+				}
+			}
+		})
+	}
+}
@@ -2,53 +2,153 @@ package database
 
 import (
 	"bytes"
-	"github.com/dgraph-io/badger/v4"
+	"math"
 	"sort"
+	"time"
 
 	"manifold.mleku.dev/chk"
 	"manifold.mleku.dev/database/indexes"
 	"manifold.mleku.dev/database/indexes/types/identhash"
 	"manifold.mleku.dev/database/indexes/types/number"
 	"manifold.mleku.dev/database/indexes/types/pubhash"
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/event"
 	"manifold.mleku.dev/filter"
 )
 
 // QueryEvents finds events that match the given filter and returns their IDs.
-// The results are sorted according to the Sort field in the filter.
+// The results are sorted according to the Sort field in the filter, and no more
+// than its Limit are returned. It returns ErrMigrating while schema migrations
+// are running.
 func (d *D) QueryEvents(f filter.F) (eventIds [][]byte, err error) {
+	eventIds, _, err = d.QueryEventsAt(f)
+	return
+}
+
+// QuerySorted finds the events matching a filter as QueryEvents does, and
+// returns them with their times and the values of the SortTag of the filter,
+// without recording their access. It returns ErrMigrating while schema migrations are
+// running.
+func (d *D) QuerySorted(f filter.F) (results []Result, err error) {
+	if err = d.migrated(); err != nil {
+		return
+	}
+	r := d.root()
+	r.replica.mx.RLock()
+	defer r.replica.mx.RUnlock()
+	start := time.Now()
+	defer func() { d.stats.queries.observe(time.Since(start)) }()
+	var found []result
+	if found, err = d.queryResults(f); err != nil {
+		return
+	}
+	if f.Limit > 0 && len(found) > f.Limit {
+		found = found[:f.Limit]
+	}
+	// the query reads the nanoseconds only of the events made in the same
+	// second as another of its results, but they order the events of others.
+	if err = d.View(func(txn store.Txn) (err error) {
+		for i := range found {
+			if found[i].ser == nil || found[i].Nanos != 0 {
+				continue
+			}
+			if found[i].Nanos, err = eventNanos(txn, found[i].ser); chk.E(err) {
+				return
+			}
+		}
+		return
+	}); err != nil {
+		return
+	}
+	results = make([]Result, len(found))
+	for i, res := range found {
+		results[i] = Result{Id: res.Id, Timestamp: res.Timestamp, Nanos: res.Nanos,
+			SortValue: res.sortValue}
+	}
+	return
+}
+
+// queryEventsLimit finds the events matching a filter, up to its Limit, and
+// records how long it took.
+func (d *D) queryEventsLimit(f filter.F) (eventIds [][]byte, err error) {
+	start := time.Now()
+	defer func() { d.stats.queries.observe(time.Since(start)) }()
+	if eventIds, err = d.queryEvents(f); err != nil {
+		return
+	}
+	if f.Limit > 0 && len(eventIds) > f.Limit {
+		eventIds = eventIds[:f.Limit]
+	}
+	return
+}
+
+func (d *D) queryEvents(f filter.F) (eventIds [][]byte, err error) {
+	var results []result
+	if results, err = d.queryResults(f); err != nil {
+		return
+	}
+	for _, r := range results {
+		eventIds = append(eventIds, r.Id)
+	}
+	return
+}
+
+// result is an event found by a query, with its serial, which is nil for the
+// events of a filter by Ids, as they are returned without being looked up.
+type result struct {
+	IdPubkeyTimestamp
+	ser *number.Uint40
+	// sortValue is the value of the SortTag of the filter, or NaN if the event
+	// has none.
+	sortValue float64
+}
+
+// queryResults finds the events matching a filter, in the order of the filter.
+func (d *D) queryResults(f filter.F) (results []result, err error) {
+	var trusted bool
+	if f, trusted, err = d.withinTrust(f); err != nil || !trusted {
+		return
+	}
+	var tr timeRange
+	if f, tr, err = timeBounds(f); chk.E(err) {
+		return
+	}
+	// restricted is true if the filter has fields that are matched by finding
+	// the set of events matching each of them, to intersect with the results
+	restricted := f.Search != "" || len(f.HasTags) > 0 || len(f.TagPrefixes) > 0 ||
+		len(f.Ranges) > 0 || f.Within != nil || f.Near != nil || len(f.References) > 0
+
 	// If specific IDs are provided, just return those (considering NotIds)
 	if len(f.Ids) > 0 {
-		// If NotIds is also specified, filter out those IDs
-		if len(f.NotIds) > 0 {
-			filteredIds := make([][]byte, 0, len(f.Ids))
-			for _, id := range f.Ids {
-				excluded := false
-				for _, notId := range f.NotIds {
-					if bytes.Equal(id, notId) {
-						excluded = true
-						break
-					}
-				}
-				if !excluded {
-					filteredIds = append(filteredIds, id)
+		for _, id := range f.Ids {
+			// If NotIds is also specified, filter out those IDs
+			excluded := false
+			for _, notId := range f.NotIds {
+				if bytes.Equal(id, notId) {
+					excluded = true
+					break
 				}
 			}
-			return filteredIds, nil
+			if !excluded {
+				results = append(results, result{IdPubkeyTimestamp: IdPubkeyTimestamp{Id: id},
+					sortValue: math.NaN()})
+			}
 		}
-		return f.Ids, nil
+		return results, nil
 	}
 
 	// If only NotIds is specified, we need to get all events and filter out those IDs
-	if len(f.NotIds) > 0 && len(f.Authors) == 0 && len(f.Tags) == 0 && len(f.NotAuthors) == 0 && len(f.NotTags) == 0 && f.Since <= 0 && f.Until <= 0 {
+	if len(f.NotIds) > 0 && len(f.Authors) == 0 && len(f.Tags) == 0 && len(f.NotAuthors) == 0 && len(f.NotTags) == 0 && !tr.since && !tr.until && !restricted {
 		// Get all event IDs
-		allEvents, err := d.QueryEvents(filter.F{})
+		allEvents, err := d.queryResults(filter.F{Sort: f.Sort, SortTag: f.SortTag})
 		if err != nil {
 			return nil, err
 		}
 
 		// Filter out the NotIds
-		filteredIds := make([][]byte, 0, len(allEvents))
-		for _, id := range allEvents {
+		filtered := make([]result, 0, len(allEvents))
+		for _, r := range allEvents {
+			id := r.Id
 			excluded := false
 			for _, notId := range f.NotIds {
 				if bytes.Equal(id, notId) {
@@ -57,23 +157,24 @@ func (d *D) QueryEvents(f filter.F) (eventIds [][]byte, err error) {
 				}
 			}
 			if !excluded {
-				filteredIds = append(filteredIds, id)
+				filtered = append(filtered, r)
 			}
 		}
-		return filteredIds, nil
+		return filtered, nil
 	}
 
 	// If only NotAuthors is specified, we need to get all events and filter out those from the specified authors
-	if len(f.NotAuthors) > 0 && len(f.Ids) == 0 && len(f.Authors) == 0 && len(f.Tags) == 0 && len(f.NotIds) == 0 && len(f.NotTags) == 0 && f.Since <= 0 && f.Until <= 0 {
+	if len(f.NotAuthors) > 0 && len(f.Ids) == 0 && len(f.Authors) == 0 && len(f.Tags) == 0 && len(f.NotIds) == 0 && len(f.NotTags) == 0 && !tr.since && !tr.until && !restricted {
 		// Get all events
-		allEvents, err := d.QueryEvents(filter.F{})
+		allEvents, err := d.queryResults(filter.F{Sort: f.Sort, SortTag: f.SortTag})
 		if err != nil {
 			return nil, err
 		}
 
 		// Filter out events from the NotAuthors
-		filteredIds := make([][]byte, 0, len(allEvents))
-		for _, id := range allEvents {
+		filtered := make([]result, 0, len(allEvents))
+		for _, r := range allEvents {
+			id := r.Id
 			// Get the event to check its author
 			event, err := d.GetEventById(id)
 			if err != nil {
@@ -88,23 +189,24 @@ func (d *D) QueryEvents(f filter.F) (eventIds [][]byte, err error) {
 				}
 			}
 			if !excluded {
-				filteredIds = append(filteredIds, id)
+				filtered = append(filtered, r)
 			}
 		}
-		return filteredIds, nil
+		return filtered, nil
 	}
 
 	// If only NotTags is specified, we need to get all events and filter out those with the specified tags
-	if len(f.NotTags) > 0 && len(f.Ids) == 0 && len(f.Authors) == 0 && len(f.Tags) == 0 && len(f.NotIds) == 0 && len(f.NotAuthors) == 0 && f.Since <= 0 && f.Until <= 0 {
+	if len(f.NotTags) > 0 && len(f.Ids) == 0 && len(f.Authors) == 0 && len(f.Tags) == 0 && len(f.NotIds) == 0 && len(f.NotAuthors) == 0 && !tr.since && !tr.until && !restricted {
 		// Get all events
-		allEvents, err := d.QueryEvents(filter.F{})
+		allEvents, err := d.queryResults(filter.F{Sort: f.Sort, SortTag: f.SortTag})
 		if err != nil {
 			return nil, err
 		}
 
 		// Filter out events with the NotTags
-		filteredIds := make([][]byte, 0, len(allEvents))
-		for _, id := range allEvents {
+		filtered := make([]result, 0, len(allEvents))
+		for _, r := range allEvents {
+			id := r.Id
 			// Get the event to check its tags
 			event, err := d.GetEventById(id)
 			if err != nil {
@@ -131,23 +233,24 @@ func (d *D) QueryEvents(f filter.F) (eventIds [][]byte, err error) {
 				}
 			}
 			if !excluded {
-				filteredIds = append(filteredIds, id)
+				filtered = append(filtered, r)
 			}
 		}
-		return filteredIds, nil
+		return filtered, nil
 	}
 
 	// If both NotAuthors and NotTags are specified, we need to get all events and filter out those that match either criteria
-	if len(f.NotAuthors) > 0 && len(f.NotTags) > 0 && len(f.Ids) == 0 && len(f.Authors) == 0 && len(f.Tags) == 0 && len(f.NotIds) == 0 && f.Since <= 0 && f.Until <= 0 {
+	if len(f.NotAuthors) > 0 && len(f.NotTags) > 0 && len(f.Ids) == 0 && len(f.Authors) == 0 && len(f.Tags) == 0 && len(f.NotIds) == 0 && !tr.since && !tr.until && !restricted {
 		// Get all events
-		allEvents, err := d.QueryEvents(filter.F{})
+		allEvents, err := d.queryResults(filter.F{Sort: f.Sort, SortTag: f.SortTag})
 		if err != nil {
 			return nil, err
 		}
 
 		// Filter out events that match either NotAuthors or NotTags
-		filteredIds := make([][]byte, 0, len(allEvents))
-		for _, id := range allEvents {
+		filtered := make([]result, 0, len(allEvents))
+		for _, r := range allEvents {
+			id := r.Id
 			// Get the event to check its author and tags
 			event, err := d.GetEventById(id)
 			if err != nil {
@@ -184,17 +287,70 @@ func (d *D) QueryEvents(f filter.F) (eventIds [][]byte, err error) {
 			}
 
 			if !excluded {
-				filteredIds = append(filteredIds, id)
+				filtered = append(filtered, r)
 			}
 		}
-		return filteredIds, nil
+		return filtered, nil
 	}
 
 	// Create a map to store unique event serials
 	eventSerials := make(map[uint64]struct{})
+	// restrict are the sets of events matching each of the restricting fields,
+	// and scores the relevance of the events to the search when sorting by
+	// relevance
+	var restrict []map[uint64]struct{}
+	var scores map[uint64]float64
 
 	// Use View transaction to read from the database
-	if err = d.View(func(txn *badger.Txn) (err error) {
+	if err = d.View(func(txn store.Txn) (err error) {
+		if f.Search != "" {
+			var found map[uint64]struct{}
+			var words map[string]map[uint64][]int
+			if found, words, err = d.search(txn, f.Search); chk.E(err) {
+				return
+			}
+			if f.Sort == "relevance" {
+				if scores, err = d.score(txn, found, words); chk.E(err) {
+					return
+				}
+			}
+			restrict = append(restrict, found)
+		}
+		if len(f.HasTags) > 0 {
+			var found map[uint64]struct{}
+			if found, err = d.tagKeySerials(txn, f.HasTags); chk.E(err) {
+				return
+			}
+			restrict = append(restrict, found)
+		}
+		if len(f.TagPrefixes) > 0 {
+			var found map[uint64]struct{}
+			if found, err = d.tagPrefixSerials(txn, f.TagPrefixes); chk.E(err) {
+				return
+			}
+			restrict = append(restrict, found)
+		}
+		if len(f.Ranges) > 0 {
+			var found map[uint64]struct{}
+			if found, err = d.tagRangeSerials(txn, f.Ranges); chk.E(err) {
+				return
+			}
+			restrict = append(restrict, found)
+		}
+		if f.Within != nil || f.Near != nil {
+			var found map[uint64]struct{}
+			if found, err = d.locationSerials(txn, f.Within, f.Near); chk.E(err) {
+				return
+			}
+			restrict = append(restrict, found)
+		}
+		if len(f.References) > 0 {
+			var found map[uint64]struct{}
+			if found, err = d.referenceSerials(txn, f.References); chk.E(err) {
+				return
+			}
+			restrict = append(restrict, found)
+		}
 		// If both authors and tags are specified, use the PubkeyTagTimestamp index
 		if len(f.Authors) > 0 && len(f.Tags) > 0 {
 			for _, author := range f.Authors {
@@ -217,13 +373,13 @@ func (d *D) QueryEvents(f filter.F) (eventIds [][]byte, err error) {
 						tsStart := new(number.Uint64)
 						tsEnd := new(number.Uint64)
 
-						if f.Since > 0 {
-							tsStart.Set(uint64(f.Since))
+						if f.Since != 0 {
+							tsStart.SetInt64(f.Since)
 						}
-						if f.Until > 0 {
-							tsEnd.Set(uint64(f.Until))
+						if f.Until != 0 {
+							tsEnd.SetInt64(f.Until)
 						} else {
-							tsEnd.Set(^uint64(0)) // Max value if Until not specified
+							tsEnd.SetInt64(math.MaxInt64) // Max value if Until not specified
 						}
 
 						// Create prefix for PubkeyTagTimestamp index
@@ -233,12 +389,11 @@ func (d *D) QueryEvents(f filter.F) (eventIds [][]byte, err error) {
 						}
 
 						// Iterate over events with this author and tag
-						it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix.Bytes()})
+						it := txn.NewIterator(store.IteratorOptions{Prefix: prefix.Bytes()})
 						defer it.Close()
 
 						for it.Seek(prefix.Bytes()); it.Valid(); it.Next() {
-							item := it.Item()
-							k := item.KeyCopy(nil)
+							k := it.Key()
 							buf := bytes.NewBuffer(k)
 
 							// Decode the key
@@ -248,9 +403,9 @@ func (d *D) QueryEvents(f filter.F) (eventIds [][]byte, err error) {
 							}
 
 							// Check timestamp range
-							tsValue := ts.Get()
-							if (f.Since <= 0 || int64(tsValue) >= f.Since) &&
-								(f.Until <= 0 || int64(tsValue) <= f.Until) {
+							tsValue := ts.Int64()
+							if (f.Since == 0 || tsValue >= f.Since) &&
+								(f.Until == 0 || tsValue <= f.Until) {
 								// Add to results
 								eventSerials[ser.Get()] = struct{}{}
 							}
@@ -270,13 +425,13 @@ func (d *D) QueryEvents(f filter.F) (eventIds [][]byte, err error) {
 				tsStart := new(number.Uint64)
 				tsEnd := new(number.Uint64)
 
-				if f.Since > 0 {
-					tsStart.Set(uint64(f.Since))
+				if f.Since != 0 {
+					tsStart.SetInt64(f.Since)
 				}
-				if f.Until > 0 {
-					tsEnd.Set(uint64(f.Until))
+				if f.Until != 0 {
+					tsEnd.SetInt64(f.Until)
 				} else {
-					tsEnd.Set(^uint64(0)) // Max value if Until not specified
+					tsEnd.SetInt64(math.MaxInt64) // Max value if Until not specified
 				}
 
 				// Create prefix for PubkeyTimestamp index
@@ -286,12 +441,11 @@ func (d *D) QueryEvents(f filter.F) (eventIds [][]byte, err error) {
 				}
 
 				// Iterate over events with this author
-				it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix.Bytes()})
+				it := txn.NewIterator(store.IteratorOptions{Prefix: prefix.Bytes()})
 				defer it.Close()
 
 				for it.Seek(prefix.Bytes()); it.Valid(); it.Next() {
-					item := it.Item()
-					k := item.KeyCopy(nil)
+					k := it.Key()
 					buf := bytes.NewBuffer(k)
 
 					// Decode the key
@@ -301,9 +455,9 @@ func (d *D) QueryEvents(f filter.F) (eventIds [][]byte, err error) {
 					}
 
 					// Check timestamp range
-					tsValue := ts.Get()
-					if (f.Since <= 0 || int64(tsValue) >= f.Since) &&
-						(f.Until <= 0 || int64(tsValue) <= f.Until) {
+					tsValue := ts.Int64()
+					if (f.Since == 0 || tsValue >= f.Since) &&
+						(f.Until == 0 || tsValue <= f.Until) {
 						// Add to results
 						eventSerials[ser.Get()] = struct{}{}
 					}
@@ -325,13 +479,13 @@ func (d *D) QueryEvents(f filter.F) (eventIds [][]byte, err error) {
 					tsStart := new(number.Uint64)
 					tsEnd := new(number.Uint64)
 
-					if f.Since > 0 {
-						tsStart.Set(uint64(f.Since))
+					if f.Since != 0 {
+						tsStart.SetInt64(f.Since)
 					}
-					if f.Until > 0 {
-						tsEnd.Set(uint64(f.Until))
+					if f.Until != 0 {
+						tsEnd.SetInt64(f.Until)
 					} else {
-						tsEnd.Set(^uint64(0)) // Max value if Until not specified
+						tsEnd.SetInt64(math.MaxInt64) // Max value if Until not specified
 					}
 
 					// Create prefix for TagTimestamp index
@@ -341,12 +495,11 @@ func (d *D) QueryEvents(f filter.F) (eventIds [][]byte, err error) {
 					}
 
 					// Iterate over events with this tag
-					it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix.Bytes()})
+					it := txn.NewIterator(store.IteratorOptions{Prefix: prefix.Bytes()})
 					defer it.Close()
 
 					for it.Seek(prefix.Bytes()); it.Valid(); it.Next() {
-						item := it.Item()
-						k := item.KeyCopy(nil)
+						k := it.Key()
 						buf := bytes.NewBuffer(k)
 
 						// Decode the key
@@ -356,42 +509,55 @@ func (d *D) QueryEvents(f filter.F) (eventIds [][]byte, err error) {
 						}
 
 						// Check timestamp range
-						tsValue := ts.Get()
-						if (f.Since <= 0 || int64(tsValue) >= f.Since) &&
-							(f.Until <= 0 || int64(tsValue) <= f.Until) {
+						tsValue := ts.Int64()
+						if (f.Since == 0 || tsValue >= f.Since) &&
+							(f.Until == 0 || tsValue <= f.Until) {
 							// Add to results
 							eventSerials[ser.Get()] = struct{}{}
 						}
 					}
 				}
 			}
-		} else if f.Since > 0 || f.Until > 0 {
+		} else if restricted {
+			// If only restricting fields are specified, the events matching
+			// the first of them are the candidates, limited to the others and
+			// the timestamp range below
+			for serial := range restrict[0] {
+				eventSerials[serial] = struct{}{}
+			}
+		} else if f.Since != 0 || f.Until != 0 {
 			// If only timestamp range is specified, use the Timestamp index
 			tsStart := new(number.Uint64)
 			tsEnd := new(number.Uint64)
 
-			if f.Since > 0 {
-				tsStart.Set(uint64(f.Since))
+			if f.Since != 0 {
+				tsStart.SetInt64(f.Since)
+			} else {
+				tsStart.SetInt64(math.MinInt64) // Min value if Since not specified
 			}
-			if f.Until > 0 {
-				tsEnd.Set(uint64(f.Until))
+			if f.Until != 0 {
+				tsEnd.SetInt64(f.Until)
 			} else {
-				tsEnd.Set(^uint64(0)) // Max value if Until not specified
+				tsEnd.SetInt64(math.MaxInt64) // Max value if Until not specified
 			}
 
-			// Create prefix for Timestamp index
+			// Create prefix for Timestamp index, and the key to start from
 			prefix := new(bytes.Buffer)
 			if err = indexes.TimestampEnc(nil, nil).MarshalWrite(prefix); chk.E(err) {
 				return
 			}
+			start := new(bytes.Buffer)
+			if err = indexes.TimestampEnc(tsStart, nil).MarshalWrite(start); chk.E(err) {
+				return
+			}
 
-			// Iterate over events in the timestamp range
-			it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix.Bytes()})
+			// Iterate over events in the timestamp range, which the
+			// encoding of the timestamps keeps in order
+			it := txn.NewIterator(store.IteratorOptions{Prefix: prefix.Bytes()})
 			defer it.Close()
 
-			for it.Seek(prefix.Bytes()); it.Valid(); it.Next() {
-				item := it.Item()
-				k := item.KeyCopy(nil)
+			for it.Seek(start.Bytes()); it.Valid(); it.Next() {
+				k := it.Key()
 				buf := bytes.NewBuffer(k)
 
 				// Decode the key
@@ -400,13 +566,11 @@ func (d *D) QueryEvents(f filter.F) (eventIds [][]byte, err error) {
 					return
 				}
 
-				// Check timestamp range
-				tsValue := ts.Get()
-				if (f.Since <= 0 || int64(tsValue) >= f.Since) &&
-					(f.Until <= 0 || int64(tsValue) <= f.Until) {
-					// Add to results
-					eventSerials[ser.Get()] = struct{}{}
+				// Stop past the end of the timestamp range
+				if ts.Int64() > tsEnd.Int64() {
+					break
 				}
+				eventSerials[ser.Get()] = struct{}{}
 			}
 		} else {
 			// If no specific criteria, use the Event index to get all events
@@ -416,12 +580,11 @@ func (d *D) QueryEvents(f filter.F) (eventIds [][]byte, err error) {
 			}
 
 			// Iterate over all events
-			it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix.Bytes()})
+			it := txn.NewIterator(store.IteratorOptions{Prefix: prefix.Bytes()})
 			defer it.Close()
 
 			for it.Seek(prefix.Bytes()); it.Valid(); it.Next() {
-				item := it.Item()
-				k := item.KeyCopy(nil)
+				k := it.Key()
 				buf := bytes.NewBuffer(k)
 
 				// Decode the key
@@ -446,49 +609,82 @@ func (d *D) QueryEvents(f filter.F) (eventIds [][]byte, err error) {
 		serials = append(serials, serial)
 	}
 
-	var ipt []IdPubkeyTimestamp
+	relevance := make(map[string]float64)
 	// Get event Id, Pubkey and Timestamps
-	for _, serial := range serials {
-		ser := new(number.Uint40)
-		if err = ser.Set(serial); chk.E(err) {
-			return nil, err
-		}
-
-		var item IdPubkeyTimestamp
-		if item.Id, item.Pubkey, item.Timestamp, err = d.GetIdPubkeyTimestampFromSerial(ser); chk.E(err) {
-			return nil, err
-		}
+	if err = d.View(func(txn store.Txn) (err error) {
+		for _, serial := range serials {
+			ser := new(number.Uint40)
+			if err = ser.Set(serial); chk.E(err) {
+				return err
+			}
 
-		// Skip events from authors in NotAuthors list
-		if len(f.NotAuthors) > 0 {
-			excluded := false
-			for _, notAuthor := range f.NotAuthors {
-				if bytes.Equal(item.Pubkey, notAuthor) {
-					excluded = true
+			// Skip events that do not match all the restricting fields
+			matched := true
+			for _, found := range restrict {
+				if _, matched = found[serial]; !matched {
 					break
 				}
 			}
-			if excluded {
+			if !matched {
 				continue
 			}
-		}
 
-		// Skip events with tags in NotTags list
-		if len(f.NotTags) > 0 {
-			// Get the full event to check its tags
-			event, err := d.GetEventById(item.Id)
-			if err != nil {
-				return nil, err
+			item := result{ser: ser, sortValue: math.NaN()}
+			if item.Id, item.Pubkey, item.Timestamp, err = d.GetIdPubkeyTimestampFromSerial(ser); chk.E(err) {
+				return err
 			}
 
-			excluded := false
-			// Only check tags if the event has tags
-			if event.Tags != nil {
-				for notTagKey, notTagValues := range f.NotTags {
-					for _, notTagValue := range notTagValues {
-						for _, tag := range *event.Tags {
-							if bytes.Equal(tag.Key, []byte(notTagKey)) && bytes.Equal(tag.Value, notTagValue) {
-								excluded = true
+			// Skip events outside the time range, which the index scans above
+			// have not applied to the restricting fields, reading the
+			// nanoseconds only at the seconds of sub-second bounds
+			if tr.needsNanos(item.Timestamp) {
+				if item.Nanos, err = eventNanos(txn, ser); chk.E(err) {
+					return err
+				}
+			}
+			if !tr.contains(item.Timestamp, item.Nanos) {
+				continue
+			}
+
+			// Skip events from authors in NotAuthors list, comparing the pubkey
+			// hashes, which is what the index holds
+			if len(f.NotAuthors) > 0 {
+				excluded := false
+				for _, notAuthor := range f.NotAuthors {
+					p := pubhash.New()
+					if err = p.FromPubkey(notAuthor); chk.E(err) {
+						return err
+					}
+					if bytes.Equal(item.Pubkey, p.Bytes()) {
+						excluded = true
+						break
+					}
+				}
+				if excluded {
+					continue
+				}
+			}
+
+			// Skip events with tags in NotTags list
+			if len(f.NotTags) > 0 {
+				// Get the full event to check its tags
+				event, err := d.GetEventById(item.Id)
+				if err != nil {
+					return err
+				}
+
+				excluded := false
+				// Only check tags if the event has tags
+				if event.Tags != nil {
+					for notTagKey, notTagValues := range f.NotTags {
+						for _, notTagValue := range notTagValues {
+							for _, tag := range *event.Tags {
+								if bytes.Equal(tag.Key, []byte(notTagKey)) && bytes.Equal(tag.Value, notTagValue) {
+									excluded = true
+									break
+								}
+							}
+							if excluded {
 								break
 							}
 						}
@@ -496,32 +692,88 @@ func (d *D) QueryEvents(f filter.F) (eventIds [][]byte, err error) {
 							break
 						}
 					}
-					if excluded {
-						break
-					}
+				}
+				if excluded {
+					continue
 				}
 			}
-			if excluded {
+
+			if scores != nil {
+				relevance[string(item.Id)] = scores[serial]
+			}
+			if f.SortTag != "" {
+				// the value is read from the event, rather than scanning the
+				// values of the tag of every event for those of the results
+				var ev *event.E
+				if ev, err = eventInTxn(txn, ser); chk.E(err) {
+					return err
+				}
+				if v, ok := TagNumber(ev, f.SortTag); ok {
+					item.sortValue = v
+				}
+			}
+			results = append(results, item)
+		}
+		// the nanoseconds are only needed to order the events made in the same
+		// second, so they are read for those that have not already had them
+		// read for the bounds
+		seconds := make(map[int64]int, len(results))
+		for _, item := range results {
+			seconds[item.Timestamp]++
+		}
+		for i := range results {
+			if seconds[results[i].Timestamp] < 2 || tr.needsNanos(results[i].Timestamp) {
 				continue
 			}
+			if results[i].Nanos, err = eventNanos(txn, results[i].ser); chk.E(err) {
+				return err
+			}
 		}
-
-		ipt = append(ipt, item)
+		return
+	}); chk.E(err) {
+		return nil, err
 	}
 
-	// Sort based on requested Sort in filter, on the event timestamp
-	if f.Sort == "desc" {
-		sort.Slice(ipt, func(i, j int) bool {
-			return ipt[i].Timestamp > ipt[j].Timestamp
+	// Sort based on requested Sort in filter, on the value of the SortTag, on
+	// the relevance to the search, most relevant first, or else on the event
+	// timestamp
+	if f.SortTag != "" {
+		// Sort on the value of the SortTag, with events without one last
+		sort.Slice(results, func(i, j int) bool {
+			vi, vj := results[i].sortValue, results[j].sortValue
+			switch {
+			case math.IsNaN(vi) || math.IsNaN(vj):
+				if math.IsNaN(vi) != math.IsNaN(vj) {
+					return math.IsNaN(vj)
+				}
+			case vi != vj:
+				if f.Sort == "desc" {
+					return vi > vj
+				}
+				return vi < vj
+			}
+			if f.Sort == "desc" {
+				return results[j].Before(results[i].IdPubkeyTimestamp)
+			}
+			return results[i].Before(results[j].IdPubkeyTimestamp)
+		})
+	} else if scores != nil {
+		sort.Slice(results, func(i, j int) bool {
+			ri, rj := relevance[string(results[i].Id)], relevance[string(results[j].Id)]
+			if ri != rj {
+				return ri > rj
+			}
+			return results[j].Before(results[i].IdPubkeyTimestamp)
+		})
+	} else if f.Sort == "desc" || f.Sort == "relevance" {
+		sort.Slice(results, func(i, j int) bool {
+			return results[j].Before(results[i].IdPubkeyTimestamp)
 		})
 	} else {
 		// Default to ascending order
-		sort.Slice(ipt, func(i, j int) bool {
-			return ipt[i].Timestamp < ipt[j].Timestamp
+		sort.Slice(results, func(i, j int) bool {
+			return results[i].Before(results[j].IdPubkeyTimestamp)
 		})
 	}
-	for _, v := range ipt {
-		eventIds = append(eventIds, v.Id)
-	}
-	return eventIds, nil
+	return results, nil
 }
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/store/memory"
 	"manifold.mleku.dev/event"
 	"manifold.mleku.dev/filter"
 	"manifold.mleku.dev/p256k"
@@ -29,7 +30,25 @@ func TestQueryEvents(t *testing.T) {
 	}
 	defer db.Close()
 
+	runQueryTests(t, db)
+}
+
+// TestQueryEventsMemory runs the QueryEvents tests on the in-memory store.
+func TestQueryEventsMemory(t *testing.T) {
+	db := New()
+	if err := db.InitStore(memory.New()); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	runQueryTests(t, db)
+}
+
+// runQueryTests stores a set of test events in db and runs the QueryEvents
+// tests on them.
+func runQueryTests(t *testing.T, db *D) {
 	// Generate test events
+	var err error
 	var events []*event.E
 	events, err = generateTestEvents(10)
 	if err != nil {
@@ -88,6 +107,10 @@ func TestQueryEvents(t *testing.T) {
 		testSortingDescending(t, db, events)
 	})
 
+	t.Run("Limit", func(t *testing.T) {
+		testLimit(t, db, events)
+	})
+
 	// Tests for negation features
 	t.Run("FilterByNotIds", func(t *testing.T) {
 		testFilterByNotIds(t, db, events)
@@ -104,6 +127,10 @@ func TestQueryEvents(t *testing.T) {
 	t.Run("FilterByCombinedNegations", func(t *testing.T) {
 		testFilterByCombinedNegations(t, db, events)
 	})
+
+	t.Run("FilterByTagsAndNotAuthors", func(t *testing.T) {
+		testFilterByTagsAndNotAuthors(t, db, events)
+	})
 }
 
 // generateTestEvents generates a set of test events with various properties.
@@ -748,6 +775,33 @@ func testSortingDescending(t *testing.T, db *D, events []*event.E) {
 	}
 }
 
+// testLimit tests that a Limit returns the first events in the order of Sort.
+func testLimit(t *testing.T, db *D, events []*event.E) {
+	all, err := db.QueryEvents(filter.F{Sort: "desc"})
+	if err != nil {
+		t.Fatalf("QueryEvents failed: %v", err)
+	}
+	result, err := db.QueryEvents(filter.F{Sort: "desc", Limit: 3})
+	if err != nil {
+		t.Fatalf("QueryEvents failed: %v", err)
+	}
+	if len(result) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(result))
+	}
+	for i := range result {
+		if !bytes.Equal(result[i], all[i]) {
+			t.Fatalf("Expected the newest events in order, differs at %d", i)
+		}
+	}
+	result, err = db.QueryEvents(filter.F{Limit: len(events) + 1})
+	if err != nil {
+		t.Fatalf("QueryEvents failed: %v", err)
+	}
+	if len(result) != len(events) {
+		t.Fatalf("Expected %d events, got %d", len(events), len(result))
+	}
+}
+
 // testFilterByNotIds tests filtering events by excluding specific IDs.
 func testFilterByNotIds(t *testing.T, db *D, events []*event.E) {
 	// Get all event IDs
@@ -833,6 +887,43 @@ func testFilterByNotAuthors(t *testing.T, db *D, events []*event.E) {
 	}
 }
 
+// testFilterByTagsAndNotAuthors tests excluding authors from the events found
+// by another field, which compares them with the pubkey hashes in the index
+// rather than with the events.
+func testFilterByTagsAndNotAuthors(t *testing.T, db *D, events []*event.E) {
+	notAuthor := events[0].Pubkey
+	f := filter.F{
+		Tags:       filter.TagMap{"type": {[]byte("text")}},
+		NotAuthors: [][]byte{notAuthor},
+	}
+
+	// Count the events with the tag that are not by the excluded author
+	expectedCount := 0
+	for _, ev := range events {
+		if !bytes.Equal(ev.Pubkey, notAuthor) &&
+			bytes.Equal(ev.Tags.GetFirst([]byte("type")).Value, []byte("text")) {
+			expectedCount++
+		}
+	}
+
+	result, err := db.QueryEvents(f)
+	if err != nil {
+		t.Fatalf("QueryEvents failed: %v", err)
+	}
+	if len(result) != expectedCount {
+		t.Fatalf("Expected %d events, got %d", expectedCount, len(result))
+	}
+	for _, id := range result {
+		ev, err := db.GetEventById(id)
+		if err != nil {
+			t.Fatalf("Failed to get event: %v", err)
+		}
+		if bytes.Equal(ev.Pubkey, notAuthor) {
+			t.Fatalf("Event from excluded author found in result")
+		}
+	}
+}
+
 // testFilterByNotTags tests filtering events by excluding specific tags.
 func testFilterByNotTags(t *testing.T, db *D, events []*event.E) {
 	// Create filter with NotTags
@@ -0,0 +1,65 @@
+package database
+
+import (
+	"bytes"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/database/indexes/types/idhash"
+	"manifold.mleku.dev/database/indexes/types/number"
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/errorf"
+	"manifold.mleku.dev/event"
+)
+
+func init() {
+	RegisterMigration(Migration{
+		From:        7,
+		Description: "index the references of tags to events and pubkeys",
+		Run: func(d *D, progress func(done, total int)) (err error) {
+			return d.RebuildIndexes(progress, indexes.Reference)
+		},
+	})
+	RegisterMigration(Migration{
+		From:        10,
+		Description: "index the references of binary tag values",
+		Run: func(d *D, progress func(done, total int)) (err error) {
+			return d.RebuildIndexes(progress, indexes.Reference)
+		},
+	})
+}
+
+// referenceSerials returns the serials of the events that have a tag that
+// refers to any of the event ids or pubkeys.
+func (d *D) referenceSerials(txn store.Txn, refs [][]byte) (found map[uint64]struct{}, err error) {
+	found = make(map[uint64]struct{})
+	for _, value := range refs {
+		ref, ok := event.Reference(value)
+		if !ok {
+			return nil, errorf.E("reference %q is not 32 bytes or their base64url encoding", value)
+		}
+		r := idhash.New()
+		if err = r.FromId(ref); chk.E(err) {
+			return
+		}
+		prf := new(bytes.Buffer)
+		if err = indexes.ReferenceEnc(r, nil, nil).MarshalWrite(prf); chk.E(err) {
+			return
+		}
+		if err = func() (err error) {
+			it := txn.NewIterator(store.IteratorOptions{Prefix: prf.Bytes()})
+			defer it.Close()
+			for it.Seek(prf.Bytes()); it.Valid(); it.Next() {
+				var ser *number.Uint40
+				if ser, err = indexes.SerialOf(it.Key()); chk.E(err) {
+					return
+				}
+				found[ser.Get()] = struct{}{}
+			}
+			return
+		}(); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,114 @@
+package database
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"manifold.mleku.dev/database/store/memory"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+	"manifold.mleku.dev/p256k"
+)
+
+// TestReferenceQueries tests finding the events that refer to an event or a
+// pubkey in tags of any key.
+func TestReferenceQueries(t *testing.T) {
+	db := New()
+	if err := db.InitStore(memory.New()); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	signers := make([]*p256k.Signer, 2)
+	for i := range signers {
+		signers[i] = new(p256k.Signer)
+		if err := signers[i].Generate(); err != nil {
+			t.Fatalf("Failed to generate signer: %v", err)
+		}
+	}
+	var ids [][]byte
+	// roundTrip stores events as read from their text encoding
+	var roundTrip bool
+	store := func(signer *p256k.Signer, tags ...event.Tag) {
+		ev := &event.E{
+			Pubkey:    signer.Pub(),
+			Timestamp: time.Now().Add(time.Duration(len(ids)) * time.Minute).Unix(),
+			Content:   []byte("referring"),
+			Tags:      &event.Tags{},
+		}
+		*ev.Tags = append(*ev.Tags, tags...)
+		if err := ev.Sign(signer); err != nil {
+			t.Fatalf("Failed to sign event: %v", err)
+		}
+		if roundTrip {
+			b, err := ev.Marshal()
+			if err != nil {
+				t.Fatalf("Failed to marshal event: %v", err)
+			}
+			ev = &event.E{}
+			if err = ev.Unmarshal(b); err != nil {
+				t.Fatalf("Failed to unmarshal event: %v", err)
+			}
+		}
+		if err := db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+		id, err := ev.Id()
+		if err != nil {
+			t.Fatalf("Failed to get event ID: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	store(signers[0])
+	store(signers[0], event.Tag{Key: []byte("e"), Value: []byte(b64(ids[0]))})
+	store(signers[1], event.Tag{Key: []byte("reply"), Value: ids[0]})
+	store(signers[1], event.Tag{Key: []byte("p"), Value: []byte(b64(signers[0].Pub()))})
+	store(signers[0], event.Tag{Key: []byte("q"), Value: []byte(strings.Repeat("!", 43))})
+	roundTrip = true
+	store(signers[1], event.Tag{Key: []byte("e"), Value: append(bytes.Clone(event.BinPrefix), ids[0]...)})
+
+	tests := []struct {
+		name     string
+		f        filter.F
+		expected []int
+	}{
+		{"Event", filter.F{References: [][]byte{ids[0]}}, []int{1, 2, 5}},
+		{"Base64", filter.F{References: [][]byte{[]byte(b64(ids[0]))}}, []int{1, 2, 5}},
+		{"Pubkey", filter.F{References: [][]byte{signers[0].Pub()}}, []int{3}},
+		{"Any", filter.F{References: [][]byte{ids[0], signers[0].Pub()}}, []int{1, 2, 3, 5}},
+		{"Unreferenced", filter.F{References: [][]byte{ids[4]}}, nil},
+		{"WithAuthor", filter.F{
+			Authors:    [][]byte{signers[1].Pub()},
+			References: [][]byte{ids[0]}}, []int{2, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.f.Sort = "asc"
+			results, err := db.QueryEvents(tt.f)
+			if err != nil {
+				t.Fatalf("Failed to query events: %v", err)
+			}
+			if len(results) != len(tt.expected) {
+				t.Fatalf("Expected %d results, got %d", len(tt.expected), len(results))
+			}
+			for i, n := range tt.expected {
+				if !bytes.Equal(results[i], ids[n]) {
+					t.Fatalf("Expected event %d as result %d", n, i)
+				}
+			}
+			for _, n := range tt.expected {
+				ev, err := db.GetEventById(ids[n])
+				if err != nil {
+					t.Fatalf("Failed to get event: %v", err)
+				}
+				if !Matches(tt.f, ev) {
+					t.Errorf("Expected event %d to match the filter", n)
+				}
+			}
+		})
+	}
+}
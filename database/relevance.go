@@ -0,0 +1,429 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/database/indexes/types/number"
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/errorf"
+	"manifold.mleku.dev/event"
+)
+
+func init() {
+	RegisterMigration(Migration{
+		From:        3,
+		Description: "record word frequencies and content lengths for search ranking",
+		Run: func(d *D, progress func(done, total int)) (err error) {
+			if err = d.RebuildIndexes(progress, indexes.ContentLength); chk.E(err) {
+				return
+			}
+			return d.RebuildWordFrequencies()
+		},
+	})
+}
+
+// fulltextStatsKey is the key under which the number of events with indexed
+// content, and the total number of their indexed words, are stored as two 8
+// byte big endian numbers. Writes of events add to one of fulltextStatsShards
+// keys, the prefix followed by a byte chosen by the event signature, so that
+// concurrent writes do not all conflict on one key; the totals are the sum of
+// the key and its shards.
+var fulltextStatsKey = []byte("FULLTEXT")
+
+const fulltextStatsShards = 16
+
+// maxConflictRetries is how many times a write that conflicts with a
+// concurrent one is tried before the conflict is returned.
+const maxConflictRetries = 10
+
+// The BM25 parameters: bm25K1 limits the weight of a word repeated in the
+// content, and bm25B is how much longer content is discounted.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// wordStats are the statistics of the indexed words of a set of events.
+type wordStats struct {
+	// df is the number of events containing each word.
+	df map[string]uint64
+	// docs is the number of events with indexed words, and words the total
+	// number of their indexed words.
+	docs, words uint64
+}
+
+func newWordStats() *wordStats { return &wordStats{df: make(map[string]uint64)} }
+
+// distinctWords returns the distinct indexed words of the content of an event
+// and the number of its indexed words.
+func distinctWords(ev *event.E) (distinct [][]byte, n int) {
+	ws := contentWords(ev)
+	seen := make(map[string]struct{})
+	for _, w := range ws {
+		if _, ok := seen[string(w.Text)]; !ok {
+			seen[string(w.Text)] = struct{}{}
+			distinct = append(distinct, w.Text)
+		}
+	}
+	return distinct, len(ws)
+}
+
+func (s *wordStats) add(ev *event.E) {
+	distinct, n := distinctWords(ev)
+	if n == 0 {
+		return
+	}
+	for _, w := range distinct {
+		s.df[string(w)]++
+	}
+	s.docs++
+	s.words += uint64(n)
+}
+
+func wordFrequencyKey(word []byte) (k []byte, err error) {
+	fw := indexes.WordFrequencyVars()
+	fw.FromWord(word)
+	b := new(bytes.Buffer)
+	if err = indexes.WordFrequencyEnc(fw).MarshalWrite(b); chk.E(err) {
+		return
+	}
+	k = b.Bytes()
+	return
+}
+
+func encodeCount(n uint64) (b []byte) {
+	return binary.BigEndian.AppendUint64(nil, n)
+}
+
+func decodeCount(b []byte) (n uint64, err error) {
+	if len(b) != 8 {
+		err = errorf.E("invalid count %0x", b)
+		return
+	}
+	n = binary.BigEndian.Uint64(b)
+	return
+}
+
+// getCount reads a count stored under key, which is zero if it is not found.
+func getCount(txn store.Txn, key []byte) (n uint64, err error) {
+	var val []byte
+	if val, err = txn.Get(key); err == store.ErrKeyNotFound {
+		err = nil
+		return
+	} else if chk.E(err) {
+		return
+	}
+	return decodeCount(val)
+}
+
+// fulltextStats reads the number of events with indexed content and the total
+// number of their words, summing the shards of the totals.
+func fulltextStats(txn store.Txn) (docs, words uint64, err error) {
+	var d, w int64
+	it := txn.NewIterator(store.IteratorOptions{Prefix: fulltextStatsKey})
+	defer it.Close()
+	for it.Seek(fulltextStatsKey); it.Valid(); it.Next() {
+		var val []byte
+		if val, err = it.Value(); chk.E(err) {
+			return
+		}
+		if len(val) != 16 {
+			err = errorf.E("invalid fulltext statistics %0x", val)
+			return
+		}
+		d += int64(binary.BigEndian.Uint64(val))
+		w += int64(binary.BigEndian.Uint64(val[8:]))
+	}
+	docs, words = uint64(max(d, 0)), uint64(max(w, 0))
+	return
+}
+
+func (s *wordStats) statsValue() []byte {
+	return binary.BigEndian.AppendUint64(encodeCount(s.docs), s.words)
+}
+
+// updateWordFrequencies adds an event to the word frequencies and totals when
+// it is stored, or with a negative delta, removes it when it is deleted.
+func updateWordFrequencies(txn store.Txn, ev *event.E, delta int64) (err error) {
+	distinct, n := distinctWords(ev)
+	if n == 0 {
+		return
+	}
+	add := func(v uint64, by int64) uint64 { return uint64(max(int64(v)+by, 0)) }
+	for _, w := range distinct {
+		var k []byte
+		if k, err = wordFrequencyKey(w); chk.E(err) {
+			return
+		}
+		var c uint64
+		if c, err = getCount(txn, k); chk.E(err) {
+			return
+		}
+		if c = add(c, delta); c == 0 {
+			err = txn.Delete(k)
+		} else {
+			err = txn.Set(k, encodeCount(c))
+		}
+		if chk.E(err) {
+			return
+		}
+	}
+	// the shards hold signed differences, as an event may be removed from
+	// the totals written by an earlier version as a single key.
+	var shard byte
+	if len(ev.Signature) > 0 {
+		shard = ev.Signature[0] % fulltextStatsShards
+	}
+	k := append(bytes.Clone(fulltextStatsKey), shard)
+	var val []byte
+	var docs, words int64
+	if val, err = txn.Get(k); err == store.ErrKeyNotFound {
+		err = nil
+	} else if chk.E(err) {
+		return
+	} else if len(val) != 16 {
+		err = errorf.E("invalid fulltext statistics %0x", val)
+		return
+	} else {
+		docs = int64(binary.BigEndian.Uint64(val))
+		words = int64(binary.BigEndian.Uint64(val[8:]))
+	}
+	docs, words = docs+delta, words+delta*int64(n)
+	return txn.Set(k, binary.BigEndian.AppendUint64(
+		binary.BigEndian.AppendUint64(nil, uint64(docs)), uint64(words)))
+}
+
+// updateWithWords runs fn in a transaction that also adds an event to the word
+// frequencies by delta, so that the counts change only if the event record
+// does. Concurrent writes of events sharing words conflict on the counts, and
+// are retried, so fn must be safe to run again.
+func (d *D) updateWithWords(ev *event.E, delta int64, fn func(txn store.Txn) (err error)) (err error) {
+	err = retryConflicts(func() error {
+		return d.store.Update(func(txn store.Txn) (err error) {
+			if err = fn(txn); err != nil {
+				return
+			}
+			return updateWordFrequencies(txn, ev, delta)
+		})
+	})
+	chk.E(err)
+	return
+}
+
+// retryConflicts runs fn again while it fails with store.ErrConflict, waiting
+// a random time that doubles after each try, up to maxConflictRetries tries.
+func retryConflicts(fn func() error) (err error) {
+	wait := time.Millisecond
+	for range maxConflictRetries {
+		if err = fn(); err != store.ErrConflict {
+			return
+		}
+		time.Sleep(wait/2 + rand.N(wait))
+		wait *= 2
+	}
+	return
+}
+
+// RebuildWordFrequencies counts the words of every stored event and replaces
+// the WordFrequency index and the totals used for search ranking with the
+// counts.
+func (d *D) RebuildWordFrequencies() (err error) {
+	s := newWordStats()
+	if err = d.ForEachEvent(func(_ *number.Uint40, ev *event.E) (err error) {
+		s.add(ev)
+		return
+	}); err != nil {
+		return
+	}
+	return d.writeWordStats(s)
+}
+
+func (d *D) writeWordStats(s *wordStats) (err error) {
+	if err = d.dropPrefix([]byte(indexes.Prefix(indexes.WordFrequency)),
+		fulltextStatsKey); chk.E(err) {
+		return
+	}
+	wb := d.store.NewWriteBatch()
+	defer wb.Cancel()
+	for w, c := range s.df {
+		var k []byte
+		if k, err = wordFrequencyKey([]byte(w)); chk.E(err) {
+			return
+		}
+		if err = wb.Set(k, encodeCount(c)); chk.E(err) {
+			return
+		}
+	}
+	if err = wb.Set(fulltextStatsKey, s.statsValue()); chk.E(err) {
+		return
+	}
+	return wb.Flush()
+}
+
+// checkWordStats compares the stored word frequencies and totals with those
+// counted from the events, and returns the number that differ.
+func checkWordStats(txn store.Txn, s *wordStats) (bad int, err error) {
+	seen := make(map[string]struct{})
+	prf := []byte(indexes.Prefix(indexes.WordFrequency))
+	it := txn.NewIterator(store.IteratorOptions{Prefix: prf})
+	defer it.Close()
+	for it.Seek(prf); it.Valid(); it.Next() {
+		fw := indexes.WordFrequencyVars()
+		if err = indexes.WordFrequencyDec(fw).UnmarshalRead(bytes.NewBuffer(it.Key())); chk.E(err) {
+			return
+		}
+		var val []byte
+		if val, err = it.Value(); chk.E(err) {
+			return
+		}
+		seen[string(fw.Bytes())] = struct{}{}
+		if c, derr := decodeCount(val); derr != nil || c != s.df[string(fw.Bytes())] {
+			bad++
+		}
+	}
+	for w := range s.df {
+		if _, ok := seen[w]; !ok {
+			bad++
+		}
+	}
+	var docs, words uint64
+	if docs, words, err = fulltextStats(txn); err != nil {
+		err = nil
+		bad++
+	} else if docs != s.docs || words != s.words {
+		bad++
+	}
+	return
+}
+
+// contentLength reads the number of indexed words of the content of an event.
+func contentLength(txn store.Txn, ser *number.Uint40) (n int, err error) {
+	prf := new(bytes.Buffer)
+	if err = indexes.ContentLengthEnc(ser, nil).MarshalWrite(prf); chk.E(err) {
+		return
+	}
+	it := txn.NewIterator(store.IteratorOptions{Prefix: prf.Bytes()})
+	defer it.Close()
+	it.Seek(prf.Bytes())
+	if !it.Valid() {
+		return
+	}
+	s, l := indexes.ContentLengthVars()
+	if err = indexes.ContentLengthDec(s, l).UnmarshalRead(bytes.NewBuffer(it.Key())); chk.E(err) {
+		return
+	}
+	n = l.Int()
+	return
+}
+
+// score computes the BM25 relevance of each event found by a search, from the
+// postings of the words of the search.
+func (d *D) score(txn store.Txn, found map[uint64]struct{}, words map[string]map[uint64][]int) (scores map[uint64]float64, err error) {
+	var docs, total uint64
+	if docs, total, err = fulltextStats(txn); chk.E(err) {
+		return
+	}
+	avg := float64(total) / float64(max(docs, 1))
+	idf := make(map[string]float64, len(words))
+	for w := range words {
+		var k []byte
+		if k, err = wordFrequencyKey([]byte(w)); chk.E(err) {
+			return
+		}
+		var df uint64
+		if df, err = getCount(txn, k); chk.E(err) {
+			return
+		}
+		idf[w] = math.Log(1 + max(0, (float64(docs)-float64(df)+0.5)/(float64(df)+0.5)))
+	}
+	scores = make(map[uint64]float64, len(found))
+	for serial := range found {
+		ser := new(number.Uint40)
+		if err = ser.Set(serial); chk.E(err) {
+			return
+		}
+		var l int
+		if l, err = contentLength(txn, ser); chk.E(err) {
+			return
+		}
+		norm := bm25K1 * (1 - bm25B + bm25B*float64(l)/max(avg, 1))
+		var s float64
+		for w, p := range words {
+			if tf := float64(len(p[serial])); tf > 0 {
+				s += idf[w] * tf * (bm25K1 + 1) / (tf + norm)
+			}
+		}
+		scores[serial] = s
+	}
+	return
+}
+
+// Snippet returns an extract of content of up to width words, placed to
+// include as many of the words of a search as it can, with each of them
+// enclosed between open and close, such as "<b>" and "</b>". An ellipsis
+// marks each end where the content is cut. Binary content has no snippet.
+func Snippet(content []byte, search string, width int, open, close string) (snippet string) {
+	if bytes.HasPrefix(content, event.BinPrefix) || width <= 0 {
+		return
+	}
+	terms := make(map[string]struct{})
+	for _, phrase := range parseSearch(search) {
+		for _, w := range phrase {
+			terms[string(w.Text)] = struct{}{}
+		}
+	}
+	ws := segment(content)
+	match := func(i int) bool {
+		_, ok := terms[string(ws[i].Text)]
+		return ok
+	}
+	// find the window of width words with the most matches.
+	var start, best, n int
+	for i := range ws {
+		if match(i) {
+			n++
+		}
+		if i >= width && match(i-width) {
+			n--
+		}
+		if n > best {
+			best, start = n, max(i-width+1, 0)
+		}
+	}
+	// leave some words of context before the first match.
+	for start > 0 && !match(start) {
+		start++
+	}
+	start = max(0, min(start-width/4, len(ws)-width))
+	end := min(start+width, len(ws))
+	b := new(strings.Builder)
+	from := 0
+	if start > 0 {
+		b.WriteString("…")
+		from = ws[start].Start
+	}
+	for i := start; i < end; i++ {
+		b.Write(content[from:ws[i].Start])
+		if match(i) {
+			b.WriteString(open)
+			b.Write(content[ws[i].Start:ws[i].End])
+			b.WriteString(close)
+		} else {
+			b.Write(content[ws[i].Start:ws[i].End])
+		}
+		from = ws[i].End
+	}
+	if end < len(ws) {
+		b.WriteString("…")
+	} else {
+		b.Write(content[from:])
+	}
+	return b.String()
+}
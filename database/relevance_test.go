@@ -0,0 +1,229 @@
+package database
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/database/store/memory"
+	"manifold.mleku.dev/errorf"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+	"manifold.mleku.dev/p256k"
+)
+
+// TestRelevance tests that search results sorted by relevance are in BM25
+// order, and that the word frequencies are kept and checked.
+func TestRelevance(t *testing.T) {
+	db := New()
+	if err := db.InitStore(memory.New()); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	signer := new(p256k.Signer)
+	if err := signer.Generate(); err != nil {
+		t.Fatalf("Failed to generate signer: %v", err)
+	}
+	contents := []string{
+		"apple banana",
+		"apple apple apple banana cherry",
+		"banana cherry date elderberry fig grape apple",
+		"cherry",
+	}
+	var ids [][]byte
+	for i, c := range contents {
+		ev := &event.E{
+			Pubkey:    signer.Pub(),
+			Timestamp: time.Now().Add(time.Duration(i) * time.Minute).Unix(),
+			Content:   []byte(c),
+		}
+		if err := ev.Sign(signer); err != nil {
+			t.Fatalf("Failed to sign event: %v", err)
+		}
+		if err := db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+		id, err := ev.Id()
+		if err != nil {
+			t.Fatalf("Failed to get event ID: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	results, err := db.QueryEvents(filter.F{Search: "apple", Sort: "relevance"})
+	if err != nil {
+		t.Fatalf("Failed to search: %v", err)
+	}
+	expected := []int{1, 0, 2}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %d results, got %d", len(expected), len(results))
+	}
+	for i, n := range expected {
+		if !bytes.Equal(results[i], ids[n]) {
+			t.Fatalf("Expected event %d as result %d", n, i)
+		}
+	}
+
+	check := func(bad int) {
+		t.Helper()
+		r, err := db.Check(false)
+		if err != nil {
+			t.Fatalf("Check failed: %v", err)
+		}
+		if r.BadStatistics != bad {
+			t.Fatalf("Expected %d bad statistics, got\n%s", bad, r)
+		}
+	}
+	check(0)
+	if err = db.DeleteEventById(ids[1]); err != nil {
+		t.Fatalf("Failed to delete event: %v", err)
+	}
+	check(0)
+	// corrupt the frequency of one word
+	var k []byte
+	if k, err = wordFrequencyKey([]byte("banana")); err != nil {
+		t.Fatalf("Failed to encode key: %v", err)
+	}
+	if err = db.Set(k, encodeCount(7)); err != nil {
+		t.Fatalf("Failed to write count: %v", err)
+	}
+	check(1)
+	if _, err = db.Check(true); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	check(0)
+	if err = db.View(func(txn store.Txn) (err error) {
+		var c uint64
+		if c, err = getCount(txn, k); err != nil {
+			return
+		}
+		if c != 2 {
+			t.Fatalf("Expected repaired count of 2, got %d", c)
+		}
+		return
+	}); err != nil {
+		t.Fatalf("View failed: %v", err)
+	}
+}
+
+// TestSnippet tests that snippets are cut around the matching words and
+// highlight them.
+func TestSnippet(t *testing.T) {
+	content := []byte("The quick brown fox jumps over the lazy dog and runs far away from the hunter.")
+	tests := []struct {
+		search   string
+		width    int
+		expected string
+	}{
+		{"lazy", 5, "…the <b>lazy</b> dog and runs…"},
+		{"QUICK", 4, "The <b>quick</b> brown fox…"},
+		{"hunter", 4, "…away from the <b>hunter</b>."},
+		{`"fox jumps" dog`, 7, "…brown <b>fox</b> <b>jumps</b> over the lazy <b>dog</b>…"},
+		{"absent", 3, "The quick brown…"},
+	}
+	for _, tt := range tests {
+		if got := Snippet(content, tt.search, tt.width, "<b>", "</b>"); got != tt.expected {
+			t.Fatalf("Expected snippet %q for %q, got %q", tt.expected, tt.search, got)
+		}
+	}
+}
+
+// TestWordFrequenciesAtomic tests that the word frequencies are written in the
+// transaction of the event record, so that they do not change if it fails.
+func TestWordFrequenciesAtomic(t *testing.T) {
+	db := newMemoryDB(t)
+	defer db.Close()
+	events, err := generateTestEvents(2)
+	if err != nil {
+		t.Fatalf("Failed to generate test events: %v", err)
+	}
+	if err = db.StoreEvent(events[0]); err != nil {
+		t.Fatalf("Failed to store event: %v", err)
+	}
+	stats := func() (docs, words uint64) {
+		if err := db.View(func(txn store.Txn) (err error) {
+			docs, words, err = fulltextStats(txn)
+			return
+		}); err != nil {
+			t.Fatalf("Failed to read word statistics: %v", err)
+		}
+		return
+	}
+	docs, words := stats()
+	failed := errorf.E("failed to write event")
+	if err = db.updateWithWords(events[1], 1, func(txn store.Txn) (err error) {
+		return failed
+	}); err != failed {
+		t.Fatalf("Expected the error of the event write, got %v", err)
+	}
+	if d, w := stats(); d != docs || w != words {
+		t.Errorf("Expected %d documents and %d words after a failed write, got %d and %d",
+			docs, words, d, w)
+	}
+	if err = db.StoreEvent(events[1]); err != nil {
+		t.Fatalf("Failed to store event: %v", err)
+	}
+	if d, _ := stats(); d != docs+1 {
+		t.Errorf("Expected %d documents, got %d", docs+1, d)
+	}
+}
+
+// TestWordFrequenciesConcurrent tests that events sharing words can be stored
+// concurrently in a store that detects conflicts, and that the word statistics
+// count all of them.
+func TestWordFrequenciesConcurrent(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifold-test-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	db := New()
+	if err = db.Init(tempDir); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+	events, err := generateTestEvents(64)
+	if err != nil {
+		t.Fatalf("Failed to generate test events: %v", err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, len(events))
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := w; i < len(events); i += 8 {
+				if err := db.StoreEvent(events[i]); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err = range errs {
+		t.Errorf("Failed to store event: %v", err)
+	}
+	var docs uint64
+	if err = db.View(func(txn store.Txn) (err error) {
+		docs, _, err = fulltextStats(txn)
+		return
+	}); err != nil {
+		t.Fatalf("Failed to read word statistics: %v", err)
+	}
+	if docs != uint64(len(events)) {
+		t.Errorf("Expected %d documents, got %d", len(events), docs)
+	}
+	r, err := db.Check(false)
+	if err != nil {
+		t.Fatalf("Failed to check the database: %v", err)
+	}
+	if !r.Ok() {
+		t.Errorf("Expected a consistent database, got %+v", r)
+	}
+}
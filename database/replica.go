@@ -0,0 +1,506 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4/pb"
+	"google.golang.org/protobuf/proto"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/errorf"
+	"manifold.mleku.dev/filter"
+	"manifold.mleku.dev/log"
+)
+
+// ErrReplica is returned by the writes to a database that is following a
+// primary as a read replica.
+var ErrReplica = errors.New("database is a read replica")
+
+// replicaKey is the key of the position of the primary that a replica has
+// applied the changes up to. It is not replicated.
+var replicaKey = []byte("REPLICA")
+
+// dropsKey is the key of the count of the drops of prefixes from the database.
+// A drop deletes keys without leaving their deletions in the changes taken by
+// replicas, so it is counted, and a replica that sees the count change takes
+// the whole of the primary again.
+var dropsKey = []byte("DROPS")
+
+// discardKey is the key of the position of the primary from which it keeps the
+// deletions of keys for the Changes of its replicas. It is not replicated.
+var discardKey = []byte("DISCARD")
+
+// ErrResync is returned by Changes for a position before the deletions the
+// primary keeps, as those after it may have been discarded by compaction. The
+// replica takes the whole of the primary again.
+var ErrResync = errors.New("changes after the position are no longer kept")
+
+// badgerDeleted is the bit of the meta of a key in a badger backup that marks
+// it deleted.
+const badgerDeleted = 1 << 0
+
+// Primary is a database that a read replica takes the changes of.
+type Primary interface {
+	// Changes writes the changes made to the database after a position, in the
+	// badger backup format, and returns the position they reach.
+	Changes(w io.Writer, since uint64) (next uint64, err error)
+}
+
+// ReplicationStatus is how far a read replica has followed its primary.
+type ReplicationStatus struct {
+	// Following is true while the database is a read replica.
+	Following bool
+	// Position is the position of the primary that the replica has applied
+	// the changes up to, so that its queries return what those of the primary
+	// did at that position.
+	Position uint64
+	// Synced is when the primary was at Position, and Lag how long ago that
+	// is, which is the most the replica is behind.
+	Synced time.Time
+	Lag    time.Duration
+	// Err is the error of the last attempt to take changes from the primary,
+	// if it failed.
+	Err error
+}
+
+// replica is the state of a database following a primary.
+type replica struct {
+	// mx is held for writing while a round of changes is applied, and for
+	// reading by queries, so that they see the database at a position of the
+	// primary.
+	mx        sync.RWMutex
+	statusMx  sync.Mutex
+	status    ReplicationStatus
+	following bool
+	stop      context.CancelFunc
+	done      chan struct{}
+}
+
+// Changes writes the keys written and deleted after a position of the database
+// to w, in the badger backup format, and returns the position they reach,
+// which replicas pass back as since to take the next changes. The position is
+// the badger version, so a since of zero writes the whole database. A since
+// before the deletions that are kept returns ErrResync.
+func (d *D) Changes(w io.Writer, since uint64) (next uint64, err error) {
+	if d.bdb == nil {
+		err = errorf.E("replication is only supported by the badger store")
+		return
+	}
+	if since > 0 && since < d.retention.discarded() {
+		err = ErrResync
+		return
+	}
+	// the backup is of a snapshot taken after this, which has every change up
+	// to the last version it contains or to this, whichever is greater.
+	before := d.bdb.MaxVersion()
+	if next, err = d.bdb.Backup(w, since); chk.E(err) {
+		return
+	}
+	next = max(next, before)
+	return
+}
+
+// ReplicationHandler returns an HTTP handler that serves the Changes of the
+// database after the position in the since query parameter, with the position
+// they reach in the Position trailer, for an HTTPPrimary.
+func (d *D) ReplicationHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var since uint64
+		if s := r.URL.Query().Get("since"); s != "" {
+			var err error
+			if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+				http.Error(w, "invalid since: "+s, http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Trailer", "Position")
+		next, err := d.Changes(w, since)
+		if err == ErrResync {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		} else if chk.E(err) {
+			// the status is sent already, so the missing trailer fails it
+			return
+		}
+		w.Header().Set("Position", strconv.FormatUint(next, 10))
+	})
+}
+
+// HTTPPrimary is a Primary served by a ReplicationHandler at URL.
+type HTTPPrimary struct {
+	URL string
+	// Client makes the requests, or http.DefaultClient if it is nil.
+	Client *http.Client
+}
+
+// Changes requests the changes after a position from the primary.
+func (p *HTTPPrimary) Changes(w io.Writer, since uint64) (next uint64, err error) {
+	var u *url.URL
+	if u, err = url.Parse(p.URL); chk.E(err) {
+		return
+	}
+	q := u.Query()
+	q.Set("since", strconv.FormatUint(since, 10))
+	u.RawQuery = q.Encode()
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	var resp *http.Response
+	if resp, err = client.Get(u.String()); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		err = ErrResync
+		return
+	} else if resp.StatusCode != http.StatusOK {
+		err = errorf.E("primary %s returned %s", p.URL, resp.Status)
+		return
+	}
+	if _, err = io.Copy(w, resp.Body); err != nil {
+		return
+	}
+	if next, err = strconv.ParseUint(resp.Trailer.Get("Position"), 10, 64); err != nil {
+		err = errorf.E("primary %s did not finish sending changes", p.URL)
+	}
+	return
+}
+
+// dropPrefix deletes every key that starts with any of the prefixes, and
+// counts the drop in the database a namespace is in, for its replicas.
+func (d *D) dropPrefix(prefixes ...[]byte) (err error) {
+	if err = d.store.DropPrefix(prefixes...); chk.E(err) {
+		return
+	}
+	// concurrent drops conflict, and are retried.
+	return retryConflicts(func() error {
+		return d.root().store.Update(func(txn store.Txn) (err error) {
+			var drops uint64
+			var val []byte
+			if val, err = txn.Get(dropsKey); err == nil && len(val) == 8 {
+				drops = binary.BigEndian.Uint64(val)
+			} else if err != nil && err != store.ErrKeyNotFound {
+				return
+			}
+			return txn.Set(dropsKey, binary.BigEndian.AppendUint64(nil, drops+1))
+		})
+	})
+}
+
+// root returns the database that a namespace is in, or the database itself.
+func (d *D) root() *D {
+	for d.parent != nil {
+		d = d.parent
+	}
+	return d
+}
+
+// writable returns ErrReplica if the database, or the database a namespace is
+// in, is a read replica.
+func (d *D) writable() (err error) {
+	r := d.root()
+	r.replica.statusMx.Lock()
+	defer r.replica.statusMx.Unlock()
+	if r.replica.following {
+		return ErrReplica
+	}
+	return
+}
+
+// Follow makes the database a read replica of a primary, which takes the
+// changes of the primary every interval, from the position it last reached,
+// until the database is promoted or closed. Writes return ErrReplica, and the
+// changes taken are not sent to the subscribers of the change feed.
+//
+// A replica should start from an empty database, which is filled with the
+// whole of the primary at first. The changes of each round are applied
+// together, while queries wait, so that they see the database as the primary
+// was at a position. After the primary drops keys, as migrations, DropView and
+// DropNamespace do, or once the replica is further behind than the Retention of
+// the primary, the replica is emptied and takes the whole of it again.
+func (d *D) Follow(p Primary, interval time.Duration) (err error) {
+	if d.parent != nil {
+		return errorf.E("namespace %s is replicated with its database", d.namespace)
+	}
+	var position uint64
+	if err = d.View(func(txn store.Txn) (err error) {
+		var val []byte
+		if val, err = txn.Get(replicaKey); err == store.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return
+		}
+		if len(val) == 8 {
+			position = binary.BigEndian.Uint64(val)
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	d.replica.statusMx.Lock()
+	defer d.replica.statusMx.Unlock()
+	if d.replica.following {
+		return errorf.E("database is already following a primary")
+	}
+	ctx, stop := context.WithCancel(d.ctx)
+	d.replica.following, d.replica.stop, d.replica.done = true, stop, make(chan struct{})
+	d.replica.status = ReplicationStatus{Following: true, Position: position}
+	log.I.F("following primary from position %d", position)
+	d.workers.Add(1)
+	go d.follow(ctx, p, interval, d.replica.done)
+	return
+}
+
+func (d *D) follow(ctx context.Context, p Primary, interval time.Duration, done chan struct{}) {
+	defer d.workers.Done()
+	defer close(done)
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		err := d.syncReplica(ctx, p)
+		if err != nil && ctx.Err() == nil {
+			log.W.F("failed to take changes from primary: %v", err)
+		}
+		d.replica.statusMx.Lock()
+		d.replica.status.Err = err
+		d.replica.statusMx.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// syncReplica takes the changes of the primary after the position of the
+// replica into a temporary file, and applies them once they are all there.
+func (d *D) syncReplica(ctx context.Context, p Primary) (err error) {
+	d.replica.statusMx.Lock()
+	position := d.replica.status.Position
+	d.replica.statusMx.Unlock()
+	var f *os.File
+	if f, err = os.CreateTemp("", "manifold-replica-*"); chk.E(err) {
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	started := time.Now()
+	var next uint64
+	// a change at the position itself is taken again if the primary sends it,
+	// which writes what it did before.
+	var resync bool
+	if next, err = p.Changes(f, position); err == ErrResync {
+		resync, err = true, nil
+	} else if err != nil {
+		return
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if _, err = f.Seek(0, io.SeekStart); chk.E(err) {
+		return
+	}
+	// the keys dropped by the primary, and the deletions it no longer keeps,
+	// are not in the changes, so after a drop, or once the replica is too far
+	// behind, the whole of the primary is taken into the emptied replica.
+	if position > 0 && !resync {
+		if resync, err = d.dropped(f); chk.E(err) {
+			return
+		}
+	}
+	if resync {
+		log.I.F("primary dropped or discarded keys after position %d, taking all of it again",
+			position)
+		if err = f.Truncate(0); chk.E(err) {
+			return
+		}
+		if _, err = f.Seek(0, io.SeekStart); chk.E(err) {
+			return
+		}
+		if next, err = p.Changes(f, 0); err != nil {
+			return
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	if _, err = f.Seek(0, io.SeekStart); chk.E(err) {
+		return
+	}
+	d.replica.mx.Lock()
+	defer d.replica.mx.Unlock()
+	if resync {
+		// every key starts with one of the bytes
+		prefixes := make([][]byte, 256)
+		for i := range prefixes {
+			prefixes[i] = []byte{byte(i)}
+		}
+		if err = d.store.DropPrefix(prefixes...); chk.E(err) {
+			return
+		}
+	}
+	var n int
+	if n, err = d.applyChanges(f, next); chk.E(err) {
+		return
+	}
+	if n > 0 {
+		log.D.F("applied %d changes from primary, at position %d", n, next)
+	}
+	d.replica.statusMx.Lock()
+	d.replica.status.Position = max(position, next)
+	d.replica.status.Synced = started
+	d.replica.statusMx.Unlock()
+	return
+}
+
+// readChanges calls fn with the newest version of each key in changes in the
+// badger backup format, except the position of a replica and the position of
+// the deletions kept by the primary.
+func readChanges(r io.Reader, fn func(kv *pb.KV) (err error)) (err error) {
+	br := bufio.NewReader(r)
+	for {
+		var size uint64
+		if err = binary.Read(br, binary.LittleEndian, &size); err == io.EOF {
+			return nil
+		} else if chk.E(err) {
+			return
+		}
+		buf := make([]byte, size)
+		if _, err = io.ReadFull(br, buf); chk.E(err) {
+			return
+		}
+		list := &pb.KVList{}
+		if err = proto.Unmarshal(buf, list); chk.E(err) {
+			return
+		}
+		// the versions of a key come together, newest first
+		var last []byte
+		for _, kv := range list.Kv {
+			if bytes.Equal(kv.Key, last) || bytes.Equal(kv.Key, replicaKey) ||
+				bytes.Equal(kv.Key, discardKey) {
+				continue
+			}
+			last = kv.Key
+			if err = fn(kv); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// dropped returns true if changes have a count of drops other than that of the
+// replica, which a change taken again at the position of the replica does not.
+func (d *D) dropped(r io.Reader) (dropped bool, err error) {
+	var drops []byte
+	if err = d.View(func(txn store.Txn) (err error) {
+		if drops, err = txn.Get(dropsKey); err == store.ErrKeyNotFound {
+			err = nil
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	err = readChanges(r, func(kv *pb.KV) (err error) {
+		if bytes.Equal(kv.Key, dropsKey) && !bytes.Equal(kv.Value, drops) {
+			dropped = true
+		}
+		return
+	})
+	return
+}
+
+// applyChanges writes the newest version of each key in changes in the badger
+// backup format to the store, and then the position they reach.
+func (d *D) applyChanges(r io.Reader, next uint64) (n int, err error) {
+	wb := d.store.NewWriteBatch()
+	defer wb.Cancel()
+	if err = readChanges(r, func(kv *pb.KV) (err error) {
+		if len(kv.Meta) > 0 && kv.Meta[0]&badgerDeleted != 0 {
+			err = wb.Delete(kv.Key)
+		} else {
+			err = wb.Set(kv.Key, kv.Value)
+		}
+		if chk.E(err) {
+			return
+		}
+		n++
+		return
+	}); err != nil {
+		return
+	}
+	if err = wb.Flush(); chk.E(err) {
+		return
+	}
+	return n, d.Set(replicaKey, binary.BigEndian.AppendUint64(nil, next))
+}
+
+// ReplicationStatus returns how far the database has followed its primary.
+func (d *D) ReplicationStatus() (s ReplicationStatus) {
+	d.replica.statusMx.Lock()
+	defer d.replica.statusMx.Unlock()
+	s = d.replica.status
+	if s.Following && !s.Synced.IsZero() {
+		s.Lag = time.Since(s.Synced)
+	}
+	return
+}
+
+// QueryEventsAt returns the events matching a filter as QueryEvents does, and
+// on a read replica, the position of the primary whose QueryEvents returns the
+// same. It returns ErrMigrating while schema migrations are running.
+func (d *D) QueryEventsAt(f filter.F) (eventIds [][]byte, position uint64, err error) {
+	if err = d.migrated(); err != nil {
+		return
+	}
+	r := d.root()
+	r.replica.mx.RLock()
+	defer r.replica.mx.RUnlock()
+	position = r.ReplicationStatus().Position
+	eventIds, err = d.queryEventsLimit(f)
+	return
+}
+
+// Promote stops a read replica following its primary and makes it take writes,
+// as the primary for other replicas.
+func (d *D) Promote() (err error) {
+	d.replica.statusMx.Lock()
+	if !d.replica.following {
+		d.replica.statusMx.Unlock()
+		return errorf.E("database is not following a primary")
+	}
+	stop, done := d.replica.stop, d.replica.done
+	d.replica.statusMx.Unlock()
+	stop()
+	<-done
+	d.replica.mx.Lock()
+	defer d.replica.mx.Unlock()
+	// the serials continue from the sequence taken from the primary; the lease
+	// the replica took when it was opened is dropped without being released, as
+	// releasing it would rewind the sequence.
+	if d.seq, err = d.store.GetSequence(sequenceKey, sequenceBandwidth); chk.E(err) {
+		return
+	}
+	if err = d.Delete(replicaKey); chk.E(err) {
+		return
+	}
+	d.replica.statusMx.Lock()
+	defer d.replica.statusMx.Unlock()
+	d.replica.following = false
+	d.replica.status.Following = false
+	log.I.F("promoted to primary at position %d", d.replica.status.Position)
+	return
+}
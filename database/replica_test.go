@@ -0,0 +1,359 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+)
+
+// TestReplica tests that read replicas follow the events stored in and deleted
+// from a primary, reject writes, and take writes once promoted.
+func TestReplica(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifold-test-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	primary := New()
+	if err = primary.Init(tempDir); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer primary.Close()
+	events, err := generateTestEvents(20)
+	if err != nil {
+		t.Fatalf("Failed to generate test events: %v", err)
+	}
+	store := func(evs []*event.E) {
+		for _, ev := range evs {
+			if err := primary.StoreEvent(ev); err != nil {
+				t.Fatalf("Failed to store event: %v", err)
+			}
+		}
+	}
+	remove := func(ev *event.E) {
+		id, err := ev.Id()
+		if err != nil {
+			t.Fatalf("Failed to get event ID: %v", err)
+		}
+		if err = primary.DeleteEventById(id); err != nil {
+			t.Fatalf("Failed to delete event: %v", err)
+		}
+	}
+	store(events[:12])
+	remove(events[3])
+
+	replica := newMemoryDB(t)
+	defer replica.Close()
+	if err = replica.Follow(primary, 10*time.Millisecond); err != nil {
+		t.Fatalf("Failed to follow primary: %v", err)
+	}
+	if err = replica.Follow(primary, time.Second); err == nil {
+		t.Errorf("Expected an error following a second primary")
+	}
+	server := httptest.NewServer(primary.ReplicationHandler())
+	defer server.Close()
+	remote := newMemoryDB(t)
+	defer remote.Close()
+	if err = remote.Follow(&HTTPPrimary{URL: server.URL}, 10*time.Millisecond); err != nil {
+		t.Fatalf("Failed to follow primary: %v", err)
+	}
+
+	// caughtUp waits until a replica has the changes of the primary so far.
+	caughtUp := func(r *D) {
+		t.Helper()
+		position := primary.bdb.MaxVersion()
+		deadline := time.Now().Add(5 * time.Second)
+		for r.ReplicationStatus().Position < position {
+			if time.Now().After(deadline) {
+				t.Fatalf("Replica did not catch up to %d, at %v", position, r.ReplicationStatus())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	filters := []filter.F{
+		{Sort: "asc"},
+		{Tags: filter.TagMap{"type": {[]byte("text")}}, Sort: "desc"},
+		{Search: "content", Sort: "relevance", Limit: 5},
+	}
+	same := func(r *D) {
+		t.Helper()
+		for i, f := range filters {
+			expected, err := primary.QueryEvents(f)
+			if err != nil {
+				t.Fatalf("QueryEvents failed: %v", err)
+			}
+			ids, position, err := r.QueryEventsAt(f)
+			if err != nil {
+				t.Fatalf("QueryEvents on replica failed: %v", err)
+			}
+			if !slices.EqualFunc(ids, expected, bytes.Equal) || position == 0 {
+				t.Errorf("Filter %d: expected %d events as on the primary, got %d at %d",
+					i, len(expected), len(ids), position)
+			}
+		}
+		expected, _ := primary.Count(filter.F{Count: true, GroupBy: "author"})
+		if c, err := r.Count(filter.F{Count: true, GroupBy: "author"}); err != nil ||
+			c.Total != expected.Total || len(c.Groups) != len(expected.Groups) {
+			t.Errorf("Expected the counts of the primary, got %v: %v", c, err)
+		}
+	}
+	for _, r := range []*D{replica, remote} {
+		caughtUp(r)
+		same(r)
+	}
+
+	if err = replica.StoreEvent(events[12]); err != ErrReplica {
+		t.Errorf("Expected storing to a replica to fail with ErrReplica, got %v", err)
+	}
+	id, _ := events[0].Id()
+	if err = replica.DeleteEventById(id); err != ErrReplica {
+		t.Errorf("Expected deleting from a replica to fail with ErrReplica, got %v", err)
+	}
+	if _, err = replica.Consolidate(nil); err != ErrReplica {
+		t.Errorf("Expected consolidating a replica to fail with ErrReplica, got %v", err)
+	}
+
+	store(events[12:16])
+	remove(events[0])
+	remove(events[13])
+	for _, r := range []*D{replica, remote} {
+		caughtUp(r)
+		same(r)
+	}
+	if s := replica.ReplicationStatus(); !s.Following || s.Err != nil || s.Lag <= 0 {
+		t.Errorf("Expected a replica following without error, got %+v", s)
+	}
+
+	if st, err := replica.Stats(); err != nil || st.Replication.Position == 0 ||
+		!bytes.Contains([]byte(st.String()), []byte("replica:")) {
+		t.Errorf("Expected the stats of a replica to have its position: %v", err)
+	}
+	if err = replica.Promote(); err != nil {
+		t.Fatalf("Failed to promote replica: %v", err)
+	}
+	if err = replica.Promote(); err == nil {
+		t.Errorf("Expected an error promoting a primary")
+	}
+	if s := replica.ReplicationStatus(); s.Following {
+		t.Errorf("Expected a promoted replica not to be following")
+	}
+	// the serials of the promoted replica continue after those of the primary
+	var last uint64
+	for _, ev := range events[:16] {
+		id, _ := ev.Id()
+		if ser, err := replica.FindEventSerialById(id); err == nil && ser != nil {
+			last = max(last, ser.Get())
+		}
+	}
+	if err = replica.StoreEvent(events[16]); err != nil {
+		t.Fatalf("Failed to store event in promoted replica: %v", err)
+	}
+	id, _ = events[16].Id()
+	ser, err := replica.FindEventSerialById(id)
+	if err != nil || ser.Get() <= last {
+		t.Errorf("Expected a serial after %d, got %v: %v", last, ser, err)
+	}
+	ids, err := replica.QueryEvents(filter.F{})
+	if err != nil || len(ids) != 14 {
+		t.Errorf("Expected 14 events in the promoted replica, got %d: %v", len(ids), err)
+	}
+}
+
+// TestReplicaDrops tests that keys dropped from a primary, which leaves no
+// deletions in its changes, are dropped from its replicas too.
+func TestReplicaDrops(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifold-test-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	primary := New()
+	if err = primary.Init(tempDir); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer primary.Close()
+	events, err := generateTestEvents(10)
+	if err != nil {
+		t.Fatalf("Failed to generate test events: %v", err)
+	}
+	ns, err := primary.Namespace("app")
+	if err != nil {
+		t.Fatalf("Failed to open namespace: %v", err)
+	}
+	for i, ev := range events {
+		db := primary
+		if i < 6 {
+			db = ns
+		}
+		if err = db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+	var calls int
+	if err = primary.RegisterView(reactionsView(&calls)); err != nil {
+		t.Fatalf("Failed to register view: %v", err)
+	}
+	if err = primary.Set(append(viewKeyPrefix("reactions"), "target"...), []byte{1}); err != nil {
+		t.Fatalf("Failed to write view: %v", err)
+	}
+
+	replica := newMemoryDB(t)
+	defer replica.Close()
+	if err = replica.Follow(primary, 10*time.Millisecond); err != nil {
+		t.Fatalf("Failed to follow primary: %v", err)
+	}
+	caughtUp := func() {
+		t.Helper()
+		position := primary.bdb.MaxVersion()
+		deadline := time.Now().Add(5 * time.Second)
+		for replica.ReplicationStatus().Position < position {
+			if time.Now().After(deadline) {
+				t.Fatalf("Replica did not catch up to %d, at %v", position,
+					replica.ReplicationStatus())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	// keys counts the keys of the replica that start with a prefix.
+	keys := func(prefix []byte) (n int) {
+		if err := replica.View(func(txn store.Txn) (err error) {
+			it := txn.NewIterator(store.IteratorOptions{Prefix: prefix})
+			defer it.Close()
+			for it.Seek(prefix); it.Valid(); it.Next() {
+				n++
+			}
+			return
+		}); err != nil {
+			t.Fatalf("Failed to read replica: %v", err)
+		}
+		return
+	}
+	caughtUp()
+	if keys(keyPrefix("app")) == 0 || keys(viewKeyPrefix("reactions")) == 0 {
+		t.Fatalf("Expected the replica to have the namespace and the view")
+	}
+
+	if err = primary.DropNamespace("app"); err != nil {
+		t.Fatalf("Failed to drop namespace: %v", err)
+	}
+	if err = primary.DropView("reactions"); err != nil {
+		t.Fatalf("Failed to drop view: %v", err)
+	}
+	caughtUp()
+	if n := keys(keyPrefix("app")); n != 0 {
+		t.Errorf("Expected the keys of the dropped namespace to be gone, got %d", n)
+	}
+	if n := keys(viewKeyPrefix("reactions")); n != 0 {
+		t.Errorf("Expected the keys of the dropped view to be gone, got %d", n)
+	}
+	ids, _, err := replica.QueryEventsAt(filter.F{})
+	if err != nil || len(ids) != 4 {
+		t.Errorf("Expected the 4 events of the primary, got %d: %v", len(ids), err)
+	}
+	// the replica takes only the changes after a drop it has seen
+	position := replica.ReplicationStatus().Position
+	if err = primary.StoreEvent(events[0]); err != nil {
+		t.Fatalf("Failed to store event: %v", err)
+	}
+	caughtUp()
+	if ids, _, err = replica.QueryEventsAt(filter.F{}); err != nil || len(ids) != 5 {
+		t.Errorf("Expected the 5 events of the primary, got %d: %v", len(ids), err)
+	}
+	if replica.ReplicationStatus().Position <= position {
+		t.Errorf("Expected the replica to move on from %d", position)
+	}
+}
+
+// TestReplicaCompaction tests that a replica that is behind takes the deletions
+// of the primary after compaction, and takes the whole of the primary again
+// once it is further behind than the deletions kept.
+func TestReplicaCompaction(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifold-test-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	primary := New()
+	if err = primary.Init(tempDir); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer func() { primary.Close() }()
+	events, err := generateTestEvents(5)
+	if err != nil {
+		t.Fatalf("Failed to generate test events: %v", err)
+	}
+	for _, ev := range events {
+		if err = primary.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+	remove := func(ev *event.E) {
+		id, err := ev.Id()
+		if err != nil {
+			t.Fatalf("Failed to get event ID: %v", err)
+		}
+		if err = primary.DeleteEventById(id); err != nil {
+			t.Fatalf("Failed to delete event: %v", err)
+		}
+	}
+	// compact reopens the primary, which flushes and compacts its changes, and
+	// compacts them into one level.
+	compact := func() {
+		t.Helper()
+		if err := primary.Close(); err != nil {
+			t.Fatalf("Failed to close database: %v", err)
+		}
+		primary = New()
+		if err := primary.Init(tempDir); err != nil {
+			t.Fatalf("Failed to reopen database: %v", err)
+		}
+		if err := primary.WaitMigrations(); err != nil {
+			t.Fatalf("Failed to migrate database: %v", err)
+		}
+		if err := primary.bdb.Flatten(1); err != nil {
+			t.Fatalf("Failed to compact database: %v", err)
+		}
+	}
+	replica := newMemoryDB(t)
+	defer replica.Close()
+	sync := func(p Primary, expected int) {
+		t.Helper()
+		if err := replica.syncReplica(context.Background(), p); err != nil {
+			t.Fatalf("Failed to take changes from primary: %v", err)
+		}
+		ids, err := replica.queryEvents(filter.F{})
+		if err != nil || len(ids) != expected {
+			t.Errorf("Expected %d events in the replica, got %d: %v", expected, len(ids), err)
+		}
+	}
+	sync(primary, 5)
+
+	remove(events[0])
+	compact()
+	sync(primary, 4)
+
+	// the deletions are kept from a position after that of the replica
+	remove(events[1])
+	for range 2 {
+		if err = primary.retain(0); err != nil {
+			t.Fatalf("Failed to move retention: %v", err)
+		}
+	}
+	compact()
+	position := replica.ReplicationStatus().Position
+	if _, err = primary.Changes(io.Discard, position); err != ErrResync {
+		t.Errorf("Expected a resync for a position before the deletions kept, got %v", err)
+	}
+	server := httptest.NewServer(primary.ReplicationHandler())
+	defer server.Close()
+	sync(&HTTPPrimary{URL: server.URL}, 3)
+}
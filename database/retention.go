@@ -0,0 +1,119 @@
+package database
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"manifold.mleku.dev/chk"
+)
+
+// retention holds read transactions open on the badger database, which keep
+// compaction from discarding the versions of keys, and so their deletions,
+// written after the oldest of them, for the Changes of replicas that are
+// behind. A transaction is opened every Retention and the oldest closed once
+// there are more than two, so the deletions of at least the last Retention
+// are kept. They are not closed before the database is, so the compaction
+// when it is closed keeps them too.
+type retention struct {
+	mx   sync.Mutex
+	pins []retentionPin
+	// from is the position the deletions are kept from.
+	from uint64
+}
+
+// retentionPin is a read transaction held open, and when it was opened.
+type retentionPin struct {
+	txn *badger.Txn
+	at  time.Time
+}
+
+// discarded returns the position before which the deletions of keys may have
+// been discarded.
+func (r *retention) discarded() uint64 {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.from
+}
+
+// startRetention opens the first read transaction of the retention. It is
+// called as soon as the badger database is opened, so the deletions kept when
+// it was last closed, from the position stored then, are still kept.
+func (d *D) startRetention() (err error) {
+	txn := d.bdb.NewTransaction(false)
+	from := txn.ReadTs()
+	if err = d.bdb.View(func(txn *badger.Txn) (err error) {
+		var item *badger.Item
+		if item, err = txn.Get(discardKey); err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return
+		}
+		return item.Value(func(val []byte) (err error) {
+			if len(val) == 8 {
+				from = min(from, binary.BigEndian.Uint64(val))
+			}
+			return
+		})
+	}); chk.E(err) {
+		txn.Discard()
+		return
+	}
+	d.retention.mx.Lock()
+	defer d.retention.mx.Unlock()
+	d.retention.pins = []retentionPin{{txn: txn, at: time.Now()}}
+	d.retention.from = from
+	return d.storeDiscarded(from)
+}
+
+// retain opens a read transaction if the newest is older than retention, and
+// if there are then more than two, closes the oldest, so that the deletions
+// are kept from the read position of the next.
+func (d *D) retain(retention time.Duration) (err error) {
+	r := &d.retention
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if len(r.pins) > 0 && time.Since(r.pins[len(r.pins)-1].at) < retention {
+		return
+	}
+	r.pins = append(r.pins, retentionPin{txn: d.bdb.NewTransaction(false), at: time.Now()})
+	if len(r.pins) <= 2 {
+		return
+	}
+	// the position is stored before the transaction is closed, so it is never
+	// behind what compaction may have discarded.
+	if err = d.storeDiscarded(r.pins[1].txn.ReadTs()); chk.E(err) {
+		return
+	}
+	r.from = r.pins[1].txn.ReadTs()
+	r.pins[0].txn.Discard()
+	r.pins = r.pins[1:]
+	return
+}
+
+// storeDiscarded stores the position the deletions are kept from, for when the
+// database is next opened.
+func (d *D) storeDiscarded(from uint64) (err error) {
+	return d.bdb.Update(func(txn *badger.Txn) error {
+		return txn.Set(discardKey, binary.BigEndian.AppendUint64(nil, from))
+	})
+}
+
+// retainLoop opens and closes the read transactions of the retention until the
+// database is closed.
+func (d *D) retainLoop() {
+	defer d.workers.Done()
+	tick := time.NewTicker(max(d.Retention/2, time.Second))
+	defer tick.Stop()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-tick.C:
+			if err := d.retain(d.Retention); chk.E(err) {
+			}
+		}
+	}
+}
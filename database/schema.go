@@ -0,0 +1,309 @@
+package database
+
+import (
+	"encoding/binary"
+	"errors"
+	"slices"
+
+	"manifold.mleku.dev/database/store"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/database/indexes/types/number"
+	"manifold.mleku.dev/errorf"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/log"
+)
+
+// SchemaVersion is the version of the index key layout that this code writes
+// and queries. It must be incremented, and a Migration registered to upgrade
+// from the previous version, whenever the layout of any index in
+// database/indexes changes.
+//
+// Version 1 is the layout in use before the version was stored in the database.
+//
+// Version 2 adds the LastAccessed and SerialAccessed indexes.
+//
+// Version 3 writes the FulltextWord index of the words of event content.
+//
+// Version 4 adds the ContentLength and WordFrequency indexes.
+//
+// Version 5 adds the TagKeyValue index.
+//
+// Version 6 adds the TagNumber index.
+//
+// Version 7 adds the Location index.
+//
+// Version 8 adds the Reference index.
+//
+// Version 9 encodes the timestamps of events in all indexes with
+// number.Uint64.SetInt64, so that negative timestamps sort before positive
+// ones.
+//
+// Version 10 adds the Nanos index.
+//
+// Version 11 adds the references of tag values with the event.BinPrefix to the
+// Reference index.
+//
+// Version 12 builds the social graph view from the follow lists. It is
+// registered when the database is opened without being rebuilt, as other views
+// are, so that opening does not decode every event; a graph that is not at the
+// version of the code is rebuilt by migrating again from version 11.
+//
+// Version 13 removes the events without tags that were stored with the ids
+// that versions before the fix of event.E.Marshal gave them, which no longer
+// verify.
+const SchemaVersion uint32 = 13
+
+// schemaKey is the key under which the schema version of the database is
+// stored as a 4 byte big endian value.
+var schemaKey = []byte("SCHEMA")
+
+// Migration upgrades the database from one schema version to the next.
+type Migration struct {
+	// From is the schema version the migration upgrades from; on success the
+	// database is at version From+1.
+	From uint32
+	// Description is a short explanation of what the migration changes.
+	Description string
+	// Run performs the migration. It should report the number of items done
+	// out of the total to progress, and return early with the context error if
+	// d is closed.
+	Run func(d *D, progress func(done, total int)) (err error)
+}
+
+var migrations = make(map[uint32]Migration)
+
+// RegisterMigration adds a migration to the registry. It is intended to be
+// called from init functions, and panics if a migration from the same version
+// is already registered.
+func RegisterMigration(m Migration) {
+	if _, ok := migrations[m.From]; ok {
+		panic(errorf.E("migration from schema version %d registered twice", m.From))
+	}
+	migrations[m.From] = m
+}
+
+// MigrationStatus is the state of the schema migrations of a database.
+type MigrationStatus struct {
+	// Version is the schema version the database is currently at.
+	Version uint32
+	// Description is the description of the running migration.
+	Description string
+	// Done and Total are the number of items processed and the number to
+	// process in the running migration.
+	Done, Total int
+	// Running is true while migrations are in progress.
+	Running bool
+	// Err is the error that stopped the migrations, if any.
+	Err error
+}
+
+// ErrMigrating is returned by queries while schema migrations are running, as
+// the indexes they read may be partly rebuilt.
+var ErrMigrating = errors.New("database schema migrations are running")
+
+// Migrations returns the status of schema migrations.
+func (d *D) Migrations() (s MigrationStatus) {
+	d.migrationMx.Lock()
+	defer d.migrationMx.Unlock()
+	return d.migration
+}
+
+// WaitMigrations blocks until schema migrations started by Init are finished,
+// and returns the error that stopped them, if any.
+func (d *D) WaitMigrations() (err error) {
+	d.migrations.Wait()
+	return d.Migrations().Err
+}
+
+// migrated returns ErrMigrating if schema migrations are running.
+func (d *D) migrated() (err error) {
+	if d.Migrations().Running {
+		return ErrMigrating
+	}
+	return
+}
+
+// migrationProgress updates the count of processed items of the running
+// migration, logging the progress every 10%.
+func (d *D) migrationProgress(done, total int) {
+	d.migrationMx.Lock()
+	defer d.migrationMx.Unlock()
+	m := &d.migration
+	if total > 0 && done*10/total != m.Done*10/max(m.Total, 1) {
+		log.I.F("migration from schema version %d: %d/%d %s",
+			m.Version, done, total, m.Description)
+	}
+	m.Done, m.Total = done, total
+}
+
+// SchemaVersion returns the schema version stored in the database.
+func (d *D) SchemaVersion() (v uint32, err error) {
+	if err = d.View(func(txn store.Txn) (err error) {
+		var val []byte
+		if val, err = txn.Get(schemaKey); err != nil {
+			return
+		}
+		if len(val) != 4 {
+			return errorf.E("invalid schema version %0x", val)
+		}
+		v = binary.BigEndian.Uint32(val)
+		return
+	}); err != nil {
+		return
+	}
+	return
+}
+
+func (d *D) setSchemaVersion(v uint32) (err error) {
+	val := make([]byte, 4)
+	binary.BigEndian.PutUint32(val, v)
+	return d.Set(schemaKey, val)
+}
+
+// initSchema reads the schema version of the database, writing the current
+// version to a new database, refusing to open a database written by a newer
+// version of the code, and starting any migrations needed to bring an older
+// database up to date in the background.
+func (d *D) initSchema() (err error) {
+	var v uint32
+	if v, err = d.SchemaVersion(); err == store.ErrKeyNotFound {
+		err = nil
+		var empty bool
+		if empty, err = d.isEmpty(); chk.E(err) {
+			return
+		}
+		if empty {
+			v = SchemaVersion
+		} else {
+			v = 1
+		}
+		if err = d.setSchemaVersion(v); chk.E(err) {
+			return
+		}
+	} else if chk.E(err) {
+		return
+	}
+	if v > SchemaVersion {
+		err = errorf.E("database schema version %d is newer than the supported "+
+			"version %d", v, SchemaVersion)
+		return
+	}
+	if v, err = d.checkGraph(v); chk.E(err) {
+		return
+	}
+	d.migration.Version = v
+	if v < SchemaVersion {
+		log.I.F("database schema version %d is older than the current version "+
+			"%d, migrating", v, SchemaVersion)
+		d.migration.Running = true
+		d.migrations.Add(1)
+		go func() {
+			defer d.migrations.Done()
+			d.migrate(v, SchemaVersion)
+		}()
+	}
+	return
+}
+
+// migrate runs the registered migrations in sequence from one schema version up
+// to another, recording the version after each step so an interrupted
+// migration resumes from the last completed step.
+func (d *D) migrate(from, to uint32) {
+	var err error
+	d.migrationMx.Lock()
+	d.migration.Running = true
+	d.migrationMx.Unlock()
+	defer func() {
+		d.migrationMx.Lock()
+		d.migration.Running = false
+		d.migration.Err = err
+		d.migrationMx.Unlock()
+	}()
+	for v := from; v < to; v++ {
+		m, ok := migrations[v]
+		if !ok {
+			err = errorf.E("no migration registered from schema version %d", v)
+			return
+		}
+		d.migrationMx.Lock()
+		d.migration.Version, d.migration.Description = v, m.Description
+		d.migration.Done, d.migration.Total = 0, 0
+		d.migrationMx.Unlock()
+		log.I.F("migrating from schema version %d: %s", v, m.Description)
+		if err = m.Run(d, d.migrationProgress); chk.E(err) {
+			return
+		}
+		if err = d.ctx.Err(); err != nil {
+			return
+		}
+		if err = d.setSchemaVersion(v + 1); chk.E(err) {
+			return
+		}
+		d.migrationMx.Lock()
+		d.migration.Version = v + 1
+		d.migrationMx.Unlock()
+	}
+	log.I.F("database migrated to schema version %d", to)
+}
+
+// isEmpty returns true if the database contains no event records.
+func (d *D) isEmpty() (empty bool, err error) {
+	empty = true
+	if err = d.View(func(txn store.Txn) (err error) {
+		prf := []byte(indexes.Prefix(indexes.Event))
+		it := txn.NewIterator(store.IteratorOptions{Prefix: prf})
+		defer it.Close()
+		it.Seek(prf)
+		empty = !it.Valid()
+		return
+	}); chk.E(err) {
+		return
+	}
+	return
+}
+
+// RebuildIndexes deletes every key of the given index families and writes them
+// again from the stored events, using the key layout of the current code. It is
+// the usual body of a Migration that changes the layout of some indexes.
+func (d *D) RebuildIndexes(progress func(done, total int), families ...int) (err error) {
+	var total int
+	if total, err = d.CountEvents(); chk.E(err) {
+		return
+	}
+	prefixes := make([][]byte, len(families))
+	for i, f := range families {
+		prefixes[i] = []byte(indexes.Prefix(f))
+	}
+	if err = d.dropPrefix(prefixes...); chk.E(err) {
+		return
+	}
+	wb := d.store.NewWriteBatch()
+	defer wb.Cancel()
+	var done int
+	if err = d.ForEachEvent(func(ser *number.Uint40, ev *event.E) (err error) {
+		var idxs [][]byte
+		if idxs, err = d.GetEventIndexesForSerial(ev, ser); chk.E(err) {
+			return
+		}
+		for _, k := range idxs {
+			if slices.Contains(families, indexes.Identify(k)) {
+				if err = wb.Set(k, nil); chk.E(err) {
+					return
+				}
+			}
+		}
+		done++
+		if progress != nil {
+			progress(done, total)
+		}
+		return
+	}); err != nil {
+		return
+	}
+	if err = wb.Flush(); chk.E(err) {
+		return
+	}
+	return
+}
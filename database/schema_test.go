@@ -0,0 +1,119 @@
+package database
+
+import (
+	"os"
+	"testing"
+
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+)
+
+// TestSchemaVersion tests that a new database is written at the current schema
+// version and that a database from a newer version is refused.
+func TestSchemaVersion(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifold-test-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	db := New()
+	if err = db.Init(tempDir); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	var v uint32
+	if v, err = db.SchemaVersion(); err != nil {
+		t.Fatalf("Failed to read schema version: %v", err)
+	}
+	if v != SchemaVersion {
+		t.Fatalf("Expected schema version %d, got %d", SchemaVersion, v)
+	}
+	if err = db.setSchemaVersion(SchemaVersion + 1); err != nil {
+		t.Fatalf("Failed to write schema version: %v", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	db = New()
+	if err = db.Init(tempDir); err == nil {
+		db.Close()
+		t.Fatalf("Expected error opening database with a newer schema version")
+	}
+}
+
+// TestMigration tests that a registered migration runs, rebuilds the index
+// family it is given and advances the schema version.
+func TestMigration(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifold-test-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	db := New()
+	if err = db.Init(tempDir); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	var events []*event.E
+	if events, err = generateTestEvents(10); err != nil {
+		t.Fatalf("Failed to generate test events: %v", err)
+	}
+	for _, ev := range events {
+		if err = db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+	// remove the Timestamp index entirely, as though it were introduced in the
+	// next schema version.
+	if err = db.store.DropPrefix([]byte(indexes.Prefix(indexes.Timestamp))); err != nil {
+		t.Fatalf("Failed to drop index: %v", err)
+	}
+
+	var progressed int
+	RegisterMigration(Migration{
+		From:        SchemaVersion,
+		Description: "test rebuilding the timestamp index",
+		Run: func(d *D, progress func(done, total int)) (err error) {
+			if _, err = d.QueryEvents(filter.F{}); err != ErrMigrating {
+				t.Errorf("Expected queries to fail while migrating, got %v", err)
+			}
+			if _, err = d.Count(filter.F{Count: true}); err != ErrMigrating {
+				t.Errorf("Expected counts to fail while migrating, got %v", err)
+			}
+			return d.RebuildIndexes(func(done, total int) {
+				progressed = done
+				progress(done, total)
+			}, indexes.Timestamp)
+		},
+	})
+	defer delete(migrations, SchemaVersion)
+
+	db.migrate(SchemaVersion, SchemaVersion+1)
+	if err = db.WaitMigrations(); err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+	if progressed != len(events) {
+		t.Fatalf("Expected progress of %d events, got %d", len(events), progressed)
+	}
+	var v uint32
+	if v, err = db.SchemaVersion(); err != nil {
+		t.Fatalf("Failed to read schema version: %v", err)
+	}
+	if v != SchemaVersion+1 {
+		t.Fatalf("Expected schema version %d, got %d", SchemaVersion+1, v)
+	}
+	if ids, err := db.QueryEvents(filter.F{}); err != nil || len(ids) != len(events) {
+		t.Fatalf("Expected %d events after migrating, got %d: %v", len(events), len(ids), err)
+	}
+	var r *CheckReport
+	if r, err = db.Check(false); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !r.Ok() {
+		t.Fatalf("Expected clean report after migration, got\n%s", r)
+	}
+}
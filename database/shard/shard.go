@@ -0,0 +1,421 @@
+// Package shard spreads the events of a database across several event stores,
+// such as badger databases on different disks, choosing the store of each event
+// by the hash of its pubkey or by its time, and gathers the results of queries
+// from the stores that may hold matching events.
+package shard
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database"
+	"manifold.mleku.dev/errorf"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+	"manifold.mleku.dev/sha256"
+)
+
+// Partitioner chooses the shards of events.
+type Partitioner interface {
+	// Shard returns which of n shards an event is stored in.
+	Shard(ev *event.E, n int) int
+	// Shards returns which of n shards may hold the events matching a filter,
+	// or nil if any of them may.
+	Shards(f filter.F, n int) []int
+}
+
+// ByPubkey partitions events by the hash of their pubkey, so that the events of
+// an author are in one shard, and queries by author go only to their shards.
+type ByPubkey struct{}
+
+func pubkeyShard(pk []byte, n int) int {
+	return int(binary.BigEndian.Uint64(sha256.Sum256Bytes(pk)[:8]) % uint64(n))
+}
+
+func (ByPubkey) Shard(ev *event.E, n int) int { return pubkeyShard(ev.Pubkey, n) }
+
+func (ByPubkey) Shards(f filter.F, n int) (shards []int) {
+	if len(f.Authors) == 0 {
+		return
+	}
+	for _, pk := range f.Authors {
+		shards = append(shards, pubkeyShard(pk, n))
+	}
+	slices.Sort(shards)
+	return slices.Compact(shards)
+}
+
+// ByTime partitions events by the period of time they were made in, taking the
+// shards in turn for each period, so that queries for less than n periods go
+// only to their shards.
+type ByTime struct {
+	// Period is the length of each period, of at least a second.
+	Period time.Duration
+}
+
+// period returns the number of the period of a timestamp.
+func (p ByTime) period(ts int64) int64 {
+	length := max(int64(p.Period/time.Second), 1)
+	n := ts / length
+	if ts%length < 0 {
+		n--
+	}
+	return n
+}
+
+// shard returns the shard of a period, which may be negative.
+func shardOf(period int64, n int) int {
+	return int(((period % int64(n)) + int64(n)) % int64(n))
+}
+
+func (p ByTime) Shard(ev *event.E, n int) int { return shardOf(p.period(ev.Timestamp), n) }
+
+func (p ByTime) Shards(f filter.F, n int) (shards []int) {
+	if f.Since == 0 || f.Until == 0 {
+		return
+	}
+	first, last := p.period(seconds(f.Since, f.Unit)), p.period(seconds(f.Until, f.Unit))
+	if last-first+1 >= int64(n) {
+		return
+	}
+	for period := first; period <= last; period++ {
+		shards = append(shards, shardOf(period, n))
+	}
+	slices.Sort(shards)
+	return
+}
+
+// seconds converts a time in the Unit of a filter to whole seconds, rounding
+// down.
+func seconds(v int64, unit string) int64 {
+	var perSecond int64
+	switch unit {
+	case "ms":
+		perSecond = 1e3
+	case "ns":
+		perSecond = 1e9
+	default:
+		return v
+	}
+	s := v / perSecond
+	if v%perSecond < 0 {
+		s--
+	}
+	return s
+}
+
+// S is an event store made of shards.
+type S struct {
+	shards []database.I
+	p      Partitioner
+}
+
+var _ database.I = (*S)(nil)
+var _ database.Sorter = (*S)(nil)
+
+// New creates an event store that partitions events among the shards with p.
+// The shards must always be given in the same order.
+func New(p Partitioner, shards ...database.I) (s *S) {
+	return &S{shards: shards, p: p}
+}
+
+// Open opens a badger database at each of the paths, such as on different
+// disks, as the shards of an event store.
+func Open(p Partitioner, paths ...string) (s *S, err error) {
+	if len(paths) == 0 {
+		err = errorf.E("no shards to open")
+		return
+	}
+	shards := make([]database.I, 0, len(paths))
+	for _, path := range paths {
+		d := database.New()
+		if err = d.Init(path); chk.E(err) {
+			for _, opened := range shards {
+				chk.E(opened.Close())
+			}
+			return
+		}
+		shards = append(shards, d)
+	}
+	return New(p, shards...), nil
+}
+
+// Shards returns the event stores of the shards.
+func (s *S) Shards() []database.I { return s.shards }
+
+// each runs fn on the shards with the given numbers at once, or on all of them
+// if shards is nil, and returns the first error.
+func (s *S) each(shards []int, fn func(n int, db database.I) (err error)) (err error) {
+	if shards == nil {
+		shards = make([]int, len(s.shards))
+		for i := range shards {
+			shards[i] = i
+		}
+	}
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, n := range shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(n, s.shards[n])
+		}()
+	}
+	wg.Wait()
+	for _, err = range errs {
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// StoreEvent stores an event in its shard.
+func (s *S) StoreEvent(ev *event.E) (err error) {
+	return s.shards[s.p.Shard(ev, len(s.shards))].StoreEvent(ev)
+}
+
+// GetEventById returns the event with an id from whichever shard holds it. If
+// none does, the first error of a shard other than not holding it is returned.
+func (s *S) GetEventById(evId []byte) (ev *event.E, err error) {
+	found := make([]*event.E, len(s.shards))
+	err = s.each(nil, func(n int, db database.I) (err error) {
+		if found[n], err = db.GetEventById(evId); errors.Is(err, database.ErrEventNotFound) {
+			err = nil
+		}
+		return
+	})
+	for _, ev = range found {
+		if ev != nil {
+			return ev, nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("%w: %0x", database.ErrEventNotFound, evId)
+	}
+	return
+}
+
+// DeleteEventById deletes an event from whichever shards hold it, and returns
+// the first error of a shard other than not holding it.
+func (s *S) DeleteEventById(evId []byte) (err error) {
+	deleted := make([]bool, len(s.shards))
+	if err = s.each(nil, func(n int, db database.I) (err error) {
+		if err = db.DeleteEventById(evId); errors.Is(err, database.ErrEventNotFound) {
+			return nil
+		}
+		deleted[n] = err == nil
+		return
+	}); err != nil {
+		return
+	}
+	if !slices.Contains(deleted, true) {
+		err = fmt.Errorf("%w: %0x", database.ErrEventNotFound, evId)
+	}
+	return
+}
+
+// checkTrust refuses a filter with a TrustRoot, which would be reached in the
+// social graph of each shard rather than that of all their follow lists.
+func checkTrust(f filter.F) (err error) {
+	if f.TrustRoot != nil {
+		err = errorf.E("a trust root cannot be reached across shards")
+	}
+	return
+}
+
+// result is an event found by a shard, with what it is sorted by.
+type result struct {
+	database.Result
+	shard, rank int
+}
+
+// before returns true if a result was made before another, to the nanosecond.
+func (r *result) before(o *result) bool {
+	if r.Timestamp != o.Timestamp {
+		return r.Timestamp < o.Timestamp
+	}
+	return r.Nanos < o.Nanos
+}
+
+// sorted queries a shard for the events matching a filter with what they are
+// sorted by, which shards that are not a database.Sorter return by reading
+// each of the events.
+func sorted(db database.I, f filter.F, byRank bool) (results []database.Result, err error) {
+	if sorter, ok := db.(database.Sorter); ok {
+		return sorter.QuerySorted(f)
+	}
+	var ids [][]byte
+	if ids, err = db.QueryEvents(f); err != nil {
+		return
+	}
+	for _, id := range ids {
+		r := database.Result{Id: id, SortValue: math.NaN()}
+		if !byRank {
+			var ev *event.E
+			if ev, err = db.GetEventById(id); errors.Is(err, database.ErrEventNotFound) {
+				// deleted since it was found
+				err = nil
+				continue
+			} else if err != nil {
+				return
+			}
+			r.Timestamp, r.Nanos = ev.Timestamp, ev.Nanos()
+			if f.SortTag != "" {
+				if v, ok := database.TagNumber(ev, f.SortTag); ok {
+					r.SortValue = v
+				}
+			}
+		}
+		results = append(results, r)
+	}
+	return
+}
+
+// QueryEvents queries the shards that may hold events matching a filter at
+// once, and merges their results in the order of the filter, up to its Limit,
+// as one database would. Results sorted by relevance are interleaved by rank,
+// as each shard scores them against the words of its own events. Filters with
+// a TrustRoot are refused, as the social graph of each shard holds only the
+// follow lists stored in it.
+func (s *S) QueryEvents(f filter.F) (eventIds [][]byte, err error) {
+	var results []database.Result
+	if results, err = s.QuerySorted(f); err != nil {
+		return
+	}
+	for _, r := range results {
+		eventIds = append(eventIds, r.Id)
+	}
+	return
+}
+
+// QuerySorted queries the shards as QueryEvents does, and returns the results
+// with what they are sorted by, which the shards return without the events
+// being read, if they are a database.Sorter.
+func (s *S) QuerySorted(f filter.F) (merged []database.Result, err error) {
+	if err = checkTrust(f); err != nil {
+		return
+	}
+	if len(f.Ids) > 0 {
+		// the ids are returned without reading the events
+		var ids [][]byte
+		if ids, err = s.shards[0].QueryEvents(f); err != nil {
+			return
+		}
+		for _, id := range ids {
+			merged = append(merged, database.Result{Id: id, SortValue: math.NaN()})
+		}
+		return
+	}
+	byRank := f.Sort == "relevance" && f.Search != "" && f.SortTag == ""
+	found := make([][]database.Result, len(s.shards))
+	if err = s.each(s.p.Shards(f, len(s.shards)), func(n int, db database.I) (err error) {
+		found[n], err = sorted(db, f, byRank)
+		return
+	}); chk.E(err) {
+		return
+	}
+	var results []*result
+	for n, rs := range found {
+		for rank, r := range rs {
+			results = append(results, &result{Result: r, shard: n, rank: rank})
+		}
+	}
+	desc := f.Sort == "desc" || f.Sort == "relevance"
+	sort.SliceStable(results, func(i, j int) bool {
+		ri, rj := results[i], results[j]
+		switch {
+		case byRank:
+			if ri.rank != rj.rank {
+				return ri.rank < rj.rank
+			}
+			return ri.shard < rj.shard
+		case f.SortTag != "":
+			if math.IsNaN(ri.SortValue) != math.IsNaN(rj.SortValue) {
+				return math.IsNaN(rj.SortValue)
+			}
+			if ri.SortValue != rj.SortValue && !math.IsNaN(ri.SortValue) {
+				if f.Sort == "desc" {
+					return ri.SortValue > rj.SortValue
+				}
+				return ri.SortValue < rj.SortValue
+			}
+			if f.Sort == "desc" {
+				return rj.before(ri)
+			}
+			return ri.before(rj)
+		case desc:
+			return rj.before(ri)
+		}
+		return ri.before(rj)
+	})
+	seen := make(map[string]struct{}, len(results))
+	for _, r := range results {
+		if f.Limit > 0 && len(merged) >= f.Limit {
+			break
+		}
+		// an event stored in more than one shard is returned once
+		if _, ok := seen[string(r.Id)]; ok {
+			continue
+		}
+		seen[string(r.Id)] = struct{}{}
+		merged = append(merged, r.Result)
+	}
+	return
+}
+
+// Count counts the events matching a filter in the shards that may hold them
+// at once, and adds up their counts and groups, up to the Limit of the filter.
+// Events by id are counted in all the shards, as each counts those it holds.
+func (s *S) Count(f filter.F) (c *filter.Counts, err error) {
+	if err = checkTrust(f); err != nil {
+		return
+	}
+	shards := s.p.Shards(f, len(s.shards))
+	if len(f.Ids) > 0 {
+		shards = nil
+	}
+	var period int64
+	if f.GroupBy != "" {
+		if _, period, err = filter.ParseGroupBy(f.GroupBy); chk.E(err) {
+			return
+		}
+	}
+	limit := f.Limit
+	f.Limit = 0
+	found := make([]*filter.Counts, len(s.shards))
+	if err = s.each(shards, func(n int, db database.I) (err error) {
+		found[n], err = db.Count(f)
+		return
+	}); chk.E(err) {
+		return
+	}
+	c = &filter.Counts{}
+	for _, counts := range found {
+		if counts != nil {
+			c.Add(counts)
+		}
+	}
+	c.Sort(period > 0)
+	if limit > 0 && len(c.Groups) > limit {
+		c.Groups = c.Groups[:limit]
+	}
+	return
+}
+
+// Close closes every shard, returning the first error.
+func (s *S) Close() (err error) {
+	for _, db := range s.shards {
+		if e := db.Close(); chk.E(e) && err == nil {
+			err = e
+		}
+	}
+	return
+}
@@ -0,0 +1,267 @@
+package shard
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"manifold.mleku.dev/database"
+	"manifold.mleku.dev/database/store/memory"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+	"manifold.mleku.dev/p256k"
+)
+
+func newMemoryDB(t *testing.T) (db *database.D) {
+	db = database.New()
+	if err := db.InitStore(memory.New()); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	return
+}
+
+// generateEvents makes events by several authors over several hours, some of
+// them in the same second, with a number tag on some.
+func generateEvents(t *testing.T, count int) (events []*event.E, authors [][]byte) {
+	signers := make([]*p256k.Signer, 12)
+	for i := range signers {
+		signers[i] = new(p256k.Signer)
+		if err := signers[i].Generate(); err != nil {
+			t.Fatalf("Failed to generate signer: %v", err)
+		}
+		authors = append(authors, signers[i].Pub())
+	}
+	start := time.Unix(1700000000, 0)
+	for i := range count {
+		signer := signers[i%len(signers)]
+		ev := &event.E{
+			Pubkey:  signer.Pub(),
+			Content: []byte(fmt.Sprintf("sharded event %d", i)),
+			Tags:    &event.Tags{},
+		}
+		ev.SetTime(start.Add(time.Duration(i/2)*17*time.Minute +
+			time.Duration(i%2)*time.Millisecond))
+		if i%3 == 0 {
+			*ev.Tags = append(*ev.Tags, event.Tag{Key: []byte("price"),
+				Value: []byte(strconv.Itoa((i * 7) % 10))})
+		}
+		if err := ev.Sign(signer); err != nil {
+			t.Fatalf("Failed to sign event: %v", err)
+		}
+		events = append(events, ev)
+	}
+	return
+}
+
+// TestQueryEvents tests that the results of queries on shards are the same as
+// those of a single database holding all the events.
+func TestQueryEvents(t *testing.T) {
+	events, authors := generateEvents(t, 40)
+	for _, p := range []Partitioner{ByPubkey{}, ByTime{Period: time.Hour}} {
+		t.Run(fmt.Sprintf("%T", p), func(t *testing.T) {
+			single := newMemoryDB(t)
+			defer single.Close()
+			s := New(p, newMemoryDB(t), newMemoryDB(t), newMemoryDB(t))
+			defer s.Close()
+			for _, ev := range events {
+				if err := single.StoreEvent(ev); err != nil {
+					t.Fatalf("Failed to store event: %v", err)
+				}
+				if err := s.StoreEvent(ev); err != nil {
+					t.Fatalf("Failed to store event: %v", err)
+				}
+			}
+			for n, db := range s.Shards() {
+				if ids, err := db.QueryEvents(filter.F{}); err != nil || len(ids) == 0 {
+					t.Errorf("Expected events in shard %d: %v", n, err)
+				}
+			}
+			filters := []filter.F{
+				{Sort: "asc"},
+				{Sort: "desc", Limit: 7},
+				{Authors: [][]byte{authors[1], authors[3]}, Sort: "desc"},
+				{Since: 1700003000, Until: 1700009000, Sort: "asc", Limit: 5},
+				{SortTag: "price", Sort: "desc"},
+				{SortTag: "price", Limit: 4},
+				{NotAuthors: [][]byte{authors[0]}, Sort: "desc", Limit: 10},
+			}
+			for i, f := range filters {
+				expected, err := single.QueryEvents(f)
+				if err != nil {
+					t.Fatalf("Failed to query events: %v", err)
+				}
+				ids, err := s.QueryEvents(f)
+				if err != nil {
+					t.Fatalf("Failed to query shards: %v", err)
+				}
+				if !slices.EqualFunc(ids, expected, bytes.Equal) {
+					t.Errorf("Filter %d: expected %d events in the order of a single database, got %d",
+						i, len(expected), len(ids))
+				}
+			}
+			// ids of events spread across the shards
+			var ids [][]byte
+			for _, ev := range events[:12] {
+				id, err := ev.Id()
+				if err != nil {
+					t.Fatalf("Failed to get event ID: %v", err)
+				}
+				ids = append(ids, id)
+			}
+			for _, f := range []filter.F{
+				{Count: true, GroupBy: "author"},
+				{Count: true, Ids: ids},
+				{Count: true, GroupBy: "author", Ids: ids},
+				{Count: true, GroupBy: "time:3600", Since: 1700003000},
+				{Count: true, GroupBy: "author", Limit: 2, NotAuthors: [][]byte{authors[0]}},
+			} {
+				expected, err := single.Count(f)
+				if err != nil {
+					t.Fatalf("Failed to count events: %v", err)
+				}
+				c, err := s.Count(f)
+				if err != nil {
+					t.Fatalf("Failed to count shards: %v", err)
+				}
+				if !reflect.DeepEqual(c, expected) {
+					t.Errorf("Group by %s: expected the counts of a single database %v, got %v",
+						f.GroupBy, expected, c)
+				}
+			}
+			trust := filter.F{TrustRoot: authors[0], TrustRadius: 1}
+			if _, err := s.QueryEvents(trust); err == nil {
+				t.Errorf("Expected an error querying shards with a trust root")
+			}
+			if _, err := s.Count(trust); err == nil {
+				t.Errorf("Expected an error counting shards with a trust root")
+			}
+			id, err := events[5].Id()
+			if err != nil {
+				t.Fatalf("Failed to get event ID: %v", err)
+			}
+			if ev, err := s.GetEventById(id); err != nil || ev.Timestamp != events[5].Timestamp {
+				t.Fatalf("Failed to get event from shards: %v", err)
+			}
+			if err = s.DeleteEventById(id); err != nil {
+				t.Fatalf("Failed to delete event from shards: %v", err)
+			}
+			if _, err = s.GetEventById(id); err == nil {
+				t.Errorf("Expected deleted event not to be found")
+			}
+		})
+	}
+}
+
+func TestShards(t *testing.T) {
+	p := ByTime{Period: time.Hour}
+	tests := []struct {
+		f        filter.F
+		expected []int
+	}{
+		{filter.F{}, nil},
+		{filter.F{Since: 3600, Until: 3600*2 + 5}, []int{1, 2}},
+		{filter.F{Since: -1, Until: 10}, []int{0, 3}},
+		{filter.F{Since: 3600e3, Until: 3601e3, Unit: "ms"}, []int{1}},
+		{filter.F{Since: 0, Until: 3600 * 10}, nil},
+		{filter.F{Since: 3600, Until: 3600 * 5}, nil},
+	}
+	for i, tt := range tests {
+		if got := p.Shards(tt.f, 4); !slices.Equal(got, tt.expected) {
+			t.Errorf("Test %d: expected shards %v, got %v", i, tt.expected, got)
+		}
+	}
+	authors := [][]byte{bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)}
+	shards := ByPubkey{}.Shards(filter.F{Authors: authors}, 4)
+	for _, pk := range authors {
+		if !slices.Contains(shards, ByPubkey{}.Shard(&event.E{Pubkey: pk}, 4)) {
+			t.Errorf("Expected the shard of each author to be queried")
+		}
+	}
+}
+
+// reads is a shard that counts the events read from it by id.
+type reads struct {
+	*database.D
+	n *atomic.Int32
+}
+
+func (r reads) GetEventById(evId []byte) (ev *event.E, err error) {
+	r.n.Add(1)
+	return r.D.GetEventById(evId)
+}
+
+// plain is a shard that is not a database.Sorter.
+type plain struct{ database.I }
+
+// failing is a shard whose reads and deletes by id fail.
+type failing struct{ database.I }
+
+var errFailing = errors.New("shard failed")
+
+func (failing) GetEventById(evId []byte) (ev *event.E, err error) { return nil, errFailing }
+
+func (failing) DeleteEventById(evId []byte) (err error) { return errFailing }
+
+// TestShardReads tests that queries merge the results of shards without reading
+// the events from those that return what they are sorted by, and that the
+// failures of shards are returned rather than taken for missing events.
+func TestShardReads(t *testing.T) {
+	events, _ := generateEvents(t, 20)
+	var n atomic.Int32
+	single := newMemoryDB(t)
+	defer single.Close()
+	sorters := New(ByPubkey{}, reads{newMemoryDB(t), &n}, reads{newMemoryDB(t), &n})
+	defer sorters.Close()
+	plains := New(ByPubkey{}, plain{newMemoryDB(t)}, plain{newMemoryDB(t)})
+	defer plains.Close()
+	for _, ev := range events {
+		for _, db := range []database.I{single, sorters, plains} {
+			if err := db.StoreEvent(ev); err != nil {
+				t.Fatalf("Failed to store event: %v", err)
+			}
+		}
+	}
+	for _, f := range []filter.F{{Sort: "desc"}, {SortTag: "price", Limit: 5}} {
+		expected, err := single.QueryEvents(f)
+		if err != nil {
+			t.Fatalf("Failed to query events: %v", err)
+		}
+		for _, s := range []*S{sorters, plains} {
+			ids, err := s.QueryEvents(f)
+			if err != nil {
+				t.Fatalf("Failed to query shards: %v", err)
+			}
+			if !slices.EqualFunc(ids, expected, bytes.Equal) {
+				t.Errorf("Expected %d events in the order of a single database, got %d",
+					len(expected), len(ids))
+			}
+		}
+	}
+	if got := n.Load(); got != 0 {
+		t.Errorf("Expected no events read from shards that sort, got %d", got)
+	}
+
+	failed := New(ByPubkey{}, newMemoryDB(t), failing{newMemoryDB(t)})
+	defer failed.Close()
+	missing := make([]byte, 32)
+	if _, err := failed.GetEventById(missing); !errors.Is(err, errFailing) {
+		t.Errorf("Expected the error of the failing shard, got %v", err)
+	}
+	if err := failed.DeleteEventById(missing); !errors.Is(err, errFailing) {
+		t.Errorf("Expected the error of the failing shard, got %v", err)
+	}
+	healthy := New(ByPubkey{}, newMemoryDB(t), newMemoryDB(t))
+	defer healthy.Close()
+	if _, err := healthy.GetEventById(missing); !errors.Is(err, database.ErrEventNotFound) {
+		t.Errorf("Expected a missing event not to be found, got %v", err)
+	}
+	if err := healthy.DeleteEventById(missing); !errors.Is(err, database.ErrEventNotFound) {
+		t.Errorf("Expected a missing event not to be found, got %v", err)
+	}
+}
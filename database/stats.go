@@ -0,0 +1,382 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/hex"
+	"manifold.mleku.dev/log"
+)
+
+// TopStats is the number of authors and tags listed in Stats.
+const TopStats = 20
+
+// maxTallied is how many authors or tags are counted before the least of them
+// are forgotten.
+const maxTallied = 4096
+
+// Stats are the counts of the keys and events of the database, and its size
+// and query latencies.
+type Stats struct {
+	// Time is when the keys were counted. The counts are refreshed in the
+	// background when they are older than D.StatsInterval.
+	Time time.Time
+	// Took is how long counting the keys took.
+	Took time.Duration
+	// Events is the number of stored events.
+	Events int
+	// Prefixes are the counts of the keys of each index family, by prefix.
+	Prefixes map[string]PrefixStats
+	// Bytes is the total length of the keys and values of the index families.
+	Bytes int64
+	// Authors are those with the most bytes of events, the most first.
+	Authors []AuthorStats
+	// Tags are the most common tags, the most common first.
+	Tags []TagStats
+	// LSMSize and VlogSize are the sizes of the badger LSM tree and value log,
+	// which are zero for other stores.
+	LSMSize, VlogSize int64
+	// Queries is the histogram of the latencies of QueryEvents.
+	Queries Histogram
+	// Replication is how far the database has followed its primary, if it is
+	// a read replica.
+	Replication ReplicationStatus
+}
+
+// PrefixStats are the number of keys of an index family and the total length
+// of their keys and values.
+type PrefixStats struct {
+	Keys  int
+	Bytes int64
+}
+
+// AuthorStats are the number and total size of the events of an author.
+type AuthorStats struct {
+	Pubkey []byte
+	Events int
+	Bytes  int64
+}
+
+// TagStats are the number of events with a tag.
+type TagStats struct {
+	Key, Value []byte
+	Events     int
+}
+
+// LatencyBuckets are the upper bounds, in seconds, of the buckets of the
+// latency histograms.
+var LatencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram counts durations in the LatencyBuckets.
+type Histogram struct {
+	// Counts are the number of durations in each bucket that are more than
+	// the bound of the one before, with those over the last bound at the end.
+	Counts []uint64
+	// Count is the number of durations, and Sum their total.
+	Count uint64
+	Sum   time.Duration
+}
+
+// latency records durations for a Histogram.
+type latency struct {
+	counts [15]atomic.Uint64
+	sum    atomic.Int64
+}
+
+func (l *latency) observe(d time.Duration) {
+	i, _ := slices.BinarySearch(LatencyBuckets, d.Seconds())
+	l.counts[i].Add(1)
+	l.sum.Add(int64(d))
+}
+
+func (l *latency) histogram() (h Histogram) {
+	h.Counts = make([]uint64, len(l.counts))
+	for i := range l.counts {
+		h.Counts[i] = l.counts[i].Load()
+		h.Count += h.Counts[i]
+	}
+	h.Sum = time.Duration(l.sum.Load())
+	return
+}
+
+// statsCache holds the last counts of the keys of the database.
+type statsCache struct {
+	mx         sync.Mutex
+	last       *Stats
+	refreshing bool
+	queries    latency
+}
+
+// tally counts the events and bytes of many keys in bounded memory, forgetting
+// the least of them when there are more than twice maxTallied, so the counts of
+// the greatest are exact unless there are very many keys.
+type tally struct {
+	byBytes bool
+	counts  map[string]*AuthorStats
+}
+
+func newTally(byBytes bool) *tally {
+	return &tally{byBytes: byBytes, counts: make(map[string]*AuthorStats)}
+}
+
+func (t *tally) add(k string, size int64) {
+	c := t.counts[k]
+	if c == nil {
+		c = &AuthorStats{}
+		t.counts[k] = c
+	}
+	c.Events++
+	c.Bytes += size
+	if len(t.counts) > 2*maxTallied {
+		keys := t.top(len(t.counts))
+		for _, k := range keys[maxTallied:] {
+			delete(t.counts, k)
+		}
+	}
+}
+
+// top returns the n greatest keys, the greatest first.
+func (t *tally) top(n int) (keys []string) {
+	for k := range t.counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ci, cj := t.counts[keys[i]], t.counts[keys[j]]
+		if t.byBytes && ci.Bytes != cj.Bytes {
+			return ci.Bytes > cj.Bytes
+		}
+		if ci.Events != cj.Events {
+			return ci.Events > cj.Events
+		}
+		return keys[i] < keys[j]
+	})
+	return keys[:min(n, len(keys))]
+}
+
+// Stats returns the counts of the keys and events of the database, and its
+// sizes and query latencies. The counts are taken by reading every key, which
+// the first call waits for; after that they are refreshed in the background
+// when they are older than StatsInterval, and the last are returned, so Stats
+// is cheap to call often.
+func (d *D) Stats() (s *Stats, err error) {
+	c := &d.stats
+	c.mx.Lock()
+	last := c.last
+	if last != nil && !c.refreshing && now().Sub(last.Time) > d.StatsInterval &&
+		d.ctx.Err() == nil {
+		c.refreshing = true
+		d.workers.Add(1)
+		go func() {
+			defer d.workers.Done()
+			counted, err := d.countKeys()
+			c.mx.Lock()
+			defer c.mx.Unlock()
+			c.refreshing = false
+			if chk.E(err) {
+				return
+			}
+			c.last = counted
+		}()
+	}
+	c.mx.Unlock()
+	if last == nil {
+		if last, err = d.countKeys(); chk.E(err) {
+			return
+		}
+		c.mx.Lock()
+		c.last = last
+		c.mx.Unlock()
+	}
+	counts := *last
+	s = &counts
+	if d.bdb != nil {
+		s.LSMSize, s.VlogSize = d.bdb.Size()
+	}
+	s.Queries = c.queries.histogram()
+	s.Replication = d.root().ReplicationStatus()
+	return
+}
+
+// countKeys reads every key of the index families, and every event, to count
+// them.
+func (d *D) countKeys() (s *Stats, err error) {
+	start := now()
+	s = &Stats{Time: start, Prefixes: make(map[string]PrefixStats)}
+	authors, tags := newTally(true), newTally(false)
+	evPrefix := []byte(indexes.Prefix(indexes.Event))
+	if err = d.View(func(txn store.Txn) (err error) {
+		it := txn.NewIterator(store.IteratorOptions{})
+		defer it.Close()
+		for it.Seek(nil); it.Valid(); it.Next() {
+			if d.ctx.Err() != nil {
+				return d.ctx.Err()
+			}
+			k := it.Key()
+			if indexes.Identify(k) < 0 {
+				continue
+			}
+			var val []byte
+			if val, err = it.Value(); chk.E(err) {
+				return
+			}
+			size := int64(len(k) + len(val))
+			p := s.Prefixes[string(k[:2])]
+			p.Keys++
+			p.Bytes += size
+			s.Prefixes[string(k[:2])] = p
+			s.Bytes += size
+			if !bytes.HasPrefix(k, evPrefix) {
+				continue
+			}
+			s.Events++
+			ev := &event.E{}
+			if err = ev.ReadBinary(bytes.NewBuffer(val)); err != nil {
+				err = nil
+				continue
+			}
+			authors.add(string(ev.Pubkey), size)
+			if ev.Tags != nil {
+				for _, t := range *ev.Tags {
+					tags.add(string(t.Key)+"\x00"+string(t.Value), 0)
+				}
+			}
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	for _, k := range authors.top(TopStats) {
+		a := authors.counts[k]
+		s.Authors = append(s.Authors, AuthorStats{Pubkey: []byte(k), Events: a.Events, Bytes: a.Bytes})
+	}
+	for _, k := range tags.top(TopStats) {
+		key, value, _ := strings.Cut(k, "\x00")
+		s.Tags = append(s.Tags, TagStats{Key: []byte(key), Value: []byte(value),
+			Events: tags.counts[k].Events})
+	}
+	s.Took = now().Sub(start)
+	log.D.F("counted %d events in %v", s.Events, s.Took)
+	return
+}
+
+func (s *Stats) String() string {
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "counted:  %s in %v\n", s.Time.Format(time.RFC3339), s.Took)
+	fmt.Fprintf(b, "events:   %d\n", s.Events)
+	fmt.Fprintf(b, "bytes:    %d\n", s.Bytes)
+	fmt.Fprintf(b, "lsm:      %d\n", s.LSMSize)
+	fmt.Fprintf(b, "vlog:     %d\n", s.VlogSize)
+	fmt.Fprintf(b, "queries:  %d in %v\n", s.Queries.Count, s.Queries.Sum)
+	if s.Replication.Following {
+		fmt.Fprintf(b, "replica:  at %d, %v behind\n", s.Replication.Position, s.Replication.Lag)
+	}
+	fmt.Fprintf(b, "prefixes:\n")
+	for _, p := range slices.Sorted(maps.Keys(s.Prefixes)) {
+		fmt.Fprintf(b, "  %s %12d keys %14d bytes\n", p, s.Prefixes[p].Keys, s.Prefixes[p].Bytes)
+	}
+	fmt.Fprintf(b, "authors:\n")
+	for _, a := range s.Authors {
+		fmt.Fprintf(b, "  %s %8d events %12d bytes\n", hex.Enc(a.Pubkey), a.Events, a.Bytes)
+	}
+	fmt.Fprintf(b, "tags:")
+	for _, t := range s.Tags {
+		fmt.Fprintf(b, "\n  %8d %q %q", t.Events, t.Key, t.Value)
+	}
+	return b.String()
+}
+
+// labelEscaper escapes the value of a Prometheus label.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// label quotes the value of a Prometheus label, in hex if it is not text.
+func label(v []byte) string {
+	if !utf8.Valid(v) {
+		return `"` + hex.Enc(v) + `"`
+	}
+	return `"` + labelEscaper.Replace(string(v)) + `"`
+}
+
+// WritePrometheus writes the stats in the Prometheus text exposition format.
+func (s *Stats) WritePrometheus(w io.Writer) (err error) {
+	b := new(bytes.Buffer)
+	metric := func(name, help, typ string) {
+		fmt.Fprintf(b, "# HELP manifold_%s %s\n# TYPE manifold_%s %s\n", name, help, name, typ)
+	}
+	metric("events", "Number of stored events.", "gauge")
+	fmt.Fprintf(b, "manifold_events %d\n", s.Events)
+	metric("bytes", "Total length of the keys and values of the indexes.", "gauge")
+	fmt.Fprintf(b, "manifold_bytes %d\n", s.Bytes)
+	metric("index_keys", "Number of keys of each index prefix.", "gauge")
+	prefixes := slices.Sorted(maps.Keys(s.Prefixes))
+	for _, p := range prefixes {
+		fmt.Fprintf(b, "manifold_index_keys{prefix=%q} %d\n", p, s.Prefixes[p].Keys)
+	}
+	metric("index_bytes", "Total length of the keys and values of each index prefix.", "gauge")
+	for _, p := range prefixes {
+		fmt.Fprintf(b, "manifold_index_bytes{prefix=%q} %d\n", p, s.Prefixes[p].Bytes)
+	}
+	metric("author_bytes", "Total size of the events of the largest authors.", "gauge")
+	for _, a := range s.Authors {
+		fmt.Fprintf(b, "manifold_author_bytes{pubkey=%q} %d\n", hex.Enc(a.Pubkey), a.Bytes)
+	}
+	metric("tag_events", "Number of events with the most common tags.", "gauge")
+	for _, t := range s.Tags {
+		fmt.Fprintf(b, "manifold_tag_events{key=%s,value=%s} %d\n", label(t.Key), label(t.Value), t.Events)
+	}
+	metric("lsm_bytes", "Size of the badger LSM tree.", "gauge")
+	fmt.Fprintf(b, "manifold_lsm_bytes %d\n", s.LSMSize)
+	metric("vlog_bytes", "Size of the badger value log.", "gauge")
+	fmt.Fprintf(b, "manifold_vlog_bytes %d\n", s.VlogSize)
+	metric("stats_age_seconds", "Age of the counts of keys, events, authors and tags.", "gauge")
+	fmt.Fprintf(b, "manifold_stats_age_seconds %g\n", now().Sub(s.Time).Seconds())
+	metric("query_duration_seconds", "Latency of event queries.", "histogram")
+	var cumulative uint64
+	for i, n := range s.Queries.Counts {
+		cumulative += n
+		le := "+Inf"
+		if i < len(LatencyBuckets) {
+			le = strconv.FormatFloat(LatencyBuckets[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(b, "manifold_query_duration_seconds_bucket{le=%q} %d\n", le, cumulative)
+	}
+	fmt.Fprintf(b, "manifold_query_duration_seconds_sum %g\n", s.Queries.Sum.Seconds())
+	fmt.Fprintf(b, "manifold_query_duration_seconds_count %d\n", s.Queries.Count)
+	if s.Replication.Following {
+		metric("replication_position", "Position of the primary the replica has applied the changes up to.", "gauge")
+		fmt.Fprintf(b, "manifold_replication_position %d\n", s.Replication.Position)
+		metric("replication_lag_seconds", "How long ago the primary was at the position of the replica.", "gauge")
+		fmt.Fprintf(b, "manifold_replication_lag_seconds %g\n", s.Replication.Lag.Seconds())
+	}
+	_, err = w.Write(b.Bytes())
+	return
+}
+
+// MetricsHandler returns an HTTP handler that serves the Stats of the database
+// in the Prometheus text exposition format, to be mounted on a path such as
+// /metrics.
+func (d *D) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := d.Stats()
+		if chk.E(err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		chk.E(s.WritePrometheus(w))
+	})
+}
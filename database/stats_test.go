@@ -0,0 +1,89 @@
+package database
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"manifold.mleku.dev/filter"
+)
+
+func TestStats(t *testing.T) {
+	db := newMemoryDB(t)
+	defer db.Close()
+	events, err := generateTestEvents(9)
+	if err != nil {
+		t.Fatalf("Failed to generate test events: %v", err)
+	}
+	for _, ev := range events[:6] {
+		if err = db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+	for range 3 {
+		if _, err = db.QueryEvents(filter.F{}); err != nil {
+			t.Fatalf("Failed to query events: %v", err)
+		}
+	}
+	s, err := db.Stats()
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+	if s.Events != 6 || s.Prefixes["ev"].Keys != 6 || s.Prefixes["id"].Keys != 6 {
+		t.Errorf("Expected 6 events and id keys, got %d, %+v", s.Events, s.Prefixes)
+	}
+	if s.Prefixes["tt"].Keys == 0 || s.Bytes == 0 {
+		t.Errorf("Expected tag keys and bytes to be counted")
+	}
+	// the events are by three authors, two each, and half are of type text
+	if len(s.Authors) != 3 || s.Authors[0].Events != 2 || s.Authors[0].Bytes < s.Authors[2].Bytes {
+		t.Errorf("Unexpected authors %+v", s.Authors)
+	}
+	if len(s.Tags) == 0 || string(s.Tags[0].Key) != "type" || s.Tags[0].Events != 3 {
+		t.Errorf("Expected type text to be the most common tag, got %+v", s.Tags)
+	}
+	if s.Queries.Count != 3 || s.Queries.Sum <= 0 {
+		t.Errorf("Expected 3 queries in the latency histogram, got %d", s.Queries.Count)
+	}
+
+	// the counts are refreshed in the background once they are stale
+	for _, ev := range events[6:] {
+		if err = db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+	}
+	if s, err = db.Stats(); err != nil || s.Events != 6 {
+		t.Fatalf("Expected the cached count of 6 events, got %d: %v", s.Events, err)
+	}
+	db.StatsInterval = 0
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Events != 9 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		if s, err = db.Stats(); err != nil {
+			t.Fatalf("Failed to get stats: %v", err)
+		}
+	}
+	if s.Events != 9 {
+		t.Fatalf("Expected the count to be refreshed to 9 events, got %d", s.Events)
+	}
+
+	rec := httptest.NewRecorder()
+	db.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		"manifold_events 9\n",
+		`manifold_index_keys{prefix="ev"} 9` + "\n",
+		`manifold_tag_events{key="type",value="text"} 5` + "\n",
+		`manifold_query_duration_seconds_bucket{le="+Inf"} 3` + "\n",
+		"manifold_query_duration_seconds_count 3\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Expected metrics to contain %q", line)
+		}
+	}
+	if !bytes.HasPrefix(rec.Body.Bytes(), []byte("# HELP")) {
+		t.Errorf("Expected metrics in the Prometheus text format")
+	}
+}
@@ -2,16 +2,21 @@ package database
 
 import (
 	"bytes"
-	"time"
 
 	"manifold.mleku.dev/chk"
 	"manifold.mleku.dev/database/indexes"
 	"manifold.mleku.dev/database/indexes/types/number"
+	"manifold.mleku.dev/database/store"
 	"manifold.mleku.dev/errorf"
 	"manifold.mleku.dev/event"
 )
 
 func (d *D) StoreEvent(ev *event.E) (err error) {
+	if err = d.writable(); err != nil {
+		return
+	}
+	d.serials.RLock()
+	defer d.serials.RUnlock()
 	var ev2 *number.Uint40
 	var eid []byte
 	if eid, err = ev.Id(); chk.E(err) {
@@ -24,18 +29,21 @@ func (d *D) StoreEvent(ev *event.E) (err error) {
 	if ev2 != nil {
 		// we did found it
 		err = errorf.E("duplicate event")
+		return
 	}
 	var ser *number.Uint40
 	var idxs [][]byte
 	if idxs, ser, err = d.GetEventIndexes(ev); chk.E(err) {
 		return
 	}
-	evK := new(bytes.Buffer)
-	if err = indexes.EventEnc(ser).MarshalWrite(evK); chk.E(err) {
+	// the event is first accessed when it is stored.
+	ts := new(number.Uint64)
+	ts.Set(uint64(now().Unix()))
+	var acc [][]byte
+	if acc, err = accessKeys(ser, ts); chk.E(err) {
 		return
 	}
-	ts := new(number.Uint64)
-	ts.Set(uint64(time.Now().Unix()))
+	idxs = append(idxs, acc...)
 	// write indexes; none of the above have values.
 	for _, v := range idxs {
 		if err = d.Set(v, nil); chk.E(err) {
@@ -52,8 +60,18 @@ func (d *D) StoreEvent(ev *event.E) (err error) {
 	if err = ev.WriteBinary(evV); chk.E(err) {
 		return
 	}
-	if err = d.Set(evk.Bytes(), evV.Bytes()); chk.E(err) {
+	d.feed.commit.RLock()
+	defer d.feed.commit.RUnlock()
+	c := Change{Serial: ser.Get(), Event: ev}
+	if err = d.updateWithWords(ev, 1, func(txn store.Txn) (err error) {
+		if err = txn.Set(evk.Bytes(), evV.Bytes()); chk.E(err) {
+			return
+		}
+		return d.pendViews(txn, c)
+	}); err != nil {
 		return
 	}
+	d.updateViews(c)
+	d.publish(c)
 	return
 }
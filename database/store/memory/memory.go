@@ -0,0 +1,297 @@
+// Package memory is an implementation of store.I that keeps its keys in an
+// ordered map in memory, for tests, and for relays and apps that do not need
+// their events to outlive the process.
+//
+// The map is a persistent treap: read-only transactions work on an immutable
+// snapshot of it and never block, while read-write transactions are run one at
+// a time and replace the snapshot when they commit.
+package memory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/errorf"
+)
+
+// S is an in-memory ordered key/value store.
+type S struct {
+	root atomic.Pointer[node]
+	// mx serializes writers.
+	mx     sync.Mutex
+	closed atomic.Bool
+}
+
+var _ store.I = (*S)(nil)
+
+// New creates an empty in-memory store.
+func New() (s *S) { return &S{} }
+
+func (s *S) check() (err error) {
+	if s.closed.Load() {
+		err = errorf.E("memory store is closed")
+	}
+	return
+}
+
+// View runs fn on a snapshot of the store.
+func (s *S) View(fn func(txn store.Txn) (err error)) (err error) {
+	if err = s.check(); err != nil {
+		return
+	}
+	return fn(&txn{root: s.root.Load()})
+}
+
+// Update runs fn in a transaction, and commits its writes if it returns no
+// error. Updates run one at a time so they cannot conflict.
+func (s *S) Update(fn func(txn store.Txn) (err error)) (err error) {
+	if err = s.check(); err != nil {
+		return
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	t := &txn{root: s.root.Load(), writable: true}
+	if err = fn(t); err != nil {
+		return
+	}
+	s.root.Store(t.root)
+	return
+}
+
+// NewWriteBatch creates a batch that applies its writes when flushed.
+func (s *S) NewWriteBatch() store.WriteBatch { return &batch{s: s} }
+
+// DropPrefix deletes every key that starts with any of the prefixes.
+func (s *S) DropPrefix(prefixes ...[]byte) (err error) {
+	return s.Update(func(tx store.Txn) (err error) {
+		t := tx.(*txn)
+		for _, prf := range prefixes {
+			var keys [][]byte
+			it := t.NewIterator(store.IteratorOptions{Prefix: prf})
+			for it.Seek(prf); it.Valid(); it.Next() {
+				keys = append(keys, it.Key())
+			}
+			it.Close()
+			for _, k := range keys {
+				t.root = remove(t.root, k)
+			}
+		}
+		return
+	})
+}
+
+// GetSequence returns a sequence stored under key. The bandwidth is ignored,
+// as there is no cost to storing every value.
+func (s *S) GetSequence(key []byte, _ uint64) (seq store.Sequence, err error) {
+	if err = s.check(); err != nil {
+		return
+	}
+	seq = &sequence{s: s, key: bytes.Clone(key)}
+	return
+}
+
+// Size returns the number of bytes of the keys and values in the store.
+func (s *S) Size() (size int64) {
+	var walk func(n *node)
+	walk = func(n *node) {
+		if n == nil {
+			return
+		}
+		size += int64(len(n.key) + len(n.val))
+		walk(n.left)
+		walk(n.right)
+	}
+	walk(s.root.Load())
+	return
+}
+
+// PrefixSize returns the number of bytes of the keys that start with a prefix,
+// and their values.
+func (s *S) PrefixSize(prefix []byte) (size int64) {
+	var walk func(n *node)
+	walk = func(n *node) {
+		if n == nil {
+			return
+		}
+		if bytes.HasPrefix(n.key, prefix) {
+			size += int64(len(n.key) + len(n.val))
+		}
+		walk(n.left)
+		walk(n.right)
+	}
+	walk(s.root.Load())
+	return
+}
+
+// Close marks the store closed, after which transactions return an error.
+func (s *S) Close() (err error) {
+	s.closed.Store(true)
+	return
+}
+
+type txn struct {
+	root     *node
+	writable bool
+}
+
+func (t *txn) Get(key []byte) (val []byte, err error) {
+	n := find(t.root, key)
+	if n == nil {
+		err = store.ErrKeyNotFound
+		return
+	}
+	val = bytes.Clone(n.val)
+	return
+}
+
+func (t *txn) Set(key, val []byte) (err error) {
+	if !t.writable {
+		err = errorf.E("set in read-only transaction")
+		return
+	}
+	t.root = insert(t.root, bytes.Clone(key), bytes.Clone(val))
+	return
+}
+
+func (t *txn) Delete(key []byte) (err error) {
+	if !t.writable {
+		err = errorf.E("delete in read-only transaction")
+		return
+	}
+	t.root = remove(t.root, key)
+	return
+}
+
+func (t *txn) NewIterator(opts store.IteratorOptions) store.Iterator {
+	return &iterator{root: t.root, opts: opts}
+}
+
+// iterator walks a snapshot of the treap, keeping the path to the current node
+// that has yet to be visited on a stack.
+type iterator struct {
+	root  *node
+	opts  store.IteratorOptions
+	stack []*node
+}
+
+// Seek finds the least key not less than key, or the greatest not greater than
+// key if the iterator is reversed.
+func (it *iterator) Seek(key []byte) {
+	it.stack = it.stack[:0]
+	for n := it.root; n != nil; {
+		c := bytes.Compare(n.key, key)
+		switch {
+		case c == 0:
+			it.stack = append(it.stack, n)
+			return
+		case (c > 0) != it.opts.Reverse:
+			it.stack = append(it.stack, n)
+			n = it.near(n)
+		default:
+			n = it.far(n)
+		}
+	}
+}
+
+// near and far are the children towards the start and the end of the
+// iteration.
+func (it *iterator) near(n *node) *node {
+	if it.opts.Reverse {
+		return n.right
+	}
+	return n.left
+}
+
+func (it *iterator) far(n *node) *node {
+	if it.opts.Reverse {
+		return n.left
+	}
+	return n.right
+}
+
+func (it *iterator) Valid() bool {
+	if len(it.stack) == 0 {
+		return false
+	}
+	return bytes.HasPrefix(it.stack[len(it.stack)-1].key, it.opts.Prefix)
+}
+
+func (it *iterator) Next() {
+	n := it.stack[len(it.stack)-1]
+	it.stack = it.stack[:len(it.stack)-1]
+	for n = it.far(n); n != nil; n = it.near(n) {
+		it.stack = append(it.stack, n)
+	}
+}
+
+func (it *iterator) Key() []byte { return bytes.Clone(it.stack[len(it.stack)-1].key) }
+
+func (it *iterator) Value() (val []byte, err error) {
+	return bytes.Clone(it.stack[len(it.stack)-1].val), nil
+}
+
+func (it *iterator) Close() {}
+
+type op struct {
+	key, val []byte
+	del      bool
+}
+
+type batch struct {
+	s   *S
+	ops []op
+}
+
+func (b *batch) Set(key, val []byte) (err error) {
+	b.ops = append(b.ops, op{key: bytes.Clone(key), val: bytes.Clone(val)})
+	return
+}
+
+func (b *batch) Delete(key []byte) (err error) {
+	b.ops = append(b.ops, op{key: bytes.Clone(key), del: true})
+	return
+}
+
+func (b *batch) Flush() (err error) {
+	ops := b.ops
+	b.ops = nil
+	return b.s.Update(func(tx store.Txn) (err error) {
+		for _, o := range ops {
+			if o.del {
+				err = tx.Delete(o.key)
+			} else {
+				err = tx.Set(o.key, o.val)
+			}
+			if err != nil {
+				return
+			}
+		}
+		return
+	})
+}
+
+func (b *batch) Cancel() { b.ops = nil }
+
+// sequence stores its last value as an 8 byte big endian number under its key.
+type sequence struct {
+	s   *S
+	key []byte
+}
+
+func (q *sequence) Next() (n uint64, err error) {
+	err = q.s.Update(func(tx store.Txn) (err error) {
+		var val []byte
+		if val, err = tx.Get(q.key); err == nil && len(val) == 8 {
+			n = binary.BigEndian.Uint64(val)
+		}
+		val = make([]byte, 8)
+		binary.BigEndian.PutUint64(val, n+1)
+		return tx.Set(q.key, val)
+	})
+	return
+}
+
+func (q *sequence) Release() (err error) { return }
@@ -0,0 +1,77 @@
+package memory
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"manifold.mleku.dev/database/store"
+)
+
+// TestIterator tests that iteration follows key order in both directions
+// within a prefix, and that a view keeps its snapshot while the store changes.
+func TestIterator(t *testing.T) {
+	s := New()
+	defer s.Close()
+	var err error
+	if err = s.Update(func(txn store.Txn) (err error) {
+		// insert in an order unrelated to the key order
+		for _, i := range []int{5, 2, 8, 0, 9, 3, 7, 1, 6, 4} {
+			for _, p := range []string{"a", "b", "c"} {
+				if err = txn.Set([]byte(fmt.Sprintf("%s%d", p, i)), []byte{byte(i)}); err != nil {
+					return
+				}
+			}
+		}
+		return
+	}); err != nil {
+		t.Fatalf("Failed to write keys: %v", err)
+	}
+	collect := func(txn store.Txn, reverse bool, seek string) (keys []string) {
+		it := txn.NewIterator(store.IteratorOptions{Prefix: []byte("b"), Reverse: reverse})
+		defer it.Close()
+		for it.Seek([]byte(seek)); it.Valid(); it.Next() {
+			keys = append(keys, string(it.Key()))
+		}
+		return
+	}
+	if err = s.View(func(txn store.Txn) (err error) {
+		if got := fmt.Sprint(collect(txn, false, "b")); got != "[b0 b1 b2 b3 b4 b5 b6 b7 b8 b9]" {
+			t.Fatalf("Unexpected forward iteration %s", got)
+		}
+		if got := fmt.Sprint(collect(txn, true, "b\xff")); got != "[b9 b8 b7 b6 b5 b4 b3 b2 b1 b0]" {
+			t.Fatalf("Unexpected reverse iteration %s", got)
+		}
+		if got := fmt.Sprint(collect(txn, false, "b45")); got != "[b5 b6 b7 b8 b9]" {
+			t.Fatalf("Unexpected iteration from seek %s", got)
+		}
+		if got := fmt.Sprint(collect(txn, true, "b45")); got != "[b4 b3 b2 b1 b0]" {
+			t.Fatalf("Unexpected reverse iteration from seek %s", got)
+		}
+		// the view must not see writes committed after it started.
+		if err = s.DropPrefix([]byte("b")); err != nil {
+			return
+		}
+		var val []byte
+		if val, err = txn.Get([]byte("b3")); err != nil {
+			return
+		}
+		if !bytes.Equal(val, []byte{3}) {
+			t.Fatalf("Unexpected value %v", val)
+		}
+		return
+	}); err != nil {
+		t.Fatalf("View failed: %v", err)
+	}
+	if err = s.View(func(txn store.Txn) (err error) {
+		if _, err = txn.Get([]byte("b3")); err != store.ErrKeyNotFound {
+			t.Fatalf("Expected dropped key to be gone, got %v", err)
+		}
+		if got := fmt.Sprint(collect(txn, false, "b")); got != "[]" {
+			t.Fatalf("Expected no keys with dropped prefix, got %s", got)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("View failed: %v", err)
+	}
+}
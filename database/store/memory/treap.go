@@ -0,0 +1,88 @@
+package memory
+
+import (
+	"bytes"
+	"hash/fnv"
+)
+
+// node is a node of a persistent treap ordered by key, and heap ordered by a
+// priority derived from a hash of the key. Nodes are never modified once they
+// are part of a tree; writes copy the path from the root to the changed node,
+// so a root is an immutable snapshot of the whole map.
+type node struct {
+	key, val    []byte
+	prio        uint64
+	left, right *node
+}
+
+func priority(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return h.Sum64()
+}
+
+// split divides t into the keys less than key, and the rest. If inclusive is
+// true, keys equal to key go to the left.
+func split(t *node, key []byte, inclusive bool) (l, r *node) {
+	if t == nil {
+		return
+	}
+	c := bytes.Compare(t.key, key)
+	if c < 0 || (inclusive && c == 0) {
+		n := *t
+		n.right, r = split(t.right, key, inclusive)
+		l = &n
+		return
+	}
+	n := *t
+	l, n.left = split(t.left, key, inclusive)
+	r = &n
+	return
+}
+
+// merge joins two treaps where every key of l is less than every key of r.
+func merge(l, r *node) *node {
+	switch {
+	case l == nil:
+		return r
+	case r == nil:
+		return l
+	case l.prio > r.prio:
+		n := *l
+		n.right = merge(l.right, r)
+		return &n
+	default:
+		n := *r
+		n.left = merge(l, r.left)
+		return &n
+	}
+}
+
+// insert returns t with key set to val.
+func insert(t *node, key, val []byte) *node {
+	l, r := split(t, key, false)
+	_, r = split(r, key, true)
+	return merge(merge(l, &node{key: key, val: val, prio: priority(key)}), r)
+}
+
+// remove returns t without key.
+func remove(t *node, key []byte) *node {
+	l, r := split(t, key, false)
+	_, r = split(r, key, true)
+	return merge(l, r)
+}
+
+// find returns the node of key, or nil.
+func find(t *node, key []byte) *node {
+	for t != nil {
+		switch c := bytes.Compare(key, t.key); {
+		case c < 0:
+			t = t.left
+		case c > 0:
+			t = t.right
+		default:
+			return t
+		}
+	}
+	return nil
+}
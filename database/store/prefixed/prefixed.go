@@ -0,0 +1,111 @@
+// Package prefixed is an implementation of store.I that keeps its keys in
+// another store under a prefix, so that several databases can share one store,
+// and its cache, without seeing each other's keys.
+package prefixed
+
+import (
+	"bytes"
+
+	"manifold.mleku.dev/database/store"
+)
+
+// S is a view of the keys of a store that start with a prefix, with the prefix
+// removed.
+type S struct {
+	s      store.I
+	prefix []byte
+}
+
+var _ store.I = (*S)(nil)
+var _ store.PrefixSizer = (*S)(nil)
+
+// New creates a view of the keys of s under prefix. No prefix may be the start
+// of the prefix of another view of the same store.
+func New(s store.I, prefix []byte) *S {
+	return &S{s: s, prefix: bytes.Clone(prefix)}
+}
+
+// Prefix returns the prefix of the keys of the view in the underlying store.
+func (s *S) Prefix() []byte { return s.prefix }
+
+// key returns a key with the prefix of the view.
+func (s *S) key(k []byte) []byte {
+	return append(bytes.Clone(s.prefix), k...)
+}
+
+func (s *S) View(fn func(txn store.Txn) (err error)) (err error) {
+	return s.s.View(func(txn store.Txn) error { return fn(&txnView{txn, s}) })
+}
+
+func (s *S) Update(fn func(txn store.Txn) (err error)) (err error) {
+	return s.s.Update(func(txn store.Txn) error { return fn(&txnView{txn, s}) })
+}
+
+func (s *S) NewWriteBatch() store.WriteBatch { return &batch{s.s.NewWriteBatch(), s} }
+
+func (s *S) DropPrefix(prefixes ...[]byte) (err error) {
+	if len(prefixes) == 0 {
+		return
+	}
+	p := make([][]byte, len(prefixes))
+	for i := range prefixes {
+		p[i] = s.key(prefixes[i])
+	}
+	return s.s.DropPrefix(p...)
+}
+
+func (s *S) GetSequence(key []byte, bandwidth uint64) (seq store.Sequence, err error) {
+	return s.s.GetSequence(s.key(key), bandwidth)
+}
+
+// Size returns the number of bytes of the keys of the view and their values, or
+// zero if the underlying store cannot report it.
+func (s *S) Size() (size int64) { return s.PrefixSize(nil) }
+
+// PrefixSize returns the number of bytes of the keys of the view that start
+// with a prefix and their values, or zero if the underlying store cannot report
+// it.
+func (s *S) PrefixSize(prefix []byte) (size int64) {
+	if ps, ok := s.s.(store.PrefixSizer); ok {
+		size = ps.PrefixSize(s.key(prefix))
+	}
+	return
+}
+
+// Close does nothing, as the underlying store is shared. It must be closed by
+// its owner after the views of it.
+func (s *S) Close() (err error) { return }
+
+type txnView struct {
+	store.Txn
+	s *S
+}
+
+func (t *txnView) Get(key []byte) (val []byte, err error) { return t.Txn.Get(t.s.key(key)) }
+
+func (t *txnView) Set(key, val []byte) (err error) { return t.Txn.Set(t.s.key(key), val) }
+
+func (t *txnView) Delete(key []byte) (err error) { return t.Txn.Delete(t.s.key(key)) }
+
+func (t *txnView) NewIterator(opts store.IteratorOptions) store.Iterator {
+	opts.Prefix = t.s.key(opts.Prefix)
+	return &iterator{t.Txn.NewIterator(opts), t.s}
+}
+
+type iterator struct {
+	store.Iterator
+	s *S
+}
+
+func (it *iterator) Seek(key []byte) { it.Iterator.Seek(it.s.key(key)) }
+
+func (it *iterator) Key() []byte { return it.Iterator.Key()[len(it.s.prefix):] }
+
+type batch struct {
+	store.WriteBatch
+	s *S
+}
+
+func (b *batch) Set(key, val []byte) (err error) { return b.WriteBatch.Set(b.s.key(key), val) }
+
+func (b *batch) Delete(key []byte) (err error) { return b.WriteBatch.Delete(b.s.key(key)) }
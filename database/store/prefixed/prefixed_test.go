@@ -0,0 +1,70 @@
+package prefixed
+
+import (
+	"fmt"
+	"testing"
+
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/database/store/memory"
+)
+
+// TestIsolation tests that views under different prefixes of a store see only
+// their own keys, and that dropping a prefix in one leaves the others.
+func TestIsolation(t *testing.T) {
+	m := memory.New()
+	defer m.Close()
+	a, b := New(m, []byte("A:")), New(m, []byte("B:"))
+	var err error
+	for i, s := range []*S{a, b} {
+		if err = s.Update(func(txn store.Txn) (err error) {
+			for _, k := range []string{"x1", "x2", "y1"} {
+				if err = txn.Set([]byte(k), []byte{byte(i)}); err != nil {
+					return
+				}
+			}
+			return
+		}); err != nil {
+			t.Fatalf("Failed to write keys: %v", err)
+		}
+	}
+	collect := func(s *S, reverse bool, seek string) (keys []string) {
+		if err := s.View(func(txn store.Txn) (err error) {
+			it := txn.NewIterator(store.IteratorOptions{Prefix: []byte("x"), Reverse: reverse})
+			defer it.Close()
+			for it.Seek([]byte(seek)); it.Valid(); it.Next() {
+				keys = append(keys, string(it.Key()))
+			}
+			return
+		}); err != nil {
+			t.Fatalf("Failed to read keys: %v", err)
+		}
+		return
+	}
+	if got := fmt.Sprint(collect(a, false, "x")); got != "[x1 x2]" {
+		t.Fatalf("Unexpected forward iteration %s", got)
+	}
+	if got := fmt.Sprint(collect(b, true, "x\xff")); got != "[x2 x1]" {
+		t.Fatalf("Unexpected reverse iteration %s", got)
+	}
+	if err = b.View(func(txn store.Txn) (err error) {
+		var v []byte
+		if v, err = txn.Get([]byte("y1")); err != nil {
+			return
+		}
+		if v[0] != 1 {
+			t.Errorf("Expected the value written to B, got %d", v[0])
+		}
+		return
+	}); err != nil {
+		t.Fatalf("Failed to get key: %v", err)
+	}
+	if err = a.DropPrefix([]byte("x")); err != nil {
+		t.Fatalf("Failed to drop prefix: %v", err)
+	}
+	if got := fmt.Sprint(collect(a, false, "x")); got != "[]" {
+		t.Fatalf("Expected no keys after drop, got %s", got)
+	}
+	if got := fmt.Sprint(collect(b, false, "x")); got != "[x1 x2]" {
+		t.Fatalf("Expected B to keep its keys, got %s", got)
+	}
+}
@@ -0,0 +1,107 @@
+// Package store defines the ordered key/value store that the event database
+// keeps its events and indexes in, so that it can run on badger on disk or on
+// a store held in memory.
+//
+// The interfaces follow the shape of the subset of badger that the database
+// uses: read-only and read-write transactions, prefix iterators, write batches
+// for bulk loading, and monotonic sequences.
+package store
+
+import (
+	"errors"
+)
+
+var (
+	// ErrKeyNotFound is returned by Txn.Get when the key does not exist.
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrConflict is returned by I.Update when the transaction conflicts
+	// with another that committed first, and may be retried.
+	ErrConflict = errors.New("transaction conflict")
+)
+
+// I is an ordered key/value store.
+type I interface {
+	// View runs fn in a read-only transaction that sees a consistent snapshot
+	// of the store.
+	View(fn func(txn Txn) (err error)) (err error)
+	// Update runs fn in a read-write transaction, which is committed if fn
+	// returns no error.
+	Update(fn func(txn Txn) (err error)) (err error)
+	// NewWriteBatch creates a batch of writes that are applied without the
+	// size limits of a transaction, for bulk changes.
+	NewWriteBatch() WriteBatch
+	// DropPrefix deletes every key that starts with any of the prefixes.
+	DropPrefix(prefixes ...[]byte) (err error)
+	// GetSequence returns a monotonic sequence stored under key. Values are
+	// leased from the store in blocks of bandwidth.
+	GetSequence(key []byte, bandwidth uint64) (seq Sequence, err error)
+	// Close releases the resources of the store.
+	Close() (err error)
+}
+
+// Sizer is implemented by stores that can report the number of bytes they use.
+type Sizer interface {
+	Size() (size int64)
+}
+
+// PrefixSizer is implemented by stores that can report the number of bytes of
+// the keys that start with a prefix, and their values.
+type PrefixSizer interface {
+	PrefixSize(prefix []byte) (size int64)
+}
+
+// Txn is a transaction on a store.
+type Txn interface {
+	// Get returns a copy of the value of a key, or ErrKeyNotFound.
+	Get(key []byte) (val []byte, err error)
+	// Set writes the value of a key.
+	Set(key, val []byte) (err error)
+	// Delete removes a key.
+	Delete(key []byte) (err error)
+	// NewIterator creates an iterator over the keys of the transaction,
+	// including the writes made in it.
+	NewIterator(opts IteratorOptions) Iterator
+}
+
+// IteratorOptions configure an Iterator.
+type IteratorOptions struct {
+	// Prefix limits the iteration to keys starting with it.
+	Prefix []byte
+	// Reverse iterates from the greatest key to the least.
+	Reverse bool
+}
+
+// Iterator walks the keys of a transaction in order.
+type Iterator interface {
+	// Seek moves to the least key greater than or equal to key, or with
+	// Reverse, the greatest key less than or equal to key.
+	Seek(key []byte)
+	// Valid returns false when the iteration is finished.
+	Valid() bool
+	// Next moves to the next key.
+	Next()
+	// Key returns a copy of the current key.
+	Key() []byte
+	// Value returns a copy of the value of the current key.
+	Value() (val []byte, err error)
+	// Close releases the iterator.
+	Close()
+}
+
+// WriteBatch is a set of writes applied together by Flush.
+type WriteBatch interface {
+	Set(key, val []byte) (err error)
+	Delete(key []byte) (err error)
+	// Flush applies the writes.
+	Flush() (err error)
+	// Cancel discards writes that have not been flushed.
+	Cancel()
+}
+
+// Sequence is a monotonic source of unique numbers.
+type Sequence interface {
+	// Next returns the next number of the sequence.
+	Next() (n uint64, err error)
+	// Release returns the unused part of the leased block to the store.
+	Release() (err error)
+}
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"bytes"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/database/indexes/types/identhash"
+	"manifold.mleku.dev/database/indexes/types/number"
+	"manifold.mleku.dev/database/indexes/types/rawvalue"
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+)
+
+func init() {
+	RegisterMigration(Migration{
+		From:        4,
+		Description: "index tags by key and raw value",
+		Run: func(d *D, progress func(done, total int)) (err error) {
+			return d.RebuildIndexes(progress, indexes.TagKeyValue)
+		},
+	})
+}
+
+// scanTagKeyValue calls fn with the serial of every event with a tag of a key
+// whose value starts with prefix, and the value of the tag as stored in the
+// index, which is truncated to rawvalue.MaxLen bytes.
+func scanTagKeyValue(txn store.Txn, key string, prefix []byte,
+	fn func(ser *number.Uint40, value []byte) (err error)) (err error) {
+
+	k := identhash.New()
+	if err = k.FromIdent([]byte(key)); chk.E(err) {
+		return
+	}
+	prf := new(bytes.Buffer)
+	if err = indexes.TagKeyValueEnc(k, nil, nil, nil).MarshalWrite(prf); chk.E(err) {
+		return
+	}
+	prf.Write(rawvalue.Escape(prefix[:min(len(prefix), rawvalue.MaxLen)]))
+	it := txn.NewIterator(store.IteratorOptions{Prefix: prf.Bytes()})
+	defer it.Close()
+	for it.Seek(prf.Bytes()); it.Valid(); it.Next() {
+		k, v, ts, ser := indexes.TagKeyValueVars()
+		if err = indexes.TagKeyValueDec(k, v, ts, ser).UnmarshalRead(bytes.NewBuffer(it.Key())); chk.E(err) {
+			return
+		}
+		if err = fn(ser, v.Bytes()); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// tagKeySerials returns the serials of the events that have a tag with any of
+// the keys, whatever its value.
+func (d *D) tagKeySerials(txn store.Txn, keys []string) (found map[uint64]struct{}, err error) {
+	found = make(map[uint64]struct{})
+	for _, key := range keys {
+		if err = scanTagKeyValue(txn, key, nil, func(ser *number.Uint40, _ []byte) (err error) {
+			found[ser.Get()] = struct{}{}
+			return
+		}); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// tagPrefixSerials returns the serials of the events that have a tag whose
+// value starts with any of the prefixes given for its key. Prefixes longer than
+// the values stored in the index are confirmed against the tags of the event.
+func (d *D) tagPrefixSerials(txn store.Txn, prefixes filter.TagMap) (found map[uint64]struct{}, err error) {
+	found = make(map[uint64]struct{})
+	for key, values := range prefixes {
+		for _, prefix := range values {
+			if err = scanTagKeyValue(txn, key, prefix, func(ser *number.Uint40, value []byte) (err error) {
+				if len(prefix) > rawvalue.MaxLen {
+					var ev *event.E
+					if ev, err = eventInTxn(txn, ser); chk.E(err) {
+						return
+					}
+					if !hasTagPrefix(ev, key, prefix) {
+						return
+					}
+				}
+				found[ser.Get()] = struct{}{}
+				return
+			}); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// hasTagPrefix returns true if an event has a tag of a key whose value starts
+// with prefix.
+func hasTagPrefix(ev *event.E, key string, prefix []byte) bool {
+	if ev.Tags == nil {
+		return false
+	}
+	for _, t := range *ev.Tags {
+		if string(t.Key) == key && bytes.HasPrefix(t.Value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventInTxn reads the event with a serial in a transaction.
+func eventInTxn(txn store.Txn, ser *number.Uint40) (ev *event.E, err error) {
+	evk := new(bytes.Buffer)
+	if err = indexes.EventEnc(ser).MarshalWrite(evk); chk.E(err) {
+		return
+	}
+	var val []byte
+	if val, err = txn.Get(evk.Bytes()); chk.E(err) {
+		return
+	}
+	ev = &event.E{}
+	if err = ev.ReadBinary(bytes.NewBuffer(val)); chk.E(err) {
+		return
+	}
+	return
+}
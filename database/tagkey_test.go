@@ -0,0 +1,100 @@
+package database
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"manifold.mleku.dev/database/store/memory"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+	"manifold.mleku.dev/p256k"
+)
+
+// TestTagKeyQueries tests finding events by the key of a tag alone and by a
+// prefix of its value.
+func TestTagKeyQueries(t *testing.T) {
+	db := New()
+	if err := db.InitStore(memory.New()); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	signer := new(p256k.Signer)
+	if err := signer.Generate(); err != nil {
+		t.Fatalf("Failed to generate signer: %v", err)
+	}
+	long := strings.Repeat("x", 300)
+	tags := [][]string{
+		{"mimetype", "image/png"},
+		{"mimetype", "image/jpeg", "reply", "abc"},
+		{"mimetype", "text/plain"},
+		{"reply", "def"},
+		{},
+		{"url", long + "/a"},
+		{"url", long + "/b"},
+	}
+	var ids [][]byte
+	for i, kv := range tags {
+		ev := &event.E{
+			Pubkey:    signer.Pub(),
+			Timestamp: time.Now().Add(time.Duration(i) * time.Minute).Unix(),
+			Content:   []byte("tagged"),
+			Tags:      &event.Tags{},
+		}
+		for j := 0; j < len(kv); j += 2 {
+			*ev.Tags = append(*ev.Tags, event.Tag{Key: []byte(kv[j]), Value: []byte(kv[j+1])})
+		}
+		if err := ev.Sign(signer); err != nil {
+			t.Fatalf("Failed to sign event: %v", err)
+		}
+		if err := db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+		id, err := ev.Id()
+		if err != nil {
+			t.Fatalf("Failed to get event ID: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	tests := []struct {
+		name     string
+		f        filter.F
+		expected []int
+	}{
+		{"HasTag", filter.F{HasTags: []string{"mimetype"}}, []int{0, 1, 2}},
+		{"HasAnyTag", filter.F{HasTags: []string{"reply", "url"}}, []int{1, 3, 5, 6}},
+		{"HasMissingTag", filter.F{HasTags: []string{"missing"}}, nil},
+		{"TagPrefix", filter.F{TagPrefixes: filter.TagMap{
+			"mimetype": {[]byte("image/")}}}, []int{0, 1}},
+		{"TagPrefixes", filter.F{TagPrefixes: filter.TagMap{
+			"mimetype": {[]byte("image/j"), []byte("text/")}}}, []int{1, 2}},
+		{"HasTagAndTagPrefix", filter.F{
+			HasTags:     []string{"reply"},
+			TagPrefixes: filter.TagMap{"mimetype": {[]byte("image/")}}}, []int{1}},
+		{"LongTagPrefix", filter.F{TagPrefixes: filter.TagMap{
+			"url": {[]byte(long + "/b")}}}, []int{6}},
+		{"TagPrefixWithTags", filter.F{
+			Tags:        filter.TagMap{"reply": {[]byte("abc"), []byte("def")}},
+			TagPrefixes: filter.TagMap{"mimetype": {[]byte("image/")}}}, []int{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.f.Sort = "asc"
+			results, err := db.QueryEvents(tt.f)
+			if err != nil {
+				t.Fatalf("Failed to query events: %v", err)
+			}
+			if len(results) != len(tt.expected) {
+				t.Fatalf("Expected %d results, got %d", len(tt.expected), len(results))
+			}
+			for i, n := range tt.expected {
+				if !bytes.Equal(results[i], ids[n]) {
+					t.Fatalf("Expected event %d as result %d", n, i)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package database
+
+import (
+	"manifold.mleku.dev/database/indexes"
+)
+
+// timestampFamilies are the index families whose keys contain the timestamp of
+// an event.
+var timestampFamilies = []int{
+	indexes.IdPubkeyTimestamp,
+	indexes.Timestamp,
+	indexes.PubkeyTimestamp,
+	indexes.PubkeyTagTimestamp,
+	indexes.TagTimestamp,
+	indexes.TagKeyValue,
+	indexes.TagNumber,
+	indexes.Location,
+	indexes.Reference,
+}
+
+func init() {
+	RegisterMigration(Migration{
+		From:        8,
+		Description: "encode timestamps so that those before 1970 sort first",
+		Run: func(d *D, progress func(done, total int)) (err error) {
+			return d.RebuildIndexes(progress, timestampFamilies...)
+		},
+	})
+}
@@ -0,0 +1,159 @@
+package database
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/database/indexes/types/number"
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+	"manifold.mleku.dev/p256k"
+)
+
+// timestamps are in order from long before 1970 to far in the future.
+var timestamps = []int64{
+	-62135596800, // 0001-01-01
+	-2208988800,  // 1900-01-01
+	-86400,
+	-1,
+	1,
+	1700000000,
+	32503680000,  // 3000-01-01
+	253402300799, // 9999-12-31
+}
+
+// storeTimestampEvents stores an event at each of the timestamps, alternating
+// between two authors, with a tag on every third.
+func storeTimestampEvents(t *testing.T, db *D) (ids [][]byte, signers []*p256k.Signer) {
+	signers = make([]*p256k.Signer, 2)
+	for i := range signers {
+		signers[i] = new(p256k.Signer)
+		if err := signers[i].Generate(); err != nil {
+			t.Fatalf("Failed to generate signer: %v", err)
+		}
+	}
+	for i, ts := range timestamps {
+		signer := signers[i%2]
+		ev := &event.E{
+			Pubkey:    signer.Pub(),
+			Timestamp: ts,
+			Content:   []byte("dated"),
+			Tags:      &event.Tags{},
+		}
+		if i%3 == 0 {
+			*ev.Tags = append(*ev.Tags, event.Tag{Key: []byte("era"), Value: []byte("any")})
+		}
+		if err := ev.Sign(signer); err != nil {
+			t.Fatalf("Failed to sign event: %v", err)
+		}
+		if err := db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+		id, err := ev.Id()
+		if err != nil {
+			t.Fatalf("Failed to get event ID: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	return
+}
+
+func checkTimestampQueries(t *testing.T, db *D, ids [][]byte, signers []*p256k.Signer) {
+	tests := []struct {
+		name     string
+		f        filter.F
+		expected []int
+	}{
+		{"All", filter.F{}, []int{0, 1, 2, 3, 4, 5, 6, 7}},
+		{"SinceBeforeEpoch", filter.F{Since: -86400}, []int{2, 3, 4, 5, 6, 7}},
+		{"UntilBeforeEpoch", filter.F{Until: -1}, []int{0, 1, 2, 3}},
+		{"RangeBeforeEpoch", filter.F{Since: -3000000000, Until: -2}, []int{1, 2}},
+		{"FarFuture", filter.F{Since: 1800000000}, []int{6, 7}},
+		{"AuthorBeforeEpoch", filter.F{Authors: [][]byte{signers[0].Pub()},
+			Until: -1}, []int{0, 2}},
+		{"TagBeforeEpoch", filter.F{Tags: filter.TagMap{"era": {[]byte("any")}},
+			Since: -3000000000, Until: 1700000000}, []int{3}},
+		{"AuthorAndTag", filter.F{Authors: [][]byte{signers[1].Pub()},
+			Tags: filter.TagMap{"era": {[]byte("any")}}, Since: -100}, []int{3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.f.Sort = "asc"
+			results, err := db.QueryEvents(tt.f)
+			if err != nil {
+				t.Fatalf("Failed to query events: %v", err)
+			}
+			if len(results) != len(tt.expected) {
+				t.Fatalf("Expected %d results, got %d", len(tt.expected), len(results))
+			}
+			for i, n := range tt.expected {
+				if !bytes.Equal(results[i], ids[n]) {
+					t.Fatalf("Expected event %d as result %d", n, i)
+				}
+			}
+		})
+	}
+}
+
+// TestTimestamps tests querying events from before 1970 and far in the future
+// by timestamp.
+func TestTimestamps(t *testing.T) {
+	db := newMemoryDB(t)
+	defer db.Close()
+	ids, signers := storeTimestampEvents(t, db)
+	checkTimestampQueries(t, db, ids, signers)
+}
+
+// TestTimestampMigration tests that the migration to signed timestamps
+// rewrites keys with the timestamps encoded as unsigned numbers.
+func TestTimestampMigration(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifold-test-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	db := New()
+	if err = db.Init(tempDir); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	ids, signers := storeTimestampEvents(t, db)
+	// rewrite the Timestamp index as it was before schema version 9
+	if err = db.store.DropPrefix([]byte(indexes.Prefix(indexes.Timestamp))); err != nil {
+		t.Fatalf("Failed to drop index: %v", err)
+	}
+	if err = db.ForEachEvent(func(ser *number.Uint40, ev *event.E) (err error) {
+		ts := new(number.Uint64)
+		ts.Set(uint64(ev.Timestamp))
+		k := new(bytes.Buffer)
+		if err = indexes.TimestampEnc(ts, ser).MarshalWrite(k); err != nil {
+			return
+		}
+		return db.store.Update(func(txn store.Txn) error { return txn.Set(k.Bytes(), nil) })
+	}); err != nil {
+		t.Fatalf("Failed to write old index: %v", err)
+	}
+	if err = db.setSchemaVersion(8); err != nil {
+		t.Fatalf("Failed to write schema version: %v", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	db = New()
+	if err = db.Init(tempDir); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+	if err = db.WaitMigrations(); err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+	var v uint32
+	if v, err = db.SchemaVersion(); err != nil || v != SchemaVersion {
+		t.Fatalf("Expected schema version %d, got %d: %v", SchemaVersion, v, err)
+	}
+	checkTimestampQueries(t, db, ids, signers)
+}
@@ -0,0 +1,385 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database/indexes"
+	"manifold.mleku.dev/database/indexes/types/number"
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/errorf"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+	"manifold.mleku.dev/log"
+)
+
+// viewPrefix is the start of the keys of every materialized view, which no
+// index key starts with.
+var viewPrefix = []byte("mv")
+
+// Reducer updates the state of a view for an event that was stored in or
+// deleted from the database. It is called after the change is committed, so
+// the database it can query through the ViewState already has the change. A
+// change that was committed but not reduced before the database was stopped is
+// reduced when the view is next registered, when the database may also have
+// the changes after it.
+type Reducer func(s *ViewState, c Change) (err error)
+
+// View is a materialized view: state kept by a Reducer of the events that match
+// a filter, such as the count of the reactions to each event, or the latest
+// profile of each author, so that it is not recomputed from the events for
+// every request.
+type View struct {
+	// Name is the name the state of the view is stored under, made of lower
+	// case letters, digits, dots, dashes and underscores. The social graph is
+	// the view named graph.
+	Name string
+	// Filter is matched against the events stored and deleted, as by Matches,
+	// for the changes passed to Reduce.
+	Filter filter.F
+	// Version is stored with the state of the view, which is rebuilt from the
+	// stored events when a view is registered with a different Version, so it
+	// should be changed whenever the Filter or what Reduce does changes.
+	Version string
+	// Reduce updates the state of the view for each change. Serials change when
+	// the database is consolidated, so events should be kept by their id.
+	Reduce Reducer
+}
+
+// ViewState is the state of a view, which is a set of keys and values of its
+// own, read and written in a transaction.
+type ViewState struct {
+	d      *D
+	txn    store.Txn
+	prefix []byte
+}
+
+// DB returns the database of the view. Reducers run while the change is held
+// against consolidation and new subscriptions, so they must query it through
+// the GetEventById and QueryEvents of the ViewState, which take no locks, as the
+// methods of the database that do would deadlock with those waiting for them.
+func (s *ViewState) DB() *D { return s.d }
+
+// GetEventById returns the event with an id, without recording the access.
+func (s *ViewState) GetEventById(evId []byte) (ev *event.E, err error) {
+	var ser *number.Uint40
+	if ser, err = s.d.FindEventSerialById(evId); err != nil {
+		return
+	}
+	return s.d.fetchEventFromSerial(ser)
+}
+
+// QueryEvents finds the events that match a filter, as the QueryEvents of the
+// database does, including while migrations that rebuild views are running.
+func (s *ViewState) QueryEvents(f filter.F) (eventIds [][]byte, err error) {
+	return s.d.queryEventsLimit(f)
+}
+
+// Get returns the value of a key of the view, or nil if it has none.
+func (s *ViewState) Get(key []byte) (value []byte, err error) {
+	if value, err = s.txn.Get(append(bytes.Clone(s.prefix), key...)); err == store.ErrKeyNotFound {
+		value, err = nil, nil
+	}
+	return
+}
+
+// Set sets the value of a key of the view.
+func (s *ViewState) Set(key, value []byte) (err error) {
+	return s.txn.Set(append(bytes.Clone(s.prefix), key...), value)
+}
+
+// Delete removes a key of the view.
+func (s *ViewState) Delete(key []byte) (err error) {
+	return s.txn.Delete(append(bytes.Clone(s.prefix), key...))
+}
+
+// Scan calls fn with every key of the view that starts with prefix, in order,
+// and its value, until fn returns an error.
+func (s *ViewState) Scan(prefix []byte, fn func(key, value []byte) (err error)) (err error) {
+	prf := append(bytes.Clone(s.prefix), prefix...)
+	it := s.txn.NewIterator(store.IteratorOptions{Prefix: prf})
+	defer it.Close()
+	for it.Seek(prf); it.Valid(); it.Next() {
+		var val []byte
+		if val, err = it.Value(); chk.E(err) {
+			return
+		}
+		if err = fn(it.Key()[len(s.prefix):], val); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// viewKeyPrefix returns the prefix of the keys of the state of a view.
+func viewKeyPrefix(name string) []byte {
+	return append(append(bytes.Clone(viewPrefix), name...), ':')
+}
+
+// viewVersionKey returns the key of the version of a view, which is outside
+// the prefix of its state, as ';' is not in the names of views.
+func viewVersionKey(name string) []byte {
+	return append(append(bytes.Clone(viewPrefix), name...), ';')
+}
+
+// viewPendingPrefix returns the prefix of the changes that are yet to be
+// reduced into a view, which is also outside the prefix of its state.
+func viewPendingPrefix(name string) []byte {
+	return append(append(bytes.Clone(viewPrefix), name...), '!')
+}
+
+// viewPendingKey returns the key of a change that is yet to be reduced into a
+// view, which sorts the changes by serial, and the storing of an event before
+// its deletion.
+func viewPendingKey(name string, c Change) []byte {
+	k := binary.BigEndian.AppendUint64(viewPendingPrefix(name), c.Serial)
+	if c.Deleted {
+		return append(k, 1)
+	}
+	return append(k, 0)
+}
+
+// pendViews records a change as pending in the views whose filter matches the
+// event, in the transaction of the change. Reducing a change removes it, so
+// those left when the database was stopped before they were reduced are
+// reduced when the view is registered again. It must be called with the feed
+// commit lock held for reading.
+func (d *D) pendViews(txn store.Txn, c Change) (err error) {
+	d.viewsMx.RLock()
+	defer d.viewsMx.RUnlock()
+	var val []byte
+	for _, v := range d.views {
+		if !Matches(v.Filter, c.Event) {
+			continue
+		}
+		if val == nil {
+			buf := new(bytes.Buffer)
+			if err = c.Event.WriteBinary(buf); chk.E(err) {
+				return
+			}
+			val = buf.Bytes()
+		}
+		if err = txn.Set(viewPendingKey(v.Name, c), val); chk.E(err) {
+			return
+		}
+	}
+	return
+}
+
+// reducePending reduces the changes left pending in a view, in order.
+func (d *D) reducePending(v *View) (err error) {
+	var pending []Change
+	if err = d.View(func(txn store.Txn) (err error) {
+		prf := viewPendingPrefix(v.Name)
+		it := txn.NewIterator(store.IteratorOptions{Prefix: prf})
+		defer it.Close()
+		for it.Seek(prf); it.Valid(); it.Next() {
+			k := it.Key()[len(prf):]
+			if len(k) != 9 {
+				continue
+			}
+			var val []byte
+			if val, err = it.Value(); chk.E(err) {
+				return
+			}
+			ev := &event.E{}
+			if err = ev.ReadBinary(bytes.NewBuffer(val)); chk.E(err) {
+				return
+			}
+			pending = append(pending, Change{Serial: binary.BigEndian.Uint64(k),
+				Event: ev, Deleted: k[8] == 1})
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	for _, c := range pending {
+		if err = d.reduce(v, c); chk.E(err) {
+			return
+		}
+	}
+	if len(pending) > 0 {
+		log.I.F("reduced %d pending changes into view %s", len(pending), v.Name)
+	}
+	return
+}
+
+// RegisterView registers a view to be updated as events are stored and deleted.
+// The view is rebuilt from the stored events first if its stored version is not
+// that of the view, or if it has never been built, and otherwise the changes
+// that were stored but not reduced into it before the database was stopped are
+// reduced.
+func (d *D) RegisterView(v View) (err error) {
+	if err = checkName("view", v.Name); chk.E(err) {
+		return
+	}
+	if v.Reduce == nil {
+		return errorf.E("view %s has no reducer", v.Name)
+	}
+	// changes are held back while the view is registered, so that each is
+	// either in the state it is rebuilt from or passed to the reducer.
+	d.feed.commit.Lock()
+	defer d.feed.commit.Unlock()
+	d.viewsMx.RLock()
+	_, ok := d.views[v.Name]
+	d.viewsMx.RUnlock()
+	if ok {
+		return errorf.E("view %s is already registered", v.Name)
+	}
+	var version []byte
+	if err = d.View(func(txn store.Txn) (err error) {
+		if version, err = txn.Get(viewVersionKey(v.Name)); err == store.ErrKeyNotFound {
+			version, err = nil, nil
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	if version == nil || string(version) != v.Version {
+		if err = d.rebuildView(&v); chk.E(err) {
+			return
+		}
+	} else if err = d.reducePending(&v); err != nil {
+		// a change that cannot be reduced leaves the view to be rebuilt.
+		log.E.F("view %s failed to reduce pending changes, rebuilding it: %v", v.Name, err)
+		if err = d.rebuildView(&v); chk.E(err) {
+			return
+		}
+	}
+	return d.addView(v)
+}
+
+// addView registers a view without rebuilding it.
+func (d *D) addView(v View) (err error) {
+	d.viewsMx.Lock()
+	defer d.viewsMx.Unlock()
+	if d.views == nil {
+		d.views = make(map[string]*View)
+	}
+	if _, ok := d.views[v.Name]; ok {
+		return errorf.E("view %s is already registered", v.Name)
+	}
+	d.views[v.Name] = &v
+	return
+}
+
+// RebuildView clears the state of a registered view and reduces every stored
+// event that matches its filter again, in the order they were stored.
+func (d *D) RebuildView(name string) (err error) {
+	d.feed.commit.Lock()
+	defer d.feed.commit.Unlock()
+	d.viewsMx.RLock()
+	v := d.views[name]
+	d.viewsMx.RUnlock()
+	if v == nil {
+		return errorf.E("view %s is not registered", name)
+	}
+	return d.rebuildView(v)
+}
+
+// rebuildView clears the state of a view and reduces the stored events into it.
+// It must be called with the feed commit lock held.
+func (d *D) rebuildView(v *View) (err error) {
+	log.I.F("rebuilding view %s", v.Name)
+	if err = d.dropPrefix(viewKeyPrefix(v.Name), viewVersionKey(v.Name),
+		viewPendingPrefix(v.Name)); chk.E(err) {
+		return
+	}
+	var n int
+	if err = d.View(func(txn store.Txn) (err error) {
+		prf := []byte(indexes.Prefix(indexes.Event))
+		it := txn.NewIterator(store.IteratorOptions{Prefix: prf})
+		defer it.Close()
+		for it.Seek(prf); it.Valid(); it.Next() {
+			ser := indexes.EventVars()
+			if err = indexes.EventDec(ser).UnmarshalRead(bytes.NewBuffer(it.Key())); chk.E(err) {
+				return
+			}
+			var val []byte
+			if val, err = it.Value(); chk.E(err) {
+				return
+			}
+			ev := &event.E{}
+			if err = ev.ReadBinary(bytes.NewBuffer(val)); err != nil {
+				log.W.F("event serial %d could not be decoded: %v", ser.Get(), err)
+				err = nil
+				continue
+			}
+			if !Matches(v.Filter, ev) {
+				continue
+			}
+			if err = d.reduce(v, Change{Serial: ser.Get(), Event: ev}); chk.E(err) {
+				return
+			}
+			n++
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	if err = d.Set(viewVersionKey(v.Name), []byte(v.Version)); chk.E(err) {
+		return
+	}
+	log.I.F("rebuilt view %s from %d events", v.Name, n)
+	return
+}
+
+// reduce passes a change to the reducer of a view in a transaction of its own,
+// which also removes the change from those pending in the view. Concurrent
+// changes reduced into the same keys conflict, and are retried.
+func (d *D) reduce(v *View, c Change) (err error) {
+	return retryConflicts(func() error {
+		return d.store.Update(func(txn store.Txn) (err error) {
+			if err = v.Reduce(&ViewState{d: d, txn: txn, prefix: viewKeyPrefix(v.Name)}, c); err != nil {
+				return
+			}
+			return txn.Delete(viewPendingKey(v.Name, c))
+		})
+	})
+}
+
+// updateViews passes a change to the reducers of the views whose filter matches
+// the event. A view whose reducer fails is left to be rebuilt when it is next
+// registered, as its state no longer follows the events. It must be called with
+// the feed commit lock held for reading.
+func (d *D) updateViews(c Change) {
+	d.viewsMx.RLock()
+	defer d.viewsMx.RUnlock()
+	for _, v := range d.views {
+		if !Matches(v.Filter, c.Event) {
+			continue
+		}
+		if err := d.reduce(v, c); err != nil {
+			log.E.F("view %s failed to reduce event serial %d, it will be rebuilt: %v",
+				v.Name, c.Serial, err)
+			if err = d.dropPrefix(viewVersionKey(v.Name)); chk.E(err) {
+				continue
+			}
+		}
+	}
+}
+
+// ReadView calls fn with the state of a view in a read-only transaction. The
+// view does not need to be registered to be read.
+func (d *D) ReadView(name string, fn func(s *ViewState) (err error)) (err error) {
+	if err = checkName("view", name); chk.E(err) {
+		return
+	}
+	return d.View(func(txn store.Txn) (err error) {
+		return fn(&ViewState{d: d, txn: txn, prefix: viewKeyPrefix(name)})
+	})
+}
+
+// DropView unregisters a view and deletes its state.
+func (d *D) DropView(name string) (err error) {
+	if err = checkName("view", name); chk.E(err) {
+		return
+	}
+	d.feed.commit.Lock()
+	defer d.feed.commit.Unlock()
+	d.viewsMx.Lock()
+	delete(d.views, name)
+	d.viewsMx.Unlock()
+	return d.dropPrefix(viewKeyPrefix(name), viewVersionKey(name), viewPendingPrefix(name))
+}
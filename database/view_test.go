@@ -0,0 +1,346 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+
+	"manifold.mleku.dev/database/store"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+	"manifold.mleku.dev/p256k"
+)
+
+// reactionsView counts the events with a reaction tag by its value.
+func reactionsView(calls *int) View {
+	return View{
+		Name:    "reactions",
+		Filter:  filter.F{HasTags: []string{"reaction"}},
+		Version: "1",
+		Reduce: func(s *ViewState, c Change) (err error) {
+			*calls++
+			for _, tag := range *c.Event.Tags {
+				if string(tag.Key) != "reaction" {
+					continue
+				}
+				var v []byte
+				if v, err = s.Get(tag.Value); err != nil {
+					return
+				}
+				var n uint64
+				if v != nil {
+					n = binary.BigEndian.Uint64(v)
+				}
+				if c.Deleted {
+					n--
+				} else {
+					n++
+				}
+				if n == 0 {
+					err = s.Delete(tag.Value)
+				} else {
+					err = s.Set(tag.Value, binary.BigEndian.AppendUint64(nil, n))
+				}
+				if err != nil {
+					return
+				}
+			}
+			return
+		},
+	}
+}
+
+// profilesView keeps the id of the latest profile of each author.
+func profilesView(version string, calls *int) View {
+	f := filter.F{Tags: filter.TagMap{"type": {[]byte("profile")}}}
+	return View{
+		Name:    "profiles",
+		Filter:  f,
+		Version: version,
+		Reduce: func(s *ViewState, c Change) (err error) {
+			*calls++
+			var id, latest []byte
+			if id, err = c.Event.Id(); err != nil {
+				return
+			}
+			if latest, err = s.Get(c.Event.Pubkey); err != nil {
+				return
+			}
+			if !c.Deleted {
+				if latest != nil {
+					var ev *event.E
+					if ev, err = s.GetEventById(latest); err == nil && ev.Timestamp > c.Event.Timestamp {
+						return
+					}
+				}
+				return s.Set(c.Event.Pubkey, id)
+			}
+			if !bytes.Equal(latest, id) {
+				return
+			}
+			f := f
+			f.Authors, f.Sort, f.Limit = [][]byte{c.Event.Pubkey}, "desc", 1
+			var ids [][]byte
+			if ids, err = s.QueryEvents(f); err != nil {
+				return
+			}
+			if len(ids) == 0 {
+				return s.Delete(c.Event.Pubkey)
+			}
+			return s.Set(c.Event.Pubkey, ids[0])
+		},
+	}
+}
+
+// TestViews tests that views are updated as events are stored and deleted, and
+// rebuilt when they are registered with a new version.
+func TestViews(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifold-test-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	db := New()
+	if err = db.Init(tempDir); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	signer := new(p256k.Signer)
+	if err = signer.Generate(); err != nil {
+		t.Fatalf("Failed to generate signer: %v", err)
+	}
+	store := func(ts int64, tag event.Tag) (id []byte) {
+		ev := &event.E{Pubkey: signer.Pub(), Timestamp: ts, Content: []byte("view"),
+			Tags: &event.Tags{tag}}
+		if err := ev.Sign(signer); err != nil {
+			t.Fatalf("Failed to sign event: %v", err)
+		}
+		if err := db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+		if id, err = ev.Id(); err != nil {
+			t.Fatalf("Failed to get event ID: %v", err)
+		}
+		return
+	}
+	get := func(name string, key []byte) (value []byte) {
+		if err := db.ReadView(name, func(s *ViewState) (err error) {
+			value, err = s.Get(key)
+			return
+		}); err != nil {
+			t.Fatalf("Failed to read view: %v", err)
+		}
+		return
+	}
+	count := func(target string) (n uint64) {
+		if v := get("reactions", []byte(target)); v != nil {
+			n = binary.BigEndian.Uint64(v)
+		}
+		return
+	}
+	var reactions, profiles int
+	if err = db.RegisterView(reactionsView(&reactions)); err != nil {
+		t.Fatalf("Failed to register view: %v", err)
+	}
+	if err = db.RegisterView(reactionsView(&reactions)); err == nil {
+		t.Errorf("Expected an error registering a view twice")
+	}
+	if err = db.RegisterView(View{Name: "Bad Name", Reduce: reactionsView(nil).Reduce}); err == nil {
+		t.Errorf("Expected an error for an invalid view name")
+	}
+	profile := event.Tag{Key: []byte("type"), Value: []byte("profile")}
+	older := store(100, profile)
+	newer := store(200, profile)
+	reaction := store(300, event.Tag{Key: []byte("reaction"), Value: []byte("t1")})
+	store(301, event.Tag{Key: []byte("reaction"), Value: []byte("t1")})
+	store(302, event.Tag{Key: []byte("reaction"), Value: []byte("t2")})
+	if count("t1") != 2 || count("t2") != 1 || reactions != 3 {
+		t.Errorf("Expected 2 and 1 reactions from 3 calls, got %d and %d from %d",
+			count("t1"), count("t2"), reactions)
+	}
+	// registered after the events are stored, so it is built from them
+	if err = db.RegisterView(profilesView("1", &profiles)); err != nil {
+		t.Fatalf("Failed to register view: %v", err)
+	}
+	if latest := get("profiles", signer.Pub()); !bytes.Equal(latest, newer) || profiles != 2 {
+		t.Errorf("Expected the newer profile from 2 calls, got %x from %d", latest, profiles)
+	}
+	for _, id := range [][]byte{newer, reaction} {
+		if err = db.DeleteEventById(id); err != nil {
+			t.Fatalf("Failed to delete event: %v", err)
+		}
+	}
+	if latest := get("profiles", signer.Pub()); !bytes.Equal(latest, older) {
+		t.Errorf("Expected the older profile after deleting the newer, got %x", latest)
+	}
+	if count("t1") != 1 {
+		t.Errorf("Expected 1 reaction after deleting one, got %d", count("t1"))
+	}
+	if err = db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	db = New()
+	if err = db.Init(tempDir); err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	reactions, profiles = 0, 0
+	if err = db.RegisterView(reactionsView(&reactions)); err != nil {
+		t.Fatalf("Failed to register view: %v", err)
+	}
+	if err = db.RegisterView(profilesView("2", &profiles)); err != nil {
+		t.Fatalf("Failed to register view: %v", err)
+	}
+	if reactions != 0 || profiles != 1 {
+		t.Errorf("Expected only the view of a new version to be rebuilt, got %d and %d calls",
+			reactions, profiles)
+	}
+	if count("t1") != 1 || count("t2") != 1 {
+		t.Errorf("Expected the reactions to be kept, got %d and %d", count("t1"), count("t2"))
+	}
+	if latest := get("profiles", signer.Pub()); !bytes.Equal(latest, older) {
+		t.Errorf("Expected the older profile after rebuilding, got %x", latest)
+	}
+	reactions = 0
+	if err = db.RebuildView("reactions"); err != nil {
+		t.Fatalf("Failed to rebuild view: %v", err)
+	}
+	if count("t1") != 1 || count("t2") != 1 || reactions != 2 {
+		t.Errorf("Expected the same reactions from 2 calls, got %d and %d from %d",
+			count("t1"), count("t2"), reactions)
+	}
+	if err = db.DropView("reactions"); err != nil {
+		t.Fatalf("Failed to drop view: %v", err)
+	}
+	if count("t1") != 0 {
+		t.Errorf("Expected no reactions after dropping the view")
+	}
+	store(400, event.Tag{Key: []byte("reaction"), Value: []byte("t1")})
+	if count("t1") != 0 || reactions != 2 {
+		t.Errorf("Expected a dropped view not to be updated")
+	}
+}
+
+// TestViewsPending tests that a change committed but not reduced into a view
+// before the database was stopped is reduced when the view is registered again.
+func TestViewsPending(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "manifold-test-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	db := New()
+	if err = db.Init(tempDir); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	signer := new(p256k.Signer)
+	if err = signer.Generate(); err != nil {
+		t.Fatalf("Failed to generate signer: %v", err)
+	}
+	var reactions int
+	if err = db.RegisterView(reactionsView(&reactions)); err != nil {
+		t.Fatalf("Failed to register view: %v", err)
+	}
+	ev := &event.E{Pubkey: signer.Pub(), Timestamp: 300, Content: []byte("view"),
+		Tags: &event.Tags{{Key: []byte("reaction"), Value: []byte("t1")}}}
+	if err = ev.Sign(signer); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	// the change is committed, and the database stops before it is reduced
+	if err = db.Update(func(txn store.Txn) (err error) {
+		return db.pendViews(txn, Change{Serial: 1, Event: ev})
+	}); err != nil {
+		t.Fatalf("Failed to record pending change: %v", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	db = New()
+	if err = db.Init(tempDir); err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	reactions = 0
+	if err = db.RegisterView(reactionsView(&reactions)); err != nil {
+		t.Fatalf("Failed to register view: %v", err)
+	}
+	var n uint64
+	var pending int
+	if err = db.ReadView("reactions", func(s *ViewState) (err error) {
+		var v []byte
+		if v, err = s.Get([]byte("t1")); v != nil {
+			n = binary.BigEndian.Uint64(v)
+		}
+		return
+	}); err != nil {
+		t.Fatalf("Failed to read view: %v", err)
+	}
+	if err = db.View(func(txn store.Txn) (err error) {
+		prf := viewPendingPrefix("reactions")
+		it := txn.NewIterator(store.IteratorOptions{Prefix: prf})
+		defer it.Close()
+		for it.Seek(prf); it.Valid(); it.Next() {
+			pending++
+		}
+		return
+	}); err != nil {
+		t.Fatalf("Failed to read pending changes: %v", err)
+	}
+	if n != 1 || reactions != 1 || pending != 0 {
+		t.Errorf("Expected the pending reaction reduced once and removed, got %d from %d calls and %d pending",
+			n, reactions, pending)
+	}
+}
+
+// TestViewsConsolidate tests that reducers reading the database do not deadlock
+// with a consolidation waiting for the event they reduce to be stored.
+func TestViewsConsolidate(t *testing.T) {
+	db := newMemoryDB(t)
+	defer db.Close()
+	signer := new(p256k.Signer)
+	if err := signer.Generate(); err != nil {
+		t.Fatalf("Failed to generate signer: %v", err)
+	}
+	consolidated := make(chan error, 1)
+	if err := db.RegisterView(View{
+		Name: "reads",
+		Reduce: func(s *ViewState, c Change) (err error) {
+			go func() {
+				_, err := db.Consolidate(func(done, total int) {})
+				consolidated <- err
+			}()
+			// let the consolidation wait for the store to finish
+			time.Sleep(50 * time.Millisecond)
+			var id []byte
+			if id, err = c.Event.Id(); err != nil {
+				return
+			}
+			if _, err = s.GetEventById(id); err != nil {
+				return
+			}
+			_, err = s.QueryEvents(filter.F{Authors: [][]byte{c.Event.Pubkey}})
+			return
+		},
+	}); err != nil {
+		t.Fatalf("Failed to register view: %v", err)
+	}
+	ev := &event.E{Pubkey: signer.Pub(), Timestamp: 1700000000, Content: []byte("read")}
+	if err := ev.Sign(signer); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	stored := make(chan error, 1)
+	go func() { stored <- db.StoreEvent(ev) }()
+	for _, done := range []chan error{stored, consolidated} {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Failed to store and consolidate: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Reducer deadlocked with the consolidation")
+		}
+	}
+}
@@ -98,8 +98,8 @@ var BinPrefix = []byte("BIN:")
 func (e *E) Unmarshal(data []byte) (err error) {
 	founds := make([]bool, len(Sentinels))
 	scanner := bufio.NewScanner(bytes.NewBuffer(data))
-	buf := make([]byte, 1_000_000)
-	scanner.Buffer(buf, len(buf))
+	// no line is longer than the data
+	scanner.Buffer(nil, max(len(data), bufio.MaxScanTokenSize)+1)
 	var lines int
 	for scanner.Scan() {
 		if scanner.Err() != nil {
@@ -168,10 +168,12 @@ func (e *E) Unmarshal(data []byte) (err error) {
 				content = make([]byte, base64.URLEncoding.
 					DecodedLen(len(rawValue))+len(BinPrefix))
 				copy(content, BinPrefix)
-				if _, err = base64.URLEncoding.Decode(content[len(BinPrefix):],
+				var n int
+				if n, err = base64.URLEncoding.Decode(content[len(BinPrefix):],
 					rawValue); chk.E(err) {
 					return
 				}
+				content = content[:len(BinPrefix)+n]
 			} else {
 				// Handle plain text
 				if content, err = text.Read(bytes.NewBuffer(rawValue)); chk.E(err) {
@@ -215,10 +217,12 @@ func (e *E) Unmarshal(data []byte) (err error) {
 				value = make([]byte, base64.URLEncoding.
 					DecodedLen(len(rawValue))+len(BinPrefix))
 				copy(value, BinPrefix)
-				if _, err = base64.URLEncoding.Decode(value[len(BinPrefix):],
+				var n int
+				if n, err = base64.URLEncoding.Decode(value[len(BinPrefix):],
 					rawValue); chk.E(err) {
 					return
 				}
+				value = value[:len(BinPrefix)+n]
 			} else {
 				// Handle plain text
 				if value, err = text.Read(bytes.NewBuffer(rawValue)); chk.E(err) {
@@ -267,11 +271,16 @@ func (e *E) Unmarshal(data []byte) (err error) {
 	return
 }
 
-func (e *E) Marshal() (data []byte, err error) {
+func (e *E) Marshal() (data []byte, err error) { return e.marshal(true) }
+
+// marshal writes the event, with the sentinels of its fields unless sentinels
+// is false, as versions before the precedence of the tag condition was fixed
+// did for an event whose tags were empty.
+func (e *E) marshal(sentinels bool) (data []byte, err error) {
 	buf := new(bytes.Buffer)
 out:
 	for i := range Sentinels {
-		if (i == SIGNATURE && e.Signature == nil) || (i == TAG && e.Tags == nil || len(*e.Tags) == 0) {
+		if !sentinels || (i == SIGNATURE && e.Signature == nil) || (i == TAG && (e.Tags == nil || len(*e.Tags) == 0)) {
 			// if no signature is present, this means it should be marshaled in
 			// the canonical format to be hashed to generate the message hash to
 			// sign.
@@ -367,6 +376,23 @@ func (e *E) Id() (id []byte, err error) {
 	return
 }
 
+// LegacyId returns the id that versions before the fix of Marshal gave an
+// event without tags whose tags were empty rather than nil, which was hashed
+// from its fields without their sentinels.
+func (e *E) LegacyId() (id []byte, err error) {
+	e2 := &E{
+		Pubkey:    e.Pubkey,
+		Timestamp: e.Timestamp,
+		Content:   e.Content,
+	}
+	var data []byte
+	if data, err = e2.marshal(false); chk.E(err) {
+		return
+	}
+	id = sha256.Sum256Bytes(data)
+	return
+}
+
 func (e *E) Sign(sign signer.I) (err error) {
 	if e.Signature != nil {
 		err = errorf.E("event already signed")
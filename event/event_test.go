@@ -3,8 +3,10 @@ package event
 import (
 	"bytes"
 	"encoding/base64"
+	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	"manifold.mleku.dev/chk"
 	"manifold.mleku.dev/p256k"
@@ -82,3 +84,97 @@ SIGNATURE:9DOOTXtcIZqcO7LaRaNAD8s9BjMyf46qp75NNJb_T-5piA57L4EjGYIx3Fok8L3pSIH7hB
 		t.Fatalf("failed to decode binary event")
 	}
 }
+
+func TestTime(t *testing.T) {
+	ev := &E{Tags: &Tags{{Key: []byte("key1"), Value: []byte("value1")}}}
+	tm := time.Unix(1700000000, 123456789)
+	ev.SetTime(tm)
+	if ev.Timestamp != 1700000000 || ev.Nanos() != 123456789 || !ev.Time().Equal(tm) {
+		t.Fatalf("Expected time %v, got %v", tm, ev.Time())
+	}
+	ev.SetTime(tm.Add(time.Millisecond))
+	if len(ev.Tags.GetAll(NanosKey)) != 1 || ev.Nanos() != 124456789 {
+		t.Fatalf("Expected the nanos tag to be replaced, got %v", *ev.Tags)
+	}
+	ev.SetTime(time.Unix(-86400, 0))
+	if ev.Timestamp != -86400 || ev.Nanos() != 0 || len(*ev.Tags) != 1 {
+		t.Fatalf("Expected a whole second without a nanos tag, got %v", *ev.Tags)
+	}
+	*ev.Tags = append(*ev.Tags, Tag{Key: NanosKey, Value: []byte("1000000000")})
+	if ev.Nanos() != 0 {
+		t.Fatalf("Expected an out of range nanos tag to be ignored")
+	}
+}
+
+// TestMarshal_EmptyTags tests that an event with empty tags is marshaled with
+// the sentinels of its fields, as one without tags is. Before the precedence of
+// the tag condition was fixed, no sentinels were written for an event whose
+// tags were empty, which changed its id, and one with nil tags panicked.
+func TestMarshal_EmptyTags(t *testing.T) {
+	pk := bytes.Repeat([]byte{1}, 32)
+	empty := &E{Pubkey: pk, Timestamp: 1700000000, Content: []byte("hello"), Tags: &Tags{}}
+	none := &E{Pubkey: pk, Timestamp: 1700000000, Content: []byte("hello")}
+	b, err := empty.Marshal()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for _, s := range [][]byte{Sentinels[PUBKEY], Sentinels[TIMESTAMP], Sentinels[CONTENT]} {
+		if !bytes.Contains(b, s) {
+			t.Errorf("Expected %s in the marshaled event:\n%s", s, b)
+		}
+	}
+	if bytes.Contains(b, Sentinels[TAG]) {
+		t.Errorf("Expected no tags in the marshaled event:\n%s", b)
+	}
+	c, err := none.Marshal()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !bytes.Equal(b, c) {
+		t.Errorf("Expected empty and nil tags to marshal the same:\n%s\n%s", b, c)
+	}
+	e := new(E)
+	if err = e.Unmarshal(b); err != nil {
+		t.Fatalf("Failed to unmarshal event: %v", err)
+	}
+	id1, _ := empty.Id()
+	id2, _ := e.Id()
+	if !bytes.Equal(id1, id2) {
+		t.Errorf("Expected the same id after unmarshaling")
+	}
+}
+
+// TestLegacyId tests that the id of an event without tags is that given by
+// versions before the fix of Marshal, hashed from its fields without their
+// sentinels.
+func TestLegacyId(t *testing.T) {
+	e := &E{Pubkey: bytes.Repeat([]byte{1}, 32), Timestamp: 1700000000, Content: []byte("hello"),
+		Tags: &Tags{}}
+	id, err := e.LegacyId()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if fmt.Sprintf("%x", id) != "24a43ecc7e21f162f6f2bde24499e21a568042c5c39697cf1e7f06380a5853dc" {
+		t.Errorf("Expected the id of earlier versions, got %x", id)
+	}
+}
+
+// TestUnmarshal_Binary tests that binary content and tag values are read back
+// with the length they were written with.
+func TestUnmarshal_Binary(t *testing.T) {
+	value := append(bytes.Clone(BinPrefix), bytes.Repeat([]byte{7}, 32)...)
+	e := &E{Pubkey: bytes.Repeat([]byte{1}, 32), Timestamp: 1700000000, Content: value,
+		Tags: &Tags{{Key: []byte("e"), Value: value}}}
+	b, err := e.Marshal()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	e2 := new(E)
+	if err = e2.Unmarshal(b); err != nil {
+		t.Fatalf("Failed to unmarshal event: %v", err)
+	}
+	if !bytes.Equal(e2.Content, value) || !bytes.Equal((*e2.Tags)[0].Value, value) {
+		t.Errorf("Expected binary values of %d bytes, got %d and %d",
+			len(value), len(e2.Content), len((*e2.Tags)[0].Value))
+	}
+}
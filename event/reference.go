@@ -0,0 +1,26 @@
+package event
+
+import (
+	"bytes"
+	"encoding/base64"
+
+	"manifold.mleku.dev/sha256"
+)
+
+// Reference returns the event id or pubkey that a tag value refers to, if it is
+// 32 bytes, or the unpadded base64url encoding of 32 bytes, with or without the
+// BinPrefix of binary values.
+func Reference(value []byte) (ref []byte, ok bool) {
+	value = bytes.TrimPrefix(value, BinPrefix)
+	switch len(value) {
+	case sha256.Size:
+		return value, true
+	case base64.RawURLEncoding.EncodedLen(sha256.Size):
+		ref = make([]byte, sha256.Size)
+		if _, err := base64.RawURLEncoding.Decode(ref, value); err != nil {
+			return nil, false
+		}
+		return ref, true
+	}
+	return
+}
@@ -0,0 +1,53 @@
+package event
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+)
+
+// NanosKey is the key of the tag that gives the nanoseconds past the second of
+// the Timestamp at which an event was made, as a decimal from 0 to 999999999,
+// for events made many times a second, such as by sensors and in chats. Events
+// with millisecond precision give the milliseconds as nanoseconds.
+var NanosKey = []byte("ns")
+
+// Nanos returns the nanoseconds past the second of the Timestamp given by the
+// NanosKey tag of the event, or zero if it has none or its value is invalid.
+func (e *E) Nanos() (ns int) {
+	if e.Tags == nil {
+		return
+	}
+	t := e.Tags.GetFirst(NanosKey)
+	if t.Key == nil {
+		return
+	}
+	n, err := strconv.Atoi(string(t.Value))
+	if err != nil || n < 0 || n >= int(time.Second) {
+		return
+	}
+	return n
+}
+
+// Time returns the time the event was made, to the precision of its NanosKey
+// tag if it has one.
+func (e *E) Time() time.Time { return time.Unix(e.Timestamp, int64(e.Nanos())) }
+
+// SetTime sets the Timestamp of the event, and its NanosKey tag if the time is
+// not a whole second, replacing any it has. The event must be signed after.
+func (e *E) SetTime(t time.Time) {
+	e.Timestamp = t.Unix()
+	if e.Tags == nil {
+		e.Tags = &Tags{}
+	}
+	tags := (*e.Tags)[:0]
+	for _, tag := range *e.Tags {
+		if !bytes.Equal(tag.Key, NanosKey) {
+			tags = append(tags, tag)
+		}
+	}
+	if ns := t.Nanosecond(); ns != 0 {
+		tags = append(tags, Tag{Key: NanosKey, Value: []byte(strconv.Itoa(ns))})
+	}
+	*e.Tags = tags
+}
@@ -0,0 +1,135 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"sort"
+	"strconv"
+	"strings"
+
+	"manifold.mleku.dev/errorf"
+)
+
+// GroupByAuthor is the GroupBy that counts events by their author.
+const GroupByAuthor = "author"
+
+// ParseGroupBy returns the key of the tag, or the length in seconds of the
+// periods, that a GroupBy counts events by. Both are empty for GroupByAuthor.
+func ParseGroupBy(g string) (tag string, period int64, err error) {
+	switch {
+	case g == GroupByAuthor:
+	case strings.HasPrefix(g, "tag:") && len(g) > len("tag:"):
+		tag = g[len("tag:"):]
+	case strings.HasPrefix(g, "time:"):
+		if period, err = strconv.ParseInt(g[len("time:"):], 10, 64); err != nil || period <= 0 {
+			err = errorf.E("invalid period of group by %q", g)
+		}
+	default:
+		err = errorf.E("unknown group by %q", g)
+	}
+	return
+}
+
+// Group is the number of events in a group of those counted for a filter with
+// a GroupBy.
+type Group struct {
+	// Key is the pubkey of the author, the value of the tag, or the start of
+	// the period as a decimal timestamp.
+	Key   []byte
+	Count int
+}
+
+// Counts is the answer to a filter with Count set: the number of events that
+// match it, and the number in each group if it has a GroupBy.
+type Counts struct {
+	Total  int
+	Groups []Group
+}
+
+// Add adds the total and groups of other Counts, of events not counted in c.
+func (c *Counts) Add(o *Counts) {
+	c.Total += o.Total
+	index := make(map[string]int, len(c.Groups))
+	for i, g := range c.Groups {
+		index[string(g.Key)] = i
+	}
+	for _, g := range o.Groups {
+		if i, ok := index[string(g.Key)]; ok {
+			c.Groups[i].Count += g.Count
+			continue
+		}
+		index[string(g.Key)] = len(c.Groups)
+		c.Groups = append(c.Groups, Group{Key: g.Key, Count: g.Count})
+	}
+}
+
+// Sort sorts the groups by count, most first, then by key, or if byTime, by
+// the start of their periods.
+func (c *Counts) Sort(byTime bool) {
+	sort.Slice(c.Groups, func(i, j int) bool {
+		a, b := c.Groups[i], c.Groups[j]
+		if byTime {
+			x, _ := strconv.ParseInt(string(a.Key), 10, 64)
+			y, _ := strconv.ParseInt(string(b.Key), 10, 64)
+			return x < y
+		}
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return bytes.Compare(a.Key, b.Key) < 0
+	})
+}
+
+var (
+	totalSentinel = []byte("TOTAL:")
+	groupSentinel = []byte("GROUP:")
+)
+
+// Marshal encodes Counts as a line of the Total, and a line of the base64url
+// encoded key and the count of each group, separated by a colon.
+func (c *Counts) Marshal() (data []byte, err error) {
+	buf := new(bytes.Buffer)
+	buf.Write(totalSentinel)
+	buf.WriteString(strconv.Itoa(c.Total))
+	for _, g := range c.Groups {
+		buf.WriteByte('\n')
+		buf.Write(groupSentinel)
+		buf.WriteString(base64.RawURLEncoding.EncodeToString(g.Key))
+		buf.WriteByte(':')
+		buf.WriteString(strconv.Itoa(g.Count))
+	}
+	data = buf.Bytes()
+	return
+}
+
+// Unmarshal decodes Counts encoded by Marshal.
+func (c *Counts) Unmarshal(data []byte) (err error) {
+	*c = Counts{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		switch {
+		case bytes.HasPrefix(line, totalSentinel):
+			if c.Total, err = strconv.Atoi(string(line[len(totalSentinel):])); err != nil {
+				return
+			}
+		case bytes.HasPrefix(line, groupSentinel):
+			key, count, ok := bytes.Cut(line[len(groupSentinel):], []byte(":"))
+			if !ok {
+				return errorf.E("invalid group: '%s'", line)
+			}
+			var g Group
+			if g.Key, err = base64.RawURLEncoding.DecodeString(string(key)); err != nil {
+				return
+			}
+			if g.Count, err = strconv.Atoi(string(count)); err != nil {
+				return
+			}
+			c.Groups = append(c.Groups, g)
+		default:
+			return errorf.E("unknown sentinel: '%s'", line)
+		}
+	}
+	return scanner.Err()
+}
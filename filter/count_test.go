@@ -0,0 +1,74 @@
+package filter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCountsMarshalUnmarshal(t *testing.T) {
+	c := &Counts{
+		Total: 7,
+		Groups: []Group{
+			{Key: []byte("bitcoin"), Count: 4},
+			{Key: []byte{0x00, 0xff, ':', '\n'}, Count: 2},
+			{Key: []byte{}, Count: 1},
+		},
+	}
+	data, err := c.Marshal()
+	if err != nil {
+		t.Fatalf("Failed to marshal counts: %v", err)
+	}
+	c2 := &Counts{}
+	if err = c2.Unmarshal(data); err != nil {
+		t.Fatalf("Failed to unmarshal counts: %v", err)
+	}
+	if !reflect.DeepEqual(c, c2) {
+		t.Errorf("Expected %v, got %v", c, c2)
+	}
+	if err = c2.Unmarshal([]byte("GROUP:nocount")); err == nil {
+		t.Errorf("Expected an error for a group without a count")
+	}
+}
+
+func TestCountsAddSort(t *testing.T) {
+	c := &Counts{Total: 3, Groups: []Group{{Key: []byte("a"), Count: 1}, {Key: []byte("b"), Count: 2}}}
+	c.Add(&Counts{Total: 4, Groups: []Group{{Key: []byte("a"), Count: 3}, {Key: []byte("c"), Count: 1}}})
+	c.Sort(false)
+	want := []Group{{Key: []byte("a"), Count: 4}, {Key: []byte("b"), Count: 2}, {Key: []byte("c"), Count: 1}}
+	if c.Total != 7 || !reflect.DeepEqual(c.Groups, want) {
+		t.Errorf("Expected 7 %v, got %d %v", want, c.Total, c.Groups)
+	}
+	c = &Counts{Groups: []Group{{Key: []byte("86400"), Count: 1}, {Key: []byte("-86400"), Count: 5}, {Key: []byte("0"), Count: 2}}}
+	c.Sort(true)
+	if string(c.Groups[0].Key) != "-86400" || string(c.Groups[2].Key) != "86400" {
+		t.Errorf("Expected groups by time, got %v", c.Groups)
+	}
+}
+
+func TestParseGroupBy(t *testing.T) {
+	tests := []struct {
+		groupBy string
+		tag     string
+		period  int64
+		wantErr bool
+	}{
+		{groupBy: "author"},
+		{groupBy: "tag:t", tag: "t"},
+		{groupBy: "time:86400", period: 86400},
+		{groupBy: "time:0", wantErr: true},
+		{groupBy: "time:day", wantErr: true},
+		{groupBy: "tag:", wantErr: true},
+		{groupBy: "kind", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.groupBy, func(t *testing.T) {
+			tag, period, err := ParseGroupBy(tt.groupBy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if !tt.wantErr && (tag != tt.tag || period != tt.period) {
+				t.Errorf("Expected %q %d, got %q %d", tt.tag, tt.period, tag, period)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/base64"
+	"strconv"
 
 	"manifold.mleku.dev/errorf"
 	"manifold.mleku.dev/ints"
@@ -20,6 +21,19 @@ const (
 	SINCE
 	UNTIL
 	SORT
+	SEARCH
+	HASTAGS
+	TAGPREFIXES
+	RANGES
+	SORTTAG
+	WITHIN
+	NEAR
+	REFERENCES
+	UNIT
+	LIMIT
+	COUNT
+	GROUPBY
+	TRUST
 )
 
 var Sentinels = [][]byte{
@@ -32,6 +46,19 @@ var Sentinels = [][]byte{
 	[]byte("SINCE:"),
 	[]byte("UNTIL:"),
 	[]byte("SORT:"),
+	[]byte("SEARCH:"),
+	[]byte("HASTAGS:"),
+	[]byte("TAGPREFIXES:"),
+	[]byte("RANGES:"),
+	[]byte("SORTTAG:"),
+	[]byte("WITHIN:"),
+	[]byte("NEAR:"),
+	[]byte("REFERENCES:"),
+	[]byte("UNIT:"),
+	[]byte("LIMIT:"),
+	[]byte("COUNT:"),
+	[]byte("GROUPBY:"),
+	[]byte("TRUST:"),
 }
 
 // Marshal encodes a filter.F into a byte slice.
@@ -101,6 +128,18 @@ func (f *F) Marshal() (data []byte, err error) {
 		}
 	}
 	
+	// References
+	for _, ref := range f.References {
+		if lineCount > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.Write(Sentinels[REFERENCES])
+		b := make([]byte, base64.RawURLEncoding.EncodedLen(len(ref)))
+		base64.RawURLEncoding.Encode(b, ref)
+		buf.Write(b)
+		lineCount++
+	}
+	
 	// Tags
 	if f.Tags != nil && len(f.Tags) > 0 {
 		for key, values := range f.Tags {
@@ -141,6 +180,72 @@ func (f *F) Marshal() (data []byte, err error) {
 		}
 	}
 	
+	// HasTags
+	for _, key := range f.HasTags {
+		if lineCount > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.Write(Sentinels[HASTAGS])
+		if err = text.Write(buf, []byte(key)); err != nil {
+			return nil, err
+		}
+		lineCount++
+	}
+	
+	// TagPrefixes
+	for key, values := range f.TagPrefixes {
+		for _, value := range values {
+			if lineCount > 0 {
+				buf.WriteByte('\n')
+			}
+			buf.Write(Sentinels[TAGPREFIXES])
+			if err = text.Write(buf, []byte(key)); err != nil {
+				return nil, err
+			}
+			buf.WriteByte(':')
+			b := make([]byte, base64.RawURLEncoding.EncodedLen(len(value)))
+			base64.RawURLEncoding.Encode(b, value)
+			buf.Write(b)
+			lineCount++
+		}
+	}
+	
+	// Ranges, with the bounds after the key as they may not contain a colon
+	for key, r := range f.Ranges {
+		if lineCount > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.Write(Sentinels[RANGES])
+		if err = text.Write(buf, []byte(key)); err != nil {
+			return nil, err
+		}
+		buf.WriteByte(':')
+		buf.WriteString(strconv.FormatFloat(r.Min, 'g', -1, 64))
+		buf.WriteByte(':')
+		buf.WriteString(strconv.FormatFloat(r.Max, 'g', -1, 64))
+		lineCount++
+	}
+	
+	// Within
+	if f.Within != nil {
+		if lineCount > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.Write(Sentinels[WITHIN])
+		writeFloats(buf, f.Within.MinLat, f.Within.MinLon, f.Within.MaxLat, f.Within.MaxLon)
+		lineCount++
+	}
+	
+	// Near
+	if f.Near != nil {
+		if lineCount > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.Write(Sentinels[NEAR])
+		writeFloats(buf, f.Near.Lat, f.Near.Lon, f.Near.Radius)
+		lineCount++
+	}
+	
 	// Since
 	if f.Since != 0 {
 		if lineCount > 0 {
@@ -165,6 +270,16 @@ func (f *F) Marshal() (data []byte, err error) {
 		lineCount++
 	}
 	
+	// Unit of Since and Until
+	if f.Unit != "" {
+		if lineCount > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.Write(Sentinels[UNIT])
+		buf.WriteString(f.Unit)
+		lineCount++
+	}
+	
 	// Sort (defaults to descending if not specified)
 	if f.Sort != "" && f.Sort != "desc" {
 		if lineCount > 0 {
@@ -175,6 +290,71 @@ func (f *F) Marshal() (data []byte, err error) {
 		lineCount++
 	}
 	
+	// SortTag
+	if f.SortTag != "" {
+		if lineCount > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.Write(Sentinels[SORTTAG])
+		if err = text.Write(buf, []byte(f.SortTag)); err != nil {
+			return nil, err
+		}
+		lineCount++
+	}
+	
+	// Limit
+	if f.Limit > 0 {
+		if lineCount > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.Write(Sentinels[LIMIT])
+		buf.WriteString(strconv.Itoa(f.Limit))
+		lineCount++
+	}
+	
+	// Count, grouped by GroupBy
+	if f.Count {
+		if lineCount > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.Write(Sentinels[COUNT])
+		lineCount++
+	}
+	if f.GroupBy != "" {
+		if lineCount > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.Write(Sentinels[GROUPBY])
+		if err = text.Write(buf, []byte(f.GroupBy)); err != nil {
+			return nil, err
+		}
+		lineCount++
+	}
+	
+	// TrustRoot and TrustRadius, as the base64url root and the radius
+	if f.TrustRoot != nil {
+		if lineCount > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.Write(Sentinels[TRUST])
+		buf.WriteString(base64.RawURLEncoding.EncodeToString(f.TrustRoot))
+		buf.WriteByte(':')
+		buf.WriteString(strconv.Itoa(f.TrustRadius))
+		lineCount++
+	}
+	
+	// Search
+	if f.Search != "" {
+		if lineCount > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.Write(Sentinels[SEARCH])
+		if err = text.Write(buf, []byte(f.Search)); err != nil {
+			return nil, err
+		}
+		lineCount++
+	}
+	
 	data = buf.Bytes()
 	return
 }
@@ -313,6 +493,130 @@ func (f *F) Unmarshal(data []byte) (err error) {
 			keyStr := string(key)
 			f.NotTags[keyStr] = append(f.NotTags[keyStr], value)
 			
+		case bytes.HasPrefix(line, Sentinels[HASTAGS]):
+			key, keyErr := text.Read(bytes.NewBuffer(line[len(Sentinels[HASTAGS]):]))
+			if keyErr != nil {
+				return keyErr
+			}
+			f.HasTags = append(f.HasTags, string(key))
+			
+		case bytes.HasPrefix(line, Sentinels[TAGPREFIXES]):
+			line = line[len(Sentinels[TAGPREFIXES]):]
+			keyEnd := bytes.IndexByte(line, ':')
+			if keyEnd == -1 {
+				return errorf.E("invalid TAGPREFIXES format")
+			}
+			
+			key, keyErr := text.Read(bytes.NewBuffer(line[:keyEnd]))
+			if keyErr != nil {
+				return keyErr
+			}
+			
+			value := make([]byte, base64.RawURLEncoding.DecodedLen(len(line)-keyEnd-1))
+			n, decErr := base64.RawURLEncoding.Decode(value, line[keyEnd+1:])
+			if decErr != nil {
+				return decErr
+			}
+			value = value[:n]
+			
+			// Initialize TagPrefixes if nil
+			if f.TagPrefixes == nil {
+				f.TagPrefixes = make(TagMap)
+			}
+			
+			keyStr := string(key)
+			f.TagPrefixes[keyStr] = append(f.TagPrefixes[keyStr], value)
+			
+		case bytes.HasPrefix(line, Sentinels[RANGES]):
+			line = line[len(Sentinels[RANGES]):]
+			maxStart := bytes.LastIndexByte(line, ':')
+			if maxStart == -1 {
+				return errorf.E("invalid RANGES format")
+			}
+			minStart := bytes.LastIndexByte(line[:maxStart], ':')
+			if minStart == -1 {
+				return errorf.E("invalid RANGES format")
+			}
+			
+			key, keyErr := text.Read(bytes.NewBuffer(line[:minStart]))
+			if keyErr != nil {
+				return keyErr
+			}
+			
+			var r Range
+			var numErr error
+			if r.Min, numErr = strconv.ParseFloat(string(line[minStart+1:maxStart]), 64); numErr != nil {
+				return numErr
+			}
+			if r.Max, numErr = strconv.ParseFloat(string(line[maxStart+1:]), 64); numErr != nil {
+				return numErr
+			}
+			
+			// Initialize Ranges if nil
+			if f.Ranges == nil {
+				f.Ranges = make(map[string]Range)
+			}
+			f.Ranges[string(key)] = r
+			
+		case bytes.HasPrefix(line, Sentinels[SORTTAG]):
+			key, keyErr := text.Read(bytes.NewBuffer(line[len(Sentinels[SORTTAG]):]))
+			if keyErr != nil {
+				return keyErr
+			}
+			f.SortTag = string(key)
+			
+		case bytes.HasPrefix(line, Sentinels[LIMIT]):
+			limit, limitErr := strconv.Atoi(string(line[len(Sentinels[LIMIT]):]))
+			if limitErr != nil {
+				return limitErr
+			}
+			f.Limit = limit
+			
+		case bytes.Equal(line, Sentinels[COUNT]):
+			f.Count = true
+			
+		case bytes.HasPrefix(line, Sentinels[GROUPBY]):
+			groupBy, groupErr := text.Read(bytes.NewBuffer(line[len(Sentinels[GROUPBY]):]))
+			if groupErr != nil {
+				return groupErr
+			}
+			f.GroupBy = string(groupBy)
+			
+		case bytes.HasPrefix(line, Sentinels[TRUST]):
+			root, radius, ok := bytes.Cut(line[len(Sentinels[TRUST]):], []byte(":"))
+			if !ok {
+				return errorf.E("invalid trust: '%s'", line)
+			}
+			var decErr error
+			if f.TrustRoot, decErr = base64.RawURLEncoding.DecodeString(string(root)); decErr != nil {
+				return decErr
+			}
+			if f.TrustRadius, decErr = strconv.Atoi(string(radius)); decErr != nil {
+				return decErr
+			}
+			
+		case bytes.HasPrefix(line, Sentinels[REFERENCES]):
+			ref := make([]byte, base64.RawURLEncoding.DecodedLen(len(line)-len(Sentinels[REFERENCES])))
+			n, decErr := base64.RawURLEncoding.Decode(ref, line[len(Sentinels[REFERENCES]):])
+			if decErr != nil {
+				return decErr
+			}
+			f.References = append(f.References, ref[:n])
+			
+		case bytes.HasPrefix(line, Sentinels[WITHIN]):
+			v, floatErr := readFloats(line[len(Sentinels[WITHIN]):], 4)
+			if floatErr != nil {
+				return floatErr
+			}
+			f.Within = &Box{MinLat: v[0], MinLon: v[1], MaxLat: v[2], MaxLon: v[3]}
+			
+		case bytes.HasPrefix(line, Sentinels[NEAR]):
+			v, floatErr := readFloats(line[len(Sentinels[NEAR]):], 3)
+			if floatErr != nil {
+				return floatErr
+			}
+			f.Near = &Circle{Lat: v[0], Lon: v[1], Radius: v[2]}
+			
 		case bytes.HasPrefix(line, Sentinels[SINCE]):
 			ts := ints.New(int64(0))
 			if _, tsErr := ts.Unmarshal(line[len(Sentinels[SINCE]):]); tsErr != nil {
@@ -327,9 +631,19 @@ func (f *F) Unmarshal(data []byte) (err error) {
 			}
 			f.Until = ts.Int64()
 			
+		case bytes.HasPrefix(line, Sentinels[UNIT]):
+			f.Unit = string(line[len(Sentinels[UNIT]):])
+			
 		case bytes.HasPrefix(line, Sentinels[SORT]):
 			f.Sort = string(line[len(Sentinels[SORT]):])
 			
+		case bytes.HasPrefix(line, Sentinels[SEARCH]):
+			search, searchErr := text.Read(bytes.NewBuffer(line[len(Sentinels[SEARCH]):]))
+			if searchErr != nil {
+				return searchErr
+			}
+			f.Search = string(search)
+			
 		default:
 			return errorf.E("unknown sentinel: '%s'", line)
 		}
@@ -345,7 +659,45 @@ func hasOtherFields(f *F) bool {
 		(f.NotAuthors != nil && len(f.NotAuthors) > 0) ||
 		(f.Tags != nil && len(f.Tags) > 0) ||
 		(f.NotTags != nil && len(f.NotTags) > 0) ||
+		len(f.HasTags) > 0 ||
+		len(f.TagPrefixes) > 0 ||
+		len(f.Ranges) > 0 ||
+		f.Within != nil ||
+		f.Near != nil ||
+		len(f.References) > 0 ||
+		f.SortTag != "" ||
+		f.Limit > 0 ||
+		f.Count ||
+		f.GroupBy != "" ||
+		f.TrustRoot != nil ||
 		f.Since != 0 ||
 		f.Until != 0 ||
-		(f.Sort != "" && f.Sort != "desc")
-}
\ No newline at end of file
+		f.Unit != "" ||
+		(f.Sort != "" && f.Sort != "desc") ||
+		f.Search != ""
+}
+
+// writeFloats writes numbers separated by colons.
+func writeFloats(buf *bytes.Buffer, v ...float64) {
+	for i, n := range v {
+		if i > 0 {
+			buf.WriteByte(':')
+		}
+		buf.WriteString(strconv.FormatFloat(n, 'g', -1, 64))
+	}
+}
+
+// readFloats reads a number of numbers separated by colons.
+func readFloats(b []byte, n int) (v []float64, err error) {
+	fields := bytes.Split(b, []byte(":"))
+	if len(fields) != n {
+		return nil, errorf.E("expected %d numbers, got %d", n, len(fields))
+	}
+	v = make([]float64, n)
+	for i, field := range fields {
+		if v[i], err = strconv.ParseFloat(string(field), 64); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
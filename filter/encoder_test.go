@@ -2,6 +2,8 @@ package filter
 
 import (
 	"bytes"
+	"math"
+	"reflect"
 	"testing"
 )
 
@@ -59,9 +61,31 @@ func TestMarshalUnmarshal(t *testing.T) {
 		NotTags: TagMap{
 			"nottag1": [][]byte{[]byte("notvalue1")},
 		},
-		Since: 1000,
-		Until: 2000,
-		Sort:  "asc",
+		HasTags: []string{"reply", "mime:type"},
+		TagPrefixes: TagMap{
+			"mimetype": [][]byte{[]byte("image/"), []byte("video/")},
+		},
+		Ranges: map[string]Range{
+			"price":  {Min: 1.5, Max: 20},
+			"height": {Min: math.Inf(-1), Max: -3e-5},
+		},
+		SortTag:     "price",
+		Limit:       20,
+		Count:       true,
+		GroupBy:     "tag:t",
+		TrustRoot:   bytes.Repeat([]byte{0x07}, 32),
+		TrustRadius: 2,
+		Within:      &Box{MinLat: -33.9, MinLon: 151.1, MaxLat: -33.8, MaxLon: 151.3},
+		Near:        &Circle{Lat: 51.5074, Lon: -0.1278, Radius: 2500},
+		References: [][]byte{
+			bytes.Repeat([]byte{0xab}, 32),
+			bytes.Repeat([]byte{0x01}, 32),
+		},
+		Since:  1000,
+		Until:  2000,
+		Unit:   "ms",
+		Sort:   "asc",
+		Search: "quick \"brown fox\"\nover",
 	}
 
 	data2, err := f2.Marshal()
@@ -91,6 +115,9 @@ func TestMarshalUnmarshal(t *testing.T) {
 	if !bytes.Contains(data2, []byte("SORT:")) {
 		t.Errorf("Marshaled data should contain SORT sentinel when not 'desc'")
 	}
+	if !bytes.Contains(data2, []byte("SEARCH:")) {
+		t.Errorf("Marshaled data should contain SEARCH sentinel")
+	}
 
 	// Unmarshal back
 	f2Unmarshaled := &F{}
@@ -117,9 +144,49 @@ func TestMarshalUnmarshal(t *testing.T) {
 	if f2Unmarshaled.Until != 2000 {
 		t.Errorf("Expected Until to be 2000, got %d", f2Unmarshaled.Until)
 	}
+	if f2Unmarshaled.Unit != "ms" {
+		t.Errorf("Expected Unit to be 'ms', got '%s'", f2Unmarshaled.Unit)
+	}
 	if f2Unmarshaled.Sort != "asc" {
 		t.Errorf("Expected Sort to be 'asc', got '%s'", f2Unmarshaled.Sort)
 	}
+	if len(f2Unmarshaled.HasTags) != 2 || f2Unmarshaled.HasTags[1] != "mime:type" {
+		t.Errorf("Expected HasTags %v, got %v", f2.HasTags, f2Unmarshaled.HasTags)
+	}
+	if len(f2Unmarshaled.TagPrefixes["mimetype"]) != 2 {
+		t.Errorf("Expected 2 TagPrefixes, got %d", len(f2Unmarshaled.TagPrefixes["mimetype"]))
+	}
+	if !reflect.DeepEqual(f2Unmarshaled.Ranges, f2.Ranges) {
+		t.Errorf("Expected Ranges %v, got %v", f2.Ranges, f2Unmarshaled.Ranges)
+	}
+	if f2Unmarshaled.SortTag != "price" {
+		t.Errorf("Expected SortTag to be 'price', got '%s'", f2Unmarshaled.SortTag)
+	}
+	if f2Unmarshaled.Limit != 20 {
+		t.Errorf("Expected Limit to be 20, got %d", f2Unmarshaled.Limit)
+	}
+	if !f2Unmarshaled.Count {
+		t.Errorf("Expected Count to be true")
+	}
+	if f2Unmarshaled.GroupBy != "tag:t" {
+		t.Errorf("Expected GroupBy to be 'tag:t', got '%s'", f2Unmarshaled.GroupBy)
+	}
+	if !bytes.Equal(f2Unmarshaled.TrustRoot, f2.TrustRoot) || f2Unmarshaled.TrustRadius != 2 {
+		t.Errorf("Expected TrustRoot %x within 2, got %x within %d",
+			f2.TrustRoot, f2Unmarshaled.TrustRoot, f2Unmarshaled.TrustRadius)
+	}
+	if !reflect.DeepEqual(f2Unmarshaled.References, f2.References) {
+		t.Errorf("Expected References %x, got %x", f2.References, f2Unmarshaled.References)
+	}
+	if !reflect.DeepEqual(f2Unmarshaled.Within, f2.Within) {
+		t.Errorf("Expected Within %v, got %v", f2.Within, f2Unmarshaled.Within)
+	}
+	if !reflect.DeepEqual(f2Unmarshaled.Near, f2.Near) {
+		t.Errorf("Expected Near %v, got %v", f2.Near, f2Unmarshaled.Near)
+	}
+	if f2Unmarshaled.Search != f2.Search {
+		t.Errorf("Expected Search to be %q, got %q", f2.Search, f2Unmarshaled.Search)
+	}
 
 	// Test case 3: Filter with default Sort
 	f3 := &F{
@@ -2,13 +2,72 @@ package filter
 
 type TagMap map[string][][]byte
 
+// Range is an inclusive range of numbers. An end is unbounded if it is set to
+// an infinity of math.Inf.
+type Range struct{ Min, Max float64 }
+
+// Box is a range of latitudes and longitudes in degrees. A box whose MinLon is
+// greater than its MaxLon crosses the antimeridian.
+type Box struct{ MinLat, MinLon, MaxLat, MaxLon float64 }
+
+// Circle is the area within Radius meters of a latitude and longitude in
+// degrees.
+type Circle struct{ Lat, Lon, Radius float64 }
+
 type F struct {
-	Ids          [][]byte
-	NotIds       [][]byte
-	Authors      [][]byte
-	NotAuthors   [][]byte
-	Tags         TagMap
-	NotTags      TagMap
+	Ids        [][]byte
+	NotIds     [][]byte
+	Authors    [][]byte
+	NotAuthors [][]byte
+	Tags       TagMap
+	NotTags    TagMap
+	// HasTags matches events with a tag of any of the keys, whatever its
+	// value.
+	HasTags []string
+	// TagPrefixes matches events with a tag whose value starts with any of
+	// the prefixes given for its key.
+	TagPrefixes TagMap
+	// Ranges matches events with a tag whose value is a number within the
+	// range given for its key.
+	Ranges map[string]Range
+	// Within matches events with a tag giving a location within the box, and
+	// Near, one within the circle. Locations are given by a "g" tag with a
+	// geohash or a "latlon" tag with a latitude and longitude.
+	Within *Box
+	Near   *Circle
+	// References matches events with a tag, of any key, whose value is any
+	// of the event ids or pubkeys, as 32 bytes or their base64url encoding.
+	References [][]byte
+	// Since and Until are the earliest and latest timestamps of the events,
+	// inclusive, which may be before 1970. Zero is no limit.
 	Since, Until int64
-	Sort         string
+	// Unit is the unit of Since and Until: seconds if empty, or "ms" or "ns"
+	// for milliseconds or nanoseconds since the epoch, to match the ns tag of
+	// events made within a second.
+	Unit string
+	// Sort is "asc" or "desc" for the order of the event timestamps, or
+	// "relevance" to order the results of a Search by how well they match it.
+	Sort string
+	// SortTag orders the results by the numeric value of the tag of this key
+	// instead of the timestamp, in the direction of Sort. Events without a
+	// number in the tag come last.
+	SortTag string
+	// Limit is the most events returned, the first of them in the order of
+	// Sort, or the most groups when counting. Zero is no limit.
+	Limit int
+	// Count asks for the Counts of the matching events instead of the events.
+	Count bool
+	// GroupBy counts the events in groups: "author" by their author, "tag:"
+	// and a key by the values of their tags of the key, or "time:" and a
+	// number of seconds by the periods of that length they were made in.
+	GroupBy string
+	// TrustRoot and TrustRadius restrict the authors to TrustRoot and the
+	// pubkeys it reaches by following at most TrustRadius follow lists of the
+	// social graph. QueryEvents and Count apply them; Matches, which has no
+	// social graph to look in, does not.
+	TrustRoot   []byte
+	TrustRadius int
+	// Search matches events whose content contains all of its words, and the
+	// words of each double quoted phrase in sequence.
+	Search string
 }
@@ -16,6 +16,8 @@ require (
 	github.com/templexxx/xhex v0.0.0-20200614015412-aed53437177b
 	golang.org/x/exp v0.0.0-20250620022241-b7579e27df2b
 	golang.org/x/lint v0.0.0-20241112194109-818c5a804067
+	golang.org/x/text v0.26.0
+	google.golang.org/protobuf v1.36.6
 	honnef.co/go/tools v0.6.1
 	lukechampine.com/frand v1.5.1
 )
@@ -42,8 +44,6 @@ require (
 	golang.org/x/net v0.41.0 // indirect
 	golang.org/x/sync v0.15.0 // indirect
 	golang.org/x/sys v0.33.0 // indirect
-	golang.org/x/text v0.26.0 // indirect
 	golang.org/x/tools v0.34.0 // indirect
-	google.golang.org/protobuf v1.36.6 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,96 @@
+package relay
+
+import (
+	"strings"
+	"sync"
+
+	"manifold.mleku.dev/database"
+	"manifold.mleku.dev/errorf"
+)
+
+// Router maps the endpoints of a relay, such as the paths of its websocket
+// URLs, to the event stores that serve them, so that one relay can host several
+// apps whose events are kept apart.
+type Router struct {
+	mx     sync.RWMutex
+	routes map[string]database.I
+	// namespaces are the namespaces routed to by HandleNamespace, by endpoint.
+	namespaces map[string]namespaceRoute
+	// Default serves the endpoints that have no route, if it is not nil.
+	Default database.I
+}
+
+// namespaceRoute is a namespace of a database that an endpoint is routed to.
+type namespaceRoute struct {
+	d    *database.D
+	name string
+}
+
+// NewRouter creates a Router with no routes.
+func NewRouter() (r *Router) {
+	return &Router{routes: make(map[string]database.I),
+		namespaces: make(map[string]namespaceRoute)}
+}
+
+// endpoint normalizes an endpoint, so that "/app", "app" and "/app/" are the
+// same.
+func endpoint(e string) string { return strings.Trim(e, "/") }
+
+// Handle routes an endpoint to an event store.
+func (r *Router) Handle(e string, db database.I) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.routes[endpoint(e)] = db
+	delete(r.namespaces, endpoint(e))
+}
+
+// Remove removes the route of an endpoint, which is then served by the Default.
+func (r *Router) Remove(e string) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	delete(r.routes, endpoint(e))
+	delete(r.namespaces, endpoint(e))
+}
+
+// HandleNamespace routes an endpoint to a namespace of a database, opening it.
+func (r *Router) HandleNamespace(e string, d *database.D, namespace string) (err error) {
+	var ns *database.D
+	if ns, err = d.Namespace(namespace); err != nil {
+		return
+	}
+	r.Handle(e, ns)
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.namespaces[endpoint(e)] = namespaceRoute{d: d, name: namespace}
+	return
+}
+
+// DropNamespace removes the routes to a namespace of a database, which closes
+// it, and drops it.
+func (r *Router) DropNamespace(d *database.D, namespace string) (err error) {
+	r.mx.Lock()
+	for e, ns := range r.namespaces {
+		if ns.d == d && ns.name == namespace {
+			delete(r.routes, e)
+			delete(r.namespaces, e)
+		}
+	}
+	r.mx.Unlock()
+	return d.DropNamespace(namespace)
+}
+
+// Route returns the event store of an endpoint, or the Default if it has no
+// route.
+func (r *Router) Route(e string) (db database.I, err error) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	var ok bool
+	if db, ok = r.routes[endpoint(e)]; ok {
+		return
+	}
+	if r.Default == nil {
+		err = errorf.E("no route for endpoint %q", e)
+		return
+	}
+	return r.Default, nil
+}
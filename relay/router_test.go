@@ -0,0 +1,50 @@
+package relay
+
+import (
+	"testing"
+
+	"manifold.mleku.dev/database"
+	"manifold.mleku.dev/database/store/memory"
+)
+
+func TestRouter(t *testing.T) {
+	d := database.New()
+	if err := d.InitStore(memory.New()); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer d.Close()
+	r := NewRouter()
+	for _, e := range []string{"chat", "notes"} {
+		if err := r.HandleNamespace("/"+e, d, e); err != nil {
+			t.Fatalf("Failed to route namespace: %v", err)
+		}
+	}
+	chat, err := r.Route("chat/")
+	if err != nil {
+		t.Fatalf("Failed to route endpoint: %v", err)
+	}
+	ns, err := d.Namespace("chat")
+	if err != nil {
+		t.Fatalf("Failed to open namespace: %v", err)
+	}
+	if chat != database.I(ns) {
+		t.Errorf("Expected the chat namespace for the chat endpoint")
+	}
+	if _, err = r.Route("/other"); err == nil {
+		t.Errorf("Expected an error for an endpoint with no route")
+	}
+	r.Default = d
+	if db, err := r.Route("/other"); err != nil || db != database.I(d) {
+		t.Errorf("Expected the default store for an endpoint with no route")
+	}
+	if err = r.DropNamespace(d, "chat"); err != nil {
+		t.Fatalf("Failed to drop namespace: %v", err)
+	}
+	if db, err := r.Route("/chat"); err != nil || db != database.I(d) {
+		t.Errorf("Expected the default store for the endpoint of a dropped namespace")
+	}
+	r.Remove("notes")
+	if db, err := r.Route("/notes"); err != nil || db != database.I(d) {
+		t.Errorf("Expected the default store for a removed endpoint")
+	}
+}
@@ -0,0 +1,278 @@
+// Package thread reconstructs threaded discussions from the "root" and "reply"
+// tags of events. A reply has a "root" tag with the id of the first event of
+// the thread, and a "reply" tag with the id of the event it answers, which is
+// left out when it answers the root. Ids are given as 32 bytes or their
+// unpadded base64url encoding.
+//
+// Fetch finds the root of the thread of an event and all the events that
+// descend from it in a database, and builds them into a tree of replies in the
+// order they were made. Events that are referred to but not stored appear in
+// the tree as nodes without an event, so that their replies keep their place,
+// and reply tags that would make a cycle are ignored.
+package thread
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	"manifold.mleku.dev/chk"
+	"manifold.mleku.dev/database"
+	"manifold.mleku.dev/errorf"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/filter"
+)
+
+var (
+	Root  = []byte("root")
+	Reply = []byte("reply")
+)
+
+// Source is an event store that threads are read from, such as a database.I.
+// QueryEvents must support the References field of filter.F, and GetEventById
+// return an error wrapping database.ErrEventNotFound for an event not stored.
+type Source interface {
+	GetEventById(evId []byte) (ev *event.E, err error)
+	QueryEvents(f filter.F) (eventIds [][]byte, err error)
+}
+
+// Node is an event of a thread and the replies to it.
+type Node struct {
+	Id []byte
+	// Event is nil if the event is referred to by the thread but not stored.
+	Event *event.E
+	// Parent is the node of the event that this one replies to, and nil for
+	// the root.
+	Parent *Node
+	// Replies are the nodes that reply to this one, earliest first.
+	Replies []*Node
+	// Depth is the number of replies between the root and this node.
+	Depth int
+	// time is the timestamp of the event, or for a missing event the earliest
+	// of its replies, used to order the replies.
+	time int64
+}
+
+// Missing returns true if the event of the node is not stored.
+func (n *Node) Missing() bool { return n.Event == nil }
+
+// T is a thread of replies to a root event.
+type T struct {
+	Root *Node
+	// Nodes are the nodes of the thread by id.
+	Nodes map[string]*Node
+}
+
+// maxBatch is the most ids whose references are queried at once.
+const maxBatch = 256
+
+// Fetch reads the thread that contains the event with the given id from src.
+func Fetch(src Source, id []byte) (t *T, err error) {
+	var ev *event.E
+	if ev, err = src.GetEventById(id); chk.E(err) {
+		return
+	}
+	t = &T{Nodes: make(map[string]*Node)}
+	var rootId []byte
+	if rootId, err = findRoot(src, id, ev); chk.E(err) {
+		return
+	}
+	t.Root = t.node(rootId)
+	if !bytes.Equal(rootId, id) {
+		if t.Root.Event, err = src.GetEventById(rootId); errors.Is(err, database.ErrEventNotFound) {
+			err = nil
+		} else if chk.E(err) {
+			return
+		}
+	} else {
+		t.Root.Event = ev
+	}
+	parents := make(map[string][]byte)
+	// find the descendants of the root a generation at a time from the events
+	// that refer to the events found in the previous one
+	frontier := [][]byte{rootId}
+	for len(frontier) > 0 {
+		var next [][]byte
+		for len(frontier) > 0 {
+			batch := frontier[:min(len(frontier), maxBatch)]
+			frontier = frontier[len(batch):]
+			var ids [][]byte
+			if ids, err = src.QueryEvents(filter.F{References: batch}); chk.E(err) {
+				return
+			}
+			for _, rid := range ids {
+				if _, ok := parents[string(rid)]; ok || bytes.Equal(rid, rootId) {
+					continue
+				}
+				var rev *event.E
+				if rev, err = src.GetEventById(rid); chk.E(err) {
+					return
+				}
+				root, reply := refs(rev)
+				parent := reply
+				if parent == nil {
+					parent = root
+				}
+				if !bytes.Equal(root, rootId) && !containsId(batch, parent) {
+					// the event refers to the thread without replying in it
+					continue
+				}
+				parents[string(rid)] = parent
+				t.node(rid).Event = rev
+				next = append(next, rid)
+			}
+		}
+		frontier = next
+	}
+	for rid, parent := range parents {
+		t.attach(t.Nodes[rid], parent)
+	}
+	t.order(t.Root, 0)
+	return
+}
+
+// findRoot returns the id of the root of the thread of an event, which is the
+// value of its root tag, or else the first event found by following its reply
+// tags that has none, or is not stored.
+func findRoot(src Source, id []byte, ev *event.E) (rootId []byte, err error) {
+	seen := map[string]struct{}{string(id): {}}
+	for {
+		root, reply := refs(ev)
+		if root != nil {
+			return root, nil
+		}
+		if reply == nil {
+			return id, nil
+		}
+		if _, ok := seen[string(reply)]; ok {
+			return id, nil
+		}
+		seen[string(reply)] = struct{}{}
+		id = reply
+		if ev, err = src.GetEventById(id); errors.Is(err, database.ErrEventNotFound) {
+			return id, nil
+		} else if chk.E(err) {
+			return
+		}
+	}
+}
+
+// node returns the node of an id, adding a node without an event if the id is
+// not yet in the thread.
+func (t *T) node(id []byte) (n *Node) {
+	var ok bool
+	if n, ok = t.Nodes[string(id)]; !ok {
+		n = &Node{Id: id}
+		t.Nodes[string(id)] = n
+	}
+	return
+}
+
+// attach adds a node to the replies of the node of the parent id. A node whose
+// parent is not in the thread is attached to a missing node for the parent
+// under the root, and a node whose parent descends from it is attached to the
+// root to break the cycle.
+func (t *T) attach(n *Node, parent []byte) {
+	if n.Parent != nil {
+		return
+	}
+	p := t.node(parent)
+	if p != t.Root && p.Parent == nil && p.Missing() {
+		p.Parent = t.Root
+		t.Root.Replies = append(t.Root.Replies, p)
+	}
+	for a := p; a != nil; a = a.Parent {
+		if a == n {
+			p = t.Root
+			break
+		}
+	}
+	n.Parent = p
+	p.Replies = append(p.Replies, n)
+}
+
+// order sets the depth of the nodes under n and sorts their replies by time,
+// earliest first, then by id.
+func (t *T) order(n *Node, depth int) {
+	n.Depth = depth
+	if n.Event != nil {
+		n.time = n.Event.Timestamp
+	}
+	for _, r := range n.Replies {
+		t.order(r, depth+1)
+		if n.Event == nil && (n.time == 0 || r.time < n.time) {
+			n.time = r.time
+		}
+	}
+	sort.Slice(n.Replies, func(i, j int) bool {
+		ri, rj := n.Replies[i], n.Replies[j]
+		if ri.time != rj.time {
+			return ri.time < rj.time
+		}
+		return bytes.Compare(ri.Id, rj.Id) < 0
+	})
+}
+
+// Walk calls fn with the nodes of the thread in order, each before its
+// replies, until fn returns false.
+func (t *T) Walk(fn func(n *Node) bool) {
+	var walk func(n *Node) bool
+	walk = func(n *Node) bool {
+		if !fn(n) {
+			return false
+		}
+		for _, r := range n.Replies {
+			if !walk(r) {
+				return false
+			}
+		}
+		return true
+	}
+	walk(t.Root)
+}
+
+// Page returns up to limit nodes of the thread in the order of Walk, starting
+// after the node with the id after, or from the root if after is nil. If there
+// are more nodes, next is the id to pass as after to get the next page. A limit
+// of 0 returns all the remaining nodes.
+func (t *T) Page(after []byte, limit int) (nodes []*Node, next []byte, err error) {
+	started := after == nil
+	if !started {
+		if _, ok := t.Nodes[string(after)]; !ok {
+			err = errorf.E("event %0x is not in the thread", after)
+			return
+		}
+	}
+	t.Walk(func(n *Node) bool {
+		if !started {
+			started = bytes.Equal(n.Id, after)
+			return true
+		}
+		if limit > 0 && len(nodes) == limit {
+			next = nodes[len(nodes)-1].Id
+			return false
+		}
+		nodes = append(nodes, n)
+		return true
+	})
+	return
+}
+
+// refs returns the ids given by the root and reply tags of an event.
+func refs(ev *event.E) (root, reply []byte) {
+	if ev.Tags == nil {
+		return
+	}
+	root, _ = event.Reference(ev.Tags.GetFirst(Root).Value)
+	reply, _ = event.Reference(ev.Tags.GetFirst(Reply).Value)
+	return
+}
+
+func containsId(ids [][]byte, id []byte) bool {
+	for _, i := range ids {
+		if bytes.Equal(i, id) {
+			return true
+		}
+	}
+	return false
+}
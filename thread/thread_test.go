@@ -0,0 +1,167 @@
+package thread
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"manifold.mleku.dev/database"
+	"manifold.mleku.dev/database/store/memory"
+	"manifold.mleku.dev/event"
+	"manifold.mleku.dev/p256k"
+)
+
+func TestFetch(t *testing.T) {
+	db := database.New()
+	if err := db.InitStore(memory.New()); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	signer := new(p256k.Signer)
+	if err := signer.Generate(); err != nil {
+		t.Fatalf("Failed to generate signer: %v", err)
+	}
+	ids := make(map[string][]byte)
+	now := time.Now()
+	store := func(name string, minutes int, tags ...event.Tag) {
+		ev := &event.E{
+			Pubkey:    signer.Pub(),
+			Timestamp: now.Add(time.Duration(minutes) * time.Minute).Unix(),
+			Content:   []byte(name),
+			Tags:      &event.Tags{},
+		}
+		*ev.Tags = append(*ev.Tags, tags...)
+		if err := ev.Sign(signer); err != nil {
+			t.Fatalf("Failed to sign event: %v", err)
+		}
+		if err := db.StoreEvent(ev); err != nil {
+			t.Fatalf("Failed to store event: %v", err)
+		}
+		id, err := ev.Id()
+		if err != nil {
+			t.Fatalf("Failed to get event ID: %v", err)
+		}
+		ids[name] = id
+	}
+	b64 := func(name string) []byte {
+		return []byte(base64.RawURLEncoding.EncodeToString(ids[name]))
+	}
+	missing := bytes.Repeat([]byte{0x42}, 32)
+	ids["M"] = missing
+
+	store("R", 0)
+	store("A", 1, event.Tag{Key: Root, Value: b64("R")})
+	store("B", 2, event.Tag{Key: Root, Value: b64("R")}, event.Tag{Key: Reply, Value: b64("A")})
+	store("C", 3, event.Tag{Key: Root, Value: ids["R"]})
+	store("D", 4, event.Tag{Key: Root, Value: b64("R")}, event.Tag{Key: Reply, Value: missing})
+	store("Q", 5, event.Tag{Key: []byte("quote"), Value: b64("R")})
+	store("F", 6, event.Tag{Key: Reply, Value: b64("A")})
+	store("G", 7, event.Tag{Key: Reply, Value: b64("F")})
+
+	expected := []struct {
+		name  string
+		depth int
+	}{
+		{"R", 0}, {"A", 1}, {"B", 2}, {"F", 2}, {"G", 3}, {"C", 1}, {"M", 1}, {"D", 2},
+	}
+	for _, start := range []string{"R", "B", "G"} {
+		th, err := Fetch(db, ids[start])
+		if err != nil {
+			t.Fatalf("Failed to fetch thread of %s: %v", start, err)
+		}
+		nodes, next, err := th.Page(nil, 0)
+		if err != nil {
+			t.Fatalf("Failed to get page: %v", err)
+		}
+		if next != nil {
+			t.Errorf("Expected no next page")
+		}
+		if len(nodes) != len(expected) {
+			t.Fatalf("Expected %d nodes from %s, got %d", len(expected), start, len(nodes))
+		}
+		for i, e := range expected {
+			if !bytes.Equal(nodes[i].Id, ids[e.name]) {
+				t.Fatalf("Expected event %s as node %d from %s", e.name, i, start)
+			}
+			if nodes[i].Depth != e.depth {
+				t.Errorf("Expected depth %d for %s, got %d", e.depth, e.name, nodes[i].Depth)
+			}
+			if nodes[i].Missing() != (e.name == "M") {
+				t.Errorf("Expected only M to be missing, %s is %v", e.name, nodes[i].Missing())
+			}
+		}
+	}
+
+	th, err := Fetch(db, ids["R"])
+	if err != nil {
+		t.Fatalf("Failed to fetch thread: %v", err)
+	}
+	var after []byte
+	var paged []*Node
+	for pages := 0; ; pages++ {
+		nodes, next, err := th.Page(after, 3)
+		if err != nil {
+			t.Fatalf("Failed to get page: %v", err)
+		}
+		paged = append(paged, nodes...)
+		if next == nil {
+			if pages != 2 {
+				t.Errorf("Expected 3 pages, got %d", pages+1)
+			}
+			break
+		}
+		after = next
+	}
+	if len(paged) != len(expected) {
+		t.Fatalf("Expected %d nodes in pages, got %d", len(expected), len(paged))
+	}
+	for i, e := range expected {
+		if !bytes.Equal(paged[i].Id, ids[e.name]) {
+			t.Fatalf("Expected event %s as paged node %d", e.name, i)
+		}
+	}
+	// a root that is not stored is missing, but one that fails to be read
+	// fails the fetch
+	store("N", 8, event.Tag{Key: Root, Value: bytes.Repeat([]byte{0x43}, 32)})
+	if th, err = Fetch(db, ids["N"]); err != nil || !th.Root.Missing() {
+		t.Errorf("Expected a thread with a missing root, got %v", err)
+	}
+	if _, err = Fetch(failing{db, ids["R"]}, ids["B"]); err == nil {
+		t.Errorf("Expected an error fetching a thread whose root fails to be read")
+	}
+	if _, err = Fetch(failing{db, ids["A"]}, ids["G"]); err == nil {
+		t.Errorf("Expected an error fetching a thread whose parent fails to be read")
+	}
+}
+
+// failing is a Source that fails to read one event.
+type failing struct {
+	Source
+	id []byte
+}
+
+func (f failing) GetEventById(evId []byte) (ev *event.E, err error) {
+	if bytes.Equal(evId, f.id) {
+		return nil, errors.New("read failed")
+	}
+	return f.Source.GetEventById(evId)
+}
+
+func TestAttachCycle(t *testing.T) {
+	th := &T{Nodes: make(map[string]*Node)}
+	th.Root = th.node([]byte("r"))
+	a, b := th.node([]byte("a")), th.node([]byte("b"))
+	a.Event, b.Event = &event.E{Timestamp: 1}, &event.E{Timestamp: 2}
+	th.attach(a, []byte("b"))
+	th.attach(b, []byte("a"))
+	th.order(th.Root, 0)
+	if b.Parent != th.Root || a.Parent != b {
+		t.Fatalf("Expected the cycle to be broken at the root")
+	}
+	if a.Depth != 2 {
+		t.Errorf("Expected depth 2, got %d", a.Depth)
+	}
+}
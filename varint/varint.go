@@ -11,12 +11,15 @@ import (
 	"manifold.mleku.dev/chk"
 )
 
+// Encode writes an integer. Negative values are written as the uint64 of the
+// same bits, which Decode returns, so that they can be converted back.
 func Encode[V constraints.Integer](w io.Writer, v V) {
 	x := []byte{0}
+	u := uint64(v)
 	for {
-		x[0] = byte(v) & 127
-		v >>= 7
-		if v == 0 {
+		x[0] = byte(u) & 127
+		u >>= 7
+		if u == 0 {
 			x[0] |= 128
 			_, _ = w.Write(x)
 			break
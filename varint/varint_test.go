@@ -27,3 +27,17 @@ func TestEncode_Decode(t *testing.T) {
 
 	}
 }
+
+func TestEncode_DecodeNegative(t *testing.T) {
+	for _, v := range []int64{-1, -86400, math.MinInt64} {
+		buf := new(bytes.Buffer)
+		Encode(buf, v)
+		u, err := Decode(buf)
+		if chk.E(err) {
+			t.Fatal(err)
+		}
+		if int64(u) != v {
+			t.Fatalf("expected %d got %d", v, int64(u))
+		}
+	}
+}